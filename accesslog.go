@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// An accessRecord is one line of the access log, for one key served.
+// Outcome is hit, miss, or failed if the key couldn't be served. A record
+// with reopen set is instead the writer's cue to reopen the file.
+type accessRecord struct {
+	Time        time.Time `json:"time"`
+	Client      string    `json:"client"`
+	Credentials string    `json:"credentials,omitempty"`
+	BucketName  string    `json:"bucket"`
+	KeyName     string    `json:"key"`
+	Bytes       int64     `json:"bytes"`
+	Outcome     string    `json:"outcome"`
+	Status      string    `json:"status"`
+	reopen      bool
+}
+
+// An accessLog appends a JSON line per key served to a file, or stdout
+// for "-". Records are handed off to a single writer goroutine through a
+// buffered channel, so serving never waits on the log; if it falls that
+// far behind, records are dropped and counted rather than queued. The file
+// is reopened on request, for log rotation. A nil *accessLog records
+// nothing.
+type accessLog struct {
+	path    string
+	records chan accessRecord
+	done    chan struct{}
+	dropped int64
+}
+
+func newAccessLog(path string, buffered int) (*accessLog, error) {
+	out, err := openAccessLog(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &accessLog{path: path, records: make(chan accessRecord, buffered), done: make(chan struct{})}
+	go a.run(out)
+	return a, nil
+}
+
+func openAccessLog(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// record logs each of results, served to r.
+func (a *accessLog) record(r *http.Request, credentials string, results []getResult) {
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	for _, result := range results {
+		record := accessRecord{Time: now, Client: r.RemoteAddr, Credentials: credentials,
+			BucketName: result.bucketName, KeyName: result.keyName, Bytes: result.bytesTransferred,
+			Outcome: outcomeOf(result), Status: result.status}
+		if record.Bytes == 0 && result.localPath != nil {
+			if info, err := os.Stat(*result.localPath); err == nil {
+				record.Bytes = info.Size()
+			}
+		}
+		select {
+		case a.records <- record:
+		default:
+			atomic.AddInt64(&a.dropped, 1)
+		}
+	}
+}
+
+func outcomeOf(result getResult) string {
+	switch {
+	case result.localPath == nil:
+		return "failed"
+	case result.status == "cache_hit" || result.status == "disk cache hit" || result.status == staleServed:
+		return "hit"
+	default:
+		return "miss"
+	}
+}
+
+// reopen has the writer reopen the log's file, as after it's rotated,
+// once it's written what was recorded before.
+func (a *accessLog) reopen() {
+	a.records <- accessRecord{reopen: true}
+}
+
+// close writes out what's been recorded and closes the log's file.
+func (a *accessLog) close() {
+	if a == nil {
+		return
+	}
+	close(a.records)
+	<-a.done
+}
+
+func (a *accessLog) run(out io.WriteCloser) {
+	defer close(a.done)
+	buffered := bufio.NewWriter(out)
+	encoder := json.NewEncoder(buffered)
+	for record := range a.records {
+		if record.reopen {
+			buffered.Flush()
+			if reopened, err := openAccessLog(a.path); err != nil {
+				log.Printf("Couldn't reopen the access log, still writing to the old file: %v", err)
+			} else {
+				out.Close()
+				out = reopened
+				buffered.Reset(out)
+			}
+		} else if err := encoder.Encode(record); err != nil {
+			log.Printf("Couldn't write to the access log: %v", err)
+		}
+		if len(a.records) == 0 {
+			buffered.Flush()
+		}
+		if dropped := atomic.SwapInt64(&a.dropped, 0); dropped > 0 {
+			log.Printf("The access log fell behind and dropped %v records", dropped)
+		}
+	}
+	buffered.Flush()
+	out.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func readAccessLog(t *testing.T, logPath string) []accessRecord {
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []accessRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record accessRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestKeyServerAccessLog(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	logPath := path.Join(cacheDir, "_access.log")
+	accesses, err := newAccessLog(logPath, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getter := &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{base: base, cacheDir: cacheDir}}
+	server := &keyServer{MutableKeyGetter: getter, accessLog: accesses}
+	serve := func(body string) {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(body)))
+		req.RemoteAddr = "10.0.0.1:1234"
+		server.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve(`{"bucket_name": "bucket", "keynames": ["key1"]}`)
+	// as logrotate would, before sending a SIGHUP
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatal(err)
+	}
+	accesses.reopen()
+	serve(`{"bucket_name": "bucket", "keynames": ["key1", "key2"]}`)
+	accesses.close()
+
+	if rotated := readAccessLog(t, logPath+".1"); len(rotated) != 1 {
+		t.Logf("Expected only the first request's record in the rotated log, but got %+v", rotated)
+		t.Fail()
+	}
+	records := append(readAccessLog(t, logPath+".1"), readAccessLog(t, logPath)...)
+	expected := []accessRecord{
+		{Client: "10.0.0.1:1234", BucketName: "bucket", KeyName: "key1", Bytes: 14, Outcome: "miss"},
+		{Client: "10.0.0.1:1234", BucketName: "bucket", KeyName: "key1", Bytes: 14, Outcome: "hit"},
+		{Client: "10.0.0.1:1234", BucketName: "bucket", KeyName: "key2", Bytes: 14, Outcome: "miss"},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %v access records, but got %+v", len(expected), records)
+	}
+	for i, want := range expected {
+		got := records[i]
+		if got.Time.IsZero() || got.Status == "" {
+			t.Logf("Expected access record %v to have a time and status, but got %+v", i, got)
+			t.Fail()
+		}
+		got.Time, got.Status = want.Time, want.Status
+		if got != want {
+			t.Logf("Expected access record %v to be %+v, but got %+v", i, want, got)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A bucketAllowlist is the buckets a server may fetch from, as glob
+// patterns like those path.Match takes, so logs-* allows every bucket
+// named with that prefix. An empty one allows any bucket.
+type bucketAllowlist []string
+
+// parseBucketAllowlist parses a comma-separated list of bucket patterns.
+func parseBucketAllowlist(spec string) (bucketAllowlist, error) {
+	var patterns bucketAllowlist
+	for _, pattern := range strings.Split(spec, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad bucket pattern %q: %v", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func (a bucketAllowlist) allows(bucketName string) bool {
+	if len(a) == 0 {
+		return true
+	}
+	for _, pattern := range a {
+		if matched, _ := path.Match(pattern, bucketName); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBucketAllowlist(t *testing.T) {
+	allowed, err := parseBucketAllowlist("assets, logs-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for bucketName, expected := range map[string]bool{
+		"assets":      true,
+		"assets-2":    false,
+		"logs-2024":   true,
+		"logs":        false,
+		"secret-logs": false,
+	} {
+		if allowed.allows(bucketName) != expected {
+			t.Logf("Expected %v to be allowed: %v", bucketName, expected)
+			t.Fail()
+		}
+	}
+	if _, err := parseBucketAllowlist("logs-[a"); err == nil {
+		t.Logf("Expected an error for a malformed pattern")
+		t.Fail()
+	}
+	if none, _ := parseBucketAllowlist(""); !none.allows("anything") {
+		t.Logf("Expected an empty allowlist to allow any bucket")
+		t.Fail()
+	}
+}
+
+func TestKeyServerRejectsDisallowedBuckets(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: dkg},
+		allowedBuckets: bucketAllowlist{"assets-*"}}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader([]byte(`{"bucket_name": "secrets", "keynames": ["key1"]}`))))
+	if rec.Code != 403 {
+		t.Logf("Expected a 403 for a bucket that isn't allowed, but got %v", rec.Code)
+		t.Fail()
+	}
+	rec = httptest.NewRecorder()
+	server.serveObject(rec, httptest.NewRequest("GET", "/object?bucket=secrets&key=key1", nil))
+	if rec.Code != 403 {
+		t.Logf("Expected a 403 from /object for a bucket that isn't allowed, but got %v", rec.Code)
+		t.Fail()
+	}
+	lister := &countingBucketLister{keyNames: []string{"key1"}}
+	listings := &listingCache{lister: lister, ttl: time.Minute, allowed: server.allowedBuckets}
+	rec = httptest.NewRecorder()
+	listings.ServeHTTP(rec, httptest.NewRequest("GET", "/list?bucket=secrets", nil))
+	if rec.Code != 403 || lister.called != 0 {
+		t.Logf("Expected a 403 from /list for a bucket that isn't allowed, but got %v after %v listings", rec.Code, lister.called)
+		t.Fail()
+	}
+	warmer := &inventoryWarmer{manifests: mapKeyReaderGetter{
+		"secrets/data.csv":          "\"assets-web\",\"key1\"\n",
+		"assets-inventory/data.csv": "\"secrets\",\"key1\"\n",
+	}, getter: server.MutableKeyGetter, maxKeys: 10, allowed: server.allowedBuckets}
+	rec = httptest.NewRecorder()
+	warmer.ServeHTTP(rec, httptest.NewRequest("POST", "/warm-inventory",
+		strings.NewReader(`{"bucket_name": "secrets", "manifest_key": "data.csv"}`)))
+	if rec.Code != 403 {
+		t.Logf("Expected a 403 from /warm-inventory for a manifest in a bucket that isn't allowed, but got %v", rec.Code)
+		t.Fail()
+	}
+	rec = httptest.NewRecorder()
+	warmer.ServeHTTP(rec, httptest.NewRequest("POST", "/warm-inventory",
+		strings.NewReader(`{"bucket_name": "assets-inventory", "manifest_key": "data.csv"}`)))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"refused":1`) {
+		t.Logf("Expected /warm-inventory to refuse an object in a bucket that isn't allowed, but got %v: %v", rec.Code, rec.Body)
+		t.Fail()
+	}
+	history := &accessHistory{}
+	history.record("", []getResult{{bucketName: "secrets", keyName: "key1", localPath: new(string)}})
+	if warmed, _ := history.warm(context.Background(), server.MutableKeyGetter, server.allowedBuckets, 0, 0); warmed != 0 {
+		t.Logf("Expected the history warm-up to skip a bucket that isn't allowed, but it warmed %v keys", warmed)
+		t.Fail()
+	}
+	if base.called != 0 {
+		t.Logf("Expected nothing to be fetched for a bucket that isn't allowed, but there were %v fetches", base.called)
+		t.Fail()
+	}
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader([]byte(`{"bucket_name": "assets-web", "keynames": ["key1"]}`))))
+	if rec.Code != 200 || base.called != 1 {
+		t.Logf("Expected an allowed bucket to be fetched from, but got %v after %v fetches", rec.Code, base.called)
+		t.Fail()
+	}
+}
+
+func TestCacheFileHandlersRejectDisallowedBuckets(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	// cached before the allowlist was set
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir, contentAddressed: true}
+	dkg.get(context.Background(), "secrets", []string{"key1"})
+	dkg.get(context.Background(), "assets-web", []string{"key1"})
+	cacheFiles := &diskCachedKeyGetter{cacheDir: cacheDir, allowed: bucketAllowlist{"assets-*"}}
+
+	rec := httptest.NewRecorder()
+	cacheFiles.serveDigest(rec, httptest.NewRequest("GET", "/digest?bucket=secrets&key=key1", nil))
+	if rec.Code != 403 {
+		t.Logf("Expected a 403 from /digest for a bucket that isn't allowed, but got %v", rec.Code)
+		t.Fail()
+	}
+	rec = httptest.NewRecorder()
+	cacheFiles.serveDigest(rec, httptest.NewRequest("GET", "/digest?bucket=assets-web&key=key1", nil))
+	if rec.Code != 200 {
+		t.Logf("Expected a 200 from /digest for an allowed bucket, but got %v", rec.Code)
+		t.Fail()
+	}
+	rec = httptest.NewRecorder()
+	cacheFiles.serveManifest(rec, httptest.NewRequest("GET", "/manifest", nil))
+	if rec.Code != 200 || strings.Contains(rec.Body.String(), "secrets") || !strings.Contains(rec.Body.String(), "assets-web") {
+		t.Logf("Expected /manifest to list only allowed buckets, but got %v: %v", rec.Code, rec.Body)
+		t.Fail()
+	}
+	rec = httptest.NewRecorder()
+	cacheFiles.serveCAS(rec, httptest.NewRequest("GET", "/cas/d524cc049aa9e17e50110b184db46691", nil))
+	if rec.Code != 403 {
+		t.Logf("Expected a 403 from /cas/ with an allowlist set, but got %v", rec.Code)
+		t.Fail()
+	}
+}
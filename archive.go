@@ -0,0 +1,195 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A cacheArchive serves /export and /import for disk's files, to requests
+// carrying admin's token as a bearer token, as POST /config must. Keys
+// imported are admitted to bounded, if it's set, so that its lru and byte
+// total count them as they would keys it fetched.
+type cacheArchive struct {
+	disk    *diskCachedKeyGetter
+	bounded *boundedDiskCachedKeyGetter
+	admin   *runtimeConfig
+}
+
+// Imported files are written to temp files named .import_* beside where
+// they land, until they're renamed into place.
+const importTempPrefix = ".import_"
+
+// internalToArchive is true of the cache's own paths under cacheDir that
+// don't belong in an archive: directories such as _cas and _partial, whose
+// names no bucket can have, and imports still being written. The _cas
+// links are remade on import from the keys they link to, rather than
+// coming back as copies of them.
+func internalToArchive(rel string) bool {
+	return strings.HasPrefix(rel, "_") || strings.HasPrefix(path.Base(rel), importTempPrefix)
+}
+
+// serveExport streams every cached file, sidecar metadata included, as a
+// tar archive. Each file is opened before its header is written, so an
+// entry evicted mid-export is either skipped or exported whole.
+func (a *cacheArchive) serveExport(w http.ResponseWriter, r *http.Request) {
+	if !a.admin.authorized(r) {
+		http.Error(w, "a valid bearer token is required", 401)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "export only supports GET", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	tw := tar.NewWriter(w)
+	root := filepath.Clean(a.disk.cacheDir + "/")
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		if internalToArchive(filepath.ToSlash(rel)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err = f.Stat()
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{Name: filepath.ToSlash(rel), Mode: 0644, Size: info.Size(),
+			ModTime: info.ModTime(), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err = io.CopyN(tw, f, info.Size())
+		return err
+	})
+	if err != nil {
+		// the headers are long gone, so all we can do is cut the archive short
+		log.Printf("Export failed partway: %v", err)
+		return
+	}
+	tw.Close()
+}
+
+// serveImport unpacks a tar archive made by serveExport into the cache.
+// Each file lands via a rename, so readers never see a partial entry.
+// Whatever was imported before any error is admitted all the same.
+func (a *cacheArchive) serveImport(w http.ResponseWriter, r *http.Request) {
+	if !a.admin.authorized(r) {
+		http.Error(w, "a valid bearer token is required", 401)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "import only supports POST", 405)
+		return
+	}
+	imported, err := a.disk.importArchive(r.Body)
+	for _, result := range imported {
+		// the sidecars may have come after their files
+		a.disk.loadMetadata(&result)
+		if a.disk.contentAddressed {
+			if err := a.disk.linkCAS(result); err != nil {
+				log.Printf("Couldn't link imported %v/%v by content: %v", result.bucketName, result.keyName, err)
+			}
+		}
+		if a.bounded != nil {
+			a.bounded.admitImported(result)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	fmt.Fprintf(w, "imported %v keys\n", len(imported))
+}
+
+// importArchive unpacks archive into the cache, returning a result for
+// each key it imported.
+func (d *diskCachedKeyGetter) importArchive(archive io.Reader) ([]getResult, error) {
+	tr := tar.NewReader(archive)
+	var imported []getResult
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return imported, fmt.Errorf("refusing to import %v outside the cache", header.Name)
+		}
+		if internalToArchive(name) {
+			// archives from before these were left out of exports
+			continue
+		}
+		if err := d.importFile(name, tr); err != nil {
+			return imported, err
+		}
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) < 2 || checkBucketName(parts[0]) != nil {
+			// sidecars and the cache's own files aren't keys
+			continue
+		}
+		if keyName, ok := d.keyNameAt(parts[1]); ok {
+			d.stats.stored(parts[0], header.Size)
+			localPath := path.Join(d.cacheDir, name)
+			imported = append(imported, getResult{bucketName: parts[0], keyName: keyName, localPath: &localPath,
+				bytesTransferred: header.Size, status: "cache_hit"})
+		}
+	}
+}
+
+func (d *diskCachedKeyGetter) importFile(name string, contents io.Reader) error {
+	destination := path.Join(d.cacheDir, name)
+	if err := os.MkdirAll(path.Dir(destination), 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(path.Dir(destination), importTempPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, contents)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), destination)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
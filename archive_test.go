@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	exportDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(exportDir)
+	exporter := &diskCachedKeyGetter{base: base, cacheDir: exportDir, contentAddressed: true}
+	exporter.get(context.Background(), "bucket", []string{"key1", "dir/key2"})
+	// leftovers of a move and an import, which aren't the cache's to export
+	if err := os.MkdirAll(path.Join(exportDir, "_partial"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, leftover := range []string{"_partial/move_1", "bucket/.import_1"} {
+		if err := ioutil.WriteFile(path.Join(exportDir, leftover), []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin := &runtimeConfig{token: "secret"}
+	authorized := func(r *http.Request) *http.Request {
+		r.Header.Set("Authorization", "Bearer secret")
+		return r
+	}
+
+	rec := httptest.NewRecorder()
+	(&cacheArchive{disk: exporter, admin: admin}).serveExport(rec, httptest.NewRequest("GET", "/export", nil))
+	if rec.Code != 401 {
+		t.Logf("Expected a 401 from export without the token, but got %v", rec.Code)
+		t.Fail()
+	}
+	rec = httptest.NewRecorder()
+	bare := httptest.NewRequest("GET", "/export", nil)
+	bare.Header.Set("Authorization", "secret")
+	(&cacheArchive{disk: exporter, admin: admin}).serveExport(rec, bare)
+	if rec.Code != 401 {
+		t.Logf("Expected a 401 from export with a bare token, but got %v", rec.Code)
+		t.Fail()
+	}
+	rec = httptest.NewRecorder()
+	(&cacheArchive{disk: exporter, admin: admin}).serveExport(rec, authorized(httptest.NewRequest("GET", "/export", nil)))
+	if rec.Code != 200 {
+		t.Fatalf("Expected a 200 from export, but got %v", rec.Code)
+	}
+	tr := tar.NewReader(bytes.NewReader(rec.Body.Bytes()))
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if internalToArchive(header.Name) {
+			t.Logf("Expected the cache's own %v to be left out of the export", header.Name)
+			t.Fail()
+		}
+	}
+
+	importBase := newMockKeyGetter("never fetched")
+	defer os.RemoveAll(importBase.dir)
+	importDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(importDir)
+	importer := &diskCachedKeyGetter{base: importBase, cacheDir: importDir, contentAddressed: true}
+	bounded := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: importer}, disk: importer,
+		wake: make(chan struct{}, 1)}
+	imports := &cacheArchive{disk: importer, bounded: bounded, admin: admin}
+	archive := rec.Body.Bytes()
+	rec = httptest.NewRecorder()
+	imports.serveImport(rec, httptest.NewRequest("POST", "/import", bytes.NewReader(archive)))
+	if rec.Code != 401 || importer.has("bucket", "key1") {
+		t.Logf("Expected a 401 from import without the token, but got %v", rec.Code)
+		t.Fail()
+	}
+	rec = httptest.NewRecorder()
+	imports.serveImport(rec, authorized(httptest.NewRequest("POST", "/import", bytes.NewReader(archive))))
+	if rec.Code != 200 {
+		t.Fatalf("Expected a 200 from import, but got %v: %v", rec.Code, rec.Body.String())
+	}
+
+	linked := 0
+	for _, result := range importer.get(context.Background(), "bucket", []string{"key1", "dir/key2"}) {
+		if result.status != "disk cache hit" {
+			t.Logf("Expected %v to be a hit after importing, but got %v", result.keyName, result.status)
+			t.Fail()
+			continue
+		}
+		compareContents("sample content", *result.localPath, t)
+		// both keys have the same content, so whichever was imported first
+		// has the link
+		keyInfo, _ := os.Stat(*result.localPath)
+		digest, _ := importer.casDigest(result)
+		if casInfo, err := os.Stat(importer.casPathFor(digest)); err == nil && os.SameFile(keyInfo, casInfo) {
+			linked += 1
+		}
+		if result.cachedAt.IsZero() {
+			t.Logf("Expected %v's sidecar metadata to come along", result.keyName)
+			t.Fail()
+		}
+	}
+	if linked != 1 {
+		t.Logf("Expected the imported keys to be linked by content again, but %v were", linked)
+		t.Fail()
+	}
+	if importBase.called != 0 {
+		t.Logf("Expected no fetches after importing, but had %v", importBase.called)
+		t.Fail()
+	}
+	size := 2 * int64(len("sample content"))
+	if tallied := bounded.lru.aggregates(); tallied.Entries != 2 || tallied.Bytes != size || bounded.size() != size {
+		t.Logf("Expected both imported keys, %v bytes, in the lru, but it had %+v and a total of %v",
+			size, tallied, bounded.size())
+		t.Fail()
+	}
+}
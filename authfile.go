@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"launchpad.net/goamz/aws"
+	"launchpad.net/goamz/s3"
+)
+
+// A swappableS3 is a connection to S3 whose credentials and region can be
+// replaced while it's in use. Each operation uses whichever connection is
+// current when it starts.
+type swappableS3 struct {
+	conn atomic.Pointer[s3.S3]
+}
+
+func newSwappableS3(conn *s3.S3) *swappableS3 {
+	s := &swappableS3{}
+	s.conn.Store(conn)
+	return s
+}
+
+func (s *swappableS3) current() *s3.S3 {
+	return s.conn.Load()
+}
+
+func (s *swappableS3) swap(conn *s3.S3) {
+	s.conn.Store(conn)
+}
+
+func (s *swappableS3) Bucket(name string) *s3.Bucket {
+	return s.current().Bucket(name)
+}
+
+// An authFile holds the default credentials and region, for deployments
+// that mount them as a file rather than setting them in the environment.
+type authFile struct {
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Region    string `json:"region"`
+}
+
+var errEmptyAuthFile = errors.New("credentials file is empty")
+
+// parseAuthFile reads an authFile, in defaultRegion unless it names one.
+func parseAuthFile(raw []byte, defaultRegion aws.Region) (aws.Auth, aws.Region, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return aws.Auth{}, aws.Region{}, errEmptyAuthFile
+	}
+	var parsed authFile
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		return aws.Auth{}, aws.Region{}, err
+	}
+	if parsed.AccessKey == "" || parsed.SecretKey == "" {
+		return aws.Auth{}, aws.Region{}, fmt.Errorf("credentials file needs an access_key and secret_key")
+	}
+	region := defaultRegion
+	if parsed.Region != "" {
+		var ok bool
+		if region, ok = aws.Regions[parsed.Region]; !ok {
+			return aws.Auth{}, aws.Region{}, fmt.Errorf("credentials file has unknown region %q", parsed.Region)
+		}
+	}
+	return aws.Auth{AccessKey: parsed.AccessKey, SecretKey: parsed.SecretKey}, region, nil
+}
+
+// An authWatcher polls an authFile, swapping conn for one with the new
+// credentials and region each time its contents change. Rotation can
+// leave the file briefly empty or half-written, so contents that don't
+// parse are ignored, keeping the current connection until a later poll
+// finds them whole. Files that don't name a region are for defaultRegion,
+// or us-east-1 if that's unset.
+type authWatcher struct {
+	path          string
+	conn          *swappableS3
+	endpointFor   func(aws.Region) aws.Region
+	defaultRegion aws.Region
+	applied       []byte
+}
+
+// check reloads the file if it's changed, reporting whether conn was
+// swapped.
+func (a *authWatcher) check() bool {
+	raw, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		log.Printf("Couldn't read credentials from %v, keeping the current ones: %v", a.path, err)
+		return false
+	}
+	if bytes.Equal(raw, a.applied) {
+		return false
+	}
+	defaultRegion := a.defaultRegion
+	if defaultRegion.Name == "" {
+		defaultRegion = aws.USEast
+	}
+	auth, region, err := parseAuthFile(raw, defaultRegion)
+	if err != nil {
+		if err != errEmptyAuthFile {
+			log.Printf("Couldn't load credentials from %v, keeping the current ones: %v", a.path, err)
+		}
+		return false
+	}
+	a.conn.swap(s3.New(auth, a.endpointFor(region)))
+	a.applied = raw
+	log.Printf("Loaded new credentials for region %v from %v", region.Name, a.path)
+	return true
+}
+
+func (a *authWatcher) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		a.check()
+	}
+}
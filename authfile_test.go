@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"launchpad.net/goamz/aws"
+	"launchpad.net/goamz/s3"
+)
+
+func TestAuthWatcherReconfiguresOnChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authPath := path.Join(dir, "credentials.json")
+	write := func(contents string) {
+		if err := ioutil.WriteFile(authPath, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"access_key": "first", "secret_key": "secret1"}`)
+	conn := newSwappableS3(s3.New(aws.Auth{}, aws.USEast))
+	watcher := &authWatcher{path: authPath, conn: conn, endpointFor: func(region aws.Region) aws.Region { return region }}
+	if !watcher.check() || conn.current().AccessKey != "first" || conn.current().Region.Name != aws.USEast.Name {
+		t.Fatalf("Expected the first credentials to be loaded, but got %v", conn.current().Auth)
+	}
+	if watcher.check() {
+		t.Logf("Expected an unchanged file not to be reloaded")
+		t.Fail()
+	}
+
+	// mid-rotation, the file can be empty or half-written
+	for _, partial := range []string{"", `{"access_key": "sec`} {
+		write(partial)
+		if watcher.check() || conn.current().AccessKey != "first" {
+			t.Logf("Expected %q to leave the current credentials alone, but got %v", partial, conn.current().Auth)
+			t.Fail()
+		}
+	}
+
+	write(`{"access_key": "second", "secret_key": "secret2", "region": "eu-west-1"}`)
+	if !watcher.check() {
+		t.Fatalf("Expected the rotated credentials to be loaded")
+	}
+	if current := conn.current(); current.AccessKey != "second" || current.SecretKey != "secret2" || current.Region.Name != "eu-west-1" {
+		t.Logf("Expected the connection to use the rotated credentials and region, but got %v in %v", current.Auth, current.Region.Name)
+		t.Fail()
+	}
+	if conn.Bucket("bucket").S3 != conn.current() {
+		t.Logf("Expected buckets to come from the rotated connection")
+		t.Fail()
+	}
+}
+
+func TestAuthFileDefaultsToTheConfiguredRegion(t *testing.T) {
+	for raw, expected := range map[string]string{
+		`{"access_key": "key", "secret_key": "secret"}`:                        "ap-southeast-2",
+		`{"access_key": "key", "secret_key": "secret", "region": "eu-west-1"}`: "eu-west-1",
+	} {
+		_, region, err := parseAuthFile([]byte(raw), aws.APSoutheast2)
+		if err != nil || region.Name != expected {
+			t.Logf("Expected %v to be for %v, but got %v, %v", raw, expected, region.Name, err)
+			t.Fail()
+		}
+	}
+}
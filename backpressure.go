@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// What a bounded cache does with downloads while its eviction is behind.
+const (
+	slowWhenBehind   = "slow"
+	rejectWhenBehind = "reject"
+)
+
+var behindActions = []string{slowWhenBehind, rejectWhenBehind}
+
+// evictionBehindStatus is the status of a key that wasn't downloaded
+// because the cache is over budget and eviction isn't catching up.
+const evictionBehindStatus = "eviction_behind"
+
+// behind reports whether the cache has been over its soft limit for
+// longer than behindAfter, which means downloads are outpacing eviction.
+// It logs and counts in stats each time that starts and stops.
+func (b *boundedDiskCachedKeyGetter) behind() bool {
+	if b.behindAfter <= 0 {
+		return false
+	}
+	b.Lock()
+	now, was := time.Now(), b.isBehind
+	if b.total <= b.softLimit {
+		b.overSince, b.isBehind = time.Time{}, false
+	} else if b.overSince.IsZero() {
+		b.overSince = now
+	} else if now.Sub(b.overSince) > b.behindAfter {
+		b.isBehind = true
+	}
+	is, total, soft, since := b.isBehind, b.total, b.softLimit, b.overSince
+	b.Unlock()
+	switch {
+	case is && !was:
+		log.Printf("EVICTION IS FALLING BEHIND: %v bytes cached against a soft limit of %v since %v; holding back downloads",
+			total, soft, since.Format(time.RFC3339))
+		b.stats.evictionBehind(1)
+	case was && !is:
+		log.Printf("Eviction has caught up, with %v bytes cached", total)
+		b.stats.evictionBehind(-1)
+	}
+	return is
+}
+
+// holdBack applies backpressure to a request about to download keyNames,
+// returning the keys it may still download and results for those it
+// mustn't. With behindAction slow, it waits behindBackoff first, or until
+// eviction catches up; with reject, none may be downloaded.
+func (b *boundedDiskCachedKeyGetter) holdBack(ctx context.Context, bucketName string, keyNames []string) ([]string, []getResult) {
+	if len(keyNames) == 0 || !b.behind() {
+		return keyNames, nil
+	}
+	b.stats.backpressured()
+	if b.behindAction == rejectWhenBehind {
+		refused := make([]getResult, 0, len(keyNames))
+		for _, keyName := range keyNames {
+			refused = append(refused, getResult{keyName: keyName, bucketName: bucketName, status: evictionBehindStatus})
+		}
+		return nil, refused
+	}
+	timer := time.NewTimer(b.behindBackoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return keyNames, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBoundedDiskCachedKeyGetterBackpressure(t *testing.T) {
+	for _, action := range behindActions {
+		base := newMockKeyGetter("sample content")
+		defer os.RemoveAll(base.dir)
+		cacheDir, err := ioutil.TempDir("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(cacheDir)
+		dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+		size := int64(len("sample content"))
+		stats := &cacheStats{}
+		b := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg}, disk: dkg, softLimit: size,
+			wake: make(chan struct{}, 1), behindAfter: 10 * time.Millisecond, behindAction: action,
+			behindBackoff: 50 * time.Millisecond, stats: stats}
+
+		// nothing's evicting, so downloads outpace eviction
+		b.get(context.Background(), "bucket", []string{"key1", "key2"})
+		time.Sleep(20 * time.Millisecond)
+		start := time.Now()
+		result := b.get(context.Background(), "bucket", []string{"key3"})[0]
+		switch action {
+		case rejectWhenBehind:
+			if result.localPath != nil || result.status != evictionBehindStatus || base.called != 2 {
+				t.Logf("Expected key3 to be refused while eviction is behind, but got %v after %v downloads", result.status, base.called)
+				t.Fail()
+			}
+		case slowWhenBehind:
+			if result.localPath == nil || time.Since(start) < b.behindBackoff {
+				t.Logf("Expected key3 to be downloaded after backing off, but got %v after %v", result.status, time.Since(start))
+				t.Fail()
+			}
+		}
+		if total, _ := stats.snapshot(); total.EvictionBehind != 1 || total.Backpressured != 1 {
+			t.Logf("Expected eviction to be counted as behind for %v, but got %+v", action, total)
+			t.Fail()
+		}
+
+		go b.keepClean()
+		b.wake <- struct{}{}
+		deadline := time.Now().Add(5 * time.Second)
+		for b.size() > b.softLimit && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		start = time.Now()
+		result = b.get(context.Background(), "bucket", []string{"key4"})[0]
+		close(b.wake)
+		if result.localPath == nil || time.Since(start) >= b.behindBackoff {
+			t.Logf("Expected key4 to be downloaded right away once eviction caught up, but got %v after %v", result.status, time.Since(start))
+			t.Fail()
+		}
+		if total, _ := stats.snapshot(); total.EvictionBehind != 0 || total.Backpressured != 1 {
+			t.Logf("Expected eviction to be counted as caught up for %v, but got %+v", action, total)
+			t.Fail()
+		}
+	}
+}
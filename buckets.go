@@ -0,0 +1,105 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// A bucketCappedKeyGetter caches keys from at most maxBuckets buckets.
+// Requesting a key from one more drops everything cached for the least
+// recently requested bucket, directories included, so deployments that
+// touch many short-lived buckets don't accumulate them forever.
+type bucketCappedKeyGetter struct {
+	CachedKeyGetter
+	disk       *diskCachedKeyGetter
+	maxBuckets int
+	recent     list.List
+	buckets    map[string]*list.Element
+	sync.Mutex
+}
+
+func (b *bucketCappedKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	if checkBucketName(bucketName) != nil {
+		// nothing will be cached for it, so it shouldn't take a slot
+		return b.CachedKeyGetter.get(ctx, bucketName, keyNames)
+	}
+	for _, dropped := range b.touch(bucketName) {
+		b.drop(dropped)
+	}
+	return b.CachedKeyGetter.get(ctx, bucketName, keyNames)
+}
+
+// touch marks bucketName as the most recently requested bucket and
+// returns the buckets that no longer fit.
+func (b *bucketCappedKeyGetter) touch(bucketName string) []string {
+	b.Lock()
+	defer b.Unlock()
+	if b.buckets == nil {
+		b.buckets = make(map[string]*list.Element)
+	}
+	if elem, had := b.buckets[bucketName]; had {
+		b.recent.MoveToFront(elem)
+		return nil
+	}
+	b.buckets[bucketName] = b.recent.PushFront(bucketName)
+	var dropped []string
+	for b.recent.Len() > b.maxBuckets {
+		oldest := b.recent.Remove(b.recent.Back()).(string)
+		delete(b.buckets, oldest)
+		dropped = append(dropped, oldest)
+	}
+	return dropped
+}
+
+// drop removes every key cached for bucketName through the wrapped getter,
+// so any byte accounting above the disk stays right, then its directories.
+func (b *bucketCappedKeyGetter) drop(bucketName string) {
+	if trace.enabled() {
+		trace.event("drop_bucket", "bucket", bucketName)
+	}
+	for _, keyName := range b.disk.keysIn(bucketName) {
+		b.remove(bucketName, keyName)
+	}
+	os.RemoveAll(path.Join(b.disk.cacheDir, bucketName))
+	os.RemoveAll(path.Join(b.disk.cacheDir, ".meta", bucketName))
+}
+
+// keysIn lists the keys cached for bucketName.
+func (d *diskCachedKeyGetter) keysIn(bucketName string) []string {
+	if checkBucketName(bucketName) != nil {
+		return nil
+	}
+	root := path.Join(d.cacheDir, bucketName)
+	var keyNames []string
+	filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return nil
+		}
+		if keyName, ok := d.keyNameAt(filepath.ToSlash(rel)); ok {
+			keyNames = append(keyNames, keyName)
+		}
+		return nil
+	})
+	return keyNames
+}
+
+// keyNameAt recovers the key name cached at rel, a path relative to its
+// bucket's directory, if it's one pathFor could have made.
+func (d *diskCachedKeyGetter) keyNameAt(rel string) (string, bool) {
+	keyName, ok := rel, true
+	if d.layout != nil {
+		keyName, ok = d.layout.keyName(keyName)
+	}
+	if ok && d.foldCase {
+		keyName, ok = unfoldKeyName(keyName)
+	}
+	return keyName, ok
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestBucketCappedKeyGetterDropsLeastRecentBucket(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	b := &bucketCappedKeyGetter{CachedKeyGetter: dkg, disk: dkg, maxBuckets: 2}
+
+	b.get(context.Background(), "bucket-a", []string{"key1", "dir/key2"})
+	b.get(context.Background(), "bucket-b", []string{"key1"})
+	b.get(context.Background(), "bucket-a", []string{"key1"})
+	b.get(context.Background(), "bucket-c", []string{"key1"})
+
+	if b.has("bucket-b", "key1") {
+		t.Logf("Expected the least recently used bucket to be dropped")
+		t.Fail()
+	}
+	if _, err := os.Stat(path.Join(cacheDir, "bucket-b")); !os.IsNotExist(err) {
+		t.Logf("Expected the dropped bucket's directory to be removed, but got %v", err)
+		t.Fail()
+	}
+	for _, kept := range [][2]string{{"bucket-a", "key1"}, {"bucket-a", "dir/key2"}, {"bucket-c", "key1"}} {
+		if !b.has(kept[0], kept[1]) {
+			t.Logf("Expected %v/%v to still be cached", kept[0], kept[1])
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// zipFetchesAtOnce caps the keys one /zip request fetches at once.
+const zipFetchesAtOnce = 16
+
+// serveZip fetches the keys of a CacheRequest through the cache and
+// streams them back as a zip archive with an entry named for each key, as
+// zipEntryName names it. Keys are fetched concurrently and written in the
+// order they land, so the first entries go out while later keys are still
+// downloading. Keys that can't be fetched are left out of the archive,
+// and those passed through rather than cached are removed once they're in
+// it. Requests are admitted, logged and recorded in the access history as
+// cache requests are, and fetch at most zipFetchesAtOnce keys at a time.
+func (s *keyServer) serveZip(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "zip only supports GET and POST", 405)
+		return
+	}
+	if err := s.admit(); err != nil {
+		s.reject(w, err)
+		return
+	}
+	defer s.release()
+	cr, getter, ok := s.decode(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	landed := make(chan getResult, len(cr.KeyNames))
+	go func() {
+		fetches := newSlots(zipFetchesAtOnce)
+		for _, keyName := range cr.KeyNames {
+			if !fetches.acquire(ctx) {
+				landed <- getResult{bucketName: cr.BucketName, keyName: keyName, status: ctx.Err().Error()}
+				continue
+			}
+			go func(keyName string) {
+				defer fetches.release()
+				for _, result := range cr.fetch(ctx, getter, []string{keyName}) {
+					landed <- result
+				}
+			}(keyName)
+		}
+	}()
+	w.Header().Set("Content-Type", "application/zip")
+	zw := zip.NewWriter(w)
+	var failed error
+	results := make([]getResult, 0, len(cr.KeyNames))
+	for range cr.KeyNames {
+		result := <-landed
+		results = append(results, result)
+		if result.localPath == nil {
+			log.Printf("Leaving %v/%v out of the zip: %v", cr.BucketName, result.keyName, result.status)
+			continue
+		}
+		if failed == nil {
+			failed = addToZip(zw, zipEntryName(result.keyName), *result.localPath)
+			if failed != nil {
+				// the headers are long gone, so all we can do is cut the archive short
+				log.Printf("Zip of %v failed partway: %v", cr.BucketName, failed)
+			}
+		}
+		if passedThroughFile(result) {
+			os.Remove(*result.localPath)
+		}
+		if failed == nil {
+			zw.Flush()
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+	}
+	s.accessLog.record(r, cr.Credentials, results)
+	s.history.record(cr.Credentials, results)
+	if failed == nil {
+		zw.Close()
+	}
+}
+
+// zipEntryName is the name keyName's entry in a zip goes by. A key name
+// can start with /, which unzipping would take to mean the root rather
+// than the directory it unzips into, so it's cleaned to a relative path
+// with no empty or .. segments that stays inside that directory.
+func zipEntryName(keyName string) string {
+	return strings.TrimPrefix(path.Clean("/"+keyName), "/")
+}
+
+func addToZip(zw *zip.Writer, name, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, f)
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServeZip(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	contents := map[string]string{
+		"a.txt":      "first object",
+		"dir/b.txt":  "second object",
+		"dir/c.json": `{"third": "object"}`,
+		"/d.txt":     "fourth object",
+	}
+	objects := mapKeyReaderGetter{}
+	entries := make(map[string]string)
+	for keyName, content := range contents {
+		objects["bucket/"+keyName] = content
+		entries[zipEntryName(keyName)] = content
+	}
+	getter := &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{
+		base: &tempKeyGetter{keyReaderGetter: objects}, cacheDir: cacheDir}}
+	accesses, err := newAccessLog(path.Join(cacheDir, "_access.log"), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &keyServer{MutableKeyGetter: getter, accessLog: accesses, history: &accessHistory{}}
+
+	rec := httptest.NewRecorder()
+	server.serveZip(rec, httptest.NewRequest("DELETE", "/zip", nil))
+	if rec.Code != 405 {
+		t.Logf("Expected a 405 for a DELETE, but got %v", rec.Code)
+		t.Fail()
+	}
+	body := []byte(`{"bucket_name": "bucket", "keynames": ["a.txt", "dir/b.txt", "dir/c.json", "/d.txt", "missing"]}`)
+	rec = httptest.NewRecorder()
+	server.serveZip(rec, httptest.NewRequest("POST", "/zip", bytes.NewReader(body)))
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected a 200 zip, but got %v %v: %v", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(contents) {
+		t.Logf("Expected %v entries, but found %v", len(contents), len(zr.File))
+		t.Fail()
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != entries[f.Name] {
+			t.Logf("Expected %q in %v, but found %q", entries[f.Name], f.Name, content)
+			t.Fail()
+		}
+	}
+	accesses.close()
+	if records := readAccessLog(t, path.Join(cacheDir, "_access.log")); len(records) != len(contents)+1 {
+		t.Logf("Expected an access record for each key zipped, but got %+v", records)
+		t.Fail()
+	}
+	if hottest := server.history.hottest(); len(hottest) != len(contents) {
+		t.Logf("Expected each key zipped in the access history, but it has %+v", hottest)
+		t.Fail()
+	}
+}
+
+// A concurrencyKeyGetter fetches through its mockKeyGetter, keeping track
+// of the most Gets it's had in flight at once.
+type concurrencyKeyGetter struct {
+	*mockKeyGetter
+	inFlight, most int
+	sync.Mutex
+}
+
+func (c *concurrencyKeyGetter) Get(ctx context.Context, bucketName string, keyNames []string, opts getOptions) []getResult {
+	c.Lock()
+	c.inFlight += 1
+	if c.inFlight > c.most {
+		c.most = c.inFlight
+	}
+	c.Unlock()
+	time.Sleep(time.Millisecond)
+	defer func() {
+		c.Lock()
+		c.inFlight -= 1
+		c.Unlock()
+	}()
+	return c.mockKeyGetter.get(ctx, bucketName, keyNames)
+}
+
+func (c *concurrencyKeyGetter) GetCached(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	return nil
+}
+
+func TestServeZipIsAdmittedAndBounded(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	getter := &concurrencyKeyGetter{mockKeyGetter: base}
+	server := &keyServer{MutableKeyGetter: getter, maxGoroutines: 1, goroutines: func() int { return 2 }}
+	keyNames := make([]string, 4*zipFetchesAtOnce)
+	for i := range keyNames {
+		keyNames[i] = fmt.Sprintf("key%v", i)
+	}
+	body, err := json.Marshal(CacheRequest{BucketName: "bucket", KeyNames: keyNames})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.serveZip(rec, httptest.NewRequest("POST", "/zip", bytes.NewReader(body)))
+	if rec.Code != 503 || base.called != 0 {
+		t.Logf("Expected a 503 with too many goroutines running, but got %v after %v fetches", rec.Code, base.called)
+		t.Fail()
+	}
+
+	server.maxGoroutines = 0
+	rec = httptest.NewRecorder()
+	server.serveZip(rec, httptest.NewRequest("POST", "/zip", bytes.NewReader(body)))
+	if zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len())); err != nil || len(zr.File) != len(keyNames) {
+		t.Fatalf("Expected a zip of all %v keys, but got %v: %v", len(keyNames), rec.Code, err)
+	}
+	if getter.most > zipFetchesAtOnce {
+		t.Logf("Expected at most %v keys fetched at once, but there were %v", zipFetchesAtOnce, getter.most)
+		t.Fail()
+	}
+}
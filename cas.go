@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Content-addressed copies live under cacheDir/_cas, named by md5. No S3
+// bucket name can start with an underscore, so that can't collide with a
+// cached bucket.
+func (d *diskCachedKeyGetter) casPathFor(digest string) string {
+	return path.Join(d.cacheDir, "_cas", digest)
+}
+
+func isMD5Hex(digest string) bool {
+	if len(digest) != 2*md5.Size || strings.ToLower(digest) != digest {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
+
+// casDigest is the md5 to file g under, hashing its cached file if g
+// doesn't carry a usable one.
+func (d *diskCachedKeyGetter) casDigest(g getResult) (string, error) {
+	if isMD5Hex(g.md5) {
+		return g.md5, nil
+	}
+	f, err := d.files().Open(*g.localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// linkCAS hard-links a newly cached key's file under its md5. An existing
+// link for the same digest already has the same content, so it's kept.
+func (d *diskCachedKeyGetter) linkCAS(g getResult) error {
+	digest, err := d.casDigest(g)
+	if err != nil {
+		return err
+	}
+	casPath := d.casPathFor(digest)
+	if err := d.files().MkdirAll(path.Dir(casPath), 0777); err != nil {
+		return err
+	}
+	if err := d.files().Link(*g.localPath, casPath); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// unlinkCAS removes the content-addressed link made for a key about to be
+// removed, unless it was made for some other key with the same content.
+func (d *diskCachedKeyGetter) unlinkCAS(bucketName, keyName string) {
+	keyPath, err := d.pathFor(bucketName, keyName)
+	if err != nil {
+		return
+	}
+	g := getResult{bucketName: bucketName, keyName: keyName, localPath: &keyPath}
+	d.loadMetadata(&g)
+	digest, err := d.casDigest(g)
+	if err != nil {
+		return
+	}
+	casPath := d.casPathFor(digest)
+	keyInfo, err := d.files().Stat(keyPath)
+	if err != nil {
+		return
+	}
+	if casInfo, err := d.files().Stat(casPath); err == nil && d.files().SameFile(keyInfo, casInfo) {
+		d.files().Remove(casPath)
+	}
+}
+
+// serveCAS serves GET /cas/<md5> with the content of any cached key
+// with that md5, or a 404 if there is none. Content isn't filed by
+// bucket, so there's no telling whether it came from one the allowlist
+// allows; with an allowlist set, it's refused outright.
+func (d *diskCachedKeyGetter) serveCAS(w http.ResponseWriter, r *http.Request) {
+	if len(d.allowed) > 0 {
+		http.Error(w, "content-addressed reads aren't allowed with -allowed-buckets", 403)
+		return
+	}
+	digest := strings.TrimPrefix(r.URL.Path, "/cas/")
+	if !isMD5Hex(digest) {
+		http.Error(w, "expected a lowercase hex md5", 400)
+		return
+	}
+	f, err := d.files().Open(d.casPathFor(digest))
+	if os.IsNotExist(err) {
+		http.Error(w, "not cached", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("ETag", `"`+digest+`"`)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestServeCAS(t *testing.T) {
+	sampleContent := "sample content"
+	base := newMockKeyGetter(sampleContent)
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir, contentAddressed: true}
+	dkg.get(context.Background(), "bucket", []string{"key1"})
+
+	sum := md5.Sum([]byte(sampleContent))
+	digest := hex.EncodeToString(sum[:])
+	rec := httptest.NewRecorder()
+	dkg.serveCAS(rec, httptest.NewRequest("GET", "/cas/"+digest, nil))
+	if rec.Code != 200 || rec.Body.String() != sampleContent {
+		t.Logf("Expected %q by digest, but got %v %q", sampleContent, rec.Code, rec.Body.String())
+		t.Fail()
+	}
+
+	dkg.remove("bucket", "key1")
+	rec = httptest.NewRecorder()
+	dkg.serveCAS(rec, httptest.NewRequest("GET", "/cas/"+digest, nil))
+	if rec.Code != 404 {
+		t.Logf("Expected a 404 once the key was removed, but got %v", rec.Code)
+		t.Fail()
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// What -case-insensitive-fs can be set to.
+const (
+	caseFoldAuto = "auto"
+	caseFoldOn   = "on"
+	caseFoldOff  = "off"
+)
+
+var caseFoldSettings = []string{caseFoldAuto, caseFoldOn, caseFoldOff}
+
+// foldSafeKeyName encodes keyName so that no two key names differing only
+// in case encode the same, even once case is folded: each capital letter
+// becomes a ! and its lowercase, and each ! becomes !!. S3 keys are case
+// sensitive, so on a case-insensitive filesystem Key and key would
+// otherwise share a file.
+func foldSafeKeyName(keyName string) string {
+	if strings.IndexFunc(keyName, func(r rune) bool { return r == '!' || ('A' <= r && r <= 'Z') }) < 0 {
+		return keyName
+	}
+	var b strings.Builder
+	for i := 0; i < len(keyName); i++ {
+		switch c := keyName[i]; {
+		case c == '!':
+			b.WriteString("!!")
+		case 'A' <= c && c <= 'Z':
+			b.WriteByte('!')
+			b.WriteByte(c - 'A' + 'a')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unfoldKeyName recovers the key name foldSafeKeyName encoded as encoded,
+// or reports false if it couldn't have made it.
+func unfoldKeyName(encoded string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(encoded); i++ {
+		c := encoded[i]
+		switch {
+		case 'A' <= c && c <= 'Z':
+			return "", false
+		case c != '!':
+			b.WriteByte(c)
+		case i+1 == len(encoded):
+			return "", false
+		case encoded[i+1] == '!':
+			b.WriteByte('!')
+			i++
+		case 'a' <= encoded[i+1] && encoded[i+1] <= 'z':
+			b.WriteByte(encoded[i+1] - 'a' + 'A')
+			i++
+		default:
+			return "", false
+		}
+	}
+	return b.String(), true
+}
+
+// caseInsensitive reports whether dir is on a filesystem that ignores the
+// case of names, by making a file there and looking for it in lowercase.
+func caseInsensitive(dir string) (bool, error) {
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return false, err
+	}
+	probe, err := ioutil.TempFile(dir, ".CaseProbe")
+	if err != nil {
+		return false, fmt.Errorf("couldn't check whether %v is case-insensitive: %v", dir, err)
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+	info, err := os.Stat(probe.Name())
+	if err != nil {
+		return false, err
+	}
+	folded, err := os.Stat(path.Join(path.Dir(probe.Name()), strings.ToLower(path.Base(probe.Name()))))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(info, folded), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// A foldingFS ignores the case of names, as macOS's default filesystem does.
+type foldingFS struct {
+	*memFS
+}
+
+func (f foldingFS) Stat(name string) (os.FileInfo, error) {
+	return f.memFS.Stat(strings.ToLower(name))
+}
+
+func (f foldingFS) Remove(name string) error {
+	return f.memFS.Remove(strings.ToLower(name))
+}
+
+func (f foldingFS) Open(name string) (cacheFile, error) {
+	return f.memFS.Open(strings.ToLower(name))
+}
+
+func (f foldingFS) ReadFile(name string) ([]byte, error) {
+	return f.memFS.ReadFile(strings.ToLower(name))
+}
+
+func (f foldingFS) Sync(name string) error {
+	return f.memFS.Sync(strings.ToLower(name))
+}
+
+func (f foldingFS) Rename(oldpath, newpath string) error {
+	return f.memFS.Rename(strings.ToLower(oldpath), strings.ToLower(newpath))
+}
+
+func (f foldingFS) MkdirAll(name string, perm os.FileMode) error {
+	return f.memFS.MkdirAll(strings.ToLower(name), perm)
+}
+
+func (f foldingFS) Link(oldname, newname string) error {
+	return f.memFS.Link(strings.ToLower(oldname), strings.ToLower(newname))
+}
+
+func (f foldingFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return f.memFS.WriteFile(strings.ToLower(name), data, perm)
+}
+
+func TestFoldSafeKeyNames(t *testing.T) {
+	for keyName, expected := range map[string]string{
+		"key":           "key",
+		"Key":           "!key",
+		"a/B/c!":        "a/!b/c!!",
+		"ALL!CAPS.json": "!a!l!l!!!c!a!p!s.json",
+	} {
+		encoded := foldSafeKeyName(keyName)
+		if encoded != expected {
+			t.Logf("Expected %q to encode as %q, but got %q", keyName, expected, encoded)
+			t.Fail()
+		}
+		if decoded, ok := unfoldKeyName(encoded); !ok || decoded != keyName {
+			t.Logf("Expected %q to decode back to %q, but got %q, %v", encoded, keyName, decoded, ok)
+			t.Fail()
+		}
+	}
+	for _, bad := range []string{"Key", "key!", "!1"} {
+		if _, ok := unfoldKeyName(bad); ok {
+			t.Logf("Expected %q not to decode", bad)
+			t.Fail()
+		}
+	}
+}
+
+func TestDiskCachedKeyGetterFoldCase(t *testing.T) {
+	mem := newMemFS()
+	fs := foldingFS{mem}
+	base := &memKeyGetter{fs: mem, content: "upper"}
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: "/cache", fs: fs, foldCase: true}
+
+	dkg.get(context.Background(), "bucket", []string{"Key"})
+	base.content = "lower"
+	keyNames := []string{"key", "Key"}
+	results := inRequestOrder(keyNames, dkg.get(context.Background(), "bucket", keyNames))
+	if base.called != 2 {
+		t.Logf("Expected Key and key to be downloaded separately, but there were %v downloads", base.called)
+		t.Fail()
+	}
+	for i, expected := range []string{"lower", "upper"} {
+		if results[i].localPath == nil {
+			t.Fatalf("Expected %v to be cached, but got %v", results[i].keyName, results[i].status)
+		}
+		content, err := fs.ReadFile(*results[i].localPath)
+		if err != nil || string(content) != expected {
+			t.Logf("Expected %q for %v, but got %q, %v", expected, results[i].keyName, content, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestDiskCachedKeyGetterFoldCaseKeysIn(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir, foldCase: true}
+	dkg.get(context.Background(), "bucket", []string{"Dir/Key!", "dir/key"})
+
+	keyNames := dkg.keysIn("bucket")
+	sort.Strings(keyNames)
+	if !reflect.DeepEqual(keyNames, []string{"Dir/Key!", "dir/key"}) {
+		t.Logf("Expected the cached key names back as requested, but got %v", keyNames)
+		t.Fail()
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// An inflightGet is a download that later requests for the same key wait
+// on instead of starting their own.
+type inflightGet struct {
+	id      string
+	done    chan struct{}
+	result  getResult
+	waiters int64
+	fetch   *sharedFetch
+}
+
+// A sharedFetch is one get of the keys a request led, which runs until
+// every request waiting on any of them has its result or has gone away.
+type sharedFetch struct {
+	cancel  context.CancelFunc
+	waiting int
+}
+
+// A coalescingKeyGetter lets only one get of a key through to its
+// CachedKeyGetter at a time; concurrent requests for that key wait for
+// and share its result, so a popular key that misses is downloaded once
+// rather than once per client. The get runs apart from the request that
+// started it, so that request's client going away doesn't fail the others
+// waiting on it; it's only cancelled once they've all gone.
+type coalescingKeyGetter struct {
+	CachedKeyGetter
+	stats    *cacheStats
+	inflight map[string]*inflightGet
+	sync.Mutex
+}
+
+// coalescingID is what gets of keyName under ctx share a download by. A
+// get expecting a particular ETag only shares with others expecting the
+// same one, since its download fails if the key has changed, and one
+// forwarding headers only with others forwarding the same ones.
+func coalescingID(ctx context.Context, bucketName, keyName string) string {
+	id := bucketName + "/" + keyName
+	if etag := ifMatchFor(ctx, keyName); etag != "" {
+		id += "\x00If-Match: " + etag
+	}
+	forwarded := forwardedHeadersFor(ctx)
+	names := make([]string, 0, len(forwarded))
+	for name := range forwarded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		id += "\x00" + name + ": " + strings.Join(forwarded[name], ", ")
+	}
+	return id
+}
+
+func (c *coalescingKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	flights := make([]*inflightGet, len(keyNames))
+	var leading []string
+	leads := make(map[string]*inflightGet)
+	fetchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	fetch := &sharedFetch{cancel: cancel}
+	c.Lock()
+	if c.inflight == nil {
+		c.inflight = make(map[string]*inflightGet)
+	}
+	for i, keyName := range keyNames {
+		id := coalescingID(ctx, bucketName, keyName)
+		flight, had := c.inflight[id]
+		if had {
+			flight.waiters += 1
+			c.stats.coalesced(bucketName, flight.waiters)
+			if trace.enabled() {
+				trace.event("coalesced", "bucket", bucketName, "key", keyName, "waiters", flight.waiters)
+			}
+		} else {
+			flight = &inflightGet{id: id, done: make(chan struct{}), fetch: fetch}
+			c.inflight[id] = flight
+			leading = append(leading, keyName)
+			leads[keyName] = flight
+		}
+		flight.fetch.waiting += 1
+		flights[i] = flight
+	}
+	c.Unlock()
+
+	if len(leading) > 0 {
+		go c.lead(fetchCtx, fetch, bucketName, leading, leads)
+	} else {
+		cancel()
+	}
+
+	out := make([]getResult, 0, len(keyNames))
+	for i, flight := range flights {
+		select {
+		case <-flight.done:
+			out = append(out, flight.result)
+		case <-ctx.Done():
+			out = append(out, getResult{keyName: keyNames[i], bucketName: bucketName, status: cancelled})
+		}
+		c.Lock()
+		if flight.fetch.waiting -= 1; flight.fetch.waiting == 0 {
+			flight.fetch.cancel()
+		}
+		c.Unlock()
+	}
+	return out
+}
+
+// lead gets leading, handing each key's result to the requests waiting
+// on it in leads.
+func (c *coalescingKeyGetter) lead(ctx context.Context, fetch *sharedFetch, bucketName string, leading []string, leads map[string]*inflightGet) {
+	defer fetch.cancel()
+	results := c.CachedKeyGetter.get(ctx, bucketName, leading)
+	c.Lock()
+	defer c.Unlock()
+	for _, result := range results {
+		if flight, ok := leads[result.keyName]; ok {
+			flight.result = result
+		}
+	}
+	for keyName, flight := range leads {
+		if flight.result.keyName == "" {
+			flight.result = getResult{keyName: keyName, bucketName: bucketName, status: cancelled}
+		}
+		delete(c.inflight, flight.id)
+		c.stats.landed(bucketName, flight.waiters)
+		close(flight.done)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedKeyGetter holds every get until its gate is closed.
+type gatedKeyGetter struct {
+	KeyGetter
+	gate chan struct{}
+}
+
+func (g *gatedKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	<-g.gate
+	return g.KeyGetter.get(ctx, bucketName, keyNames)
+}
+
+func TestCoalescingKeyGetterRecordsWaiters(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	gated := &gatedKeyGetter{KeyGetter: base, gate: make(chan struct{})}
+	stats := &cacheStats{}
+	ckg := &coalescingKeyGetter{
+		CachedKeyGetter: &diskCachedKeyGetter{base: gated, cacheDir: cacheDir},
+		stats:           stats,
+	}
+
+	const clients = 5
+	var wg sync.WaitGroup
+	results := make([][]getResult, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = ckg.get(context.Background(), "bucket", []string{"popular"})
+		}(i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		total, _ := stats.snapshot()
+		if total.Waiting == clients-1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v waiters, but only saw %+v", clients-1, total)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(gated.gate)
+	wg.Wait()
+
+	if base.called != 1 {
+		t.Logf("Expected 1 download, but had %v", base.called)
+		t.Fail()
+	}
+	for _, result := range results {
+		if len(result) != 1 || result[0].localPath == nil {
+			t.Logf("Expected every client to get the cached key, but got %v", result)
+			t.Fail()
+		}
+	}
+	total, _ := stats.snapshot()
+	if total.Coalesced != clients-1 || total.PeakWaiters != clients-1 || total.Waiting != 0 {
+		t.Logf("Expected %v coalesced requests peaking at %v waiters, but got %+v", clients-1, clients-1, total)
+		t.Fail()
+	}
+	rec := httptest.NewRecorder()
+	stats.servePrometheus(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if line := `s3cache_coalesced_requests_total{bucket="bucket"} 4`; !strings.Contains(rec.Body.String(), line) {
+		t.Logf("Expected %q in the prometheus output:\n%v", line, rec.Body.String())
+		t.Fail()
+	}
+}
+
+// cancellableKeyGetter holds every get until its gate is closed, then
+// fails it if its context was cancelled meanwhile.
+type cancellableKeyGetter struct {
+	KeyGetter
+	gate chan struct{}
+}
+
+func (g *cancellableKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	<-g.gate
+	if ctx.Err() != nil {
+		out := make([]getResult, len(keyNames))
+		for i, keyName := range keyNames {
+			out[i] = getResult{keyName: keyName, bucketName: bucketName, status: cancelled}
+		}
+		return out
+	}
+	return g.KeyGetter.get(ctx, bucketName, keyNames)
+}
+
+func TestCoalescingKeyGetterOutlivesItsLeader(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	gated := &cancellableKeyGetter{KeyGetter: base, gate: make(chan struct{})}
+	stats := &cacheStats{}
+	ckg := &coalescingKeyGetter{
+		CachedKeyGetter: &diskCachedKeyGetter{base: gated, cacheDir: cacheDir},
+		stats:           stats,
+	}
+
+	leaderCtx, leave := context.WithCancel(context.Background())
+	led := make(chan []getResult)
+	go func() { led <- ckg.get(leaderCtx, "bucket", []string{"popular"}) }()
+	for {
+		ckg.Lock()
+		started := len(ckg.inflight) > 0
+		ckg.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	followed := make(chan []getResult)
+	go func() { followed <- ckg.get(context.Background(), "bucket", []string{"popular"}) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if total, _ := stats.snapshot(); total.Waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the follower to wait on the leader's download")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	leave()
+	if result := <-led; result[0].status != cancelled {
+		t.Logf("Expected the leader to give up once its client went away, but got %v", result[0].status)
+		t.Fail()
+	}
+	close(gated.gate)
+	if result := <-followed; result[0].localPath == nil {
+		t.Logf("Expected the follower to get the key despite its leader going away, but got %v", result[0].status)
+		t.Fail()
+	}
+}
+
+func TestCoalescingKeyGetterKeepsDifferentGetsApart(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	gated := &gatedKeyGetter{KeyGetter: base, gate: make(chan struct{})}
+	ckg := &coalescingKeyGetter{
+		CachedKeyGetter: &diskCachedKeyGetter{base: gated, cacheDir: cacheDir},
+		stats:           &cacheStats{},
+	}
+
+	ctxs := []context.Context{
+		withIfMatch(context.Background(), map[string]string{"popular": "0123abcd"}),
+		withForwardedHeaders(context.Background(), map[string]string{"X-Amz-Request-Payer": "requester"}),
+		context.Background(),
+	}
+	var wg sync.WaitGroup
+	for _, ctx := range ctxs {
+		wg.Add(1)
+		go func(ctx context.Context) {
+			defer wg.Done()
+			ckg.get(ctx, "bucket", []string{"popular"})
+		}(ctx)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ckg.Lock()
+		inflight := len(ckg.inflight)
+		ckg.Unlock()
+		if inflight == len(ctxs) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a download for each differently made get, but saw %v", inflight)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(gated.gate)
+	wg.Wait()
+}
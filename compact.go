@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A dirGuard keeps directories from being pruned out from under keys
+// being moved into them. Caching holds it shared from making a key's
+// directory until the key is in it; pruning holds it alone. Getters
+// sharing a cache directory must share a dirGuard. A nil *dirGuard
+// guards nothing, and prunes nothing.
+type dirGuard struct {
+	sync.RWMutex
+}
+
+func (g *dirGuard) filling() {
+	if g != nil {
+		g.RLock()
+	}
+}
+
+func (g *dirGuard) filled() {
+	if g != nil {
+		g.RUnlock()
+	}
+}
+
+// under reports whether dir is inside root, and not root itself.
+func under(dir, root string) bool {
+	rel, err := filepath.Rel(root, dir)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// pruneParents removes the directories that held name, from its own up,
+// for as long as they're left empty, stopping short of root.
+func (g *dirGuard) pruneParents(files cacheFS, name, root string) {
+	if g == nil {
+		return
+	}
+	g.Lock()
+	defer g.Unlock()
+	for dir := path.Dir(name); under(dir, root); dir = path.Dir(dir) {
+		// removing a directory only succeeds once it's empty
+		if files.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// compact removes every empty directory left under the cached buckets and
+// their metadata, deepest first, as remove would have had it pruned them,
+// returning how many it removed. It catches those left by removes made
+// before pruning was on, or by another process.
+func (d *diskCachedKeyGetter) compact() int {
+	if d.dirs == nil {
+		return 0
+	}
+	var dirs []string
+	for _, bucketName := range d.cachedBuckets() {
+		for _, root := range []string{path.Join(d.cacheDir, bucketName), path.Join(d.cacheDir, ".meta", bucketName)} {
+			filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+				if err == nil && info.IsDir() {
+					dirs = append(dirs, name)
+				}
+				return nil
+			})
+		}
+	}
+	// a directory's subdirectories sort after it
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	removed := 0
+	for _, dir := range dirs {
+		d.dirs.Lock()
+		if d.files().Remove(dir) == nil {
+			removed++
+		}
+		d.dirs.Unlock()
+	}
+	return removed
+}
+
+// compactEvery compacts the cache every interval, forever.
+func (d *diskCachedKeyGetter) compactEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if removed := d.compact(); removed > 0 {
+			log.Printf("Removed %v empty directories from the cache", removed)
+		}
+	}
+}
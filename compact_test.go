@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDiskCachedKeyGetterPrunesEmptyDirs(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir, dirs: &dirGuard{}}
+	evicted := []string{"prefix/a/1", "prefix/a/2", "prefix/b/3"}
+	dkg.get(context.Background(), "bucket", append([]string{"kept"}, evicted...))
+	for _, keyName := range evicted {
+		dkg.remove("bucket", keyName)
+	}
+	for _, gone := range []string{"bucket/prefix", ".meta/bucket/prefix"} {
+		if _, err := os.Stat(path.Join(cacheDir, gone)); !os.IsNotExist(err) {
+			t.Logf("Expected %v to be pruned once empty, but got %v", gone, err)
+			t.Fail()
+		}
+	}
+	if !dkg.has("bucket", "kept") {
+		t.Logf("Expected the key outside the prefix to be left alone")
+		t.Fail()
+	}
+
+	dkg.remove("bucket", "kept")
+	if _, err := os.Stat(cacheDir); err != nil {
+		t.Logf("Expected the cache directory itself never to be pruned, but got %v", err)
+		t.Fail()
+	}
+}
+
+func TestDiskCachedKeyGetterCompact(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	// left behind by removes before pruning was on
+	for _, dir := range []string{"bucket/empty/a/b", "bucket/empty/c", ".meta/bucket/empty/a"} {
+		if err := os.MkdirAll(path.Join(cacheDir, dir), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir, dirs: &dirGuard{}}
+	dkg.get(context.Background(), "bucket", []string{"full/key"})
+
+	if removed := dkg.compact(); removed != 6 {
+		t.Logf("Expected the 6 empty directories to be removed, but %v were", removed)
+		t.Fail()
+	}
+	if _, err := os.Stat(path.Join(cacheDir, "bucket/empty")); !os.IsNotExist(err) {
+		t.Logf("Expected the empty directories to be gone, but got %v", err)
+		t.Fail()
+	}
+	if !dkg.has("bucket", "full/key") {
+		t.Logf("Expected cached keys to survive compaction")
+		t.Fail()
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runtimeLimits are the settings /config can change without a restart.
+// MaxBytes and SoftMaxBytes are only tunable if the server was started
+// with -max-bytes, since the eviction machinery only exists then.
+type runtimeLimits struct {
+	MaxBytes     int64  `json:"max_bytes,omitempty"`
+	SoftMaxBytes int64  `json:"soft_max_bytes,omitempty"`
+	EvictionPace string `json:"eviction_pace,omitempty"`
+	MaxDownloads int    `json:"max_downloads"`
+	MaxRequests  int    `json:"max_requests"`
+}
+
+// A limitsUpdate is a POST /config body. Fields left out are unchanged.
+type limitsUpdate struct {
+	MaxBytes     *int64  `json:"max_bytes"`
+	SoftMaxBytes *int64  `json:"soft_max_bytes"`
+	EvictionPace *string `json:"eviction_pace"`
+	MaxDownloads *int    `json:"max_downloads"`
+	MaxRequests  *int    `json:"max_requests"`
+}
+
+// A runtimeConfig holds the current tunable limits and everything they
+// apply to. Bounded getters are tracked as newGetter builds them, so
+// credentials first used after a change start out with the new limits.
+// POST /config must carry the token as a bearer token.
+type runtimeConfig struct {
+	token         string
+	maxBytes      int64
+	softMaxBytes  int64
+	evictionPace  time.Duration
+	downloadSlots *slots
+	requestSlots  *slots
+	bounded       []*boundedDiskCachedKeyGetter
+	sync.Mutex
+}
+
+// track applies the current limits to b and keeps them applied.
+func (c *runtimeConfig) track(b *boundedDiskCachedKeyGetter) {
+	c.Lock()
+	defer c.Unlock()
+	b.setLimits(c.softMaxBytes, c.maxBytes, c.evictionPace)
+	c.bounded = append(c.bounded, b)
+}
+
+func (c *runtimeConfig) current() runtimeLimits {
+	c.Lock()
+	defer c.Unlock()
+	limits := runtimeLimits{
+		MaxBytes:     c.maxBytes,
+		SoftMaxBytes: c.softMaxBytes,
+		MaxDownloads: c.downloadSlots.currentLimit(),
+		MaxRequests:  c.requestSlots.currentLimit(),
+	}
+	if c.maxBytes > 0 {
+		limits.EvictionPace = c.evictionPace.String()
+	}
+	return limits
+}
+
+// apply checks every field of u before changing anything, so an update
+// either takes effect entirely or not at all.
+func (c *runtimeConfig) apply(u limitsUpdate) error {
+	c.Lock()
+	defer c.Unlock()
+	maxBytes, softMaxBytes, pace := c.maxBytes, c.softMaxBytes, c.evictionPace
+	if u.MaxBytes != nil || u.SoftMaxBytes != nil || u.EvictionPace != nil {
+		if c.maxBytes <= 0 {
+			return fmt.Errorf("max_bytes, soft_max_bytes and eviction_pace can only be changed when started with -max-bytes")
+		}
+	}
+	if u.MaxBytes != nil {
+		if *u.MaxBytes <= 0 {
+			return fmt.Errorf("max_bytes must be positive, got %v", *u.MaxBytes)
+		}
+		maxBytes = *u.MaxBytes
+		if u.SoftMaxBytes == nil && softMaxBytes > maxBytes {
+			softMaxBytes = maxBytes
+		}
+	}
+	if u.SoftMaxBytes != nil {
+		if *u.SoftMaxBytes <= 0 || *u.SoftMaxBytes > maxBytes {
+			return fmt.Errorf("soft_max_bytes must be positive and at most max_bytes (%v), got %v", maxBytes, *u.SoftMaxBytes)
+		}
+		softMaxBytes = *u.SoftMaxBytes
+	}
+	if u.EvictionPace != nil {
+		var err error
+		if pace, err = time.ParseDuration(*u.EvictionPace); err != nil {
+			return fmt.Errorf("eviction_pace: %v", err)
+		}
+		if pace < 0 {
+			return fmt.Errorf("eviction_pace can't be negative, got %v", pace)
+		}
+	}
+	if u.MaxDownloads != nil && *u.MaxDownloads < 0 {
+		return fmt.Errorf("max_downloads can't be negative, got %v", *u.MaxDownloads)
+	}
+	if u.MaxRequests != nil && *u.MaxRequests < 0 {
+		return fmt.Errorf("max_requests can't be negative, got %v", *u.MaxRequests)
+	}
+
+	c.maxBytes, c.softMaxBytes, c.evictionPace = maxBytes, softMaxBytes, pace
+	for _, b := range c.bounded {
+		b.setLimits(softMaxBytes, maxBytes, pace)
+	}
+	if u.MaxDownloads != nil {
+		c.downloadSlots.setLimit(*u.MaxDownloads)
+	}
+	if u.MaxRequests != nil {
+		c.requestSlots.setLimit(*u.MaxRequests)
+	}
+	return nil
+}
+
+// readTokenFile reads the token in path, refusing an empty one.
+func readTokenFile(path string) (string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(raw))
+	if token == "" {
+		return "", fmt.Errorf("%v is empty", path)
+	}
+	return token, nil
+}
+
+// authorized is true of requests carrying the token as a bearer token. A
+// bare token, without the scheme, isn't accepted.
+func (c *runtimeConfig) authorized(r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	if c.token == "" || !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1
+}
+
+// ServeHTTP serves GET /config as the current limits, and POST /config to
+// change them. Fields that aren't tunable are rejected.
+func (c *runtimeConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !c.authorized(r) {
+		http.Error(w, "a valid bearer token is required", 401)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		var update limitsUpdate
+		if err := decoder.Decode(&update); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := c.apply(update); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	default:
+		http.Error(w, "config only supports GET and POST", 405)
+		return
+	}
+	out, err := json.Marshal(c.current())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
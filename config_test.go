@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postConfig(config *runtimeConfig, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/config", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+	config.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestRuntimeConfigLowersMaxBytes(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	size := int64(len("sample content"))
+	b := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg}, disk: dkg, wake: make(chan struct{}, 1)}
+	config := &runtimeConfig{token: "secret", maxBytes: 10 * size, softMaxBytes: 10 * size,
+		downloadSlots: newSlots(0), requestSlots: newSlots(4)}
+	config.track(b)
+	go b.keepClean()
+	defer close(b.wake)
+
+	b.get(context.Background(), "bucket", []string{"key1", "key2", "key3", "key4"})
+	if b.size() != 4*size {
+		t.Fatalf("Expected nothing evicted under the starting budget, but size is %v", b.size())
+	}
+
+	if resp := postConfig(config, "wrong", `{"max_bytes": 10}`); resp.Code != 401 {
+		t.Logf("Expected a bad token to get a 401, but got %v", resp.Code)
+		t.Fail()
+	}
+	if resp := postConfig(config, "secret", `{"max_bytes": 10, "gzip_min_bytes": 5}`); resp.Code != 400 {
+		t.Logf("Expected a non-tunable field to get a 400, but got %v", resp.Code)
+		t.Fail()
+	}
+	if resp := postConfig(config, "secret", `{"max_bytes": 10, "max_requests": -1}`); resp.Code != 400 {
+		t.Logf("Expected an invalid field to get a 400, but got %v", resp.Code)
+		t.Fail()
+	}
+	if _, hard, _ := b.limits(); hard != 10*size {
+		t.Logf("Expected rejected updates to change nothing, but the hard limit is %v", hard)
+		t.Fail()
+	}
+
+	body := fmt.Sprintf(`{"max_bytes": %v, "max_requests": 1}`, 2*size)
+	if resp := postConfig(config, "secret", body); resp.Code != http.StatusOK {
+		t.Fatalf("Expected the update to succeed, but got %v: %v", resp.Code, resp.Body.String())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for b.size() > 2*size && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if b.size() != 2*size {
+		t.Logf("Expected eviction to bring the size down to the new budget of %v, but it's %v", 2*size, b.size())
+		t.Fail()
+	}
+	if b.has("bucket", "key1") || !b.has("bucket", "key4") {
+		t.Logf("Expected the oldest keys to be the ones evicted")
+		t.Fail()
+	}
+	if !config.requestSlots.tryAcquire() || config.requestSlots.tryAcquire() {
+		t.Logf("Expected max_requests to be lowered to 1")
+		t.Fail()
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"launchpad.net/goamz/aws"
+	"os"
+	"sync"
+)
+
+// A credentialSet is a named, alternate set of AWS credentials that a
+// request may opt into, but only for the buckets it lists.
+type credentialSet struct {
+	AccessKey string   `json:"access_key"`
+	SecretKey string   `json:"secret_key"`
+	Region    string   `json:"region"`
+	Buckets   []string `json:"buckets"`
+}
+
+func (c credentialSet) allows(bucketName string) bool {
+	for _, allowed := range c.Buckets {
+		if allowed == bucketName {
+			return true
+		}
+	}
+	return false
+}
+
+func loadCredentialSets(fileName string) (map[string]credentialSet, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sets := make(map[string]credentialSet)
+	if err := json.NewDecoder(f).Decode(&sets); err != nil {
+		return nil, err
+	}
+	for name, set := range sets {
+		if _, ok := aws.Regions[set.Region]; !ok {
+			return nil, fmt.Errorf("credentials %v have unknown region %q", name, set.Region)
+		}
+	}
+	return sets, nil
+}
+
+// A credentialRouter hands out a MutableKeyGetter for a named credentialSet,
+// building at most one per distinct credential and region. A rotated
+// secret gets a getter of its own, rather than the one signing with the
+// old secret.
+type credentialRouter struct {
+	sets      map[string]credentialSet
+	newGetter func(aws.Auth, aws.Region) MutableKeyGetter
+	getters   map[string]MutableKeyGetter
+	sync.Mutex
+}
+
+func (c *credentialRouter) getterFor(name, bucketName string) (MutableKeyGetter, error) {
+	set, ok := c.sets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown credentials %q", name)
+	}
+	if !set.allows(bucketName) {
+		return nil, fmt.Errorf("credentials %q may not be used for bucket %q", name, bucketName)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.getters == nil {
+		c.getters = make(map[string]MutableKeyGetter)
+	}
+	memoKey := set.AccessKey + "\x00" + set.SecretKey + "\x00" + set.Region
+	getter, had := c.getters[memoKey]
+	if !had {
+		auth := aws.Auth{AccessKey: set.AccessKey, SecretKey: set.SecretKey}
+		getter = c.newGetter(auth, aws.Regions[set.Region])
+		c.getters[memoKey] = getter
+	}
+	return getter, nil
+}
+
+type cachingDiskKey struct{}
+
+// A credentialKeyGetter gets keys from a CachedKeyGetter shared by every
+// set of credentials, such as the LRU bounding -cache-dir, having what it
+// misses cached through disk, these credentials' own disk getter.
+type credentialKeyGetter struct {
+	CachedKeyGetter
+	disk KeyGetter
+}
+
+func (c *credentialKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	return c.CachedKeyGetter.get(context.WithValue(ctx, cachingDiskKey{}, c.disk), bucketName, keyNames)
+}
+
+// A credentialDiskRouter is what a shared CachedKeyGetter gets its misses
+// from: the disk getter of the credentialKeyGetter the request came
+// through, or its own CachedKeyGetter for requests that came some other
+// way.
+type credentialDiskRouter struct {
+	CachedKeyGetter
+}
+
+func (c *credentialDiskRouter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	if disk, ok := ctx.Value(cachingDiskKey{}).(KeyGetter); ok {
+		return disk.get(ctx, bucketName, keyNames)
+	}
+	return c.CachedKeyGetter.get(ctx, bucketName, keyNames)
+}
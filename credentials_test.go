@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"launchpad.net/goamz/aws"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestCredentialRouting(t *testing.T) {
+	clients := map[string]*mockKeyGetter{
+		"AKIAONE": newMockKeyGetter("one"),
+		"AKIATWO": newMockKeyGetter("two"),
+	}
+	for _, client := range clients {
+		defer os.RemoveAll(client.dir)
+	}
+	built := 0
+	router := &credentialRouter{
+		sets: map[string]credentialSet{
+			"team-one": {AccessKey: "AKIAONE", Region: "us-east-1", Buckets: []string{"bucket-one"}},
+			"team-two": {AccessKey: "AKIATWO", Region: "eu-west-1", Buckets: []string{"bucket-two"}},
+		},
+		newGetter: func(auth aws.Auth, region aws.Region) MutableKeyGetter {
+			built += 1
+			return ignoringMutableKeyGetter{clients[auth.AccessKey]}
+		},
+	}
+	defaultClient := newMockKeyGetter("default")
+	defer os.RemoveAll(defaultClient.dir)
+	ks := keyServer{MutableKeyGetter: ignoringMutableKeyGetter{defaultClient}, credentials: router}
+
+	post := func(body string) int {
+		rec := httptest.NewRecorder()
+		ks.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader([]byte(body))))
+		return rec.Code
+	}
+	post(`{"bucket_name":"bucket-one","keynames":["key1"],"credentials":"team-one"}`)
+	post(`{"bucket_name":"bucket-one","keynames":["key2"],"credentials":"team-one"}`)
+	post(`{"bucket_name":"bucket-two","keynames":["key1"],"credentials":"team-two"}`)
+
+	if clients["AKIAONE"].called != 2 {
+		t.Logf("Expected 2 calls with the first credentials, but had %v", clients["AKIAONE"].called)
+		t.Fail()
+	}
+	if clients["AKIATWO"].called != 1 {
+		t.Logf("Expected 1 call with the second credentials, but had %v", clients["AKIATWO"].called)
+		t.Fail()
+	}
+	if built != 2 {
+		t.Logf("Expected a getter to be built once per credential set, but built %v", built)
+		t.Fail()
+	}
+
+	if code := post(`{"bucket_name":"bucket-two","keynames":["key1"],"credentials":"team-one"}`); code != 403 {
+		t.Logf("Expected a 403 using credentials outside their buckets, but got %v", code)
+		t.Fail()
+	}
+	if code := post(`{"bucket_name":"bucket-one","keynames":["key1"],"credentials":"nobody"}`); code != 403 {
+		t.Logf("Expected a 403 for unknown credentials, but got %v", code)
+		t.Fail()
+	}
+	if clients["AKIAONE"].called != 2 || clients["AKIATWO"].called != 1 {
+		t.Logf("Rejected requests should not have reached any client")
+		t.Fail()
+	}
+
+	rotated := router.sets["team-one"]
+	rotated.SecretKey = "rotated"
+	router.sets["team-one"] = rotated
+	post(`{"bucket_name":"bucket-one","keynames":["key3"],"credentials":"team-one"}`)
+	if built != 3 {
+		t.Logf("Expected a rotated secret to get a getter of its own, but built %v", built)
+		t.Fail()
+	}
+}
+
+func TestCredentialKeyGettersShareOneLRU(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	one, two := newMockKeyGetter("one"), newMockKeyGetter("two")
+	defer os.RemoveAll(one.dir)
+	defer os.RemoveAll(two.dir)
+	diskOne := &diskCachedKeyGetter{base: one, cacheDir: cacheDir}
+	diskTwo := &diskCachedKeyGetter{base: two, cacheDir: cacheDir}
+	router := &credentialDiskRouter{CachedKeyGetter: diskOne}
+	bounded := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: router}, disk: diskOne,
+		softLimit: 100, hardLimit: 100, wake: make(chan struct{}, 1)}
+	teamOne := &credentialKeyGetter{CachedKeyGetter: bounded, disk: diskOne}
+	teamTwo := &credentialKeyGetter{CachedKeyGetter: bounded, disk: diskTwo}
+
+	teamOne.get(context.Background(), "bucket", []string{"key1"})
+	results := teamTwo.get(context.Background(), "bucket", []string{"key2"})
+	if len(results) != 1 || results[0].localPath == nil {
+		t.Fatalf("Expected key2 to be cached, but got %v", results)
+	}
+	compareContents("two", *results[0].localPath, t)
+	if one.called != 1 || two.called != 1 {
+		t.Logf("Expected each key fetched with its own credentials, but had %v and %v fetches", one.called, two.called)
+		t.Fail()
+	}
+	if size := bounded.size(); size != int64(len("one")+len("two")) {
+		t.Logf("Expected both credentials' keys counted against the one limit, but counted %v bytes", size)
+		t.Fail()
+	}
+	teamOne.remove("bucket", "key2")
+	if size := bounded.size(); size != int64(len("one")) || bounded.lru.has("bucket", "key2") {
+		t.Logf("Expected a key removed through either credentials to leave the shared LRU, but counted %v bytes", size)
+		t.Fail()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A digester looks up the current md5 of a key upstream, as lowercase hex.
+type digester interface {
+	currentDigest(bucketName, keyName string) (string, error)
+}
+
+// currentDigest takes AWS's word that the ETag is the md5.
+func (s *s3Conn) currentDigest(bucketName, keyName string) (string, error) {
+	return md5For(s.current(), bucketName, keyName)
+}
+
+// A headerDigester reads the md5 from a response header, for S3-compatible
+// stores whose ETags aren't md5s. It asks for a single byte of the key,
+// since it only wants the headers, and accepts the digest in hex or, like
+// Content-MD5, base64.
+type headerDigester struct {
+	header string
+	urlFor func(bucketName, keyName string) string
+	client *http.Client
+}
+
+func (h *headerDigester) currentDigest(bucketName, keyName string) (string, error) {
+	req, err := http.NewRequest("GET", h.urlFor(bucketName, keyName), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	client := h.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == 404:
+		return "", fmt.Errorf("%v/%v %w", bucketName, keyName, errNotFoundUpstream)
+	case resp.StatusCode >= 300:
+		return "", fmt.Errorf("couldn't get the digest of %v/%v: %v", bucketName, keyName, resp.Status)
+	}
+	value := strings.TrimSpace(resp.Header.Get(h.header))
+	if value == "" {
+		return "", fmt.Errorf("%v/%v has no %v header", bucketName, keyName, h.header)
+	}
+	if isMD5Hex(strings.ToLower(value)) {
+		return strings.ToLower(value), nil
+	}
+	if raw, err := base64.StdEncoding.DecodeString(value); err == nil && len(raw) == 16 {
+		return hex.EncodeToString(raw), nil
+	}
+	return "", fmt.Errorf("%v/%v has an unreadable %v header %q", bucketName, keyName, h.header, value)
+}
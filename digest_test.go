@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderDigester(t *testing.T) {
+	headers := map[string]string{
+		"/bucket/hex":     "9E107D9D372BB6826BD81D3542A419D6",
+		"/bucket/base64":  "nhB9nTcrtoJr2B01QqQZ1g==",
+		"/bucket/missing": "",
+	}
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "bytes=0-0" {
+			t.Logf("Expected only the first byte to be requested, but got Range %q", r.Header.Get("Range"))
+			t.Fail()
+		}
+		if value, ok := headers[r.URL.Path]; ok {
+			w.Header().Set("X-Content-Md5", value)
+			w.WriteHeader(206)
+			w.Write([]byte("x"))
+		} else {
+			w.WriteHeader(404)
+		}
+	}))
+	defer store.Close()
+	d := &headerDigester{header: "X-Content-Md5", urlFor: func(bucketName, keyName string) string {
+		return store.URL + "/" + bucketName + "/" + keyName
+	}}
+	evicter := &md5ShouldEvicter{d}
+
+	for _, keyName := range []string{"hex", "base64"} {
+		evict, err := evicter.ShouldEvict(getResult{bucketName: "bucket", keyName: keyName,
+			md5: "9e107d9d372bb6826bd81d3542a419d6"})
+		if err != nil || evict {
+			t.Logf("Expected %v's header digest to match, but got %v, %v", keyName, evict, err)
+			t.Fail()
+		}
+	}
+	if _, err := d.currentDigest("bucket", "missing"); err == nil {
+		t.Logf("Expected an error for a key with no digest header")
+		t.Fail()
+	}
+	if _, err := d.currentDigest("bucket", "deleted"); !isNotFound(err) {
+		t.Logf("Expected a not found error for a deleted key, but got %v", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"launchpad.net/goamz/aws"
+)
+
+// s3Region is region with its S3 endpoint replaced by endpoint, if one is
+// given, for S3-compatible stores. With httpsOnly, an endpoint that isn't
+// https is an error, so the cache never talks to S3 in plaintext.
+func s3Region(region aws.Region, endpoint string, httpsOnly bool) (aws.Region, error) {
+	if endpoint != "" {
+		region.S3Endpoint = endpoint
+		region.S3BucketEndpoint = ""
+	}
+	if !httpsOnly {
+		return region, nil
+	}
+	for _, configured := range []string{region.S3Endpoint, region.S3BucketEndpoint} {
+		if configured == "" {
+			continue
+		}
+		u, err := url.Parse(configured)
+		if err != nil {
+			return region, err
+		}
+		if u.Scheme != "https" {
+			return region, fmt.Errorf("S3 endpoint %v isn't https", configured)
+		}
+	}
+	return region, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"launchpad.net/goamz/aws"
+)
+
+func TestS3RegionHTTPSOnly(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint  string
+		httpsOnly bool
+		ok        bool
+	}{
+		{"", true, true},
+		{"https://minio.internal:9000", true, true},
+		{"http://minio.internal:9000", true, false},
+		{"minio.internal:9000", true, false},
+		{"http://minio.internal:9000", false, true},
+	} {
+		region, err := s3Region(aws.USEast, tc.endpoint, tc.httpsOnly)
+		if (err == nil) != tc.ok {
+			t.Logf("Expected endpoint %q with httpsOnly %v to be allowed: %v, but got %v", tc.endpoint, tc.httpsOnly, tc.ok, err)
+			t.Fail()
+		}
+		if err == nil && tc.endpoint != "" && region.S3Endpoint != tc.endpoint {
+			t.Logf("Expected the endpoint to be %v, but it was %v", tc.endpoint, region.S3Endpoint)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// An s3Event is an S3 event notification, as S3 posts it to a webhook or
+// SQS queue. SNS deliveries wrap the same JSON as a string in Message;
+// SNS asks for its subscription to be confirmed by visiting SubscribeURL.
+type s3Event struct {
+	Type         string `json:"Type"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+	Records      []struct {
+		EventSource string `json:"eventSource"`
+		EventName   string `json:"eventName"`
+		S3          struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+type keyRemover interface {
+	remove(bucketName, keyName string) bool
+}
+
+// An eventInvalidator evicts the keys named by ObjectCreated and
+// ObjectRemoved S3 event notifications, and forgets their buckets'
+// listings, so the next request for them goes back to S3. Events must
+// carry token, as a bearer token or, since that's all an SNS subscription
+// can send, as the password of the endpoint URL's basic auth. An SNS
+// subscription is confirmed by visiting its SubscribeURL with visit, or
+// http.Get if that's nil, as long as it's on an SNS endpoint.
+type eventInvalidator struct {
+	cache    keyRemover
+	listings *listingCache
+	token    string
+	visit    func(url string) (*http.Response, error)
+}
+
+func (e *eventInvalidator) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	return e.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(e.token)) == 1
+}
+
+func (e *eventInvalidator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !e.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="s3-event"`)
+		http.Error(w, "a valid token is required", 401)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "events must be POSTed", 405)
+		return
+	}
+	var event s3Event
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	switch event.Type {
+	case "":
+		// straight from S3, not through SNS
+	case "Notification":
+		if err := json.Unmarshal([]byte(event.Message), &event); err != nil {
+			http.Error(w, fmt.Sprintf("couldn't parse the SNS message: %v", err), 400)
+			return
+		}
+	case "SubscriptionConfirmation":
+		e.confirm(w, event.SubscribeURL)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("can't handle SNS %v messages", event.Type), 400)
+		return
+	}
+	evicted, ignored := 0, 0
+	for _, record := range event.Records {
+		if record.EventSource != "aws:s3" || !(strings.HasPrefix(record.EventName, "ObjectCreated:") ||
+			strings.HasPrefix(record.EventName, "ObjectRemoved:")) {
+			ignored += 1
+			continue
+		}
+		bucketName := record.S3.Bucket.Name
+		// keys in event notifications are URL-encoded, with spaces as +
+		keyName, err := url.QueryUnescape(record.S3.Object.Key)
+		if bucketName == "" || keyName == "" || err != nil {
+			http.Error(w, fmt.Sprintf("%v event has no usable bucket and key", record.EventName), 400)
+			return
+		}
+		if trace.enabled() {
+			trace.event("s3_event", "bucket", bucketName, "key", keyName, "event", record.EventName)
+		}
+		if e.cache.remove(bucketName, keyName) {
+			evicted += 1
+		}
+		if e.listings != nil {
+			e.listings.invalidate(bucketName)
+		}
+	}
+	out, err := json.Marshal(map[string]int{"evicted": evicted, "ignored": ignored})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// confirm subscribes to the SNS topic asking to send events here, by
+// visiting subscribeURL, if it's on an SNS endpoint.
+func (e *eventInvalidator) confirm(w http.ResponseWriter, subscribeURL string) {
+	u, err := url.Parse(subscribeURL)
+	if err != nil || u.Scheme != "https" || !strings.HasPrefix(u.Host, "sns.") ||
+		!strings.HasSuffix(u.Host, ".amazonaws.com") {
+		http.Error(w, fmt.Sprintf("won't confirm a subscription at %q, which isn't SNS", subscribeURL), 400)
+		return
+	}
+	visit := e.visit
+	if visit == nil {
+		visit = http.Get
+	}
+	resp, err := visit(subscribeURL)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			err = fmt.Errorf("SNS answered with a %v", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("couldn't confirm the subscription: %v", err), 502)
+		return
+	}
+	if trace.enabled() {
+		trace.event("s3_event_subscribed", "topic", u.Query().Get("TopicArn"))
+	}
+	w.WriteHeader(200)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEventInvalidatorEvictsChangedKeys(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	dkg.get(context.Background(), "bucket", []string{"dir/changed key", "dir/untouched"})
+	invalidator := &eventInvalidator{cache: dkg, token: "secret"}
+	post := func(body string) *http.Request {
+		r := httptest.NewRequest("POST", "/s3-event", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		return r
+	}
+
+	event := `{"Records": [
+		{"eventSource": "aws:s3", "eventName": "ObjectCreated:Put",
+		 "s3": {"bucket": {"name": "bucket"}, "object": {"key": "dir/changed+key"}}},
+		{"eventSource": "aws:s3", "eventName": "ObjectRestore:Completed",
+		 "s3": {"bucket": {"name": "bucket"}, "object": {"key": "dir/untouched"}}}
+	]}`
+	rec := httptest.NewRecorder()
+	invalidator.ServeHTTP(rec, post(event))
+	if rec.Code != 200 {
+		t.Fatalf("Expected a 200, but got %v: %v", rec.Code, rec.Body.String())
+	}
+	var summary map[string]int
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary["evicted"] != 1 || summary["ignored"] != 1 {
+		t.Logf("Expected one eviction and one ignored event, but got %v", summary)
+		t.Fail()
+	}
+	if dkg.has("bucket", "dir/changed key") {
+		t.Logf("Expected the changed key to be evicted")
+		t.Fail()
+	}
+	if !dkg.has("bucket", "dir/untouched") {
+		t.Logf("Expected the key with an unrelated event to stay cached")
+		t.Fail()
+	}
+
+	rec = httptest.NewRecorder()
+	invalidator.ServeHTTP(rec, post(`{"Records": [{"eventSource": "aws:s3", "eventName": "ObjectRemoved:Delete", "s3": {}}]}`))
+	if rec.Code != 400 {
+		t.Logf("Expected a 400 for an event with no key, but got %v", rec.Code)
+		t.Fail()
+	}
+}
+
+func TestEventInvalidatorRequiresTokenAndConfirmsSNS(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	dkg.get(context.Background(), "bucket", []string{"key"})
+	var visited []string
+	invalidator := &eventInvalidator{cache: dkg, token: "secret", visit: func(url string) (*http.Response, error) {
+		visited = append(visited, url)
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}}
+	event := `{"Type": "Notification", "Message": "{\"Records\": [{\"eventSource\": \"aws:s3\", ` +
+		`\"eventName\": \"ObjectRemoved:Delete\", \"s3\": {\"bucket\": {\"name\": \"bucket\"}, \"object\": {\"key\": \"key\"}}}]}"}`
+
+	for _, password := range []string{"", "wrong"} {
+		r := httptest.NewRequest("POST", "/s3-event", strings.NewReader(event))
+		if password != "" {
+			r.SetBasicAuth("sns", password)
+		}
+		rec := httptest.NewRecorder()
+		invalidator.ServeHTTP(rec, r)
+		if rec.Code != 401 || !dkg.has("bucket", "key") {
+			t.Logf("Expected a 401 without the token, but got %v", rec.Code)
+			t.Fail()
+		}
+	}
+	// SNS sends the token as the password of the URL it was subscribed with
+	sns := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/s3-event", strings.NewReader(body))
+		r.SetBasicAuth("sns", "secret")
+		rec := httptest.NewRecorder()
+		invalidator.ServeHTTP(rec, r)
+		return rec
+	}
+	if rec := sns(event); rec.Code != 200 || dkg.has("bucket", "key") {
+		t.Logf("Expected the key evicted with the token, but got %v: %v", rec.Code, rec.Body)
+		t.Fail()
+	}
+
+	subscribeURL := "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription&TopicArn=arn&Token=abc"
+	if rec := sns(`{"Type": "SubscriptionConfirmation", "SubscribeURL": "` + subscribeURL + `"}`); rec.Code != 200 ||
+		len(visited) != 1 || visited[0] != subscribeURL {
+		t.Logf("Expected the subscription confirmed, but got %v after visiting %v", rec.Code, visited)
+		t.Fail()
+	}
+	for _, body := range []string{`{"Type": "SubscriptionConfirmation", "SubscribeURL": "http://169.254.169.254/latest"}`,
+		`{"Type": "UnsubscribeConfirmation"}`} {
+		if rec := sns(body); rec.Code != 400 {
+			t.Logf("Expected a 400 for %v, but got %v", body, rec.Code)
+			t.Fail()
+		}
+	}
+	if len(visited) != 1 {
+		t.Logf("Expected only the SNS endpoint visited, but visited %v", visited)
+		t.Fail()
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Each download holds a connection to S3 and a temp file open.
+const fdsPerDownload = 2
+
+const tooManyOpenFiles = "too many open files, try again later"
+
+// An fdGuard bounds how many file descriptors downloads hold open at once,
+// so that a big batch on a host with a low ulimit backs off with a clear
+// status instead of failing with EMFILE halfway through. A nil *fdGuard
+// imposes no limit.
+type fdGuard struct {
+	tokens    chan struct{}
+	wait      time.Duration
+	acquiring sync.Mutex
+}
+
+func newFDGuard(limit int, wait time.Duration) *fdGuard {
+	return &fdGuard{tokens: make(chan struct{}, limit), wait: wait}
+}
+
+// acquire waits up to g.wait for n descriptors to be free, returning false
+// if they aren't or ctx is cancelled first.
+func (g *fdGuard) acquire(ctx context.Context, n int) bool {
+	if g == nil {
+		return true
+	}
+	timer := time.NewTimer(g.wait)
+	defer timer.Stop()
+	// Taking tokens one waiter at a time keeps two waiters from each
+	// holding part of what they need.
+	g.acquiring.Lock()
+	defer g.acquiring.Unlock()
+	for i := 0; i < n; i++ {
+		select {
+		case g.tokens <- struct{}{}:
+		case <-ctx.Done():
+			g.release(i)
+			return false
+		case <-timer.C:
+			g.release(i)
+			return false
+		}
+	}
+	return true
+}
+
+func (g *fdGuard) release(n int) {
+	if g == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		<-g.tokens
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// A blockingKeyReaderGetter's readers block until released is closed.
+type blockingKeyReaderGetter struct {
+	started  chan string
+	released chan struct{}
+}
+
+type blockingReadCloser struct {
+	released chan struct{}
+	done     bool
+}
+
+func (b *blockingReadCloser) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	<-b.released
+	b.done = true
+	return copy(p, "contents"), nil
+}
+
+func (b *blockingReadCloser) Close() error {
+	return nil
+}
+
+func (b *blockingKeyReaderGetter) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
+	b.started <- keyName
+	return &blockingReadCloser{released: b.released}, nil
+}
+
+func TestTempKeyGetterFDGuard(t *testing.T) {
+	readers := &blockingKeyReaderGetter{started: make(chan string, 3), released: make(chan struct{})}
+	kg := &tempKeyGetter{keyReaderGetter: readers, fds: newFDGuard(fdsPerDownload, 50*time.Millisecond)}
+
+	first := make(chan getResult)
+	go func() {
+		first <- kg.getKey(context.Background(), "bucket", "key1")
+	}()
+	<-readers.started
+
+	second := kg.getKey(context.Background(), "bucket", "key2")
+	if second.status != tooManyOpenFiles {
+		t.Logf("Expected %v while the only slot was taken, but got %v", tooManyOpenFiles, second.status)
+		t.Fail()
+	}
+
+	close(readers.released)
+	if result := <-first; result.localPath == nil {
+		t.Logf("Expected the first download to succeed, but got %v", result.status)
+		t.Fail()
+	} else {
+		os.Remove(*result.localPath)
+	}
+
+	third := kg.getKey(context.Background(), "bucket", "key3")
+	if third.localPath == nil {
+		t.Logf("Expected a download to succeed once descriptors were freed, but got %v", third.status)
+		t.Fail()
+	} else {
+		os.Remove(*third.localPath)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// The orders a request's missing keys may be downloaded in.
+const (
+	asListed      = "as_listed"
+	smallestFirst = "smallest_first"
+	largestFirst  = "largest_first"
+)
+
+var fetchOrders = []string{asListed, smallestFirst, largestFirst}
+
+// sizeChecksAtOnce caps the size lookups ordering a batch makes at once.
+const sizeChecksAtOnce = 16
+
+type fetchOrderKey struct{}
+
+// withFetchOrder has downloads under ctx start in order, one of
+// fetchOrders.
+func withFetchOrder(ctx context.Context, order string) context.Context {
+	if order == "" || order == asListed {
+		return ctx
+	}
+	return context.WithValue(ctx, fetchOrderKey{}, order)
+}
+
+// inFetchOrder sorts keyNames into the order their downloads should start
+// in under ctx, looking up each key's size if that's by size. Smallest
+// first gets the most keys ready soonest; largest first finds out soonest
+// whether the big ones fit. Keys whose size can't be found go last, as
+// listed.
+func (t *tempKeyGetter) inFetchOrder(ctx context.Context, bucketName string, keyNames []string) []string {
+	order, _ := ctx.Value(fetchOrderKey{}).(string)
+	sizer, ok := t.keyReaderGetter.(keySizer)
+	if order == "" || !ok || len(keyNames) < 2 {
+		return keyNames
+	}
+	sizes := make([]int64, len(keyNames))
+	known := make([]bool, len(keyNames))
+	lookups := newSlots(sizeChecksAtOnce)
+	var wg sync.WaitGroup
+	for i, keyName := range keyNames {
+		if !lookups.acquire(ctx) {
+			break
+		}
+		wg.Add(1)
+		go func(i int, keyName string) {
+			defer wg.Done()
+			defer lookups.release()
+			size, err := sizer.keySize(bucketName, keyName)
+			sizes[i], known[i] = size, err == nil
+		}(i, keyName)
+	}
+	wg.Wait()
+	positions := make([]int, len(keyNames))
+	for i := range positions {
+		positions[i] = i
+	}
+	sort.SliceStable(positions, func(a, b int) bool {
+		i, j := positions[a], positions[b]
+		if known[i] != known[j] {
+			return known[i]
+		}
+		if order == largestFirst {
+			return sizes[i] > sizes[j]
+		}
+		return sizes[i] < sizes[j]
+	})
+	ordered := make([]string, len(keyNames))
+	for n, i := range positions {
+		ordered[n] = keyNames[i]
+	}
+	return ordered
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// A sizedKeyReaderGetter serves keys of the sizes given, recording the
+// order their downloads start in.
+type sizedKeyReaderGetter struct {
+	sizes  map[string]int
+	starts []string
+	sync.Mutex
+}
+
+func (s *sizedKeyReaderGetter) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.starts = append(s.starts, keyName)
+	return ioutil.NopCloser(bytes.NewReader(make([]byte, s.sizes[keyName]))), nil
+}
+
+func (s *sizedKeyReaderGetter) keySize(bucketName, keyName string) (int64, error) {
+	size, ok := s.sizes[keyName]
+	if !ok {
+		return 0, errors.New("no size")
+	}
+	return int64(size), nil
+}
+
+func TestFetchOrder(t *testing.T) {
+	keyNames := []string{"medium", "unsized", "large", "small"}
+	for order, expected := range map[string][]string{
+		"":            keyNames,
+		asListed:      keyNames,
+		smallestFirst: {"small", "medium", "large", "unsized"},
+		largestFirst:  {"large", "medium", "small", "unsized"},
+	} {
+		cacheDir, err := ioutil.TempDir("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(cacheDir)
+		store := &sizedKeyReaderGetter{sizes: map[string]int{"small": 1, "medium": 10, "large": 100}}
+		// one download at a time, so they start in the order queued
+		tkg := &tempKeyGetter{keyReaderGetter: store, downloadSlots: newSlots(1)}
+		emkg := &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{base: tkg, cacheDir: cacheDir}}
+		emkg.Get(context.Background(), "bucket", keyNames, getOptions{fetchOrder: order})
+		if !reflect.DeepEqual(store.starts, expected) {
+			t.Logf("Expected %q to download %v, but got %v", order, expected, store.starts)
+			t.Fail()
+		}
+	}
+	cr := CacheRequest{BucketName: "bucket", KeyNames: keyNames, FetchOrder: "alphabetical"}
+	if err := cr.validate(false); err == nil {
+		t.Logf("Expected an unknown fetch_order to be refused")
+		t.Fail()
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// formContentType is the form encoding cache requests may be posted in,
+// as bucket=...&key=...&key=..., for clients like shell scripts that find
+// JSON awkward to build.
+const formContentType = "application/x-www-form-urlencoded"
+
+// readCacheRequest decodes r's body by its Content-Type, as JSON if it
+// has none, for the clients that have never sent one. If it can't, it
+// returns the status to answer with: 415 for another Content-Type, 400
+// for a bad form, or 500 for bad JSON, as it's always been.
+func readCacheRequest(r *http.Request) (CacheRequest, int, error) {
+	var cr CacheRequest
+	mediaType := "application/json"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return cr, 415, err
+		}
+	}
+	switch mediaType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+			return cr, 500, err
+		}
+		return cr, 0, nil
+	case formContentType:
+		if err := r.ParseForm(); err != nil {
+			return cr, 400, err
+		}
+		cr, err := formRequest(r.PostForm)
+		if err != nil {
+			return cr, 400, err
+		}
+		return cr, 0, nil
+	default:
+		return cr, 415, fmt.Errorf("can't read a cache request from %v, only application/json or %v", mediaType, formContentType)
+	}
+}
+
+// formRequest reads a CacheRequest from form fields named as its JSON
+// fields are, but for bucket and key, repeated for each key requested,
+// and mutable_key, likewise. Maps like if_match can't be given in a form.
+func formRequest(form url.Values) (CacheRequest, error) {
+	cr := CacheRequest{BucketName: form.Get("bucket"), KeyNames: form["key"], MutableKeys: form["mutable_key"],
+		Credentials: form.Get("credentials"), Strategy: form.Get("strategy"), OnChange: form.Get("on_change"),
+		FallbackKey: form.Get("fallback_key"), FetchOrder: form.Get("fetch_order")}
+	for name, field := range map[string]*bool{"mutable_bucket": &cr.MutableBucket, "only_cached": &cr.OnlyCached,
+		"no_cache": &cr.NoCache} {
+		if value := form.Get(name); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return cr, fmt.Errorf("%v must be true or false, not %q", name, value)
+			}
+			*field = parsed
+		}
+	}
+	if value := form.Get("min_ready"); value != "" {
+		minReady, err := strconv.Atoi(value)
+		if err != nil {
+			return cr, fmt.Errorf("min_ready must be a whole number, not %q", value)
+		}
+		cr.MinReady = minReady
+	}
+	if value := form.Get("max_age_seconds"); value != "" {
+		maxAge, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return cr, fmt.Errorf("max_age_seconds must be a number, not %q", value)
+		}
+		cr.MaxAgeSeconds = &maxAge
+	}
+	return cr, nil
+}
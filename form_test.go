@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A dispatchRecordingKeyGetter remembers the requests it was handed,
+// answering none of them.
+type dispatchRecordingKeyGetter struct {
+	dispatched []dispatchedGet
+}
+
+type dispatchedGet struct {
+	bucketName string
+	keyNames   []string
+	opts       getOptions
+}
+
+func (d *dispatchRecordingKeyGetter) Get(ctx context.Context, bucketName string, keyNames []string, opts getOptions) []getResult {
+	d.dispatched = append(d.dispatched, dispatchedGet{bucketName, keyNames, opts})
+	return nil
+}
+
+func (d *dispatchRecordingKeyGetter) GetCached(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	return nil
+}
+
+func TestKeyServerReadsJSONAndFormRequestsAlike(t *testing.T) {
+	bodies := []struct {
+		contentType, body string
+	}{
+		{"", `{"bucket_name": "bucket", "keynames": ["a", "b c"], "mutable_keys": ["a"], "strategy": "etag",
+			"max_age_seconds": 60, "fetch_order": "smallest_first", "no_cache": true}`},
+		{"application/json; charset=utf-8", `{"bucket_name": "bucket", "keynames": ["a", "b c"], "mutable_keys": ["a"],
+			"strategy": "etag", "max_age_seconds": 60, "fetch_order": "smallest_first", "no_cache": true}`},
+		{"application/x-www-form-urlencoded",
+			"bucket=bucket&key=a&key=b+c&mutable_key=a&strategy=etag&max_age_seconds=60&fetch_order=smallest_first&no_cache=true"},
+	}
+	var dispatched []dispatchedGet
+	for _, body := range bodies {
+		getter := &dispatchRecordingKeyGetter{}
+		server := &keyServer{MutableKeyGetter: getter}
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body.body))
+		if body.contentType != "" {
+			r.Header.Set("Content-Type", body.contentType)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != 200 || len(getter.dispatched) != 1 {
+			t.Fatalf("Expected a %q request to be dispatched, but got %v: %v", body.contentType, w.Code, w.Body)
+		}
+		dispatched = append(dispatched, getter.dispatched[0])
+	}
+	for i := range dispatched[1:] {
+		if !reflect.DeepEqual(dispatched[i+1], dispatched[0]) {
+			t.Logf("Expected a %q request to be dispatched as %+v, but got %+v", bodies[i+1].contentType, dispatched[0], dispatched[i+1])
+			t.Fail()
+		}
+	}
+	if opts := dispatched[0].opts; !opts.noCache || opts.maxAge == nil || !opts.mutableKeys["a"] || opts.fetchOrder != smallestFirst {
+		t.Logf("Expected the request's options to be read, but got %+v", opts)
+		t.Fail()
+	}
+}
+
+func TestKeyServerRefusesOtherRequestBodies(t *testing.T) {
+	server := &keyServer{MutableKeyGetter: &dispatchRecordingKeyGetter{}}
+	for contentType, expected := range map[string]int{
+		"text/plain":                        415,
+		"multipart/form-data; boundary=x":   415,
+		"application/x-www-form-urlencoded": 400,
+	} {
+		r := httptest.NewRequest("POST", "/", strings.NewReader("bucket=bucket&key=a&no_cache=maybe"))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Logf("Expected a %v for a %q body, but got %v: %v", expected, contentType, w.Code, w.Body)
+			t.Fail()
+		}
+	}
+}
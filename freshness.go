@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// validationTimes are when cached keys were last found unchanged upstream.
+// A key's time is forgotten once it's removed from the cache, so they
+// only ever cover what's cached.
+type validationTimes struct {
+	times map[string]time.Time
+	sync.Mutex
+}
+
+func (v *validationTimes) record(bucketName, keyName string) {
+	v.Lock()
+	defer v.Unlock()
+	if v.times == nil {
+		v.times = make(map[string]time.Time)
+	}
+	v.times[flatLRUKey(bucketName, keyName)] = time.Now()
+}
+
+func (v *validationTimes) at(bucketName, keyName string) time.Time {
+	v.Lock()
+	defer v.Unlock()
+	return v.times[flatLRUKey(bucketName, keyName)]
+}
+
+// forget drops bucketName/keyName's time, for a key just removed.
+func (v *validationTimes) forget(bucketName, keyName string) {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.times, flatLRUKey(bucketName, keyName))
+}
+
+// validated records that bucketName/keyName was just found unchanged
+// upstream, if e has anywhere to record it.
+func (e *EvictingMutableKeyGetter) validated(bucketName, keyName string) {
+	if e.validations != nil {
+		e.validations.record(bucketName, keyName)
+	}
+}
+
+// validatedAt is when the digests and timestamps r was cached with were
+// last known to match upstream: when it was last checked, or else cached.
+func (e *EvictingMutableKeyGetter) validatedAt(r getResult) time.Time {
+	if e.validations == nil {
+		return r.cachedAt
+	}
+	if checked := e.validations.at(r.bucketName, r.keyName); checked.After(r.cachedAt) {
+		return checked
+	}
+	return r.cachedAt
+}
+
+// needsCheck reports whether to check a cached key for changes upstream.
+// A mutable_bucket request checks keys unless they were validated within
+// freshFor. Past maxMetadataAge, a key's cached metadata is too old to
+// trust and it's checked on its next access no matter what, unless the
+// request asked for no checks at all. Keys of unknown age are only checked
+// for mutable_bucket requests.
+func (e *EvictingMutableKeyGetter) needsCheck(r getResult, mutableBucket, noChecks bool) bool {
+	if noChecks {
+		return false
+	}
+	validatedAt := e.validatedAt(r)
+	if validatedAt.IsZero() {
+		return mutableBucket
+	}
+	age := time.Since(validatedAt)
+	if e.maxMetadataAge > 0 && age > e.maxMetadataAge {
+		return true
+	}
+	return mutableBucket && age >= e.freshFor
+}
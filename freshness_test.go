@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEvictingMutableKeyGetterMaxMetadataAge(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	validations := &validationTimes{}
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir, onRemove: validations.forget}
+	checked := make(map[string]int)
+	getter := &EvictingMutableKeyGetter{
+		CachedKeyGetter: dkg,
+		ShouldEvicter: ShouldEvictFunc(func(r getResult) (bool, error) {
+			checked[r.keyName] += 1
+			return false, nil
+		}),
+		freshFor:       time.Hour,
+		maxMetadataAge: 5 * time.Minute,
+		validations:    validations,
+	}
+	keyNames := []string{"recent", "old"}
+	getter.Get(context.Background(), "bucket", keyNames, getOptions{})
+	raw, _ := json.Marshal(entryMetadata{CachedAt: time.Now().Add(-10 * time.Minute)})
+	if err := ioutil.WriteFile(dkg.mustMetadataPathFor("bucket", "old"), raw, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	getter.Get(context.Background(), "bucket", keyNames, getOptions{mutableBucket: true})
+	if checked["recent"] != 0 || checked["old"] != 1 {
+		t.Logf("Expected only the entry past the metadata age to be checked within the freshness window, but checked %v", checked)
+		t.Fail()
+	}
+	getter.Get(context.Background(), "bucket", keyNames, getOptions{})
+	if checked["old"] != 1 {
+		t.Logf("Expected the revalidated entry not to be checked again, but checked %v", checked)
+		t.Fail()
+	}
+	getter.freshFor = 0
+	getter.Get(context.Background(), "bucket", keyNames, getOptions{mutableBucket: true, strategy: "none"})
+	getter.Get(context.Background(), "bucket", keyNames, getOptions{mutableBucket: true})
+	if checked["recent"] != 1 || checked["old"] != 2 {
+		t.Logf("Expected mutable_bucket to check both once outside the freshness window, but checked %v", checked)
+		t.Fail()
+	}
+
+	for _, keyName := range keyNames {
+		getter.remove("bucket", keyName)
+	}
+	if len(validations.times) != 0 {
+		t.Logf("Expected removed keys' validations to be forgotten, but had %v", validations.times)
+		t.Fail()
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A cacheFS is the filesystem a diskCachedKeyGetter keeps its entries on.
+// Production uses osFS; tests can use a memFS to avoid touching disk.
+type cacheFS interface {
+	Stat(name string) (os.FileInfo, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	MkdirAll(name string, perm os.FileMode) error
+	Link(oldname, newname string) error
+	Open(name string) (cacheFile, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	SameFile(fi1, fi2 os.FileInfo) bool
+	Sync(name string) error
+}
+
+type cacheFile interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+type osFS struct{}
+
+func (osFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (osFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) MkdirAll(name string, perm os.FileMode) error { return os.MkdirAll(name, perm) }
+func (osFS) Link(oldname, newname string) error           { return os.Link(oldname, newname) }
+func (osFS) Open(name string) (cacheFile, error)          { return os.Open(name) }
+func (osFS) ReadFile(name string) ([]byte, error)         { return ioutil.ReadFile(name) }
+func (osFS) SameFile(fi1, fi2 os.FileInfo) bool           { return os.SameFile(fi1, fi2) }
+func (osFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+
+// Sync flushes a file or directory to disk.
+func (osFS) Sync(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// A memFS is an in-memory cacheFS. Hard links share a memInode, so
+// SameFile works as it would on disk. Syncs are recorded in synced, in
+// order, for tests to check.
+type memFS struct {
+	entries map[string]*memInode
+	synced  []string
+	sync.Mutex
+}
+
+type memInode struct {
+	name    string
+	data    []byte
+	dir     bool
+	modTime time.Time
+}
+
+func (m *memInode) Name() string       { return m.name }
+func (m *memInode) Size() int64        { return int64(len(m.data)) }
+func (m *memInode) ModTime() time.Time { return m.modTime }
+func (m *memInode) IsDir() bool        { return m.dir }
+func (m *memInode) Sys() interface{}   { return m }
+func (m *memInode) Mode() os.FileMode {
+	if m.dir {
+		return os.ModeDir | 0777
+	}
+	return 0666
+}
+
+type memFile struct {
+	*bytes.Reader
+	inode *memInode
+}
+
+func (m *memFile) Close() error               { return nil }
+func (m *memFile) Stat() (os.FileInfo, error) { return m.inode, nil }
+
+func newMemFS() *memFS {
+	return &memFS{entries: map[string]*memInode{"/": {name: "/", dir: true}}}
+}
+
+func (m *memFS) lookup(op, name string) (*memInode, error) {
+	inode, ok := m.entries[path.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return inode, nil
+}
+
+// parentOK checks that name's parent exists and is a directory.
+func (m *memFS) parentOK(op, name string) error {
+	parent, err := m.lookup(op, path.Dir(path.Clean(name)))
+	if err != nil {
+		return err
+	}
+	if !parent.dir {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.lookup("stat", name)
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.Lock()
+	defer m.Unlock()
+	inode, err := m.lookup("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	if err := m.parentOK("rename", newpath); err != nil {
+		return err
+	}
+	if existing, ok := m.entries[path.Clean(newpath)]; ok && existing.dir {
+		return &os.PathError{Op: "rename", Path: newpath, Err: syscall.EISDIR}
+	}
+	delete(m.entries, path.Clean(oldpath))
+	m.entries[path.Clean(newpath)] = inode
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.Lock()
+	defer m.Unlock()
+	inode, err := m.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if inode.dir {
+		prefix := path.Clean(name) + "/"
+		for other := range m.entries {
+			if strings.HasPrefix(other, prefix) {
+				return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+			}
+		}
+	}
+	delete(m.entries, path.Clean(name))
+	return nil
+}
+
+func (m *memFS) MkdirAll(name string, perm os.FileMode) error {
+	m.Lock()
+	defer m.Unlock()
+	name = path.Clean(name)
+	var missing []string
+	for dir := name; ; dir = path.Dir(dir) {
+		if inode, ok := m.entries[dir]; ok {
+			if !inode.dir {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+			}
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for _, dir := range missing {
+		m.entries[dir] = &memInode{name: path.Base(dir), dir: true, modTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *memFS) Link(oldname, newname string) error {
+	m.Lock()
+	defer m.Unlock()
+	inode, err := m.lookup("link", oldname)
+	if err != nil {
+		return err
+	}
+	if err := m.parentOK("link", newname); err != nil {
+		return err
+	}
+	if _, ok := m.entries[path.Clean(newname)]; ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	m.entries[path.Clean(newname)] = inode
+	return nil
+}
+
+func (m *memFS) Open(name string) (cacheFile, error) {
+	m.Lock()
+	defer m.Unlock()
+	inode, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{Reader: bytes.NewReader(inode.data), inode: inode}, nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	f, err := m.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
+
+func (m *memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	m.Lock()
+	defer m.Unlock()
+	if err := m.parentOK("open", name); err != nil {
+		return err
+	}
+	m.entries[path.Clean(name)] = &memInode{name: path.Base(name), data: append([]byte(nil), data...),
+		modTime: time.Now()}
+	return nil
+}
+
+func (m *memFS) SameFile(fi1, fi2 os.FileInfo) bool {
+	return fi1.Sys() == fi2.Sys()
+}
+
+func (m *memFS) Sync(name string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, err := m.lookup("sync", name); err != nil {
+		return err
+	}
+	m.synced = append(m.synced, path.Clean(name))
+	return nil
+}
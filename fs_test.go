@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memKeyGetter "downloads" content into a memFS, as tempKeyGetter does on
+// the real filesystem.
+type memKeyGetter struct {
+	fs      *memFS
+	content string
+	called  int
+	sync.Mutex
+}
+
+func (m *memKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	out := make([]getResult, 0, len(keyNames))
+	m.fs.MkdirAll("/tmp", 0777)
+	for _, keyName := range keyNames {
+		m.Lock()
+		m.called += 1
+		localPath := fmt.Sprintf("/tmp/download-%v", m.called)
+		m.Unlock()
+		m.fs.WriteFile(localPath, []byte(m.content), 0666)
+		out = append(out, getResult{localPath: &localPath, keyName: keyName, bucketName: bucketName,
+			status: mockFetched, bytesTransferred: int64(len(m.content)), md5: "0123456789abcdef0123456789abcdef"})
+	}
+	return out
+}
+
+func TestDiskCachedKeyGetterInMemory(t *testing.T) {
+	fs := newMemFS()
+	base := &memKeyGetter{fs: fs, content: "sample content"}
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: "/cache", fs: fs}
+
+	first := dkg.get(context.Background(), "bucket", []string{"a/key1", "key2"})
+	second := dkg.get(context.Background(), "bucket", []string{"a/key1", "key2"})
+	if base.called != 2 {
+		t.Logf("Expected 2 downloads, but had %v", base.called)
+		t.Fail()
+	}
+	for i, result := range second {
+		if result.status != "disk cache hit" || *result.localPath != *first[i].localPath {
+			t.Logf("Expected a hit at %v, but got %v", *first[i].localPath, result)
+			t.Fail()
+		}
+		if result.md5 != "0123456789abcdef0123456789abcdef" {
+			t.Logf("Expected the hit's md5 to come from its metadata, but got %q", result.md5)
+			t.Fail()
+		}
+	}
+	content, err := fs.ReadFile("/cache/bucket/a/key1")
+	if err != nil || string(content) != "sample content" {
+		t.Logf("Expected the cached content in memory, but got %q, %v", content, err)
+		t.Fail()
+	}
+	if _, err := fs.Stat("/tmp/download-1"); !os.IsNotExist(err) {
+		t.Logf("Expected the download to be moved into the cache, but got %v", err)
+		t.Fail()
+	}
+
+	collisions := dkg.get(context.Background(), "bucket", []string{"a/key1/nested", "a"})
+	for _, result := range collisions {
+		if result.localPath != nil {
+			t.Logf("Expected %v to collide with a/key1, but it was cached", result.keyName)
+			t.Fail()
+		}
+	}
+
+	if !dkg.remove("bucket", "key2") || dkg.has("bucket", "key2") {
+		t.Logf("Expected key2 to be removed")
+		t.Fail()
+	}
+	if _, err := fs.Stat(dkg.mustMetadataPathFor("bucket", "key2")); !os.IsNotExist(err) {
+		t.Logf("Expected key2's metadata to be removed, but got %v", err)
+		t.Fail()
+	}
+}
+
+func TestMemFSHardLinks(t *testing.T) {
+	fs := newMemFS()
+	fs.WriteFile("/a", []byte("content"), 0666)
+	if err := fs.Link("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := fs.Stat("/a")
+	b, _ := fs.Stat("/b")
+	if !fs.SameFile(a, b) {
+		t.Logf("Expected linked files to be the same file")
+		t.Fail()
+	}
+	if err := fs.Link("/a", "/b"); !os.IsExist(err) {
+		t.Logf("Expected linking over an existing file to fail, but got %v", err)
+		t.Fail()
+	}
+	fs.Remove("/a")
+	if content, err := fs.ReadFile("/b"); err != nil || string(content) != "content" {
+		t.Logf("Expected the link to outlive the original, but got %q, %v", content, err)
+		t.Fail()
+	}
+}
+
+func TestDiskCachedKeyGetterFsyncPolicy(t *testing.T) {
+	expected := map[string][]string{
+		"":           nil,
+		fsyncNone:    nil,
+		fsyncFile:    {"/cache/bucket/a/key1"},
+		fsyncFileDir: {"/cache/bucket/a/key1", "/cache/bucket/a"},
+	}
+	for policy, want := range expected {
+		fs := newMemFS()
+		dkg := &diskCachedKeyGetter{base: &memKeyGetter{fs: fs, content: "sample content"}, cacheDir: "/cache", fs: fs,
+			fsyncPolicy: policy}
+		dkg.get(context.Background(), "bucket", []string{"a/key1"})
+		dkg.get(context.Background(), "bucket", []string{"a/key1"})
+		if !reflect.DeepEqual(fs.synced, want) {
+			t.Logf("Expected the %q policy to sync %v, but synced %v", policy, want, fs.synced)
+			t.Fail()
+		}
+	}
+}
+
+// A movesFS counts the mkdirs and renames moving downloads into the cache
+// that are underway at once, holding each a moment so that concurrent ones
+// overlap. Metadata isn't written by moveToCache, so isn't counted.
+type movesFS struct {
+	*memFS
+	active, peak int
+	lock         *sync.Mutex
+}
+
+func (m *movesFS) track(name string, f func() error) error {
+	if strings.HasPrefix(name, "/cache/.meta/") {
+		return f()
+	}
+	m.lock.Lock()
+	m.active++
+	if m.active > m.peak {
+		m.peak = m.active
+	}
+	m.lock.Unlock()
+	time.Sleep(time.Millisecond)
+	defer func() {
+		m.lock.Lock()
+		m.active--
+		m.lock.Unlock()
+	}()
+	return f()
+}
+
+func (m *movesFS) MkdirAll(name string, perm os.FileMode) error {
+	return m.track(name, func() error { return m.memFS.MkdirAll(name, perm) })
+}
+
+func (m *movesFS) Rename(oldpath, newpath string) error {
+	return m.track(newpath, func() error { return m.memFS.Rename(oldpath, newpath) })
+}
+
+func TestDiskCachedKeyGetterCapsConcurrentMoves(t *testing.T) {
+	mem := newMemFS()
+	fs := &movesFS{memFS: mem, lock: &sync.Mutex{}}
+	base := &memKeyGetter{fs: mem, content: "sample content"}
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: "/cache", fs: fs, moveSlots: newSlots(2)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keyName := fmt.Sprintf("dir%v/key", i)
+			if result := dkg.get(context.Background(), "bucket", []string{keyName})[0]; result.localPath == nil {
+				t.Logf("Expected %v to be cached, but got %v", keyName, result.status)
+				t.Fail()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if fs.peak > 2 {
+		t.Logf("Expected at most 2 mkdirs and renames at once, but there were %v", fs.peak)
+		t.Fail()
+	}
+}
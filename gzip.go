@@ -0,0 +1,68 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipResponses compresses h's responses for clients that accept gzip,
+// once a response reaches minSize bytes; smaller ones aren't worth it and
+// go out as they are.
+func gzipResponses(h http.Handler, minSize int) http.Handler {
+	if minSize <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize, status: 200}
+		h.ServeHTTP(gw, r)
+		gw.finish()
+	})
+}
+
+// A gzipResponseWriter holds back the first minSize bytes of a response,
+// and its status, until it knows whether to compress.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	held    []byte
+	gz      *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	g.status = status
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	g.held = append(g.held, p...)
+	if len(g.held) < g.minSize {
+		return len(p), nil
+	}
+	g.Header().Set("Content-Encoding", "gzip")
+	g.Header().Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	if _, err := g.gz.Write(g.held); err != nil {
+		return 0, err
+	}
+	g.held = nil
+	return len(p), nil
+}
+
+func (g *gzipResponseWriter) finish() {
+	if g.gz != nil {
+		g.gz.Close()
+		return
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	g.ResponseWriter.Write(g.held)
+}
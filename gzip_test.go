@@ -0,0 +1,57 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipResponses(t *testing.T) {
+	large := "[" + strings.Repeat(`{"key_name":"key","status":"disk cache hit"},`, 100) + "{}]"
+	h := gzipResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(r.URL.Query().Get("body")))
+		if r.URL.Query().Get("large") != "" {
+			w.Write([]byte(large))
+		}
+	}), 1024)
+
+	req := httptest.NewRequest("GET", "/?large=1", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a large response to be gzipped, but got headers %v", rec.Header())
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != large {
+		t.Logf("Expected the gzipped body to decode to the original, but got %q", body)
+		t.Fail()
+	}
+
+	req = httptest.NewRequest("GET", "/?body=small", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "small" {
+		t.Logf("Expected a small response to go out uncompressed, but got %v %q", rec.Header(), rec.Body.String())
+		t.Fail()
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?large=1", nil))
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != large {
+		t.Logf("Expected no compression for a client that doesn't accept gzip, but got %v", rec.Header())
+		t.Fail()
+	}
+}
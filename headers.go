@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"launchpad.net/goamz/s3"
+)
+
+// A headerReaderGetter can read a key with extra headers on its GET.
+type headerReaderGetter interface {
+	getKeyReaderWithHeaders(bucketName, keyName string, header http.Header) (io.ReadCloser, error)
+}
+
+// getKeyReaderWithHeaders makes its own GET of a URL it signs itself,
+// since goamz can't add headers to one.
+func (s *s3Conn) getKeyReaderWithHeaders(bucketName, keyName string, header http.Header) (io.ReadCloser, error) {
+	rc, err := s.getSignedWithHeaders(bucketName, keyName, header)
+	if err != nil && s.relocate(bucketName, err) {
+		rc, err = s.getSignedWithHeaders(bucketName, keyName, header)
+	}
+	return rc, err
+}
+
+func (s *s3Conn) getSignedWithHeaders(bucketName, keyName string, header http.Header) (io.ReadCloser, error) {
+	conn := s.connFor(bucketName)
+	req, err := http.NewRequest("GET", signedURLWithHeaders(conn, bucketName, keyName, header, time.Now().Add(time.Hour)), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	s.skew.observe(resp.Header)
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		return nil, s3ErrorFrom(resp)
+	}
+	return &etaggedReadCloser{resp.Body, normalizeETag(resp.Header.Get("ETag"))}, nil
+}
+
+// signedURLWithHeaders signs a GET of keyName that sends header, the same
+// (V2) way goamz signs the rest. S3 refuses x-amz- headers that weren't
+// signed, which goamz's SignedURL has no way to take, so those are part
+// of what's signed here.
+func signedURLWithHeaders(conn *s3.S3, bucketName, keyName string, header http.Header, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	amz := make(map[string]string)
+	var amzNames []string
+	for name, values := range header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			amzNames = append(amzNames, name)
+			amz[name] = strings.Join(values, ",")
+		}
+	}
+	sort.Strings(amzNames)
+	mac := hmac.New(sha1.New, []byte(conn.SecretKey))
+	fmt.Fprintf(mac, "GET\n\n\n%v\n", expiry)
+	for _, name := range amzNames {
+		fmt.Fprintf(mac, "%v:%v\n", name, strings.TrimSpace(amz[name]))
+	}
+	io.WriteString(mac, (&url.URL{Path: "/" + bucketName + "/" + keyName}).EscapedPath())
+	query := url.Values{"AWSAccessKeyId": {conn.AccessKey}, "Expires": {expiry},
+		"Signature": {base64.StdEncoding.EncodeToString(mac.Sum(nil))}}
+	return conn.Bucket(bucketName).URL(keyName) + "?" + query.Encode()
+}
+
+// s3ErrorFrom reads the error S3 sent back in resp's body, as goamz does
+// for its own requests, going by resp's status for anything missing.
+func s3ErrorFrom(resp *http.Response) *s3.Error {
+	s3Err := &s3.Error{}
+	xml.NewDecoder(resp.Body).Decode(s3Err)
+	s3Err.StatusCode = resp.StatusCode
+	if s3Err.Code == "" {
+		s3Err.Code = http.StatusText(resp.StatusCode)
+	}
+	if s3Err.Message == "" {
+		s3Err.Message = resp.Status
+	}
+	return s3Err
+}
+
+// forwardable keeps the headers a request asked to send to S3 that are in
+// allowed, dropping the rest.
+func forwardable(requested map[string]string, allowed []string) map[string]string {
+	if len(requested) == 0 {
+		return nil
+	}
+	kept := make(map[string]string, len(requested))
+	for name, value := range requested {
+		for _, allowedName := range allowed {
+			if http.CanonicalHeaderKey(name) == http.CanonicalHeaderKey(allowedName) {
+				kept[http.CanonicalHeaderKey(name)] = value
+			}
+		}
+	}
+	return kept
+}
+
+type forwardedHeadersKey struct{}
+
+// withForwardedHeaders has downloads under ctx send headers along with
+// their GETs, such as x-amz-request-payer for requester-pays buckets.
+func withForwardedHeaders(ctx context.Context, headers map[string]string) context.Context {
+	if len(headers) == 0 {
+		return ctx
+	}
+	header := make(http.Header, len(headers))
+	for name, value := range headers {
+		header.Set(name, value)
+	}
+	return context.WithValue(ctx, forwardedHeadersKey{}, header)
+}
+
+// forwardedHeadersFor is the headers downloads under ctx send, if any.
+func forwardedHeadersFor(ctx context.Context) http.Header {
+	header, _ := ctx.Value(forwardedHeadersKey{}).(http.Header)
+	return header
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"launchpad.net/goamz/aws"
+	"launchpad.net/goamz/s3"
+)
+
+// A headerRecordingReaderGetter stands in for S3, keeping the headers each
+// GET came with and refusing ones without x-amz-request-payer with a 403,
+// as a requester-pays bucket does.
+type headerRecordingReaderGetter struct {
+	received []http.Header
+	sync.Mutex
+}
+
+func (h *headerRecordingReaderGetter) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
+	return h.getKeyReaderWithHeaders(bucketName, keyName, http.Header{})
+}
+
+func (h *headerRecordingReaderGetter) getKeyReaderWithHeaders(bucketName, keyName string, header http.Header) (io.ReadCloser, error) {
+	h.Lock()
+	h.received = append(h.received, header)
+	h.Unlock()
+	if header.Get("X-Amz-Request-Payer") != "requester" {
+		return nil, &s3.Error{StatusCode: 403, Code: "AccessDenied", Message: "Access Denied"}
+	}
+	return ioutil.NopCloser(bytes.NewReader([]byte("paid for"))), nil
+}
+
+func TestKeyServerForwardsAllowedHeaders(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	store := &headerRecordingReaderGetter{}
+	dkg := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: store}, cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: dkg},
+		forwardHeaders: []string{"x-amz-request-payer"}}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader([]byte(
+		`{"bucket_name": "bucket", "keynames": ["key1"], "headers": {"x-amz-request-payer": "requester", "Authorization": "stolen"}}`))))
+	if !dkg.has("bucket", "key1") {
+		t.Logf("Expected the key to be cached with the request payer header sent, but got %v", rec.Body.String())
+		t.Fail()
+	}
+	if len(store.received) != 1 {
+		t.Fatalf("Expected one GET, but there were %v", len(store.received))
+	}
+	if header := store.received[0]; header.Get("X-Amz-Request-Payer") != "requester" || header.Get("Authorization") != "" {
+		t.Logf("Expected only the allowed header to be forwarded, but got %v", header)
+		t.Fail()
+	}
+
+	server.forwardHeaders = nil
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader([]byte(
+		`{"bucket_name": "bucket", "keynames": ["key2"], "headers": {"x-amz-request-payer": "requester"}}`))))
+	if dkg.has("bucket", "key2") || len(store.received) != 2 || len(store.received[1]) != 0 {
+		t.Logf("Expected headers not allowed to be dropped, but got %v", store.received)
+		t.Fail()
+	}
+}
+
+func TestGetKeyReaderWithHeadersSignsAmzHeaders(t *testing.T) {
+	auth := aws.Auth{AccessKey: "AKID", SecretKey: "secret"}
+	s3Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/key" {
+			w.WriteHeader(404)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message><RequestId>REQ1</RequestId></Error>`))
+			return
+		}
+		mac := hmac.New(sha1.New, []byte(auth.SecretKey))
+		fmt.Fprintf(mac, "GET\n\n\n%v\nx-amz-request-payer:%v\n/bucket/key", r.URL.Query().Get("Expires"), r.Header.Get("X-Amz-Request-Payer"))
+		if r.URL.Query().Get("Signature") != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(403)
+			w.Write([]byte(`<Error><Code>SignatureDoesNotMatch</Code><Message>The request signature we calculated does not match the signature you provided.</Message></Error>`))
+			return
+		}
+		w.Write([]byte("paid for"))
+	}))
+	defer s3Server.Close()
+	region := aws.USEast
+	region.S3Endpoint = s3Server.URL
+	conn := &s3Conn{swappableS3: newSwappableS3(s3.New(auth, region))}
+
+	rc, err := conn.getKeyReaderWithHeaders("bucket", "key", http.Header{"X-Amz-Request-Payer": {"requester"}})
+	if err != nil {
+		t.Fatalf("Expected the request payer header to be signed, but got %v", err)
+	}
+	rc.Close()
+
+	_, err = conn.getKeyReaderWithHeaders("bucket", "missing", http.Header{"X-Amz-Request-Payer": {"requester"}})
+	var s3Err *s3.Error
+	if !errors.As(err, &s3Err) || s3Err.Code != "NoSuchKey" || s3Err.RequestId != "REQ1" || s3Err.StatusCode != 404 {
+		t.Logf("Expected S3's own error code, but got %#v", err)
+		t.Fail()
+	}
+}
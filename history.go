@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// A keyFrequency is how often a key was served, as an accessHistory saves
+// it, and how big it was when last served.
+type keyFrequency struct {
+	BucketName string `json:"bucket"`
+	KeyName    string `json:"key"`
+	Count      int64  `json:"count"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// An accessHistory counts how often each key is served with the default
+// credentials, so that the next run can warm the keys that were hottest
+// before serving any traffic. Counts carried over from earlier runs are
+// halved at each load, so the warm set follows what's been hot lately
+// rather than what was once. A nil *accessHistory records nothing.
+type accessHistory struct {
+	counts map[string]*keyFrequency
+	sync.Mutex
+}
+
+// record counts each of results served, if served with the default
+// credentials; those fetched with others may not be warmable without them.
+func (h *accessHistory) record(credentials string, results []getResult) {
+	if h == nil || credentials != "" {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.counts == nil {
+		h.counts = make(map[string]*keyFrequency)
+	}
+	for _, result := range results {
+		if result.localPath == nil || passedThroughFile(result) || result.status == servedFallback {
+			// not cached as itself, so nothing to warm
+			continue
+		}
+		id := flatLRUKey(result.bucketName, result.keyName)
+		frequency, had := h.counts[id]
+		if !had {
+			frequency = &keyFrequency{BucketName: result.bucketName, KeyName: result.keyName}
+			h.counts[id] = frequency
+		}
+		frequency.Count += 1
+		if result.bytesTransferred > 0 {
+			frequency.Bytes = result.bytesTransferred
+		} else if info, err := os.Stat(*result.localPath); err == nil {
+			frequency.Bytes = info.Size()
+		}
+	}
+}
+
+// hottest is every key counted, most often served first.
+func (h *accessHistory) hottest() []keyFrequency {
+	h.Lock()
+	defer h.Unlock()
+	out := make([]keyFrequency, 0, len(h.counts))
+	for _, frequency := range h.counts {
+		out = append(out, *frequency)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return flatLRUKey(out[i].BucketName, out[i].KeyName) < flatLRUKey(out[j].BucketName, out[j].KeyName)
+	})
+	return out
+}
+
+// load reads the history a previous run saved to path, halving its
+// counts and dropping the keys that leaves at 0. A missing file is an
+// empty history.
+func (h *accessHistory) load(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []keyFrequency
+	if err := json.Unmarshal(raw, &saved); err != nil {
+		return err
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.counts = make(map[string]*keyFrequency, len(saved))
+	for i := range saved {
+		saved[i].Count /= 2
+		if saved[i].Count > 0 {
+			h.counts[flatLRUKey(saved[i].BucketName, saved[i].KeyName)] = &saved[i]
+		}
+	}
+	return nil
+}
+
+// save writes the history to path, via a rename so a crash mid-write
+// can't leave a truncated one.
+func (h *accessHistory) save(path string) error {
+	raw, err := json.Marshal(h.hottest())
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(raw)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// warm fetches the hottest keys through getter, at most maxKeys of them
+// and, going by the sizes they were last served at, maxBytes all told,
+// skipping any that would take it past that. Either limit is ignored if
+// it's 0. Keys in buckets allowed no longer allows are skipped too. It
+// returns how many keys it warmed and how many failed.
+func (h *accessHistory) warm(ctx context.Context, getter MutableKeyGetter, allowed bucketAllowlist, maxKeys int,
+	maxBytes int64) (warmed, failed int) {
+	var bucketNames []string
+	byBucket := make(map[string][]string)
+	var keys int
+	var bytes int64
+	for _, frequency := range h.hottest() {
+		if maxKeys > 0 && keys >= maxKeys {
+			break
+		}
+		if maxBytes > 0 && bytes+frequency.Bytes > maxBytes || !allowed.allows(frequency.BucketName) {
+			continue
+		}
+		if _, had := byBucket[frequency.BucketName]; !had {
+			bucketNames = append(bucketNames, frequency.BucketName)
+		}
+		byBucket[frequency.BucketName] = append(byBucket[frequency.BucketName], frequency.KeyName)
+		keys += 1
+		bytes += frequency.Bytes
+	}
+	for _, bucketName := range bucketNames {
+		for _, result := range getter.Get(ctx, bucketName, byBucket[bucketName], getOptions{}) {
+			if passedThroughFile(result) {
+				// fetched, but not into the cache, so nothing was warmed
+				os.Remove(*result.localPath)
+				result.localPath = nil
+			}
+			if result.localPath == nil {
+				log.Printf("Couldn't warm %v/%v: %v", bucketName, result.keyName, result.status)
+				failed += 1
+			} else {
+				warmed += 1
+			}
+		}
+	}
+	return warmed, failed
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestAccessHistoryWarmsTheHottestKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	historyPath := filepath.Join(dir, "history.json")
+	seeded := `[
+		{"bucket": "bucket", "key": "hot", "count": 100, "bytes": 14},
+		{"bucket": "other", "key": "warm", "count": 50, "bytes": 14},
+		{"bucket": "bucket", "key": "huge", "count": 40, "bytes": 1000},
+		{"bucket": "bucket", "key": "tepid", "count": 20, "bytes": 14},
+		{"bucket": "bucket", "key": "cool", "count": 10, "bytes": 14},
+		{"bucket": "bucket", "key": "cold", "count": 1, "bytes": 14}
+	]`
+	if err := ioutil.WriteFile(historyPath, []byte(seeded), 0666); err != nil {
+		t.Fatal(err)
+	}
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: filepath.Join(dir, "cache")}
+	history := &accessHistory{}
+	if err := history.load(historyPath); err != nil {
+		t.Fatal(err)
+	}
+
+	warmed, failed := history.warm(context.Background(), &EvictingMutableKeyGetter{CachedKeyGetter: dkg}, nil, 3, 100)
+	if warmed != 3 || failed != 0 {
+		t.Logf("Expected 3 keys warmed, but got %v warmed and %v failed", warmed, failed)
+		t.Fail()
+	}
+	var cached []string
+	for _, bucketName := range []string{"bucket", "other"} {
+		for _, keyName := range dkg.keysIn(bucketName) {
+			cached = append(cached, bucketName+"/"+keyName)
+		}
+	}
+	sort.Strings(cached)
+	if expected := []string{"bucket/hot", "bucket/tepid", "other/warm"}; !reflect.DeepEqual(cached, expected) {
+		t.Logf("Expected the 3 hottest keys that fit in 100 bytes to be warmed, %v, but got %v", expected, cached)
+		t.Fail()
+	}
+	if hottest := history.hottest(); len(hottest) != 5 || hottest[0].Count != 50 {
+		t.Logf("Expected the loaded counts halved and the coldest dropped, but got %+v", hottest)
+		t.Fail()
+	}
+}
+
+func TestAccessHistorySavesWhatWasServed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	historyPath := filepath.Join(dir, "history.json")
+	localPath := "/cache/bucket/key"
+	served := getResult{bucketName: "bucket", keyName: "key", localPath: &localPath, bytesTransferred: 14}
+	failed := getResult{bucketName: "bucket", keyName: "missing", status: notFound}
+	hitPath := filepath.Join(dir, "hit")
+	if err := ioutil.WriteFile(hitPath, []byte("sample content"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	hit := getResult{bucketName: "bucket", keyName: "hit", localPath: &hitPath, status: "disk cache hit"}
+	results := []getResult{served, failed, hit,
+		{bucketName: "bucket", keyName: "fallback", localPath: &localPath, status: servedFallback}}
+	for _, status := range []string{passedThrough, notCached, uncachedOnRequest} {
+		results = append(results, getResult{bucketName: "bucket", keyName: status, localPath: &localPath,
+			bytesTransferred: 14, status: status})
+	}
+	history := &accessHistory{}
+	for i := 0; i < 4; i++ {
+		history.record("", results)
+	}
+	history.record("other", []getResult{served})
+	if err := history.save(historyPath); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &accessHistory{}
+	if err := loaded.load(historyPath); err != nil {
+		t.Fatal(err)
+	}
+	expected := []keyFrequency{{BucketName: "bucket", KeyName: "hit", Count: 2, Bytes: 14},
+		{BucketName: "bucket", KeyName: "key", Count: 2, Bytes: 14}}
+	if hottest := loaded.hottest(); !reflect.DeepEqual(hottest, expected) {
+		t.Logf("Expected %+v, but got %+v", expected, hottest)
+		t.Fail()
+	}
+}
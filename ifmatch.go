@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"launchpad.net/goamz/s3"
+)
+
+// preconditionFailed is the status of a key that no longer has the ETag
+// its request expected. Nothing is cached for it.
+const preconditionFailed = "precondition_failed"
+
+// isPreconditionFailed reports whether err is S3 refusing an If-Match GET.
+func isPreconditionFailed(err error) bool {
+	var s3Err *s3.Error
+	return errors.As(err, &s3Err) && s3Err.StatusCode == 412
+}
+
+// A conditionalReaderGetter can read a key only if its ETag is still etag,
+// failing with a 412 *s3.Error otherwise.
+type conditionalReaderGetter interface {
+	getKeyReaderIfMatch(bucketName, keyName, etag string) (io.ReadCloser, error)
+}
+
+// getKeyReaderIfMatch sets an If-Match header, which goamz can't.
+func (s *s3Conn) getKeyReaderIfMatch(bucketName, keyName, etag string) (io.ReadCloser, error) {
+	return s.getKeyReaderWithHeaders(bucketName, keyName, http.Header{"If-Match": {`"` + etag + `"`}})
+}
+
+type ifMatchKey struct{}
+
+// withIfMatch has downloads under ctx expect the ETags in etags, by key
+// name. The getters between a request and its downloads don't otherwise
+// carry per-key options down.
+func withIfMatch(ctx context.Context, etags map[string]string) context.Context {
+	if len(etags) == 0 {
+		return ctx
+	}
+	normalized := make(map[string]string, len(etags))
+	for keyName, etag := range etags {
+		normalized[keyName] = normalizeETag(etag)
+	}
+	return context.WithValue(ctx, ifMatchKey{}, normalized)
+}
+
+// ifMatchFor is the ETag keyName is expected to have under ctx, if any.
+func ifMatchFor(ctx context.Context, keyName string) string {
+	etags, _ := ctx.Value(ifMatchKey{}).(map[string]string)
+	return etags[keyName]
+}
+
+// mismatched reports whether r is known to have a different ETag than
+// expected under ctx.
+func mismatched(ctx context.Context, r getResult) bool {
+	expected := ifMatchFor(ctx, r.keyName)
+	return expected != "" && r.etag != "" && r.etag != expected
+}
+
+// openKey starts reading keyName, conditional on its expected ETag if
+// there is one and the store can. Stores that can't have the result's
+// ETag checked once it's downloaded instead. Headers forwarded under ctx
+// are sent along if the store can take them, and left off otherwise.
+func (t *tempKeyGetter) openKey(ctx context.Context, bucketName, keyName string) (io.ReadCloser, error) {
+	etag := ifMatchFor(ctx, keyName)
+	if forwarded := forwardedHeadersFor(ctx); len(forwarded) > 0 {
+		if withHeaders, ok := t.keyReaderGetter.(headerReaderGetter); ok {
+			header := forwarded.Clone()
+			if etag != "" {
+				header.Set("If-Match", `"`+etag+`"`)
+			}
+			return withHeaders.getKeyReaderWithHeaders(bucketName, keyName, header)
+		}
+	}
+	if etag != "" {
+		if conditional, ok := t.keyReaderGetter.(conditionalReaderGetter); ok {
+			return conditional.getKeyReaderIfMatch(bucketName, keyName, etag)
+		}
+	}
+	return t.getKeyReader(bucketName, keyName)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"launchpad.net/goamz/s3"
+)
+
+// A conditionalKeyReaderGetter serves content with etag, refusing If-Match
+// GETs for any other ETag with a 412 as S3 does.
+type conditionalKeyReaderGetter struct {
+	content, etag string
+}
+
+func (c conditionalKeyReaderGetter) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
+	return &etaggedReadCloser{ioutil.NopCloser(bytes.NewReader([]byte(c.content))), c.etag}, nil
+}
+
+func (c conditionalKeyReaderGetter) getKeyReaderIfMatch(bucketName, keyName, etag string) (io.ReadCloser, error) {
+	if etag != c.etag {
+		return nil, &s3.Error{StatusCode: 412, Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	return c.getKeyReader(bucketName, keyName)
+}
+
+func TestKeyServerIfMatch(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: conditionalKeyReaderGetter{"new content", "beef"}},
+		cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: dkg}}
+	request := func(body string) map[string]interface{} {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader([]byte(body))))
+		var results []map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil || len(results) != 1 {
+			t.Fatalf("Expected one result, but got %v: %v", rec.Body.String(), err)
+		}
+		return results[0]
+	}
+
+	result := request(`{"bucket_name": "bucket", "keynames": ["key1"], "if_match": {"key1": "\"dead\""}}`)
+	if result["status"] != preconditionFailed || result["local_path"] != nil {
+		t.Logf("Expected a precondition failure for a changed object, but got %v", result)
+		t.Fail()
+	}
+	if errBody, _ := result["error"].(map[string]interface{}); errBody["status_code"] != float64(412) {
+		t.Logf("Expected the 412 in the result's error, but got %v", result["error"])
+		t.Fail()
+	}
+	if dkg.has("bucket", "key1") {
+		t.Logf("Expected nothing cached on a precondition failure")
+		t.Fail()
+	}
+	if result := request(`{"bucket_name": "bucket", "keynames": ["key1"], "if_match": {"key1": "beef"}}`); result["local_path"] == nil {
+		t.Logf("Expected the object to be served when its ETag matches, but got %v", result)
+		t.Fail()
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "fmt"
+
+// What tempKeyGetter does with a download that fails verification.
+// Off checks only key names' md5s, discarding mismatches; strict also
+// checks downloads against their ETags where the ETag is an md5, which
+// it isn't for multipart uploads. Lenient checks both but keeps and
+// serves mismatches with a warning in their status.
+const (
+	integrityOff     = "off"
+	integrityStrict  = "strict"
+	integrityLenient = "lenient"
+)
+
+var integrityModes = []string{integrityOff, integrityStrict, integrityLenient}
+
+// verify checks a download with md5 actual against its key name's md5 and,
+// unless integrityMode is off, its ETag.
+func (t *tempKeyGetter) verify(result getResult, actual string) error {
+	if err := t.checkKeyMD5(result.keyName, actual); err != nil {
+		return err
+	}
+	if t.integrityMode == "" || t.integrityMode == integrityOff || !isMD5Hex(result.etag) {
+		return nil
+	}
+	if result.etag != actual {
+		return fmt.Errorf("md5 mismatch: ETag is %v, but downloaded %v", result.etag, actual)
+	}
+	return nil
+}
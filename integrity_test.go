@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTempKeyGetterIntegrityModes(t *testing.T) {
+	// S3 sent the ETag of other content than it served
+	otherMD5 := md5.Sum([]byte("other content"))
+	mismatched := conditionalKeyReaderGetter{"sample content", hex.EncodeToString(otherMD5[:])}
+	for mode, expectServed := range map[string]bool{integrityOff: true, integrityStrict: false, integrityLenient: true} {
+		getter := &tempKeyGetter{keyReaderGetter: mismatched, integrityMode: mode}
+		result := getter.getKey(context.Background(), "bucket", "key")
+		if result.localPath != nil {
+			defer os.Remove(*result.localPath)
+		}
+		if (result.localPath != nil) != expectServed {
+			t.Logf("Expected a mismatched download to be served under %v: %v, but got %v", mode, expectServed, result.status)
+			t.Fail()
+		}
+		warned := strings.Contains(result.status, "md5 mismatch")
+		if warned != (mode != integrityOff) {
+			t.Logf("Expected the mismatch to be reported under %v: %v, but got %v", mode, mode != integrityOff, result.status)
+			t.Fail()
+		}
+	}
+
+	sampleMD5 := md5.Sum([]byte("sample content"))
+	matching := conditionalKeyReaderGetter{"sample content", hex.EncodeToString(sampleMD5[:])}
+	multipart := conditionalKeyReaderGetter{"sample content", hex.EncodeToString(otherMD5[:]) + "-2"}
+	for _, keyReaderGetter := range []conditionalKeyReaderGetter{matching, multipart} {
+		getter := &tempKeyGetter{keyReaderGetter: keyReaderGetter, integrityMode: integrityStrict}
+		result := getter.getKey(context.Background(), "bucket", "key")
+		if result.localPath == nil {
+			t.Logf("Expected a download with ETag %v to pass strict verification, but got %v", keyReaderGetter.etag, result.status)
+			t.Fail()
+		} else {
+			os.Remove(*result.localPath)
+		}
+	}
+}
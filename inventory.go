@@ -0,0 +1,165 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// An inventoryManifest is the manifest.json S3 Inventory publishes next to
+// the data files listing a bucket's objects.
+type inventoryManifest struct {
+	SourceBucket string `json:"sourceBucket"`
+	FileFormat   string `json:"fileFormat"`
+	Files        []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+type inventoryRequest struct {
+	BucketName  string `json:"bucket_name"`
+	ManifestKey string `json:"manifest_key"`
+}
+
+type inventoryObject struct {
+	bucketName, keyName string
+}
+
+// An inventoryWarmer reads an S3 Inventory manifest (or a single CSV data
+// file of one) and fetches up to maxKeys of the objects it lists through
+// getter, so a cache can be warmed from the inventory a data lake
+// already publishes. Neither manifests nor objects are read from buckets
+// allowed doesn't allow; the objects are counted as refused instead.
+type inventoryWarmer struct {
+	manifests keyReaderGetter
+	getter    MutableKeyGetter
+	maxKeys   int
+	allowed   bucketAllowlist
+}
+
+func (i *inventoryWarmer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var ir inventoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&ir); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if ir.BucketName == "" || ir.ManifestKey == "" {
+		http.Error(w, "a bucket_name and manifest_key are required", 400)
+		return
+	}
+	if !i.allowed.allows(ir.BucketName) {
+		http.Error(w, fmt.Sprintf("bucket %v isn't allowed", ir.BucketName), 403)
+		return
+	}
+	objects, err := i.objectsIn(ir.BucketName, ir.ManifestKey)
+	if err != nil {
+		http.Error(w, err.Error(), 502)
+		return
+	}
+	byBucket := make(map[string][]string)
+	refused := 0
+	for _, object := range objects {
+		if !i.allowed.allows(object.bucketName) {
+			refused += 1
+			continue
+		}
+		byBucket[object.bucketName] = append(byBucket[object.bucketName], object.keyName)
+	}
+	warmed, failed := 0, 0
+	for bucketName, keyNames := range byBucket {
+		for _, result := range i.getter.Get(r.Context(), bucketName, keyNames, getOptions{}) {
+			if passedThroughFile(result) {
+				// fetched, but not into the cache, so nothing was warmed
+				os.Remove(*result.localPath)
+				result.localPath = nil
+			}
+			if result.localPath == nil {
+				failed += 1
+			} else {
+				warmed += 1
+			}
+		}
+	}
+	out, err := json.Marshal(map[string]int{"warmed": warmed, "failed": failed, "refused": refused})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// objectsIn lists the objects named by a manifest.json, or by a CSV data
+// file if that's what manifestKey is.
+func (i *inventoryWarmer) objectsIn(bucketName, manifestKey string) ([]inventoryObject, error) {
+	if !strings.HasSuffix(manifestKey, ".json") {
+		return i.appendCSV(nil, bucketName, manifestKey)
+	}
+	rc, err := i.manifests.getKeyReader(bucketName, manifestKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var manifest inventoryManifest
+	if err := json.NewDecoder(rc).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	if manifest.FileFormat != "CSV" {
+		return nil, fmt.Errorf("only CSV inventories are supported, not %v", manifest.FileFormat)
+	}
+	var objects []inventoryObject
+	for _, file := range manifest.Files {
+		if objects, err = i.appendCSV(objects, bucketName, file.Key); err != nil {
+			return nil, err
+		}
+		if len(objects) >= i.maxKeys {
+			break
+		}
+	}
+	return objects, nil
+}
+
+// appendCSV adds the objects listed in an inventory data file, whose rows
+// start with the (quoted) bucket and URL-encoded key, stopping at maxKeys.
+func (i *inventoryWarmer) appendCSV(objects []inventoryObject, bucketName, keyName string) ([]inventoryObject, error) {
+	rc, err := i.manifests.getKeyReader(bucketName, keyName)
+	if err != nil {
+		return objects, err
+	}
+	defer rc.Close()
+	var rows io.Reader = rc
+	if strings.HasSuffix(keyName, ".gz") {
+		gz, err := gzip.NewReader(rc)
+		if err != nil {
+			return objects, err
+		}
+		defer gz.Close()
+		rows = gz
+	}
+	cr := csv.NewReader(rows)
+	cr.FieldsPerRecord = -1
+	for len(objects) < i.maxKeys {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return objects, err
+		}
+		if len(row) < 2 {
+			return objects, fmt.Errorf("inventory row %v has no key", row)
+		}
+		objectKey, err := url.QueryUnescape(row[1])
+		if err != nil {
+			return objects, err
+		}
+		objects = append(objects, inventoryObject{row[0], objectKey})
+	}
+	return objects, nil
+}
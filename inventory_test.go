@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+
+	"launchpad.net/goamz/s3"
+)
+
+type mapKeyReaderGetter map[string]string
+
+func (m mapKeyReaderGetter) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
+	contents, ok := m[bucketName+"/"+keyName]
+	if !ok {
+		return nil, &s3.Error{StatusCode: 404, Code: "NoSuchKey", Message: fmt.Sprintf("%v/%v not found", bucketName, keyName)}
+	}
+	return ioutil.NopCloser(bytes.NewReader([]byte(contents))), nil
+}
+
+// recordingKeyGetter remembers every bucket/key it was asked for.
+type recordingKeyGetter struct {
+	*mockKeyGetter
+	requested []string
+}
+
+func (r *recordingKeyGetter) Get(ctx context.Context, bucketName string, keyNames []string, opts getOptions) []getResult {
+	for _, keyName := range keyNames {
+		r.requested = append(r.requested, bucketName+"/"+keyName)
+	}
+	return r.get(ctx, bucketName, keyNames)
+}
+
+func (r *recordingKeyGetter) GetCached(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	return nil
+}
+
+func TestInventoryWarmer(t *testing.T) {
+	manifests := mapKeyReaderGetter{
+		"inventory/manifest.json": `{"sourceBucket":"lake","fileFormat":"CSV","files":[{"key":"data/1.csv"}]}`,
+		"inventory/data/1.csv":    "\"lake\",\"a/one\",\"1\"\n\"lake\",\"a/two%20words\",\"2\"\n\"lake\",\"a/three\",\"3\"\n",
+	}
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	getter := &recordingKeyGetter{mockKeyGetter: base}
+	warmer := &inventoryWarmer{manifests: manifests, getter: getter, maxKeys: 2}
+
+	rec := httptest.NewRecorder()
+	body := []byte(`{"bucket_name":"inventory","manifest_key":"manifest.json"}`)
+	warmer.ServeHTTP(rec, httptest.NewRequest("POST", "/warm-inventory", bytes.NewReader(body)))
+	if rec.Code != 200 {
+		t.Fatalf("Expected a 200, but got %v: %v", rec.Code, rec.Body.String())
+	}
+	sort.Strings(getter.requested)
+	expected := []string{"lake/a/one", "lake/a/two words"}
+	if fmt.Sprint(getter.requested) != fmt.Sprint(expected) {
+		t.Logf("Expected %v to be warmed, but got %v", expected, getter.requested)
+		t.Fail()
+	}
+	var summary map[string]int
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary["warmed"] != 2 {
+		t.Logf("Expected 2 keys warmed, but the summary was %v", summary)
+		t.Fail()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A keyMD5Pattern finds the md5 some pipelines embed in their key names,
+// as in blobs/<md5>, so downloads can be checked against it without
+// asking S3. It's the pattern's first group, or its whole match if it has
+// none.
+type keyMD5Pattern struct {
+	*regexp.Regexp
+}
+
+func parseKeyMD5Pattern(pattern string) (*keyMD5Pattern, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if re.NumSubexp() > 1 {
+		return nil, fmt.Errorf("key md5 pattern %q can have at most one group", pattern)
+	}
+	return &keyMD5Pattern{re}, nil
+}
+
+// expected is the md5 embedded in keyName, or "" if it has none.
+func (p *keyMD5Pattern) expected(keyName string) string {
+	if p == nil {
+		return ""
+	}
+	match := p.FindStringSubmatch(keyName)
+	if match == nil {
+		return ""
+	}
+	digest := strings.ToLower(match[len(match)-1])
+	if !isMD5Hex(digest) {
+		return ""
+	}
+	return digest
+}
+
+// checkKeyMD5 compares a download's md5 against the one in its key name,
+// returning an error for a mismatch.
+func (t *tempKeyGetter) checkKeyMD5(keyName, actual string) error {
+	if expected := t.keyMD5.expected(keyName); expected != "" && expected != actual {
+		return fmt.Errorf("md5 mismatch: key name has %v, but downloaded %v", expected, actual)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+func TestTempKeyGetterChecksKeyMD5(t *testing.T) {
+	content := "sample content"
+	sum := md5.Sum([]byte(content))
+	correct := hex.EncodeToString(sum[:])
+	incorrect := "0123456789abcdef0123456789abcdef"
+	pattern, err := parseKeyMD5Pattern(`^blobs/([0-9a-f]{32})$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getter := &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter(content), keyMD5: pattern}
+
+	results := getter.get(context.Background(), "bucket", []string{"blobs/" + correct, "blobs/" + incorrect, "unhashed"})
+	for _, result := range []getResult{results[0], results[2]} {
+		if result.localPath == nil {
+			t.Logf("Expected %v to download, but got %v", result.keyName, result.status)
+			t.Fail()
+			continue
+		}
+		os.Remove(*result.localPath)
+	}
+	if results[1].localPath != nil || results[1].err == nil {
+		t.Logf("Expected a key naming the wrong md5 to fail, but got %+v", results[1])
+		t.Fail()
+	}
+}
+
+func TestParseKeyMD5Pattern(t *testing.T) {
+	if _, err := parseKeyMD5Pattern(`(a)(b)`); err == nil {
+		t.Logf("Expected a pattern with two groups to be rejected")
+		t.Fail()
+	}
+	pattern, err := parseKeyMD5Pattern(`[0-9A-Fa-f]{32}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := pattern.expected("x/0123456789ABCDEF0123456789ABCDEF.bin"); expected != "0123456789abcdef0123456789abcdef" {
+		t.Logf("Expected the whole match, lowercased, without a group, but got %q", expected)
+		t.Fail()
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const defaultPathTemplate = "{cacheDir}/{bucket}/{key}"
+
+// A pathTemplate lays cached keys out on disk as
+// {cacheDir}/{bucket}/.../{key}, where the segments in between may be
+// literal names or {keyHash} and {keyHashPrefix}, the md5 of the key name
+// and its first two hex digits. Since every segment between the bucket and
+// the key is derived from the key alone, a key is always found at one path
+// and the key names under a bucket can be recovered from the paths.
+type pathTemplate struct {
+	middle []string
+}
+
+// parsePathTemplate checks that template has that shape, and that none of
+// its segments could climb out of the bucket's directory.
+func parsePathTemplate(template string) (*pathTemplate, error) {
+	const prefix, suffix = "{cacheDir}/{bucket}/", "/{key}"
+	if template == defaultPathTemplate {
+		return &pathTemplate{}, nil
+	}
+	if !strings.HasPrefix(template, prefix) || !strings.HasSuffix(template, suffix) ||
+		len(template) < len(prefix)+len(suffix) {
+		return nil, fmt.Errorf("path template %q must start with %v and end with %v", template, prefix, suffix)
+	}
+	middle := strings.Split(template[len(prefix):len(template)-len(suffix)], "/")
+	for _, segment := range middle {
+		switch {
+		case segment == "" || segment == "." || segment == "..":
+			return nil, fmt.Errorf("path template %q can't have an empty, . or .. segment", template)
+		case segment == "{keyHash}" || segment == "{keyHashPrefix}":
+		case strings.ContainsAny(segment, "{}\\"):
+			return nil, fmt.Errorf("path template %q has an unknown placeholder in %q", template, segment)
+		}
+	}
+	return &pathTemplate{middle}, nil
+}
+
+func (p *pathTemplate) expand(cacheDir, bucketName, keyName string) string {
+	parts := make([]string, 0, len(p.middle)+3)
+	parts = append(parts, cacheDir, bucketName)
+	for _, segment := range p.middle {
+		switch segment {
+		case "{keyHash}", "{keyHashPrefix}":
+			sum := md5.Sum([]byte(keyName))
+			hash := hex.EncodeToString(sum[:])
+			if segment == "{keyHashPrefix}" {
+				hash = hash[:2]
+			}
+			parts = append(parts, hash)
+		default:
+			parts = append(parts, segment)
+		}
+	}
+	return path.Join(append(parts, keyName)...)
+}
+
+// keyName recovers the key name from a path relative to its bucket's
+// directory, if it's one this template could have made.
+func (p *pathTemplate) keyName(rel string) (string, bool) {
+	segments := strings.SplitN(rel, "/", len(p.middle)+1)
+	if len(segments) != len(p.middle)+1 {
+		return "", false
+	}
+	keyName := segments[len(p.middle)]
+	return keyName, p.expand("", "", keyName) == rel
+}
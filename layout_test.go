@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	for _, template := range []string{
+		defaultPathTemplate,
+		"{cacheDir}/{bucket}/{keyHashPrefix}/{key}",
+		"{cacheDir}/{bucket}/team-a/{keyHash}/{key}",
+	} {
+		if _, err := parsePathTemplate(template); err != nil {
+			t.Logf("Expected %q to be a valid template, but got %v", template, err)
+			t.Fail()
+		}
+	}
+	for _, template := range []string{
+		"{bucket}/{key}",
+		"{cacheDir}/{key}",
+		"{cacheDir}/{bucket}/{key}/{keyHash}",
+		"{cacheDir}/{bucket}/../{key}",
+		"{cacheDir}/{bucket}/a//{key}",
+		"{cacheDir}/{bucket}/{date}/{key}",
+		"{cacheDir}/{bucket}/a\\..\\..\\/{key}",
+	} {
+		if _, err := parsePathTemplate(template); err == nil {
+			t.Logf("Expected %q to be rejected", template)
+			t.Fail()
+		}
+	}
+}
+
+func TestDiskCachedKeyGetterPathTemplate(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	layout, err := parsePathTemplate("{cacheDir}/{bucket}/{keyHashPrefix}/{key}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir, layout: layout}
+
+	// md5("dir/key") starts 50
+	if expected := path.Join(cacheDir, "bucket", "50", "dir/key"); dkg.mustPathFor("bucket", "dir/key") != expected {
+		t.Logf("Expected dir/key at %v, but got %v", expected, dkg.mustPathFor("bucket", "dir/key"))
+		t.Fail()
+	}
+	results := dkg.get(context.Background(), "bucket", []string{"dir/key", "other"})
+	for _, result := range results {
+		if result.localPath == nil || *result.localPath != dkg.mustPathFor("bucket", result.keyName) {
+			t.Logf("Expected %v cached at %v, but got %+v", result.keyName, dkg.mustPathFor("bucket", result.keyName), result)
+			t.Fail()
+		}
+	}
+	keyNames := dkg.keysIn("bucket")
+	sort.Strings(keyNames)
+	if !reflect.DeepEqual(keyNames, []string{"dir/key", "other"}) {
+		t.Logf("Expected the key names to round trip through their paths, but got %v", keyNames)
+		t.Fail()
+	}
+	dkg.remove("bucket", "dir/key")
+	if dkg.has("bucket", "dir/key") || !dkg.has("bucket", "other") {
+		t.Logf("Expected remove to find dir/key by its templated path")
+		t.Fail()
+	}
+}
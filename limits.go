@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// slots caps how many of something may be underway at once. Unlike a
+// buffered channel, its limit can be changed while slots are held: raising
+// it lets waiters in right away, and lowering it holds new acquires back
+// until enough of the held slots are released. A nil *slots, or a limit of
+// 0, allows any number.
+type slots struct {
+	limit   int
+	held    int
+	waiting int
+	// freed is closed, and replaced, whenever a slot is released or the
+	// limit changes, waking everything waiting in acquire
+	freed chan struct{}
+	sync.Mutex
+}
+
+func newSlots(limit int) *slots {
+	return &slots{limit: limit, freed: make(chan struct{})}
+}
+
+// tryAcquire takes a slot if one is free, returning whether it did.
+func (s *slots) tryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.limit > 0 && s.held >= s.limit {
+		return false
+	}
+	s.held++
+	return true
+}
+
+// acquire waits for a slot, returning false without taking one if ctx is
+// cancelled first.
+func (s *slots) acquire(ctx context.Context) bool {
+	if s == nil {
+		return ctx.Err() == nil
+	}
+	for {
+		if ctx.Err() != nil {
+			return false
+		}
+		s.Lock()
+		if s.limit <= 0 || s.held < s.limit {
+			s.held++
+			s.Unlock()
+			return true
+		}
+		freed := s.freed
+		s.waiting++
+		s.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+		}
+		s.Lock()
+		s.waiting--
+		s.Unlock()
+	}
+}
+
+func (s *slots) release() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.held--
+	s.wakeLocked()
+}
+
+func (s *slots) setLimit(limit int) {
+	s.Lock()
+	defer s.Unlock()
+	s.limit = limit
+	s.wakeLocked()
+}
+
+func (s *slots) currentLimit() int {
+	if s == nil {
+		return 0
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.limit
+}
+
+// queued reports whether every slot is held and at least depth acquires
+// are waiting for one.
+func (s *slots) queued(depth int) bool {
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.limit > 0 && s.held >= s.limit && s.waiting >= depth
+}
+
+func (s *slots) wakeLocked() {
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
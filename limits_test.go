@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSlotsSetLimit(t *testing.T) {
+	s := newSlots(1)
+	if !s.tryAcquire() || s.tryAcquire() {
+		t.Fatalf("Expected exactly one slot to be free")
+	}
+	acquired := make(chan bool)
+	go func() {
+		acquired <- s.acquire(context.Background())
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("Expected acquire to wait while the only slot is held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.setLimit(2)
+	if !<-acquired {
+		t.Logf("Expected raising the limit to let the waiting acquire in")
+		t.Fail()
+	}
+
+	s.setLimit(1)
+	s.release()
+	if s.tryAcquire() {
+		t.Logf("Expected lowering the limit to hold new acquires back until enough slots are released")
+		t.Fail()
+	}
+	s.release()
+	if !s.tryAcquire() {
+		t.Logf("Expected a slot once held slots fell under the new limit")
+		t.Fail()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if s.acquire(ctx) {
+		t.Logf("Expected acquire to give up once ctx is cancelled")
+		t.Fail()
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type bucketLister interface {
+	listAll(bucketName, prefix string) ([]string, error)
+}
+
+// listAll lists every key under prefix, following S3's pagination.
+func (s *s3Conn) listAll(bucketName, prefix string) ([]string, error) {
+	bucket := s.Bucket(bucketName)
+	keyNames := make([]string, 0)
+	marker := ""
+	for {
+		listResp, err := bucket.List(prefix, "", marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range listResp.Contents {
+			keyNames = append(keyNames, key.Key)
+		}
+		if !listResp.IsTruncated || len(listResp.Contents) == 0 {
+			return keyNames, nil
+		}
+		marker = listResp.Contents[len(listResp.Contents)-1].Key
+	}
+}
+
+type cachedListing struct {
+	keyNames []string
+	listedAt time.Time
+}
+
+// A listingCache remembers the result of listing a bucket and prefix for
+// ttl, so clients repeatedly listing the same prefix don't each cost a
+// round of ListObjects calls. Buckets allowed doesn't allow aren't listed.
+type listingCache struct {
+	lister   bucketLister
+	ttl      time.Duration
+	allowed  bucketAllowlist
+	listings map[string]map[string]cachedListing
+	sync.Mutex
+}
+
+func (l *listingCache) list(bucketName, prefix string) ([]string, error) {
+	l.Lock()
+	listing, had := l.listings[bucketName][prefix]
+	l.Unlock()
+	if had && time.Since(listing.listedAt) < l.ttl {
+		return listing.keyNames, nil
+	}
+	keyNames, err := l.lister.listAll(bucketName, prefix)
+	if err != nil {
+		return nil, err
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.listings == nil {
+		l.listings = make(map[string]map[string]cachedListing)
+	}
+	if l.listings[bucketName] == nil {
+		l.listings[bucketName] = make(map[string]cachedListing)
+	}
+	l.listings[bucketName][prefix] = cachedListing{keyNames, time.Now()}
+	return keyNames, nil
+}
+
+// invalidate forgets every cached listing for bucketName.
+func (l *listingCache) invalidate(bucketName string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.listings, bucketName)
+}
+
+// ServeHTTP serves GET /list?bucket=...&prefix=... as a JSON array of keys.
+func (l *listingCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "listing only supports GET", 405)
+		return
+	}
+	bucketName := r.URL.Query().Get("bucket")
+	if bucketName == "" {
+		http.Error(w, "a bucket is required", 400)
+		return
+	}
+	if !l.allowed.allows(bucketName) {
+		http.Error(w, fmt.Sprintf("bucket %v isn't allowed", bucketName), 403)
+		return
+	}
+	keyNames, err := l.list(bucketName, r.URL.Query().Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), 502)
+		return
+	}
+	out, err := json.Marshal(keyNames)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
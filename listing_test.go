@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type countingBucketLister struct {
+	keyNames []string
+	called   int
+}
+
+func (c *countingBucketLister) listAll(bucketName, prefix string) ([]string, error) {
+	c.called += 1
+	return c.keyNames, nil
+}
+
+func TestListingCache(t *testing.T) {
+	lister := &countingBucketLister{keyNames: []string{"dir/a", "dir/b"}}
+	l := &listingCache{lister: lister, ttl: time.Minute}
+	list := func() []string {
+		rec := httptest.NewRecorder()
+		l.ServeHTTP(rec, httptest.NewRequest("GET", "/list?bucket=bucket&prefix=dir/", nil))
+		var keyNames []string
+		if err := json.Unmarshal(rec.Body.Bytes(), &keyNames); err != nil {
+			t.Fatal(err)
+		}
+		return keyNames
+	}
+
+	first := list()
+	second := list()
+	if lister.called != 1 {
+		t.Logf("Expected the second listing within the TTL not to reach S3, but had %v calls", lister.called)
+		t.Fail()
+	}
+	if len(first) != 2 || len(second) != 2 {
+		t.Logf("Expected both listings to have 2 keys, but had %v and %v", first, second)
+		t.Fail()
+	}
+
+	l.invalidate("bucket")
+	list()
+	if lister.called != 2 {
+		t.Logf("Expected a listing after invalidation to reach S3, but had %v calls", lister.called)
+		t.Fail()
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// lruUses orders every use of an lru entry, so that entries kept in
+// different shards can still be told apart by which was used least
+// recently.
+var lruUses atomic.Uint64
+
+// newShardedLRU makes an lru that keeps its entries in shards segments by
+// a hash of bucket and key, each with its own lock, list and index, so
+// requests for different keys don't all wait on one lock. Eviction still
+// takes the least recently used entry across every shard, and is bounded
+// by one byte budget, since the boundedDiskCachedKeyGetter over it keeps
+// the total.
+func newShardedLRU(base KeyGetter, pinFor time.Duration, shards int) *lruCachedKeyGetter {
+	m := &lruCachedKeyGetter{base: base, pinFor: pinFor}
+	if shards <= 1 {
+		return m
+	}
+	m.shards = make([]*lruCachedKeyGetter, shards)
+	for i := range m.shards {
+		m.shards[i] = &lruCachedKeyGetter{pinFor: pinFor, cache: nestedLRUIndex{}}
+	}
+	return m
+}
+
+// shardFor is the shard keeping keyName, or m itself if it isn't sharded.
+func (m *lruCachedKeyGetter) shardFor(bucketName, keyName string) *lruCachedKeyGetter {
+	if m.shards == nil {
+		return m
+	}
+	return m.shards[m.shardIndex(bucketName, keyName)]
+}
+
+func (m *lruCachedKeyGetter) shardIndex(bucketName, keyName string) int {
+	h := fnv.New32a()
+	h.Write([]byte(bucketName))
+	h.Write([]byte{0})
+	h.Write([]byte(keyName))
+	return int(h.Sum32() % uint32(len(m.shards)))
+}
+
+// len is how many entries the lru has.
+func (m *lruCachedKeyGetter) len() int {
+	if m.shards != nil {
+		n := 0
+		for _, shard := range m.shards {
+			n += shard.len()
+		}
+		return n
+	}
+	m.RLock()
+	defer m.RUnlock()
+	return m.List.Len()
+}
+
+// shardedHits is hits across the shards, taking each shard's lock once.
+func (m *lruCachedKeyGetter) shardedHits(bucketName string, keyNames []string) ([]getResult, []string) {
+	if len(keyNames) == 1 {
+		return m.shardFor(bucketName, keyNames[0]).hits(bucketName, keyNames)
+	}
+	byShard := make([][]string, len(m.shards))
+	for _, keyName := range keyNames {
+		i := m.shardIndex(bucketName, keyName)
+		byShard[i] = append(byShard[i], keyName)
+	}
+	out := make([]getResult, 0, len(keyNames))
+	missing := make([]string, 0, len(keyNames))
+	for i, shardKeyNames := range byShard {
+		if len(shardKeyNames) == 0 {
+			continue
+		}
+		hits, misses := m.shards[i].hits(bucketName, shardKeyNames)
+		out = append(out, hits...)
+		missing = append(missing, misses...)
+	}
+	return out, missing
+}
+
+// shardedOldest is oldest across the shards: the least recently used of
+// each shard's oldest.
+func (m *lruCachedKeyGetter) shardedOldest(minAge time.Duration) *getResult {
+	var victim *getResult
+	for _, shard := range m.shards {
+		if candidate := shard.oldest(minAge); candidate != nil && (victim == nil || candidate.used < victim.used) {
+			victim = candidate
+		}
+	}
+	return victim
+}
+
+// shardedSampleOldest is sampleOldest across the shards, sampling one
+// entry from each of up to samples shards, starting from a random one.
+func (m *lruCachedKeyGetter) shardedSampleOldest(minAge time.Duration, samples int, rng *rand.Rand) *getResult {
+	var victim *getResult
+	start := rng.Intn(len(m.shards))
+	for i, sampled := 0, 0; i < len(m.shards) && sampled < samples; i++ {
+		candidate := m.shards[(start+i)%len(m.shards)].sampleOldest(minAge, 1, rng)
+		if candidate == nil {
+			continue
+		}
+		sampled++
+		if victim == nil || candidate.used < victim.used {
+			victim = candidate
+		}
+	}
+	return victim
+}
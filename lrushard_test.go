@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardedLRUEvictsLeastRecentAcrossShards(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	lru := newShardedLRU(dkg, 0, 4)
+	b := &boundedDiskCachedKeyGetter{lru: lru, disk: dkg, wake: make(chan struct{}, 1)}
+
+	var keyNames []string
+	for i := 0; i < 12; i++ {
+		keyNames = append(keyNames, fmt.Sprintf("key%v", i))
+		b.get(context.Background(), "bucket", keyNames[i:])
+	}
+	used := 0
+	for _, shard := range lru.shards {
+		if shard.len() > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Fatalf("Expected the keys to be spread over the shards, but only %v had any", used)
+	}
+	b.get(context.Background(), "bucket", []string{"key0"})
+
+	size := int64(len("sample content"))
+	b.shrinkTo(10*size, 0)
+	for i, keyName := range keyNames {
+		if cached := b.has("bucket", keyName); cached != (i == 0 || i > 2) {
+			t.Logf("Expected the two least recently used keys, whichever shard they're in, to be evicted, but %v cached: %v", keyName, cached)
+			t.Fail()
+		}
+	}
+
+	var snapshot bytes.Buffer
+	if err := lru.writeSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	var entries []lruSnapshotEntry
+	json.Unmarshal(snapshot.Bytes(), &entries)
+	var order []string
+	for _, entry := range entries {
+		order = append(order, entry.KeyName)
+	}
+	expected := append(append([]string(nil), keyNames[3:]...), "key0")
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Logf("Expected the snapshot in order of use across shards, %v, but got %v", expected, order)
+		t.Fail()
+	}
+}
+
+func TestShardedLRUConcurrentUse(t *testing.T) {
+	lru := newShardedLRU(instantKeyGetter{}, 0, 8)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				keyName := fmt.Sprintf("key%v", (g*31+i)%64)
+				lru.get(context.Background(), "bucket", []string{keyName})
+				if i%3 == 0 {
+					lru.remove("bucket", keyName)
+				}
+				lru.oldest(0)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n, entries := lru.len(), len(lru.entries()); n != entries || n > 64 {
+		t.Logf("Expected the shards to agree on their %v entries, but listed %v", n, entries)
+		t.Fail()
+	}
+}
+
+func TestShardedLRUOtherShardsDontWait(t *testing.T) {
+	lru := newShardedLRU(instantKeyGetter{}, 0, 8)
+	busy := lru.shardFor("bucket", "busy")
+	other := "other"
+	for i := 0; lru.shardFor("bucket", other) == busy; i++ {
+		other = fmt.Sprintf("other%v", i)
+	}
+	lru.get(context.Background(), "bucket", []string{"busy", other})
+
+	busy.Lock()
+	defer busy.Unlock()
+	done := make(chan struct{})
+	go func() {
+		lru.get(context.Background(), "bucket", []string{other})
+		lru.remove("bucket", other)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Logf("Expected a key in another shard to be served while one shard is locked")
+		t.Fail()
+	}
+}
+
+// An instantKeyGetter "fetches" any key at once, without touching disk.
+type instantKeyGetter struct{}
+
+func (instantKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	out := make([]getResult, 0, len(keyNames))
+	for _, keyName := range keyNames {
+		localPath := "/cache/" + bucketName + "/" + keyName
+		out = append(out, getResult{keyName: keyName, bucketName: bucketName, localPath: &localPath, bytesTransferred: 1})
+	}
+	return out
+}
+
+func benchmarkLRUHits(b *testing.B, shards int) {
+	lru := newShardedLRU(instantKeyGetter{}, 0, shards)
+	keyNames := make([]string, 1024)
+	for i := range keyNames {
+		keyNames[i] = fmt.Sprintf("prefix/%v/object", i)
+	}
+	lru.get(context.Background(), "bucket", keyNames)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			lru.get(context.Background(), "bucket", keyNames[i%len(keyNames):i%len(keyNames)+1])
+		}
+	})
+}
+
+// Compare these with -cpu past 1 to see how much the lru's lock contends.
+func BenchmarkLRUHitsSingleLock(b *testing.B) {
+	benchmarkLRUHits(b, 1)
+}
+
+func BenchmarkLRUHitsSharded(b *testing.B) {
+	benchmarkLRUHits(b, 16)
+}
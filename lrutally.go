@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// An lruTally keeps running totals of an lru's entries, the bytes they
+// take, and its hits and misses, updated as each changes so that /stats
+// can read them without taking the lru's lock.
+type lruTally struct {
+	entries, bytes, hits, misses atomic.Int64
+}
+
+// lruAggregates are an lru's totals as of one read of its tallies.
+type lruAggregates struct {
+	Entries int64
+	Bytes   int64
+	Hits    int64
+	Misses  int64
+}
+
+func (a lruAggregates) plus(b lruAggregates) lruAggregates {
+	return lruAggregates{a.Entries + b.Entries, a.Bytes + b.Bytes, a.Hits + b.Hits, a.Misses + b.Misses}
+}
+
+// aggregates reads m's tallies, across its shards if it has any.
+func (m *lruCachedKeyGetter) aggregates() lruAggregates {
+	out := lruAggregates{m.tally.entries.Load(), m.tally.bytes.Load(), m.tally.hits.Load(), m.tally.misses.Load()}
+	for _, shard := range m.shards {
+		out = out.plus(shard.aggregates())
+	}
+	return out
+}
+
+// recount walks m's entries to count them and their bytes, correcting its
+// tallies to match if they've drifted, and returns what it counted. Hits
+// and misses aren't kept anywhere else, so they're taken as tallied.
+func (m *lruCachedKeyGetter) recount() lruAggregates {
+	if m.shards != nil {
+		var out lruAggregates
+		for _, shard := range m.shards {
+			out = out.plus(shard.recount())
+		}
+		return out
+	}
+	m.Lock()
+	defer m.Unlock()
+	var entries, bytes int64
+	for elem := m.Front(); elem != nil; elem = elem.Next() {
+		if result, ok := elem.Value.(getResult); ok {
+			entries += 1
+			bytes += result.bytesTransferred
+		}
+	}
+	if tallied := m.tally.entries.Load(); tallied != entries {
+		log.Printf("The lru tallied %v entries but has %v; correcting", tallied, entries)
+		m.tally.entries.Store(entries)
+	}
+	if tallied := m.tally.bytes.Load(); tallied != bytes {
+		log.Printf("The lru tallied %v bytes but has %v; correcting", tallied, bytes)
+		m.tally.bytes.Store(bytes)
+	}
+	return lruAggregates{entries, bytes, m.tally.hits.Load(), m.tally.misses.Load()}
+}
+
+// recountEvery recounts m every interval, forever, or never if interval
+// is 0.
+func (m *lruCachedKeyGetter) recountEvery(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		m.recount()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLRUTallyMatchesRecount(t *testing.T) {
+	for _, shards := range []int{1, 4} {
+		base := newMockKeyGetter("sample content")
+		defer os.RemoveAll(base.dir)
+		cacheDir, err := ioutil.TempDir("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(cacheDir)
+		dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+		lru := newShardedLRU(dkg, 0, shards)
+		stats := &cacheStats{}
+		stats.watch(lru)
+
+		lru.get(context.Background(), "bucket", []string{"key1", "key2", "key3"})
+		lru.get(context.Background(), "bucket", []string{"key1", "key2", "key4"})
+		lru.get(context.Background(), "other", []string{"key1"})
+		lru.remove("bucket", "key2")
+		lru.remove("bucket", "missing")
+		lru.resize("bucket", "key3", 100)
+		lru.admit(getResult{bucketName: "bucket", keyName: "key1", localPath: new(string), bytesTransferred: 5})
+		lru.restore([]lruSnapshotEntry{{BucketName: "restored", KeyName: "key", Bytes: 7}},
+			func(bucketName, keyName string) bool { return true })
+
+		tallied := lru.aggregates()
+		if counted := lru.recount(); tallied != counted {
+			t.Logf("Expected the tallies to match a recount with %v shards, but tallied %+v and counted %+v", shards, tallied, counted)
+			t.Fail()
+		}
+		expected := lruAggregates{Entries: 5, Bytes: 5 + 100 + 14 + 14 + 7, Hits: 2, Misses: 5}
+		if tallied != expected {
+			t.Logf("Expected %+v with %v shards, but got %+v", expected, shards, tallied)
+			t.Fail()
+		}
+		if total, _ := stats.snapshot(); total.LRUEntries != expected.Entries || total.LRUBytes != expected.Bytes ||
+			total.LRUHits != expected.Hits || total.LRUMisses != expected.Misses {
+			t.Logf("Expected /stats to report the tallies, but got %+v", total)
+			t.Fail()
+		}
+	}
+}
+
+func TestLRURecountCorrectsDrift(t *testing.T) {
+	lru := &lruCachedKeyGetter{}
+	lru.admit(getResult{bucketName: "bucket", keyName: "key", localPath: new(string), bytesTransferred: 10})
+	lru.tally.entries.Add(3)
+	lru.tally.bytes.Add(-4)
+
+	lru.recount()
+	if tallied := lru.aggregates(); tallied.Entries != 1 || tallied.Bytes != 10 {
+		t.Logf("Expected the recount to correct the tallies to 1 entry of 10 bytes, but got %+v", tallied)
+		t.Fail()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// A manifestEntry is one cached key as listed by /manifest.
+type manifestEntry struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5"`
+}
+
+// manifest lists every cached key in an allowed bucket, sorted by bucket
+// and key, so two caches
+// holding the same content list it identically. Each entry's size and md5
+// describe the same version of its file: keys evicted mid-walk are left
+// out, and a sidecar that might predate the file it's beside is passed
+// over for hashing the file itself.
+func (d *diskCachedKeyGetter) manifest() []manifestEntry {
+	entries := make([]manifestEntry, 0)
+	for _, bucketName := range d.cachedBuckets() {
+		if !d.allowed.allows(bucketName) {
+			continue
+		}
+		for _, keyName := range d.keysIn(bucketName) {
+			if entry, ok := d.manifestEntry(bucketName, keyName); ok {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Bucket != entries[j].Bucket {
+			return entries[i].Bucket < entries[j].Bucket
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+func (d *diskCachedKeyGetter) manifestEntry(bucketName, keyName string) (manifestEntry, bool) {
+	keyPath, err := d.pathFor(bucketName, keyName)
+	if err != nil {
+		return manifestEntry{}, false
+	}
+	f, err := d.files().Open(keyPath)
+	if err != nil {
+		return manifestEntry{}, false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return manifestEntry{}, false
+	}
+	entry := manifestEntry{Bucket: bucketName, Key: keyName, Size: info.Size()}
+	// the sidecar is written after its file is moved into place, so one
+	// older than the file may be left from the version it replaced
+	var metadata entryMetadata
+	metadataPath, _ := d.metadataPathFor(bucketName, keyName)
+	raw, err := d.files().ReadFile(metadataPath)
+	if err == nil && json.Unmarshal(raw, &metadata) == nil && isMD5Hex(metadata.MD5) &&
+		metadata.Size == info.Size() && !metadata.CachedAt.Before(info.ModTime()) {
+		entry.MD5 = metadata.MD5
+		return entry, true
+	}
+	hash := md5.New()
+	if _, err := io.CopyN(hash, f, info.Size()); err != nil {
+		return manifestEntry{}, false
+	}
+	entry.MD5 = hex.EncodeToString(hash.Sum(nil))
+	return entry, true
+}
+
+// serveManifest serves GET /manifest as a JSON array of every cached key's
+// bucket, key, size and md5, for diffing one node's cache against another's.
+func (d *diskCachedKeyGetter) serveManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "manifest only supports GET", 405)
+		return
+	}
+	out, err := json.Marshal(d.manifest())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestServeManifest(t *testing.T) {
+	contents := "fancy s3 key contents"
+	manifests := make([][]byte, 0, 3)
+	for i, order := range [][]string{{"b/key2", "key1", "key3"}, {"key3", "key1", "b/key2"}, {"key1", "key3", "b/key2"}} {
+		cacheDir, err := ioutil.TempDir("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(cacheDir)
+		dkg := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter(contents)}, cacheDir: cacheDir}
+		for _, keyName := range order {
+			dkg.get(context.Background(), "bucket2", []string{keyName})
+			dkg.get(context.Background(), "bucket1", []string{keyName})
+		}
+		if i == 2 {
+			// without its sidecar, a key's md5 comes from its file
+			os.Remove(dkg.mustMetadataPathFor("bucket1", "key1"))
+		}
+		rec := httptest.NewRecorder()
+		dkg.serveManifest(rec, httptest.NewRequest("GET", "/manifest", nil))
+		if rec.Code != 200 {
+			t.Fatalf("Expected a 200, but got %v", rec.Code)
+		}
+		manifests = append(manifests, rec.Body.Bytes())
+	}
+	for _, manifest := range manifests[1:] {
+		if !bytes.Equal(manifest, manifests[0]) {
+			t.Logf("Expected caches with the same content to have the same manifest, but got %s and %s", manifests[0], manifest)
+			t.Fail()
+		}
+	}
+
+	var entries []manifestEntry
+	if err := json.Unmarshal(manifests[0], &entries); err != nil {
+		t.Fatal(err)
+	}
+	digest := md5.Sum([]byte(contents))
+	var keys []string
+	for _, entry := range entries {
+		keys = append(keys, entry.Bucket+"/"+entry.Key)
+		if entry.Size != int64(len(contents)) || entry.MD5 != hex.EncodeToString(digest[:]) {
+			t.Logf("Expected %v/%v to have the content's size and md5, but got %+v", entry.Bucket, entry.Key, entry)
+			t.Fail()
+		}
+	}
+	expected := []string{"bucket1/b/key2", "bucket1/key1", "bucket1/key3", "bucket2/b/key2", "bucket2/key1", "bucket2/key3"}
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %v in the manifest, but got %v", expected, keys)
+	}
+	for i := range expected {
+		if keys[i] != expected[i] {
+			t.Logf("Expected %v in the manifest, but got %v", expected, keys)
+			t.Fail()
+			break
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// entryMetadata is what the disk cache records alongside each entry, in a
+// sidecar file under cacheDir/.meta (no S3 bucket name can start with a
+// dot, so that can't collide with a cached bucket).
+type entryMetadata struct {
+	MD5      string    `json:"md5"`
+	ETag     string    `json:"etag,omitempty"`
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	CachedAt time.Time `json:"cached_at"`
+	// how the content got into the cache, Source aside
+	Provenance *provenance `json:"provenance,omitempty"`
+}
+
+func (d *diskCachedKeyGetter) metadataPathFor(bucketName, keyName string) (string, error) {
+	if err := checkNames(bucketName, keyName); err != nil {
+		return "", err
+	}
+	if d.foldCase {
+		keyName = foldSafeKeyName(keyName)
+	}
+	bucketDir := path.Join(d.cacheDir, ".meta", bucketName)
+	metadataPath := path.Join(bucketDir, keyName+".json")
+	return metadataPath, inside(bucketDir, metadataPath)
+}
+
+func (d *diskCachedKeyGetter) writeMetadata(bucketName string, g getResult) error {
+	metadataPath, err := d.metadataPathFor(bucketName, g.keyName)
+	if err != nil {
+		return err
+	}
+	d.dirs.filling()
+	defer d.dirs.filled()
+	if err := d.files().MkdirAll(path.Dir(metadataPath), 0777); err != nil {
+		return err
+	}
+	metadata := entryMetadata{MD5: g.md5, ETag: g.etag, SHA256: g.sha256, Size: g.bytesTransferred,
+		CachedAt: time.Now()}
+	if g.provenance.Origin != "" {
+		origin := g.provenance
+		origin.Source = ""
+		metadata.Provenance = &origin
+	}
+	out, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return d.files().WriteFile(metadataPath, out, 0666)
+}
+
+// readMetadata returns the sidecar metadata for a cached key, falling back
+// to hashing the cached file itself if the sidecar is missing or corrupt.
+func (d *diskCachedKeyGetter) readMetadata(bucketName, keyName string) (*entryMetadata, error) {
+	metadataPath, err := d.metadataPathFor(bucketName, keyName)
+	if err != nil {
+		return nil, err
+	}
+	var metadata entryMetadata
+	raw, err := d.files().ReadFile(metadataPath)
+	if err == nil && json.Unmarshal(raw, &metadata) == nil {
+		return &metadata, nil
+	}
+	keyPath, err := d.pathFor(bucketName, keyName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := d.files().Open(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), f)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	metadata = entryMetadata{MD5: hex.EncodeToString(md5Hash.Sum(nil)),
+		SHA256: hex.EncodeToString(sha256Hash.Sum(nil)), Size: size, CachedAt: info.ModTime()}
+	return &metadata, nil
+}
+
+// loadMetadata fills in r's digests and cache time from its sidecar, if
+// it has one.
+func (d *diskCachedKeyGetter) loadMetadata(r *getResult) {
+	metadataPath, err := d.metadataPathFor(r.bucketName, r.keyName)
+	if err != nil {
+		return
+	}
+	raw, err := d.files().ReadFile(metadataPath)
+	if err != nil {
+		return
+	}
+	var metadata entryMetadata
+	if json.Unmarshal(raw, &metadata) != nil {
+		return
+	}
+	r.md5, r.sha256, r.etag, r.cachedAt = metadata.MD5, metadata.SHA256, metadata.ETag, metadata.CachedAt
+	if metadata.Provenance != nil {
+		r.provenance = *metadata.Provenance
+	}
+}
+
+func (d *diskCachedKeyGetter) removeMetadata(bucketName, keyName string) {
+	if metadataPath, err := d.metadataPathFor(bucketName, keyName); err == nil {
+		d.files().Remove(metadataPath)
+	}
+}
+
+// serveDigest serves GET /digest?bucket=...&key=..., returning the recorded
+// digests for a cached key without its contents, or a 404 if it isn't cached.
+func (d *diskCachedKeyGetter) serveDigest(w http.ResponseWriter, r *http.Request) {
+	bucketName, keyName := r.URL.Query().Get("bucket"), r.URL.Query().Get("key")
+	if bucketName == "" || keyName == "" {
+		http.Error(w, "a bucket and key are required", 400)
+		return
+	}
+	if err := checkNames(bucketName, keyName); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !d.allowed.allows(bucketName) {
+		http.Error(w, fmt.Sprintf("bucket %v isn't allowed", bucketName), 403)
+		return
+	}
+	if !d.has(bucketName, keyName) {
+		http.Error(w, "not cached", 404)
+		return
+	}
+	metadata, err := d.readMetadata(bucketName, keyName)
+	if os.IsNotExist(err) {
+		http.Error(w, "not cached", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out, err := json.Marshal(metadata)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestServeDigest(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	contents := "fancy s3 key contents"
+	dkg := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter(contents)}, cacheDir: cacheDir}
+	dkg.get(context.Background(), "bucket", []string{"key1"})
+
+	rec := httptest.NewRecorder()
+	dkg.serveDigest(rec, httptest.NewRequest("GET", "/digest?bucket=bucket&key=key1", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Expected a 200 for a cached key, but got %v", rec.Code)
+	}
+	var metadata entryMetadata
+	if err := json.Unmarshal(rec.Body.Bytes(), &metadata); err != nil {
+		t.Fatal(err)
+	}
+	expectedSHA256 := sha256.Sum256([]byte(contents))
+	if metadata.SHA256 != hex.EncodeToString(expectedSHA256[:]) {
+		t.Logf("Expected a sha256 of %x, but got %v", expectedSHA256, metadata.SHA256)
+		t.Fail()
+	}
+	os.Remove(dkg.mustMetadataPathFor("bucket", "key1"))
+	recomputed, err := dkg.readMetadata("bucket", "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recomputed.SHA256 != metadata.SHA256 {
+		t.Logf("Expected a missing sidecar to be recomputed from the file, but got %v", recomputed.SHA256)
+		t.Fail()
+	}
+	if metadata.Size != int64(len(contents)) {
+		t.Logf("Expected a size of %v, but got %v", len(contents), metadata.Size)
+		t.Fail()
+	}
+
+	rec = httptest.NewRecorder()
+	dkg.serveDigest(rec, httptest.NewRequest("GET", "/digest?bucket=bucket&key=key2", nil))
+	if rec.Code != 404 {
+		t.Logf("Expected a 404 for an uncached key, but got %v", rec.Code)
+		t.Fail()
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"syscall"
+	"time"
+)
+
+// moveRetryBackoff is how long moveWithRetries waits before its first
+// retry of a move that failed with EBUSY, doubling for each one after.
+const moveRetryBackoff = 50 * time.Millisecond
+
+// moveWithRetries is moveToCache, retried up to moveRetries times when the
+// move fails for a reason that may clear: ENOSPC, after asking makeRoom to
+// evict at least the download's size, and EBUSY, after backing off. A
+// failed move leaves the download where it was, so each retry moves the
+// same file.
+func (d *diskCachedKeyGetter) moveWithRetries(ctx context.Context, bucketName string, g getResult) (getResult, error) {
+	backoff := moveRetryBackoff
+	for attempt := 0; ; attempt++ {
+		cached, err := d.moveToCache(ctx, bucketName, g)
+		if err == nil || attempt >= d.moveRetries || ctx.Err() != nil {
+			return cached, err
+		}
+		switch {
+		case errors.Is(err, syscall.ENOSPC):
+			if d.makeRoom == nil {
+				return cached, err
+			}
+			log.Printf("No space to cache %v/%v, evicting and retrying: %v", bucketName, g.keyName, err)
+			d.makeRoom(g.bytesTransferred)
+		case errors.Is(err, syscall.EBUSY):
+			log.Printf("Couldn't cache %v/%v, retrying in %v: %v", bucketName, g.keyName, backoff, err)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return cached, ctx.Err()
+			}
+			backoff *= 2
+		default:
+			return cached, err
+		}
+	}
+}
+
+// makeRoom evicts entries totalling at least bytes, however far under its
+// limits the cache already is, for a move the disk had no space for.
+func (b *boundedDiskCachedKeyGetter) makeRoom(bytes int64) {
+	if bytes <= 0 {
+		bytes = 1
+	}
+	b.shrinkTo(b.size()-bytes, 0)
+}
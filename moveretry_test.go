@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// A fullFS has no space for another cache entry while full, until one is
+// removed.
+type fullFS struct {
+	*memFS
+	full     bool
+	renames  int
+	removals int
+}
+
+func (f *fullFS) Rename(oldpath, newpath string) error {
+	f.renames++
+	if f.full && strings.HasPrefix(newpath, "/cache/bucket/") {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOSPC}
+	}
+	return f.memFS.Rename(oldpath, newpath)
+}
+
+func (f *fullFS) Remove(name string) error {
+	if strings.HasPrefix(name, "/cache/bucket/") {
+		f.removals++
+		f.full = false
+	}
+	return f.memFS.Remove(name)
+}
+
+func TestDiskCachedKeyGetterRetriesMoveAfterEvicting(t *testing.T) {
+	mem := newMemFS()
+	fs := &fullFS{memFS: mem}
+	base := &memKeyGetter{fs: mem, content: "sample content"}
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: "/cache", fs: fs, moveRetries: 2}
+	b := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg}, disk: dkg, wake: make(chan struct{}, 1)}
+	dkg.makeRoom = b.makeRoom
+
+	b.get(context.Background(), "bucket", []string{"key1"})
+	fs.full = true
+	result := b.get(context.Background(), "bucket", []string{"key2"})[0]
+	if result.localPath == nil || *result.localPath != "/cache/bucket/key2" {
+		t.Fatalf("Expected key2 to be cached once key1 was evicted, but got %v", result.status)
+	}
+	if content, err := mem.ReadFile(*result.localPath); err != nil || string(content) != "sample content" {
+		t.Logf("Expected key2's download to survive the failed move, but got %q, %v", content, err)
+		t.Fail()
+	}
+	if fs.renames != 3 || fs.removals != 1 || base.called != 2 {
+		t.Logf("Expected one failed and one retried move, one eviction and no new download, but got %v renames, %v removals and %v downloads",
+			fs.renames, fs.removals, base.called)
+		t.Fail()
+	}
+	if b.has("bucket", "key1") {
+		t.Logf("Expected key1 to be evicted to make room")
+		t.Fail()
+	}
+}
+
+func TestDiskCachedKeyGetterGivesUpMoveWithoutRetries(t *testing.T) {
+	mem := newMemFS()
+	fs := &fullFS{memFS: mem, full: true}
+	base := &memKeyGetter{fs: mem, content: "sample content"}
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: "/cache", fs: fs}
+
+	result := dkg.get(context.Background(), "bucket", []string{"key"})[0]
+	if result.localPath != nil || fs.renames != 1 {
+		t.Logf("Expected the move to fail without a retry, but got %v after %v renames", result.status, fs.renames)
+		t.Fail()
+	}
+	if _, err := mem.Stat("/tmp/download-1"); !os.IsNotExist(err) {
+		t.Logf("Expected the download to be removed once the move failed, but got %v", err)
+		t.Fail()
+	}
+}
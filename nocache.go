@@ -0,0 +1,62 @@
+package main
+
+import "context"
+
+// uncachedOnRequest is the status of a key fetched for a no_cache request
+// that wasn't already cached. Like passedThrough, its local_path is an
+// uncached temporary file the client should remove; /object removes it
+// itself once it's been served, as it does for each status passed through.
+const uncachedOnRequest = "no_cache requested, passed through"
+
+type noCacheKey struct{}
+
+// withNoCache has the keys requested under ctx fetched without caching
+// them, for clients that only ever fetch a key once.
+func withNoCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+func noCacheFor(ctx context.Context) bool {
+	noCache, _ := ctx.Value(noCacheKey{}).(bool)
+	return noCache
+}
+
+// A noCacheKeyGetter fetches keys missing from its CachedKeyGetter
+// straight from direct for no_cache requests, so that one-shot traffic
+// neither fills the cache nor evicts what's in it. Keys already cached are
+// served from the cache as usual.
+type noCacheKeyGetter struct {
+	CachedKeyGetter
+	direct KeyGetter
+}
+
+func (n *noCacheKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	if !noCacheFor(ctx) {
+		return n.CachedKeyGetter.get(ctx, bucketName, keyNames)
+	}
+	cached := make([]string, 0, len(keyNames))
+	uncached := make([]string, 0)
+	for _, keyName := range keyNames {
+		if n.has(bucketName, keyName) {
+			cached = append(cached, keyName)
+		} else {
+			uncached = append(uncached, keyName)
+		}
+	}
+	out := make([]getResult, 0, len(keyNames))
+	if len(cached) > 0 {
+		out = append(out, n.CachedKeyGetter.get(ctx, bucketName, cached)...)
+	}
+	if len(uncached) > 0 {
+		if trace.enabled() {
+			trace.event("no_cache", "bucket", bucketName, "keys", len(uncached))
+		}
+		for _, result := range n.direct.get(ctx, bucketName, uncached) {
+			if result.localPath != nil {
+				result.status = uncachedOnRequest
+			}
+			out = append(out, result)
+		}
+	}
+	return out
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNoCacheRequestLeavesTheCacheUnchanged(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	tkg := &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter("sample content")}
+	dkg := &diskCachedKeyGetter{base: tkg, cacheDir: cacheDir}
+	lru := &lruCachedKeyGetter{base: dkg}
+	b := &boundedDiskCachedKeyGetter{lru: lru, disk: dkg, softLimit: 1000, wake: make(chan struct{}, 1)}
+	getter := &EvictingMutableKeyGetter{CachedKeyGetter: &noCacheKeyGetter{CachedKeyGetter: b, direct: tkg}}
+
+	getter.Get(context.Background(), "bucket", []string{"cached"}, getOptions{})
+	size, entries := b.size(), lru.len()
+	results := inRequestOrder([]string{"cached", "oneshot"},
+		getter.Get(context.Background(), "bucket", []string{"cached", "oneshot"}, getOptions{noCache: true}))
+	if results[0].localPath == nil || *results[0].localPath != dkg.mustPathFor("bucket", "cached") {
+		t.Logf("Expected the cached key to be served from the cache, but got %v", results[0].status)
+		t.Fail()
+	}
+	oneshot := results[1]
+	if oneshot.status != uncachedOnRequest || oneshot.localPath == nil {
+		t.Fatalf("Expected the uncached key to be passed through, but got %v", oneshot.status)
+	}
+	defer os.Remove(*oneshot.localPath)
+	if content, err := ioutil.ReadFile(*oneshot.localPath); err != nil || string(content) != "sample content" {
+		t.Logf("Expected the passed through key's content, but got %q, %v", content, err)
+		t.Fail()
+	}
+	if dkg.has("bucket", "oneshot") || lru.has("bucket", "oneshot") {
+		t.Logf("Expected the no_cache key not to be cached")
+		t.Fail()
+	}
+	if b.size() != size || lru.len() != entries {
+		t.Logf("Expected the cache to stay at %v bytes in %v entries, but got %v in %v", size, entries, b.size(), lru.len())
+		t.Fail()
+	}
+	if keyNames := dkg.keysIn("bucket"); !reflect.DeepEqual(keyNames, []string{"cached"}) {
+		t.Logf("Expected only the earlier key on disk, but got %v", keyNames)
+		t.Fail()
+	}
+}
+
+func TestKeyServerRemovesNoCacheObjectsOnceServed(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{
+		CachedKeyGetter: &noCacheKeyGetter{CachedKeyGetter: dkg, direct: base}}}
+	ts := httptest.NewServer(http.HandlerFunc(server.serveObject))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/object?bucket=bucket&key=key&no_cache=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "sample content" {
+		t.Logf("Expected the key's content, but got %q, %v", body, err)
+		t.Fail()
+	}
+	if dkg.has("bucket", "key") {
+		t.Logf("Expected the no_cache key not to be cached")
+		t.Fail()
+	}
+	if downloads, _ := ioutil.ReadDir(base.dir); len(downloads) != 0 {
+		t.Logf("Expected the download to be removed once served, but found %v files", len(downloads))
+		t.Fail()
+	}
+
+	resp, err = http.Get(ts.URL + "/object?bucket=bucket&key=key&no_cache=maybe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Logf("Expected a bad no_cache to be refused, but got %v", resp.Status)
+		t.Fail()
+	}
+}
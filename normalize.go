@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// normalizeKeyName strips keyName's leading slashes and collapses runs of
+// slashes within it, so "/path//key" and "path/key" name the same key.
+// A trailing slash is kept, since S3 folder markers end in one.
+func normalizeKeyName(keyName string) string {
+	keyName = strings.TrimLeft(keyName, "/")
+	if !strings.Contains(keyName, "//") {
+		return keyName
+	}
+	var b strings.Builder
+	for i := 0; i < len(keyName); i++ {
+		if keyName[i] == '/' && i > 0 && keyName[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(keyName[i])
+	}
+	return b.String()
+}
+
+// normalizeKeys normalizes every key name cr refers to, before any of
+// them reach a getter. Results then name keys as normalized. Key names
+// that are nothing but slashes normalize to nothing, and are an error.
+func (cr *CacheRequest) normalizeKeys() error {
+	for i, keyName := range cr.KeyNames {
+		if cr.KeyNames[i] = normalizeKeyName(keyName); cr.KeyNames[i] == "" {
+			return fmt.Errorf("key %q is empty once normalized", keyName)
+		}
+	}
+	if cr.FallbackKey != "" {
+		cr.FallbackKey = normalizeKeyName(cr.FallbackKey)
+	}
+	for i, keyName := range cr.MutableKeys {
+		cr.MutableKeys[i] = normalizeKeyName(keyName)
+	}
+	if len(cr.IfMatch) > 0 {
+		etags := make(map[string]string, len(cr.IfMatch))
+		for keyName, etag := range cr.IfMatch {
+			etags[normalizeKeyName(keyName)] = etag
+		}
+		cr.IfMatch = etags
+	}
+	return nil
+}
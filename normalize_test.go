@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestNormalizeKeyName(t *testing.T) {
+	for keyName, expected := range map[string]string{
+		"path/key":     "path/key",
+		"/path/key":    "path/key",
+		"//path//key":  "path/key",
+		"path///to/":   "path/to/",
+		"/":            "",
+		"no-slashes":   "no-slashes",
+		"a/b//c///d/e": "a/b/c/d/e",
+	} {
+		if normalized := normalizeKeyName(keyName); normalized != expected {
+			t.Logf("Expected %q to normalize to %q, but got %q", keyName, expected, normalized)
+			t.Fail()
+		}
+	}
+}
+
+func TestKeyServerNormalizesKeys(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	disk := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: disk}, normalizeKeys: true}
+	type result struct {
+		KeyName   string  `json:"key_name"`
+		LocalPath *string `json:"local_path"`
+	}
+	request := func(keyName string) []result {
+		rec := httptest.NewRecorder()
+		body := bytes.NewReader([]byte(`{"bucket_name": "bucket", "keynames": ["` + keyName + `"]}`))
+		server.ServeHTTP(rec, httptest.NewRequest("POST", "/", body))
+		var results []result
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("Couldn't decode %q: %v", rec.Body.String(), err)
+		}
+		return results
+	}
+
+	raw := request("/path//key")
+	normalized := request("path/key")
+	if len(raw) != 1 || len(normalized) != 1 || raw[0].LocalPath == nil || normalized[0].LocalPath == nil {
+		t.Fatalf("Expected both requests to succeed, but got %v and %v", raw, normalized)
+	}
+	if *raw[0].LocalPath != *normalized[0].LocalPath || *raw[0].LocalPath != disk.mustPathFor("bucket", "path/key") {
+		t.Logf("Expected both keys to share the cache entry for path/key, but got %v and %v", *raw[0].LocalPath, *normalized[0].LocalPath)
+		t.Fail()
+	}
+	if base.called != 1 {
+		t.Logf("Expected the key to be fetched once, but it was fetched %v times", base.called)
+		t.Fail()
+	}
+}
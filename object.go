@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// What /object does with a download whose client goes away partway.
+const (
+	finishOnDisconnect = "finish"
+	abortOnDisconnect  = "abort"
+)
+
+var disconnectPolicies = []string{finishOnDisconnect, abortOnDisconnect}
+
+type teeKey struct{}
+
+type tee struct {
+	keyName string
+	w       io.Writer
+}
+
+// withTee has a download of keyName under ctx also write what it reads to
+// w as it goes, rather than only to its temp file.
+func withTee(ctx context.Context, keyName string, w io.Writer) context.Context {
+	return context.WithValue(ctx, teeKey{}, tee{keyName, w})
+}
+
+// teeFor is where a download of keyName under ctx should copy its bytes,
+// or nil if nowhere.
+func teeFor(ctx context.Context, keyName string) io.Writer {
+	if t, ok := ctx.Value(teeKey{}).(tee); ok && t.keyName == keyName {
+		return t.w
+	}
+	return nil
+}
+
+// servedBytesTrailer is the trailer /object reports how many bytes of the
+// key's content reached the client in, which a range or a disconnect
+// makes fewer than the key's size. It's only sent to clients that say
+// they accept trailers, with TE: trailers, since it takes a chunked
+// response without a Content-Length.
+const servedBytesTrailer = "X-Served-Bytes"
+
+// acceptsTrailers reports whether r's client said it reads trailers.
+func acceptsTrailers(r *http.Request) bool {
+	for _, te := range r.Header.Values("TE") {
+		for _, coding := range strings.Split(te, ",") {
+			if strings.EqualFold(strings.TrimSpace(coding), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A clientWriter passes a download on to a client as it lands. Once the
+// client goes away, or its handler stops it, it drops the rest rather than
+// failing the download, so the key is cached all the same.
+type clientWriter struct {
+	w       http.ResponseWriter
+	trailer bool
+	started bool
+	gone    bool
+	written int64
+	sync.Mutex
+}
+
+// stop drops whatever the download writes from now on, since a download
+// other requests are waiting on can outlast the handler that started it.
+func (c *clientWriter) stop() {
+	c.Lock()
+	defer c.Unlock()
+	c.gone = true
+}
+
+func (c *clientWriter) Write(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.gone {
+		return len(p), nil
+	}
+	if !c.started {
+		c.w.Header().Set("Content-Type", "application/octet-stream")
+		if c.trailer {
+			c.w.Header().Set("Trailer", servedBytesTrailer)
+		}
+		c.started = true
+	}
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	if err != nil {
+		c.gone = true
+		return len(p), nil
+	}
+	if flusher, ok := c.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return len(p), nil
+}
+
+// A countingWriter counts the bytes of a response's body that reach the
+// client. With trailer set, it declares servedBytesTrailer for them,
+// dropping the Content-Length so the response is chunked.
+type countingWriter struct {
+	http.ResponseWriter
+	trailer bool
+	written int64
+}
+
+func (c *countingWriter) WriteHeader(code int) {
+	if c.trailer {
+		c.Header().Del("Content-Length")
+		c.Header().Set("Trailer", servedBytesTrailer)
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// objectPath reads the bucket and key out of an /object/bucket/key path.
+// The key is taken from the path as it was escaped, so a key with ?, #, %
+// or spaces in it, each percent-encoded, comes back exactly, as does one
+// with an encoded slash.
+func objectPath(u *url.URL) (string, string, error) {
+	escaped := strings.TrimPrefix(u.EscapedPath(), "/object/")
+	i := strings.Index(escaped, "/")
+	if i < 0 {
+		return "", "", fmt.Errorf("expected /object/bucket/key")
+	}
+	bucketName, err := url.PathUnescape(escaped[:i])
+	if err != nil {
+		return "", "", err
+	}
+	keyName, err := url.PathUnescape(escaped[i+1:])
+	if err != nil {
+		return "", "", err
+	}
+	return bucketName, keyName, nil
+}
+
+// serveObject serves GET /object?bucket=...&key=..., or GET
+// /object/bucket/key, with the content of the key, fetching it through the
+// cache. A miss is streamed to the client while it downloads, rather than
+// once it's cached; anything else, such as a hit or a key another request
+// was already downloading, is served from its cached file. So is a miss
+// asked for with a Range, since a stream can only send the whole key.
+// Since a streamed key's headers go out with its first bytes, a download
+// failing partway cuts the response short. If the client disconnects
+// mid-download, the download is finished and cached unless onDisconnect
+// is abort. Either way, the bytes that reached the client are counted in
+// stats, and reported in servedBytesTrailer if it's asked for. With
+// no_cache=true, a miss isn't cached, and its download is removed once
+// served.
+func (s *keyServer) serveObject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "object only supports GET", 405)
+		return
+	}
+	bucketName, keyName := r.URL.Query().Get("bucket"), r.URL.Query().Get("key")
+	if strings.HasPrefix(r.URL.Path, "/object/") {
+		var err error
+		if bucketName, keyName, err = objectPath(r.URL); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	if s.normalizeKeys {
+		keyName = normalizeKeyName(keyName)
+	}
+	if bucketName == "" || keyName == "" {
+		http.Error(w, "a bucket and key are required", 400)
+		return
+	}
+	if err := checkNames(bucketName, keyName); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !s.allowedBuckets.allows(bucketName) {
+		http.Error(w, fmt.Sprintf("bucket %v isn't allowed", bucketName), 403)
+		return
+	}
+	var opts getOptions
+	if noCache := r.URL.Query().Get("no_cache"); noCache != "" {
+		var err error
+		if opts.noCache, err = strconv.ParseBool(noCache); err != nil {
+			http.Error(w, fmt.Sprintf("no_cache must be true or false, not %q", noCache), 400)
+			return
+		}
+	}
+	if err := s.admit(); err != nil {
+		s.reject(w, err)
+		return
+	}
+	defer s.release()
+	ctx := r.Context()
+	if s.onDisconnect != abortOnDisconnect {
+		ctx = context.WithoutCancel(ctx)
+	}
+	client := &clientWriter{w: w, trailer: acceptsTrailers(r)}
+	if r.Header.Get("Range") == "" {
+		ctx = withTee(ctx, keyName, client)
+	}
+	results := s.MutableKeyGetter.Get(ctx, bucketName, []string{keyName}, opts)
+	client.stop()
+	s.accessLog.record(r, "", results)
+	s.history.record("", results)
+	result := results[0]
+	if passedThroughFile(result) {
+		defer os.Remove(*result.localPath)
+	}
+	if client.started {
+		w.Header().Set(servedBytesTrailer, strconv.FormatInt(client.written, 10))
+		s.stats.served(client.written)
+		if result.localPath == nil {
+			log.Printf("Streaming %v/%v failed partway: %v", bucketName, keyName, result.status)
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+	if result.localPath == nil {
+		code := 502
+		if isMissing(result) {
+			code = 404
+		}
+		http.Error(w, result.status, code)
+		return
+	}
+	f, err := os.Open(*result.localPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	counted := &countingWriter{ResponseWriter: w, trailer: acceptsTrailers(r)}
+	http.ServeContent(counted, r, "", info.ModTime(), f)
+	w.Header().Set(servedBytesTrailer, strconv.FormatInt(counted.written, 10))
+	s.stats.served(counted.written)
+}
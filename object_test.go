@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+// A gatedReadCloser reads first, then waits for gate before reading rest.
+type gatedReadCloser struct {
+	first, rest []byte
+	gate        chan struct{}
+}
+
+func (g *gatedReadCloser) Read(p []byte) (int, error) {
+	if len(g.first) > 0 {
+		n := copy(p, g.first)
+		g.first = g.first[n:]
+		return n, nil
+	}
+	if len(g.rest) > 0 {
+		<-g.gate
+		n := copy(p, g.rest)
+		g.rest = g.rest[n:]
+		return n, nil
+	}
+	return 0, io.EOF
+}
+
+func (g *gatedReadCloser) Close() error {
+	return nil
+}
+
+type gatedKeyReaderGetter struct {
+	first, rest string
+	gate        chan struct{}
+}
+
+func (g *gatedKeyReaderGetter) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
+	return &gatedReadCloser{[]byte(g.first), []byte(g.rest), g.gate}, nil
+}
+
+func TestKeyServerStreamsObjectMisses(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	origin := &gatedKeyReaderGetter{first: "streamed ", rest: "content", gate: make(chan struct{})}
+	disk := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: origin}, cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: disk}}
+	ts := httptest.NewServer(http.HandlerFunc(server.serveObject))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/object?bucket=bucket&key=key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	first := make([]byte, len("streamed "))
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "streamed " {
+		t.Fatalf("Expected the start of the key before its download finished, but got %q, %v", first, err)
+	}
+	close(origin.gate)
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(rest) != "content" {
+		t.Logf("Expected the rest of the key, but got %q, %v", rest, err)
+		t.Fail()
+	}
+	if !disk.has("bucket", "key") {
+		t.Fatalf("Expected the streamed key to be cached")
+	}
+
+	resp, err = http.Get(ts.URL + "/object?bucket=bucket&key=key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	hit, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(hit) != "streamed content" || resp.Header.Get("Content-Length") != "16" {
+		t.Logf("Expected the cached key to be served from disk, but got %q, %v", hit, err)
+		t.Fail()
+	}
+}
+
+func TestKeyServerServesRangesOfObjectMisses(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	disk := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter("sample content")}, cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: disk}}
+	ts := httptest.NewServer(http.HandlerFunc(server.serveObject))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/object?bucket=bucket&key=key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=2-5")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != 206 || string(body) != "mple" {
+		t.Logf("Expected just the range of a missed key, but got %v: %q, %v", resp.StatusCode, body, err)
+		t.Fail()
+	}
+	if !disk.has("bucket", "key") {
+		t.Logf("Expected the whole key to be cached all the same")
+		t.Fail()
+	}
+}
+
+func TestKeyServerReportsServedBytes(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	stats := &cacheStats{}
+	disk := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: disk}, stats: stats}
+	ts := httptest.NewServer(http.HandlerFunc(server.serveObject))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/object?bucket=bucket&key=key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=2-5")
+	req.Header.Set("TE", "trailers")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "mple" {
+		t.Fatalf("Expected the range of the key, but got %q, %v", body, err)
+	}
+	if served := resp.Trailer.Get(servedBytesTrailer); served != "4" {
+		t.Logf("Expected the 4 bytes of the range to be reported served, but got %q", served)
+		t.Fail()
+	}
+	if total, _ := stats.snapshot(); total.ServedBytes != 4 {
+		t.Logf("Expected the 4 bytes served to be counted, but got %v", total.ServedBytes)
+		t.Fail()
+	}
+}
+
+func TestKeyServerServesObjectsWithAwkwardKeys(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	keyName := "dir/what? 100%#1"
+	disk := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: mapKeyReaderGetter{"bucket/" + keyName: "awkward content"}},
+		cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: disk}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/object", server.serveObject)
+	mux.HandleFunc("/object/", server.serveObject)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, path := range []string{
+		"/object/bucket/" + (&url.URL{Path: keyName}).EscapedPath(),
+		"/object/bucket/dir%2Fwhat%3F%20100%25%231",
+		"/object?" + url.Values{"bucket": {"bucket"}, "key": {keyName}}.Encode(),
+	} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != 200 || string(content) != "awkward content" {
+			t.Logf("Expected %v to resolve to %q, but got %v: %q, %v", path, keyName, resp.Status, content, err)
+			t.Fail()
+		}
+	}
+	if _, err := os.Stat(path.Join(cacheDir, "bucket", keyName)); err != nil {
+		t.Logf("Expected %q to be cached under its own name, but got %v", keyName, err)
+		t.Fail()
+	}
+}
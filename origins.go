@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// parseSecondaryOrigins parses chains like "primary:secondary:tertiary,
+// other:fallback" as the buckets to try, in order, for a key a bucket
+// doesn't have.
+func parseSecondaryOrigins(spec string) (map[string][]string, error) {
+	origins := make(map[string][]string)
+	for _, chain := range strings.Split(spec, ",") {
+		buckets := strings.Split(chain, ":")
+		if len(buckets) < 2 {
+			return nil, fmt.Errorf("secondary origin %q isn't bucket:secondary[:...]", chain)
+		}
+		for _, bucketName := range buckets {
+			if bucketName == "" {
+				return nil, fmt.Errorf("secondary origin %q has an empty bucket name", chain)
+			}
+		}
+		if _, had := origins[buckets[0]]; had {
+			return nil, fmt.Errorf("bucket %v has more than one secondary origin chain", buckets[0])
+		}
+		origins[buckets[0]] = buckets[1:]
+	}
+	return origins, nil
+}
+
+// openFromOrigins opens keyName in bucketName, or failing that in each of
+// bucketName's secondary origins in turn for as long as it isn't found.
+func (t *tempKeyGetter) openFromOrigins(ctx context.Context, bucketName, keyName string) (io.ReadCloser, error) {
+	rc, err := t.openKey(ctx, bucketName, keyName)
+	for i, secondary := range t.secondaryOrigins[bucketName] {
+		if err == nil || !isNotFound(err) {
+			break
+		}
+		if trace.enabled() {
+			trace.event("secondary_origin", "bucket", bucketName, "key", keyName, "origin", secondary)
+		}
+		spanFrom(ctx).set("download.retries", i+1)
+		rc, err = t.openKey(ctx, secondary, keyName)
+	}
+	return rc, err
+}
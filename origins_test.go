@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseSecondaryOrigins(t *testing.T) {
+	origins, err := parseSecondaryOrigins("primary:secondary:tertiary,other:fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{"primary": {"secondary", "tertiary"}, "other": {"fallback"}}
+	if !reflect.DeepEqual(origins, expected) {
+		t.Logf("Expected %v, but got %v", expected, origins)
+		t.Fail()
+	}
+	for _, bad := range []string{"primary", "primary:", "a:b,a:c"} {
+		if _, err := parseSecondaryOrigins(bad); err == nil {
+			t.Logf("Expected %q to be rejected", bad)
+			t.Fail()
+		}
+	}
+}
+
+func TestTempKeyGetterSecondaryOrigins(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	origin := mapKeyReaderGetter{
+		"primary/both":    "from primary",
+		"secondary/both":  "from secondary",
+		"secondary/moved": "moved content",
+		"tertiary/old":    "old content",
+	}
+	disk := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: origin,
+		secondaryOrigins: map[string][]string{"primary": {"secondary", "tertiary"}}}, cacheDir: cacheDir}
+
+	results := disk.get(context.Background(), "primary", []string{"both", "moved", "old", "missing"})
+	for i, expected := range []string{"from primary", "moved content", "old content"} {
+		if results[i].localPath == nil {
+			t.Fatalf("Expected %v to be fetched, but got %v", results[i].keyName, results[i].status)
+		}
+		content, err := ioutil.ReadFile(*results[i].localPath)
+		if err != nil || string(content) != expected {
+			t.Logf("Expected %q for %v, but got %q, %v", expected, results[i].keyName, content, err)
+			t.Fail()
+		}
+		if *results[i].localPath != disk.mustPathFor("primary", results[i].keyName) {
+			t.Logf("Expected %v to be cached as primary's, but it's at %v", results[i].keyName, *results[i].localPath)
+			t.Fail()
+		}
+	}
+	if !isMissing(results[3]) {
+		t.Logf("Expected a key no origin has to be missing, but got %v", results[3].status)
+		t.Fail()
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A spanContext identifies a span within a trace, as the W3C traceparent
+// header carries it, in hex.
+type spanContext struct {
+	traceID, spanID string
+}
+
+// A span is one timed operation of a distributed trace, in the shape
+// OpenTelemetry exports them: a span per cache request, and a child span
+// per key it served.
+type span struct {
+	spanContext
+	parentID   string
+	name       string
+	server     bool
+	start, end time.Time
+	attributes map[string]interface{}
+	exporter   spanExporter
+	sync.Mutex
+}
+
+// A spanExporter is handed each span as it finishes.
+type spanExporter interface {
+	export(*span)
+}
+
+// A spanTracer starts spans and hands them to its exporter once finished.
+// Until enabled it starts none; the nil *span it returns instead is valid
+// and records nothing, so leaving the calls in is cheap.
+type spanTracer struct {
+	exporter atomic.Value
+}
+
+var spans spanTracer
+
+// exporterBox lets spanTracer keep exporters of any type in its
+// atomic.Value, which only holds one concrete type.
+type exporterBox struct {
+	spanExporter
+}
+
+func (t *spanTracer) enable(e spanExporter) {
+	t.exporter.Store(exporterBox{e})
+}
+
+func (t *spanTracer) exporterFor() spanExporter {
+	box, _ := t.exporter.Load().(exporterBox)
+	return box.spanExporter
+}
+
+type spanKey struct{}
+
+// spanFrom is the span in progress under ctx, or nil.
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+type remoteParentKey struct{}
+
+// start starts a span named name, the child of the one in progress under
+// ctx or of the remote parent a request carried, if either, and returns
+// it with a context under which it's in progress.
+func (t *spanTracer) start(ctx context.Context, name string) (context.Context, *span) {
+	exporter := t.exporterFor()
+	if exporter == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, start: time.Now(), attributes: make(map[string]interface{}), exporter: exporter}
+	s.spanID = randomHex(8)
+	if parent := spanFrom(ctx); parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else if remote, ok := ctx.Value(remoteParentKey{}).(spanContext); ok {
+		s.traceID, s.parentID = remote.traceID, remote.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startRequest starts the span serving r, continuing the trace in its
+// traceparent header if it has a valid one.
+func (t *spanTracer) startRequest(r *http.Request, name string) (context.Context, *span) {
+	ctx := r.Context()
+	if remote, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		ctx = context.WithValue(ctx, remoteParentKey{}, remote)
+	}
+	ctx, s := t.start(ctx, name)
+	if s != nil {
+		s.server = true
+	}
+	return ctx, s
+}
+
+// parseTraceparent reads a W3C traceparent header, version-traceid-
+// parentid-flags, rejecting the all-zero IDs the spec calls invalid.
+func parseTraceparent(header string) (spanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return spanContext{}, false
+	}
+	for _, id := range parts[1:3] {
+		if _, err := hex.DecodeString(id); err != nil || strings.Trim(id, "0") == "" {
+			return spanContext{}, false
+		}
+	}
+	return spanContext{traceID: strings.ToLower(parts[1]), spanID: strings.ToLower(parts[2])}, true
+}
+
+func randomHex(n int) string {
+	raw := make([]byte, n)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// set records an attribute of s.
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.attributes[key] = value
+}
+
+// finish ends s and exports it.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.end = time.Now()
+	s.Unlock()
+	s.exporter.export(s)
+}
+
+// otlpMaxPending is how many finished spans an otlpExporter keeps between
+// flushes; past it, spans are dropped rather than let memory grow while
+// the collector is unreachable.
+const otlpMaxPending = 10000
+
+// An otlpExporter sends spans in batches to an OpenTelemetry collector,
+// as OTLP/HTTP JSON posted to endpoint's /v1/traces.
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+	pending  []*span
+	dropped  int
+	sync.Mutex
+}
+
+func (o *otlpExporter) export(s *span) {
+	o.Lock()
+	defer o.Unlock()
+	if len(o.pending) >= otlpMaxPending {
+		o.dropped += 1
+		return
+	}
+	o.pending = append(o.pending, s)
+}
+
+// flush sends the spans finished since the last flush.
+func (o *otlpExporter) flush() error {
+	o.Lock()
+	batch, dropped := o.pending, o.dropped
+	o.pending, o.dropped = nil, 0
+	o.Unlock()
+	if dropped > 0 {
+		log.Printf("Dropped %v spans while the collector at %v was behind", dropped, o.endpoint)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(otlpRequest(batch))
+	if err != nil {
+		return err
+	}
+	client := o.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(strings.TrimSuffix(o.endpoint, "/")+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector at %v answered %v", o.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// run flushes every interval, forever.
+func (o *otlpExporter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := o.flush(); err != nil {
+			log.Printf("Couldn't export spans: %v", err)
+		}
+	}
+}
+
+// otlpRequest lays batch out as an OTLP ExportTraceServiceRequest.
+func otlpRequest(batch []*span) map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		s.Lock()
+		kind := 1 // internal
+		if s.server {
+			kind = 2
+		}
+		attributes := make([]map[string]interface{}, 0, len(s.attributes))
+		for key, value := range s.attributes {
+			attributes = append(attributes, map[string]interface{}{"key": key, "value": otlpValue(value)})
+		}
+		encoded := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attributes,
+		}
+		if s.parentID != "" {
+			encoded["parentSpanId"] = s.parentID
+		}
+		s.Unlock()
+		out = append(out, encoded)
+	}
+	return map[string]interface{}{"resourceSpans": []interface{}{map[string]interface{}{
+		"resource": map[string]interface{}{"attributes": []interface{}{
+			map[string]interface{}{"key": "service.name", "value": otlpValue("s3_cache")},
+		}},
+		"scopeSpans": []interface{}{map[string]interface{}{
+			"scope": map[string]interface{}{"name": "s3_cache"},
+			"spans": out,
+		}},
+	}}}
+}
+
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+// A memExporter keeps the spans it's handed.
+type memExporter struct {
+	spans []*span
+	sync.Mutex
+}
+
+func (m *memExporter) export(s *span) {
+	m.Lock()
+	defer m.Unlock()
+	m.spans = append(m.spans, s)
+}
+
+func (m *memExporter) named(name string) []*span {
+	m.Lock()
+	defer m.Unlock()
+	var out []*span
+	for _, s := range m.spans {
+		if s.name == name {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func TestKeyServerSpans(t *testing.T) {
+	exporter := &memExporter{}
+	spans.enable(exporter)
+	defer spans.enable(nil)
+	readers := mapKeyReaderGetter{"bucket/cached": "cached", "bucket/missing": "missing!"}
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: readers}, cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: dkg}}
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", bytes.NewReader([]byte(`{"bucket_name": "bucket", "keynames": ["cached"]}`))))
+	exporter.spans = nil
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(`{"bucket_name": "bucket", "keynames": ["cached", "missing"]}`)))
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	server.ServeHTTP(httptest.NewRecorder(), req)
+
+	requests := exporter.named("cache_request")
+	if len(requests) != 1 {
+		t.Fatalf("Expected a span for the request, but got %v", len(requests))
+	}
+	request := requests[0]
+	if request.traceID != traceID || request.parentID != parentID {
+		t.Logf("Expected the request's span to continue its trace, but got trace %v, parent %v", request.traceID, request.parentID)
+		t.Fail()
+	}
+	keys := exporter.named("get_key")
+	if len(keys) != 2 {
+		t.Fatalf("Expected a span per key, but got %v", len(keys))
+	}
+	byKey := make(map[string]*span)
+	for _, s := range keys {
+		if s.traceID != traceID || s.parentID != request.spanID {
+			t.Logf("Expected %v's span to be a child of the request's, but got trace %v, parent %v", s.attributes["aws.s3.key"], s.traceID, s.parentID)
+			t.Fail()
+		}
+		if s.attributes["aws.s3.bucket"] != "bucket" {
+			t.Logf("Expected the bucket on each key's span, but got %v", s.attributes)
+			t.Fail()
+		}
+		byKey[s.attributes["aws.s3.key"].(string)] = s
+	}
+	if byKey["cached"] == nil || byKey["cached"].attributes["cache.hit"] != true {
+		t.Logf("Expected a hit for the cached key, but got %v", byKey["cached"])
+		t.Fail()
+	}
+	if missed := byKey["missing"]; missed == nil || missed.attributes["cache.hit"] != false || missed.attributes["download.bytes"] != int64(8) {
+		t.Logf("Expected a miss downloading 8 bytes for the missing key, but got %v", missed)
+		t.Fail()
+	}
+}
+
+func TestOTLPExporterFlush(t *testing.T) {
+	var posted map[string]interface{}
+	var path string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&posted)
+	}))
+	defer collector.Close()
+	exporter := &otlpExporter{endpoint: collector.URL}
+	exporter.export(&span{spanContext: spanContext{traceID: "4bf92f3577b34da6a3ce929d0e0e4736", spanID: "00f067aa0ba902b7"},
+		name: "get_key", attributes: map[string]interface{}{"download.bytes": int64(8)}})
+	if err := exporter.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v1/traces" {
+		t.Logf("Expected spans to be posted to /v1/traces, but they went to %v", path)
+		t.Fail()
+	}
+	scopeSpans := posted["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})
+	exported := scopeSpans[0].(map[string]interface{})["spans"].([]interface{})
+	if len(exported) != 1 || exported[0].(map[string]interface{})["name"] != "get_key" {
+		t.Logf("Expected the span to be exported, but got %v", posted)
+		t.Fail()
+	}
+	if len(exporter.pending) != 0 {
+		t.Logf("Expected a flush to send everything pending, but %v spans are left", len(exporter.pending))
+		t.Fail()
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A sizePartition takes cached objects of up to maxObjectBytes, within its
+// own byte budget. A maxObjectBytes of 0 takes objects of any size.
+type sizePartition struct {
+	maxObjectBytes int64
+	*boundedDiskCachedKeyGetter
+}
+
+// A partitionedKeyGetter splits a disk cache into size classes, each with
+// its own budget and eviction, so a burst of large objects can't evict
+// the small ones. New objects go to the first partition that takes their
+// size, once they've been downloaded and their size is known.
+type partitionedKeyGetter struct {
+	disk       CachedKeyGetter
+	partitions []sizePartition
+}
+
+// parseSizePartitions parses partitions like "1048576:1073741824,:1e10"
+// as each class's largest object and budget in bytes, the last class
+// leaving out its largest object to take everything else.
+func parseSizePartitions(spec string) ([]sizePartition, error) {
+	var partitions []sizePartition
+	classes := strings.Split(spec, ",")
+	for i, class := range classes {
+		parts := strings.Split(class, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("size partition %q isn't largest-object:budget", class)
+		}
+		var maxObjectBytes int64
+		if parts[0] != "" {
+			var err error
+			if maxObjectBytes, err = strconv.ParseInt(parts[0], 10, 64); err != nil || maxObjectBytes <= 0 {
+				return nil, fmt.Errorf("size partition %q has a bad largest object size", class)
+			}
+		} else if i != len(classes)-1 {
+			return nil, fmt.Errorf("only the last size partition can take objects of any size")
+		}
+		budget, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || budget <= 0 {
+			return nil, fmt.Errorf("size partition %q has a bad budget", class)
+		}
+		partitions = append(partitions, sizePartition{maxObjectBytes: maxObjectBytes,
+			boundedDiskCachedKeyGetter: &boundedDiskCachedKeyGetter{softLimit: budget, hardLimit: budget}})
+	}
+	return partitions, nil
+}
+
+func (p *partitionedKeyGetter) partitionFor(size int64) *sizePartition {
+	for i := range p.partitions {
+		if p.partitions[i].maxObjectBytes == 0 || size <= p.partitions[i].maxObjectBytes {
+			return &p.partitions[i]
+		}
+	}
+	return nil
+}
+
+// holding returns the partition key is cached in, if any.
+func (p *partitionedKeyGetter) holding(bucketName, keyName string) *sizePartition {
+	for i := range p.partitions {
+		if p.partitions[i].lru.has(bucketName, keyName) {
+			return &p.partitions[i]
+		}
+	}
+	return nil
+}
+
+func (p *partitionedKeyGetter) has(bucketName, keyName string) bool {
+	return p.disk.has(bucketName, keyName)
+}
+
+func (p *partitionedKeyGetter) remove(bucketName, keyName string) bool {
+	if partition := p.holding(bucketName, keyName); partition != nil {
+		return partition.remove(bucketName, keyName)
+	}
+	return p.disk.remove(bucketName, keyName)
+}
+
+func (p *partitionedKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	out := make([]getResult, 0, len(keyNames))
+	missing := make([]string, 0, len(keyNames))
+	for _, keyName := range keyNames {
+		if partition := p.holding(bucketName, keyName); partition != nil {
+			out = append(out, partition.get(ctx, bucketName, []string{keyName})...)
+		} else {
+			missing = append(missing, keyName)
+		}
+	}
+	if len(missing) == 0 {
+		return out
+	}
+	for _, result := range p.disk.get(ctx, bucketName, missing) {
+		out = append(out, result)
+		if result.localPath == nil || passedThroughFile(result) {
+			continue
+		}
+		if partition := p.partitionFor(result.bytesTransferred); partition != nil {
+			partition.lru.admit(result)
+			partition.account(result.bytesTransferred)
+		}
+	}
+	return out
+}
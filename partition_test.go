@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPartitionedKeyGetterKeepsSmallObjectsFromLargeChurn(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	objects := mapKeyReaderGetter{"bucket/small1": "tiny", "bucket/small2": "tiny"}
+	for i := 0; i < 5; i++ {
+		objects[fmt.Sprintf("bucket/large%v", i)] = strings.Repeat("x", 100)
+	}
+	dkg := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: objects}, cacheDir: cacheDir}
+	partitions, err := parseSizePartitions("10:8,:200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, partition := range partitions {
+		partition.lru = &lruCachedKeyGetter{base: dkg}
+		partition.disk = dkg
+		partition.wake = make(chan struct{}, 1)
+	}
+	p := &partitionedKeyGetter{disk: dkg, partitions: partitions}
+
+	p.get(context.Background(), "bucket", []string{"small1", "small2"})
+	for i := 0; i < 5; i++ {
+		p.get(context.Background(), "bucket", []string{fmt.Sprintf("large%v", i)})
+	}
+	if !p.has("bucket", "small1") || !p.has("bucket", "small2") {
+		t.Logf("Expected large-object churn to leave the small objects cached")
+		t.Fail()
+	}
+	if partitions[0].size() != 8 || partitions[1].size() > 200 {
+		t.Logf("Expected each partition within its budget, but had %v and %v", partitions[0].size(), partitions[1].size())
+		t.Fail()
+	}
+	if p.has("bucket", "large0") || !p.has("bucket", "large4") {
+		t.Logf("Expected the oldest large objects to be the ones evicted")
+		t.Fail()
+	}
+	if _, err := parseSizePartitions(":10,5:10"); err == nil {
+		t.Logf("Expected an unbounded partition before the last to be rejected")
+		t.Fail()
+	}
+}
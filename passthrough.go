@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+)
+
+// passedThrough is the status of a key too large to ever fit in the cache.
+// Its local_path is an uncached temporary file the client should remove.
+const passedThrough = "too large to cache, passed through"
+
+// passedThroughFile reports whether result's local_path is a temporary
+// file rather than a cached one, as it is for every status passed through,
+// so that whatever serves it for the client can remove it afterwards.
+func passedThroughFile(result getResult) bool {
+	switch result.status {
+	case passedThrough, notCached, uncachedOnRequest:
+		return result.localPath != nil
+	}
+	return false
+}
+
+type keySizer interface {
+	keySize(bucketName, keyName string) (int64, error)
+}
+
+func (s *s3Conn) keySize(bucketName, keyName string) (int64, error) {
+	key, err := keyFor(s.connFor(bucketName), bucketName, keyName)
+	if err != nil && s.relocate(bucketName, err) {
+		key, err = keyFor(s.connFor(bucketName), bucketName, keyName)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return key.Size, nil
+}
+
+// A passthroughKeyGetter marks the downloads of its KeyGetter larger than
+// bounded's hard limit as passedThrough, going by the size of each GET's
+// body, so the disk cache above it leaves them uncached. Caching one would
+// evict everything else in the cache, itself included, on every request.
+// The limit is read on every get, so a change through /config applies at
+// once.
+type passthroughKeyGetter struct {
+	KeyGetter
+	bounded *boundedDiskCachedKeyGetter
+}
+
+func (p *passthroughKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	results := p.KeyGetter.get(ctx, bucketName, keyNames)
+	_, hard, _ := p.bounded.limits()
+	for i, result := range results {
+		if hard > 0 && result.localPath != nil && result.bytesTransferred > hard {
+			if trace.enabled() {
+				trace.event("passthrough", "bucket", bucketName, "key", result.keyName, "bytes", result.bytesTransferred)
+			}
+			results[i].status = passedThrough
+		}
+	}
+	return results
+}
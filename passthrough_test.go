@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A byNameKeyGetter gets each key from the getter named by its key name.
+type byNameKeyGetter map[string]KeyGetter
+
+func (b byNameKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	out := make([]getResult, 0, len(keyNames))
+	for _, keyName := range keyNames {
+		out = append(out, b[keyName].get(ctx, bucketName, []string{keyName})...)
+	}
+	return out
+}
+
+// newPassthroughGetter bounds a disk cache under cacheDir to limit bytes,
+// passing through keys named huge, which are larger than that.
+func newPassthroughGetter(cacheDir string, limit int64) (*boundedDiskCachedKeyGetter, *mockKeyGetter, *mockKeyGetter) {
+	small := newMockKeyGetter("sample content")
+	huge := newMockKeyGetter(strings.Repeat("huge content ", 10))
+	dkg := &diskCachedKeyGetter{cacheDir: cacheDir}
+	bounded := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg}, disk: dkg,
+		softLimit: limit, hardLimit: limit, wake: make(chan struct{}, 1)}
+	dkg.base = &passthroughKeyGetter{KeyGetter: byNameKeyGetter{"small": small, "huge": huge}, bounded: bounded}
+	return bounded, small, huge
+}
+
+func TestPassthroughKeyGetterSkipsTheCacheForOversizedKeys(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	bounded, small, huge := newPassthroughGetter(cacheDir, 100)
+	defer os.RemoveAll(small.dir)
+	defer os.RemoveAll(huge.dir)
+
+	bounded.get(context.Background(), "bucket", []string{"small"})
+	results := bounded.get(context.Background(), "bucket", []string{"huge"})
+	if len(results) != 1 || results[0].status != passedThrough || results[0].localPath == nil {
+		t.Fatalf("Expected the huge key to be passed through, but got %v", results)
+	}
+	if bounded.has("bucket", "huge") || bounded.lru.has("bucket", "huge") {
+		t.Logf("Expected the huge key not to be cached")
+		t.Fail()
+	}
+	if !bounded.has("bucket", "small") || bounded.size() != int64(len("sample content")) {
+		t.Logf("Expected only the small key to stay cached and counted, but the cache holds %v bytes", bounded.size())
+		t.Fail()
+	}
+
+	// raising the limit, as /config does, applies to the next get
+	bounded.setLimits(1000, 1000, 0)
+	results = bounded.get(context.Background(), "bucket", []string{"huge"})
+	if len(results) != 1 || results[0].status == passedThrough || !bounded.has("bucket", "huge") {
+		t.Logf("Expected the huge key cached under the raised limit, but got %v", results)
+		t.Fail()
+	}
+}
+
+func TestPassedThroughFilesAreRemovedOnceServed(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	bounded, small, direct := newPassthroughGetter(cacheDir, 100)
+	defer os.RemoveAll(small.dir)
+	defer os.RemoveAll(direct.dir)
+	getter := &EvictingMutableKeyGetter{CachedKeyGetter: bounded}
+	server := &keyServer{MutableKeyGetter: getter}
+	leftBehind := func(servedBy string) {
+		if infos, _ := ioutil.ReadDir(direct.dir); len(infos) != 0 {
+			t.Logf("Expected %v to remove the passed through file, but %v were left", servedBy, len(infos))
+			t.Fail()
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	server.serveObject(rec, httptest.NewRequest("GET", "/object?bucket=bucket&key=huge", nil))
+	if rec.Code != 200 || rec.Body.String() != direct.content {
+		t.Fatalf("Expected the huge key to be served, but got %v: %v", rec.Code, rec.Body)
+	}
+	leftBehind("/object")
+	rec = httptest.NewRecorder()
+	server.serveZip(rec, httptest.NewRequest("POST", "/zip", strings.NewReader(`{"bucket_name": "bucket", "keynames": ["huge"]}`)))
+	if rec.Code != 200 {
+		t.Fatalf("Expected the huge key to be zipped, but got %v: %v", rec.Code, rec.Body)
+	}
+	leftBehind("/zip")
+	history := &accessHistory{counts: map[string]*keyFrequency{
+		flatLRUKey("bucket", "huge"): {BucketName: "bucket", KeyName: "huge", Count: 1}}}
+	if warmed, failed := history.warm(context.Background(), getter, nil, 0, 0); warmed != 0 || failed != 1 {
+		t.Logf("Expected a passed through key not to count as warmed, but warmed %v and failed %v", warmed, failed)
+		t.Fail()
+	}
+	leftBehind("the history warm-up")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+)
+
+type keyLister interface {
+	listKeys(bucketName, prefix string, max int) ([]string, error)
+}
+
+func (s *s3Conn) listKeys(bucketName, prefix string, max int) ([]string, error) {
+	listResp, err := s.Bucket(bucketName).List(prefix, "/", "", max)
+	if err != nil {
+		return nil, err
+	}
+	keyNames := make([]string, 0, len(listResp.Contents))
+	for _, key := range listResp.Contents {
+		keyNames = append(keyNames, key.Key)
+	}
+	return keyNames, nil
+}
+
+// prefetchesAtOnce caps how many prefixes a prefetchingKeyGetter warms at
+// once, across every request.
+const prefetchesAtOnce = 4
+
+// A prefetchingKeyGetter warms the siblings of any key that misses, on the
+// theory that keys in the same "directory" tend to be requested together.
+// Warming happens in the background and never delays the triggering get.
+// A miss doesn't warm its prefix if that prefix is already being warmed,
+// or if prefetchesAtOnce prefixes are, so a burst of misses can't multiply
+// S3 traffic without limit.
+type prefetchingKeyGetter struct {
+	CachedKeyGetter
+	lister  keyLister
+	maxKeys int
+	// prefixes are the prefixes being warmed, by flatLRUKey
+	prefixes map[string]bool
+	warming  sync.WaitGroup
+	sync.Mutex
+}
+
+func siblingPrefix(keyName string) string {
+	return keyName[:strings.LastIndex(keyName, "/")+1]
+}
+
+func (p *prefetchingKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	requested := make(map[string]bool, len(keyNames))
+	prefixes := make(map[string]bool)
+	for _, keyName := range keyNames {
+		requested[keyName] = true
+		if !p.has(bucketName, keyName) {
+			prefixes[siblingPrefix(keyName)] = true
+		}
+	}
+	for prefix := range prefixes {
+		if p.startWarming(bucketName, prefix) {
+			p.warming.Add(1)
+			go p.warm(bucketName, prefix, requested)
+		}
+	}
+	return p.CachedKeyGetter.get(ctx, bucketName, keyNames)
+}
+
+// startWarming claims prefix for warming, unless it's already being warmed
+// or prefetchesAtOnce prefixes are.
+func (p *prefetchingKeyGetter) startWarming(bucketName, prefix string) bool {
+	p.Lock()
+	defer p.Unlock()
+	id := flatLRUKey(bucketName, prefix)
+	if p.prefixes[id] || len(p.prefixes) >= prefetchesAtOnce {
+		return false
+	}
+	if p.prefixes == nil {
+		p.prefixes = make(map[string]bool)
+	}
+	p.prefixes[id] = true
+	return true
+}
+
+func (p *prefetchingKeyGetter) warm(bucketName, prefix string, requested map[string]bool) {
+	defer p.warming.Done()
+	defer func() {
+		p.Lock()
+		delete(p.prefixes, flatLRUKey(bucketName, prefix))
+		p.Unlock()
+	}()
+	keyNames, err := p.lister.listKeys(bucketName, prefix, p.maxKeys)
+	if err != nil {
+		log.Printf("Couldn't list %v/%v to prefetch: %v", bucketName, prefix, err)
+		return
+	}
+	siblings := make([]string, 0, len(keyNames))
+	for _, keyName := range keyNames {
+		if requested[keyName] || strings.HasSuffix(keyName, "/") || p.has(bucketName, keyName) {
+			continue
+		}
+		siblings = append(siblings, keyName)
+	}
+	if len(siblings) > 0 {
+		// Warming outlives the triggering request, so it mustn't share its context.
+		p.CachedKeyGetter.get(prefetching(context.Background()), bucketName, siblings)
+	}
+}
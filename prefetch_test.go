@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+type mockKeyLister []string
+
+func (m mockKeyLister) listKeys(bucketName, prefix string, max int) ([]string, error) {
+	if len(m) > max {
+		return m[:max], nil
+	}
+	return m, nil
+}
+
+func TestPrefetchingKeyGetter(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	lister := mockKeyLister{"dir/a", "dir/b", "dir/c", "dir/d"}
+	p := &prefetchingKeyGetter{CachedKeyGetter: dkg, lister: lister, maxKeys: 3}
+
+	p.get(context.Background(), "bucket", []string{"dir/a"})
+	p.warming.Wait()
+
+	for _, keyName := range []string{"dir/a", "dir/b", "dir/c"} {
+		if !dkg.has("bucket", keyName) {
+			t.Logf("Expected %v to be cached after a miss on dir/a", keyName)
+			t.Fail()
+		}
+	}
+	if dkg.has("bucket", "dir/d") {
+		t.Logf("Expected dir/d to be beyond the prefetch cap")
+		t.Fail()
+	}
+	if base.called != 3 {
+		t.Logf("Expected 3 calls to the base getter, but had %v", base.called)
+		t.Fail()
+	}
+}
+
+// A gatedKeyLister counts its listings, holding each until its gate is
+// closed.
+type gatedKeyLister struct {
+	gate   chan struct{}
+	listed int
+	sync.Mutex
+}
+
+func (g *gatedKeyLister) listKeys(bucketName, prefix string, max int) ([]string, error) {
+	g.Lock()
+	g.listed += 1
+	g.Unlock()
+	<-g.gate
+	return nil, nil
+}
+
+func TestPrefetchingKeyGetterBoundsWarming(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	lister := &gatedKeyLister{gate: make(chan struct{})}
+	p := &prefetchingKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{base: base, cacheDir: cacheDir},
+		lister: lister, maxKeys: 3}
+
+	// two misses under dir0/, and more prefixes than are warmed at once
+	p.get(context.Background(), "bucket", []string{"dir0/a"})
+	p.get(context.Background(), "bucket", []string{"dir0/b"})
+	for i := 1; i < 2*prefetchesAtOnce; i++ {
+		p.get(context.Background(), "bucket", []string{fmt.Sprintf("dir%v/a", i)})
+	}
+	close(lister.gate)
+	p.warming.Wait()
+	if lister.listed != prefetchesAtOnce {
+		t.Logf("Expected %v prefixes warmed at once, each once, but listed %v", prefetchesAtOnce, lister.listed)
+		t.Fail()
+	}
+	if len(p.prefixes) != 0 {
+		t.Logf("Expected no prefixes left warming, but had %v", p.prefixes)
+		t.Fail()
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "context"
+
+// A provenance tells a client where a result came from, for reproducible
+// builds. Source is the layer that served it; Origin is how its content
+// first got into the cache, from Region through Endpoint. Layers a result
+// passes through fill in what they know without overwriting what the
+// layers below recorded.
+type provenance struct {
+	Source   string `json:"source"`
+	Origin   string `json:"origin,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// The sources and origins a provenance can name.
+const (
+	fromMemory   = "memory"
+	fromDisk     = "disk"
+	fromS3       = "s3"
+	fromPrefetch = "prefetch"
+	fromFallback = "fallback"
+)
+
+type prefetchingKey struct{}
+
+// prefetching marks downloads under ctx as prefetches, not client requests.
+func prefetching(ctx context.Context) context.Context {
+	return context.WithValue(ctx, prefetchingKey{}, true)
+}
+
+// fetchedProvenance is the provenance of a key t is downloading under ctx.
+func (t *tempKeyGetter) fetchedProvenance(ctx context.Context) provenance {
+	p := provenance{Source: fromS3, Origin: fromS3}
+	if prefetched, _ := ctx.Value(prefetchingKey{}).(bool); prefetched {
+		p.Origin = fromPrefetch
+	}
+	if conn, ok := t.keyReaderGetter.(*s3Conn); ok {
+		region := conn.current().Region
+		p.Region, p.Endpoint = region.Name, region.S3Endpoint
+	}
+	return p
+}
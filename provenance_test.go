@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestKeyServerProvenance(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter("sample content")},
+		cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: dkg}}
+	request := func() provenance {
+		rec := httptest.NewRecorder()
+		body := bytes.NewReader([]byte(`{"bucket_name": "bucket", "keynames": ["key1"]}`))
+		server.ServeHTTP(rec, httptest.NewRequest("POST", "/", body))
+		var results []struct {
+			Provenance provenance `json:"provenance"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil || len(results) != 1 {
+			t.Fatalf("Expected one result, but got %v: %v", rec.Body.String(), err)
+		}
+		return results[0].Provenance
+	}
+
+	if fetched := request(); fetched != (provenance{Source: fromS3, Origin: fromS3}) {
+		t.Logf("Expected a fresh fetch to come from s3, but got %+v", fetched)
+		t.Fail()
+	}
+	if hit := request(); hit != (provenance{Source: fromDisk, Origin: fromS3}) {
+		t.Logf("Expected a hit to come from disk and remember its s3 origin, but got %+v", hit)
+		t.Fail()
+	}
+}
+
+func TestLRUProvenanceKeepsOrigin(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter("sample content")},
+		cacheDir: cacheDir}
+	lru := &lruCachedKeyGetter{base: dkg}
+
+	lru.get(prefetching(context.Background()), "bucket", []string{"key1"})
+	results := lru.get(context.Background(), "bucket", []string{"key1"})
+	if results[0].provenance != (provenance{Source: fromMemory, Origin: fromPrefetch}) {
+		t.Logf("Expected an lru hit on a prefetched key, but got %+v", results[0].provenance)
+		t.Fail()
+	}
+}
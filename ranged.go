@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+var errRangesUnsupported = errors.New("ranged GETs aren't supported")
+
+// A rangeReaderGetter can read part of a key, from first to last
+// inclusive, returning errRangesUnsupported if its store ignores ranges.
+type rangeReaderGetter interface {
+	keySizer
+	getRangeReader(bucketName, keyName string, first, last int64) (io.ReadCloser, error)
+}
+
+// getRangeReader makes its own GET of a signed URL, since goamz can't set
+// a Range header.
+func (s *s3Conn) getRangeReader(bucketName, keyName string, first, last int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", s.Bucket(bucketName).SignedURL(keyName, time.Now().Add(time.Hour)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", first, last))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case 206:
+		return &etaggedReadCloser{resp.Body, normalizeETag(resp.Header.Get("ETag"))}, nil
+	case 200:
+		resp.Body.Close()
+		return nil, errRangesUnsupported
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("ranged GET of %v/%v failed: %v", bucketName, keyName, resp.Status)
+	}
+}
+
+// getKeyRanged downloads a large key as concurrent ranged GETs written
+// into place in one temp file, then hashes the assembled file. It returns
+// false, having downloaded nothing, when the key should be fetched with a
+// single GET instead: it's small, its size is unknown, not enough files
+// may be opened, or the store turns out not to support ranges.
+func (t *tempKeyGetter) getKeyRanged(ctx context.Context, bucketName, keyName string) (getResult, bool) {
+	result := getResult{keyName: keyName}
+	rg, ok := t.keyReaderGetter.(rangeReaderGetter)
+	if !ok || t.rangeParts < 2 {
+		return result, false
+	}
+	size, err := rg.keySize(bucketName, keyName)
+	if err != nil || size < t.rangeMinBytes || size < int64(t.rangeParts) {
+		return result, false
+	}
+	// each part holds a connection open on top of the single GET's share
+	if !t.fds.acquire(ctx, t.rangeParts-1) {
+		return result, false
+	}
+	defer t.fds.release(t.rangeParts - 1)
+
+	f, err := ioutil.TempFile(os.TempDir(), tempFilePattern())
+	if err != nil {
+		result.status = err.Error()
+		result.err = newResultError(err)
+		return result, true
+	}
+	defer f.Close()
+	fail := func(err error) (getResult, bool) {
+		os.Remove(f.Name())
+		if trace.enabled() {
+			trace.event("download_error", "bucket", bucketName, "key", keyName, "error", err.Error())
+		}
+		result.status = err.Error()
+		result.err = newResultError(err)
+		if ctx.Err() != nil {
+			result.status = cancelled
+		}
+		return result, true
+	}
+	if err := f.Truncate(size); err != nil {
+		return fail(err)
+	}
+
+	partCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	partSize := (size + int64(t.rangeParts) - 1) / int64(t.rangeParts)
+	etags := make([]string, t.rangeParts)
+	errs := make(chan error, t.rangeParts)
+	for i := 0; i < t.rangeParts; i++ {
+		first := int64(i) * partSize
+		last := first + partSize - 1
+		if last >= size {
+			last = size - 1
+		}
+		go func(i int, first, last int64) {
+			errs <- t.getRange(partCtx, rg, bucketName, keyName, first, last, f, &etags[i])
+		}(i, first, last)
+	}
+	var firstErr error
+	for range etags {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	if errors.Is(firstErr, errRangesUnsupported) {
+		os.Remove(f.Name())
+		return result, false
+	}
+	if firstErr != nil {
+		return fail(firstErr)
+	}
+	for _, etag := range etags[1:] {
+		if etag != etags[0] {
+			return fail(fmt.Errorf("%v/%v changed during a ranged download", bucketName, keyName))
+		}
+	}
+	result.etag = etags[0]
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	h, sha256Hash := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(h, sha256Hash), f); err != nil {
+		return fail(err)
+	}
+	if trace.enabled() {
+		trace.event("download_end", "bucket", bucketName, "key", keyName, "bytes", size, "parts", t.rangeParts)
+	}
+	return t.completed(result, f.Name(), size, h, sha256Hash), true
+}
+
+// getRange copies bytes first to last of a key into the same place in f.
+func (t *tempKeyGetter) getRange(ctx context.Context, rg rangeReaderGetter, bucketName, keyName string,
+	first, last int64, f *os.File, etag *string) error {
+	rc, err := rg.getRangeReader(bucketName, keyName, first, last)
+	if err != nil {
+		return err
+	}
+	if etagged, ok := rc.(*etaggedReadCloser); ok {
+		*etag = etagged.etag
+	}
+	if t.stallTimeout > 0 {
+		rc = newWatchdogReader(rc, t.stallTimeout)
+	}
+	defer rc.Close()
+	stopCancelling := context.AfterFunc(ctx, func() { rc.Close() })
+	defer stopCancelling()
+	written, err := t.copy(io.NewOffsetWriter(f, first), rc)
+	if err != nil {
+		return err
+	}
+	if written != last-first+1 {
+		return fmt.Errorf("got %v bytes of %v/%v from %v, expected %v", written, bucketName, keyName, first, last-first+1)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// rangedKeyReaderGetter serves content whole or, if ranges is set, in
+// ranges, counting the ranged GETs.
+type rangedKeyReaderGetter struct {
+	content    []byte
+	ranges     bool
+	rangeCalls int
+	sync.Mutex
+}
+
+func (r *rangedKeyReaderGetter) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(r.content)), nil
+}
+
+func (r *rangedKeyReaderGetter) keySize(bucketName, keyName string) (int64, error) {
+	return int64(len(r.content)), nil
+}
+
+func (r *rangedKeyReaderGetter) getRangeReader(bucketName, keyName string, first, last int64) (io.ReadCloser, error) {
+	r.Lock()
+	r.rangeCalls += 1
+	r.Unlock()
+	if !r.ranges {
+		return nil, errRangesUnsupported
+	}
+	return ioutil.NopCloser(bytes.NewReader(r.content[first : last+1])), nil
+}
+
+func TestTempKeyGetterRangedDownloadMatchesSequential(t *testing.T) {
+	content := make([]byte, 1<<20+7)
+	for i := range content {
+		content[i] = byte(i * 31)
+	}
+	download := func(rkrg *rangedKeyReaderGetter, parts int) getResult {
+		tkg := &tempKeyGetter{keyReaderGetter: rkrg, rangeParts: parts, rangeMinBytes: 1024}
+		results := tkg.get(context.Background(), "bucket", []string{"big"})
+		if len(results) != 1 || results[0].localPath == nil {
+			t.Fatalf("Expected a download, but got %v", results)
+		}
+		return results[0]
+	}
+	sequential := download(&rangedKeyReaderGetter{content: content, ranges: true}, 0)
+	defer os.Remove(*sequential.localPath)
+	ranges := &rangedKeyReaderGetter{content: content, ranges: true}
+	parallel := download(ranges, 4)
+	defer os.Remove(*parallel.localPath)
+	noRanges := &rangedKeyReaderGetter{content: content}
+	fallback := download(noRanges, 4)
+	defer os.Remove(*fallback.localPath)
+
+	if ranges.rangeCalls != 4 {
+		t.Logf("Expected 4 ranged GETs, but had %v", ranges.rangeCalls)
+		t.Fail()
+	}
+	expected, err := ioutil.ReadFile(*sequential.localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, result := range map[string]getResult{"parallel": parallel, "fallback": fallback} {
+		got, err := ioutil.ReadFile(*result.localPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Logf("Expected the %v download to match the sequential one byte for byte", name)
+			t.Fail()
+		}
+		if result.md5 != sequential.md5 || result.sha256 != sequential.sha256 || result.bytesTransferred != sequential.bytesTransferred {
+			t.Logf("Expected the %v download's digests and size to match the sequential one's", name)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// A cachedSizer can tell how big a cached key's file really is.
+type cachedSizer interface {
+	cachedSize(bucketName, keyName string) (int64, error)
+}
+
+func (d *diskCachedKeyGetter) cachedSize(bucketName, keyName string) (int64, error) {
+	keyPath, err := d.pathFor(bucketName, keyName)
+	if err != nil {
+		return 0, err
+	}
+	info, err := d.files().Stat(keyPath)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// resize records that keyName's entry takes bytes, returning what it was
+// recorded as taking before, or false if it isn't in the lru.
+func (m *lruCachedKeyGetter) resize(bucketName, keyName string, bytes int64) (int64, bool) {
+	if m.shards != nil {
+		return m.shardFor(bucketName, keyName).resize(bucketName, keyName, bytes)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.cache == nil {
+		return 0, false
+	}
+	elem, had := m.cache.lookup(bucketName, keyName)
+	if !had {
+		return 0, false
+	}
+	result, ok := elem.Value.(getResult)
+	if !ok {
+		return 0, false
+	}
+	previous := result.bytesTransferred
+	result.bytesTransferred = bytes
+	elem.Value = result
+	m.tally.bytes.Add(bytes - previous)
+	return previous, true
+}
+
+// entries copies out every entry in the lru.
+func (m *lruCachedKeyGetter) entries() []getResult {
+	if m.shards != nil {
+		var entries []getResult
+		for _, shard := range m.shards {
+			entries = append(entries, shard.entries()...)
+		}
+		return entries
+	}
+	m.RLock()
+	defer m.RUnlock()
+	entries := make([]getResult, 0, m.Len())
+	for elem := m.Front(); elem != nil; elem = elem.Next() {
+		if result, ok := elem.Value.(getResult); ok {
+			entries = append(entries, result)
+		}
+	}
+	return entries
+}
+
+// reconcileAll corrects each entry's accounted size, and so the total, to
+// the size of its file on disk, which is 0 if the file is gone. A file
+// truncated or deleted behind the cache's back would otherwise go on
+// being counted at its old size, evicting other keys to make room that
+// was never taken.
+func (b *boundedDiskCachedKeyGetter) reconcileAll() {
+	sizer, ok := b.disk.(cachedSizer)
+	if !ok {
+		return
+	}
+	for _, r := range b.lru.entries() {
+		size, err := sizer.cachedSize(r.bucketName, r.keyName)
+		if os.IsNotExist(err) {
+			size, err = 0, nil
+		}
+		if err != nil || size == r.bytesTransferred {
+			continue
+		}
+		previous, ok := b.lru.resize(r.bucketName, r.keyName, size)
+		if !ok || previous == size {
+			continue
+		}
+		log.Printf("%v/%v was accounted as %v bytes but is %v; correcting", r.bucketName, r.keyName, previous, size)
+		b.adjust(size - previous)
+	}
+}
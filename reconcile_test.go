@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBoundedDiskCachedKeyGetterReconcilesSizes(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	size := int64(len("sample content"))
+	b := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg}, disk: dkg,
+		softLimit: 4 * size, hardLimit: 10 * size, reconcileSizes: true, wake: make(chan struct{}, 1)}
+
+	b.get(context.Background(), "bucket", []string{"key1", "key2", "key3", "key4"})
+	if err := os.Truncate(dkg.mustPathFor("bucket", "key4"), 0); err != nil {
+		t.Fatal(err)
+	}
+	go b.keepClean()
+	defer close(b.wake)
+	b.get(context.Background(), "bucket", []string{"key5"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b.size() != 4*size && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if b.size() != 4*size {
+		t.Logf("Expected the total to be corrected to the %v bytes really cached, but it's %v", 4*size, b.size())
+		t.Fail()
+	}
+	if !b.has("bucket", "key1") {
+		t.Logf("Expected nothing to be evicted once the truncated key's size was corrected")
+		t.Fail()
+	}
+	if entry := b.lru.peek("bucket", "key4"); entry == nil || entry.bytesTransferred != 0 {
+		t.Logf("Expected the truncated key's entry to be resized to 0 bytes, but got %v", entry)
+		t.Fail()
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// redisTimeout bounds each exchange with a redisIndex's server.
+	redisTimeout = 5 * time.Second
+	// redisRetryAfter is how long a redisIndex that couldn't reach its
+	// server waits before trying again, failing commands meanwhile.
+	redisRetryAfter = 10 * time.Second
+	// redisTouchQueue is how many touches a redisIndex holds while it
+	// sends earlier ones.
+	redisTouchQueue = 1024
+)
+
+var errRedisDown = errors.New("redis: unreachable, waiting to retry")
+
+// A redisIndex is a sharedIndex kept in Redis, for nodes caching onto one
+// shared filesystem. Keys are ranked by when they were last used in the
+// sorted set prefix:lru. It speaks just enough of Redis's protocol for
+// that over a single connection, which is dialed again after any error,
+// though not until redisRetryAfter has passed. Touches are queued and sent
+// in the background, as many at a time as have built up.
+type redisIndex struct {
+	addr, password string
+	db             int
+	prefix         string
+	conn           net.Conn
+	reader         *bufio.Reader
+	// downUntil is when to next try the server after failing to reach it
+	downUntil     time.Time
+	touches       chan redisTouch
+	startTouching sync.Once
+	sync.Mutex
+}
+
+// A redisTouch is a key to rank as used at score or, with flushed set, a
+// request to close flushed once every touch queued before it is sent.
+type redisTouch struct {
+	id, score string
+	flushed   chan struct{}
+}
+
+// parseRedisIndex reads a redis://[:password@]host:port[/db] URL.
+func parseRedisIndex(spec string) (*redisIndex, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("shared index %q must be a redis://host:port URL", spec)
+	}
+	x := &redisIndex{addr: u.Host, prefix: "s3_cache", touches: make(chan redisTouch, redisTouchQueue)}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		x.addr = net.JoinHostPort(u.Host, "6379")
+	}
+	if u.User != nil {
+		x.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if x.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("shared index %q has a bad database number %q", spec, db)
+		}
+	}
+	return x, nil
+}
+
+// touch queues entries to be ranked as just used, since hits shouldn't
+// wait on Redis, failing if too many are already waiting.
+func (x *redisIndex) touch(entries []lruSnapshotEntry) error {
+	x.startTouching.Do(func() { go x.sendTouches() })
+	score := strconv.FormatInt(time.Now().UnixNano()/int64(time.Microsecond), 10)
+	for _, entry := range entries {
+		select {
+		case x.touches <- redisTouch{id: flatLRUKey(entry.BucketName, entry.KeyName), score: score}:
+		default:
+			return fmt.Errorf("redis: %v touches already waiting to be sent", redisTouchQueue)
+		}
+	}
+	return nil
+}
+
+// flush waits for every touch queued so far to be sent.
+func (x *redisIndex) flush() {
+	x.startTouching.Do(func() { go x.sendTouches() })
+	flushed := make(chan struct{})
+	x.touches <- redisTouch{flushed: flushed}
+	<-flushed
+}
+
+// sendTouches ranks queued touches, sending as many as are waiting in
+// one ZADD.
+func (x *redisIndex) sendTouches() {
+	for touch := range x.touches {
+		args := []string{"ZADD", x.prefix + ":lru"}
+		var flushed []chan struct{}
+		for more := true; more; {
+			if touch.flushed != nil {
+				flushed = append(flushed, touch.flushed)
+			} else {
+				args = append(args, touch.score, touch.id)
+			}
+			select {
+			case touch = <-x.touches:
+				more = len(args) < 2+2*redisTouchQueue
+			default:
+				more = false
+			}
+		}
+		if len(args) > 2 {
+			// while the server is unreachable, the failure to reach it was
+			// already logged
+			if _, err := x.do(args...); err != nil && err != errRedisDown {
+				log.Printf("Couldn't record %v keys as used in the shared index: %v", (len(args)-2)/2, err)
+			}
+		}
+		for _, f := range flushed {
+			close(f)
+		}
+	}
+}
+
+func (x *redisIndex) forget(bucketName, keyName string) error {
+	_, err := x.do("ZREM", x.prefix+":lru", flatLRUKey(bucketName, keyName))
+	return err
+}
+
+// contains looks every key up in a single exchange with the server.
+func (x *redisIndex) contains(bucketName string, keyNames []string) ([]bool, error) {
+	if len(keyNames) == 0 {
+		return nil, nil
+	}
+	commands := make([][]string, len(keyNames))
+	for i, keyName := range keyNames {
+		commands[i] = []string{"ZSCORE", x.prefix + ":lru", flatLRUKey(bucketName, keyName)}
+	}
+	replies, err := x.pipeline(commands)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]bool, len(replies))
+	for i, reply := range replies {
+		if redisErr, ok := reply.(redisError); ok {
+			return nil, redisErr
+		}
+		out[i] = reply != nil
+	}
+	return out, nil
+}
+
+func (x *redisIndex) leastRecent(n int) ([]lruSnapshotEntry, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	reply, err := x.do("ZRANGE", x.prefix+":lru", "0", strconv.Itoa(n-1))
+	if err != nil {
+		return nil, err
+	}
+	ids, _ := reply.([]interface{})
+	entries := make([]lruSnapshotEntry, 0, len(ids))
+	for _, id := range ids {
+		// the first NUL always ends the bucket name; see flatLRUKey
+		id, _ := id.(string)
+		if i := strings.IndexByte(id, 0); i >= 0 {
+			entries = append(entries, lruSnapshotEntry{BucketName: id[:i], KeyName: id[i+1:]})
+		}
+	}
+	return entries, nil
+}
+
+// do sends a command and reads its reply: a string, an int64, nil, or a
+// []interface{} of those.
+func (x *redisIndex) do(args ...string) (interface{}, error) {
+	replies, err := x.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if redisErr, ok := replies[0].(redisError); ok {
+		return nil, redisErr
+	}
+	return replies[0], nil
+}
+
+// pipeline sends commands all at once and then reads their replies, in
+// order, with any error replies among them as redisErrors.
+func (x *redisIndex) pipeline(commands [][]string) ([]interface{}, error) {
+	x.Lock()
+	defer x.Unlock()
+	if x.conn == nil {
+		if time.Now().Before(x.downUntil) {
+			return nil, errRedisDown
+		}
+		if err := x.dial(); err != nil {
+			x.downUntil = time.Now().Add(redisRetryAfter)
+			return nil, err
+		}
+	}
+	replies, err := x.send(commands)
+	if err != nil {
+		// the connection is in an unknown state, so start over, after a
+		// while in case the server's gone
+		x.conn.Close()
+		x.conn = nil
+		x.downUntil = time.Now().Add(redisRetryAfter)
+	}
+	return replies, err
+}
+
+func (x *redisIndex) dial() error {
+	conn, err := net.DialTimeout("tcp", x.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	x.conn, x.reader = conn, bufio.NewReader(conn)
+	var setup [][]string
+	if x.password != "" {
+		setup = append(setup, []string{"AUTH", x.password})
+	}
+	if x.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(x.db)})
+	}
+	replies, err := x.send(setup)
+	for _, reply := range replies {
+		if redisErr, ok := reply.(redisError); ok && err == nil {
+			err = redisErr
+		}
+	}
+	if err != nil {
+		conn.Close()
+		x.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (x *redisIndex) send(commands [][]string) ([]interface{}, error) {
+	if len(commands) == 0 {
+		return nil, nil
+	}
+	x.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	for _, args := range commands {
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(x.conn, b.String()); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range replies {
+		var redisErr redisError
+		var err error
+		if replies[i], err = readRedisReply(x.reader); errors.As(err, &redisErr) {
+			replies[i] = redisErr
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// A redisError is an error reply, after which the connection is still
+// fine to use.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(rest)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		raw := make([]byte, size+2)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, err
+		}
+		return string(raw[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(rest)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		elems := make([]interface{}, count)
+		for i := range elems {
+			var redisErr redisError
+			if elems[i], err = readRedisReply(r); errors.As(err, &redisErr) {
+				// the rest of the array still has to be read
+				elems[i] = redisErr
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	}
+	return nil, fmt.Errorf("malformed redis reply %q", line)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// A fakeRedis serves the few commands a redisIndex sends, from memory.
+type fakeRedis struct {
+	zsets map[string]map[string]float64
+	sync.Mutex
+}
+
+func startFakeRedis(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{zsets: make(map[string]map[string]float64)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return listener
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		request, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range request.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+		f.Lock()
+		reply := f.reply(args)
+		f.Unlock()
+		fmt.Fprint(conn, reply)
+	}
+}
+
+func (f *fakeRedis) reply(args []string) string {
+	bulk := func(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+	switch args[0] {
+	case "ZADD":
+		if f.zsets[args[1]] == nil {
+			f.zsets[args[1]] = make(map[string]float64)
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			score, _ := strconv.ParseFloat(args[i], 64)
+			f.zsets[args[1]][args[i+1]] = score
+		}
+		return fmt.Sprintf(":%d\r\n", (len(args)-2)/2)
+	case "ZREM":
+		delete(f.zsets[args[1]], args[2])
+		return ":1\r\n"
+	case "ZSCORE":
+		score, ok := f.zsets[args[1]][args[2]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(fmt.Sprint(score))
+	case "ZRANGE":
+		var members []string
+		for member := range f.zsets[args[1]] {
+			members = append(members, member)
+		}
+		sort.Slice(members, func(i, j int) bool { return f.zsets[args[1]][members[i]] < f.zsets[args[1]][members[j]] })
+		stop, _ := strconv.Atoi(args[3])
+		if stop+1 < len(members) {
+			members = members[:stop+1]
+		}
+		out := fmt.Sprintf("*%d\r\n", len(members))
+		for _, member := range members {
+			out += bulk(member)
+		}
+		return out
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisIndexIsSharedBetweenNodes(t *testing.T) {
+	listener := startFakeRedis(t)
+	defer listener.Close()
+	a, err := parseRedisIndex("redis://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := parseRedisIndex("redis://" + listener.Addr().String())
+
+	for _, keyName := range []string{"key1", "key2", "key3"} {
+		if err := a.touch([]lruSnapshotEntry{{BucketName: "bucket", KeyName: keyName}}); err != nil {
+			t.Fatal(err)
+		}
+		a.flush()
+	}
+	// b using key1 makes it the most recently used for a too
+	b.touch([]lruSnapshotEntry{{BucketName: "bucket", KeyName: "key1"}})
+	b.flush()
+	entries, err := a.leastRecent(2)
+	if err != nil || len(entries) != 2 || entries[0].KeyName != "key2" || entries[1].KeyName != "key3" {
+		t.Logf("Expected key2 then key3 least recently used, but got %+v, %v", entries, err)
+		t.Fail()
+	}
+	b.forget("bucket", "key2")
+	contained, err := a.contains("bucket", []string{"key2", "key3"})
+	if err != nil || len(contained) != 2 || contained[0] || !contained[1] {
+		t.Logf("Expected a to see key2 forgotten by b and key3 still cached, but got %v, %v", contained, err)
+		t.Fail()
+	}
+}
+
+func TestRedisIndexBacksOffWhenUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing listens here once it's closed
+	listener.Close()
+	x, err := parseRedisIndex("redis://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x.contains("bucket", []string{"key1"}); err == nil || err == errRedisDown {
+		t.Logf("Expected the first lookup to fail dialing, but got %v", err)
+		t.Fail()
+	}
+	if _, err := x.contains("bucket", []string{"key1"}); err != errRedisDown {
+		t.Logf("Expected the next lookup to fail without dialing again, but got %v", err)
+		t.Fail()
+	}
+	if err := x.touch([]lruSnapshotEntry{{BucketName: "bucket", KeyName: "key1"}}); err != nil {
+		t.Logf("Expected touches to be queued regardless, but got %v", err)
+		t.Fail()
+	}
+	x.flush()
+}
+
+func TestParseRedisIndex(t *testing.T) {
+	x, err := parseRedisIndex("redis://:hunter2@cache-index/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.addr != "cache-index:6379" || x.password != "hunter2" || x.db != 3 {
+		t.Logf("Expected cache-index:6379, db 3, with a password, but got %+v", x)
+		t.Fail()
+	}
+	for _, spec := range []string{"cache-index:6379", "http://cache-index", "redis://cache-index/zero"} {
+		if _, err := parseRedisIndex(spec); err == nil {
+			t.Logf("Expected %q to be refused", spec)
+			t.Fail()
+		}
+	}
+}
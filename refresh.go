@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// A refresh is one replacement of a cached key found changed upstream,
+// which concurrent requests finding the same change wait on.
+type refresh struct {
+	result getResult
+	done   chan struct{}
+}
+
+// refreshes are the refreshes in progress, by flatLRUKey.
+type refreshes struct {
+	inProgress map[string]*refresh
+	sync.Mutex
+}
+
+// sameVersion reports whether a and b are the same cached copy of a key.
+func sameVersion(a, b getResult) bool {
+	return a.cachedAt.Equal(b.cachedAt) && a.md5 == b.md5 && a.etag == b.etag
+}
+
+// refresh replaces stale, a cached copy found changed upstream, with a
+// fresh one. Requests finding the same key changed at once share a single
+// eviction and re-fetch rather than each evicting what another just
+// fetched, and one finding the copy it checked already replaced takes the
+// replacement.
+func (e *EvictingMutableKeyGetter) refresh(ctx context.Context, bucketName string, stale getResult) getResult {
+	id := flatLRUKey(bucketName, stale.keyName)
+	e.refreshes.Lock()
+	if e.refreshes.inProgress == nil {
+		e.refreshes.inProgress = make(map[string]*refresh)
+	}
+	if r, ok := e.refreshes.inProgress[id]; ok {
+		e.refreshes.Unlock()
+		select {
+		case <-r.done:
+			return r.result
+		case <-ctx.Done():
+			return getResult{keyName: stale.keyName, bucketName: bucketName, status: cancelled}
+		}
+	}
+	r := &refresh{done: make(chan struct{})}
+	e.refreshes.inProgress[id] = r
+	e.refreshes.Unlock()
+
+	r.result = e.replace(ctx, bucketName, stale)
+	e.refreshes.Lock()
+	delete(e.refreshes.inProgress, id)
+	e.refreshes.Unlock()
+	close(r.done)
+	return r.result
+}
+
+// replace evicts and re-fetches stale, unless an earlier refresh already
+// has. Only one replace of a key runs at a time.
+func (e *EvictingMutableKeyGetter) replace(ctx context.Context, bucketName string, stale getResult) getResult {
+	if e.has(bucketName, stale.keyName) {
+		current := e.get(ctx, bucketName, []string{stale.keyName})
+		if len(current) == 1 && current[0].localPath != nil && !sameVersion(current[0], stale) {
+			return current[0]
+		}
+	}
+	if trace.enabled() {
+		trace.event("evict", "bucket", bucketName, "key", stale.keyName)
+	}
+	e.remove(bucketName, stale.keyName)
+	fetched := e.get(ctx, bucketName, []string{stale.keyName})
+	if len(fetched) != 1 {
+		return getResult{keyName: stale.keyName, bucketName: bucketName, status: "refresh returned no result"}
+	}
+	return fetched[0]
+}
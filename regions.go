@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"launchpad.net/goamz/aws"
+	"launchpad.net/goamz/s3"
+)
+
+// wrongRegion reports whether err is S3 refusing a request because its
+// bucket is in another region than the one asked.
+func wrongRegion(err error) bool {
+	var s3Err *s3.Error
+	if !errors.As(err, &s3Err) {
+		return false
+	}
+	return s3Err.StatusCode == 301 || s3Err.Code == "PermanentRedirect" || s3Err.Code == "AuthorizationHeaderMalformed"
+}
+
+// bucketRegions remembers the regions of buckets found to be outside the
+// connection's own, so each is only looked up once. endpointFor is
+// applied to a region before it's connected to, as it is to the default.
+type bucketRegions struct {
+	byBucket    map[string]aws.Region
+	endpointFor func(aws.Region) aws.Region
+	sync.Mutex
+}
+
+// connFor is the connection to use for bucketName: the current one, in
+// the region bucketName was found to be in if it's been redirected.
+func (s *s3Conn) connFor(bucketName string) *s3.S3 {
+	conn := s.current()
+	if s.regions == nil {
+		return conn
+	}
+	s.regions.Lock()
+	region, moved := s.regions.byBucket[bucketName]
+	s.regions.Unlock()
+	if !moved {
+		return conn
+	}
+	return s3.New(conn.Auth, region)
+}
+
+// Bucket is bucketName in whichever region it's in.
+func (s *s3Conn) Bucket(bucketName string) *s3.Bucket {
+	return s.connFor(bucketName).Bucket(bucketName)
+}
+
+// relocate looks up which region bucketName is really in when err says
+// it isn't in the one asked, remembering it for the bucket's requests
+// from then on. It reports whether retrying could now succeed.
+func (s *s3Conn) relocate(bucketName string, err error) bool {
+	if s.regions == nil || !wrongRegion(err) {
+		return false
+	}
+	asked := s.connFor(bucketName)
+	name, err := locateBucket(asked, bucketName)
+	if err != nil {
+		log.Printf("Bucket %v is in another region, but couldn't find out which: %v", bucketName, err)
+		return false
+	}
+	region, ok := aws.Regions[name]
+	if !ok {
+		log.Printf("Bucket %v is in region %q, which isn't known", bucketName, name)
+		return false
+	}
+	if s.regions.endpointFor != nil {
+		region = s.regions.endpointFor(region)
+	}
+	if region.S3Endpoint == asked.Region.S3Endpoint {
+		return false
+	}
+	log.Printf("Bucket %v is in %v rather than %v; sending its requests there", bucketName, name, asked.Region.Name)
+	s.regions.Lock()
+	defer s.regions.Unlock()
+	if s.regions.byBucket == nil {
+		s.regions.byBucket = make(map[string]aws.Region)
+	}
+	s.regions.byBucket[bucketName] = region
+	return true
+}
+
+// locateBucket asks S3 which region bucketName is in. A HEAD of the
+// bucket answers with its region in a header whether or not the request
+// was allowed or in the right region.
+func locateBucket(conn *s3.S3, bucketName string) (string, error) {
+	resp, err := http.Head(conn.Bucket(bucketName).URL(""))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	region := resp.Header.Get("X-Amz-Bucket-Region")
+	if region == "" {
+		return "", fmt.Errorf("no region in the answer to a HEAD of the bucket: %v", resp.Status)
+	}
+	return region, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"launchpad.net/goamz/aws"
+	"launchpad.net/goamz/s3"
+)
+
+func TestS3ConnFollowsRegionRedirects(t *testing.T) {
+	var euRequests int
+	eu := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		euRequests++
+		w.Write([]byte("from eu"))
+	}))
+	defer eu.Close()
+	var usRequests int
+	us := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		usRequests++
+		w.Header().Set("X-Amz-Bucket-Region", "eu-west-1")
+		w.WriteHeader(301)
+		if r.Method != "HEAD" {
+			w.Write([]byte(`<Error><Code>PermanentRedirect</Code><Message>The bucket you are attempting to access must be addressed using the specified endpoint.</Message></Error>`))
+		}
+	}))
+	defer us.Close()
+	endpointFor := func(region aws.Region) aws.Region {
+		region.S3Endpoint = map[string]string{"us-east-1": us.URL, "eu-west-1": eu.URL}[region.Name]
+		return region
+	}
+	conn := &s3Conn{swappableS3: newSwappableS3(s3.New(aws.Auth{}, endpointFor(aws.USEast))),
+		regions: &bucketRegions{endpointFor: endpointFor}}
+
+	for i := 0; i < 2; i++ {
+		rc, err := conn.getKeyReader("bucket", "key")
+		if err != nil {
+			t.Fatalf("Expected the redirect to be followed, but got %v", err)
+		}
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if string(content) != "from eu" {
+			t.Logf("Expected the key from the bucket's real region, but got %q", content)
+			t.Fail()
+		}
+	}
+	// the first GET and the HEAD finding the region; after that, the
+	// bucket's region is remembered
+	if usRequests != 2 || euRequests != 2 {
+		t.Logf("Expected the region to be looked up once, but the wrong region had %v requests and the right one %v", usRequests, euRequests)
+		t.Fail()
+	}
+
+	unfollowed := &s3Conn{swappableS3: newSwappableS3(s3.New(aws.Auth{}, endpointFor(aws.USEast)))}
+	if _, err := unfollowed.getKeyReader("bucket", "key"); !wrongRegion(err) {
+		t.Logf("Expected the redirect as an error without regions set, but got %v", err)
+		t.Fail()
+	}
+}
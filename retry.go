@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// retryTokenHeader is the response header carrying the token that lets a
+// client retry just the keys of its request that failed.
+const retryTokenHeader = "X-Retry-Token"
+
+// A pendingRetry is a request some of whose keys failed, held for the
+// client to retry.
+type pendingRetry struct {
+	cr      *CacheRequest
+	getter  MutableKeyGetter
+	results []getResult
+	heldAt  time.Time
+}
+
+// A retryStore holds requests with failed keys for ttl, by token, so that
+// POST /retry?token=... can re-attempt only those keys rather than the
+// client resubmitting the whole batch. A nil *retryStore holds nothing.
+type retryStore struct {
+	ttl     time.Duration
+	pending map[string]*pendingRetry
+	sync.Mutex
+}
+
+// retryable reports whether r failed in a way that trying again could
+// fix: not because its key doesn't exist or its ETag didn't match.
+func retryable(r getResult) bool {
+	return r.localPath == nil && !isMissing(r) && r.status != preconditionFailed
+}
+
+// hold keeps cr and its results if any of them are retryable, returning
+// the token to retry them with, or "" if there's nothing to retry.
+func (s *retryStore) hold(cr *CacheRequest, getter MutableKeyGetter, results []getResult) string {
+	if s == nil {
+		return ""
+	}
+	failed := false
+	for _, result := range results {
+		failed = failed || retryable(result)
+	}
+	if !failed {
+		return ""
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return ""
+	}
+	token := hex.EncodeToString(raw)
+	s.Lock()
+	defer s.Unlock()
+	s.expireLocked()
+	if s.pending == nil {
+		s.pending = make(map[string]*pendingRetry)
+	}
+	s.pending[token] = &pendingRetry{cr: cr, getter: getter, results: results, heldAt: time.Now()}
+	return token
+}
+
+// take removes and returns the request held under token, if it's still
+// held; a token can only be retried once.
+func (s *retryStore) take(token string) (*pendingRetry, bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.expireLocked()
+	held, ok := s.pending[token]
+	delete(s.pending, token)
+	return held, ok
+}
+
+func (s *retryStore) expireLocked() {
+	for token, held := range s.pending {
+		if time.Since(held.heldAt) > s.ttl {
+			delete(s.pending, token)
+		}
+	}
+}
+
+// serveRetry serves POST /retry?token=..., fetching again just the keys
+// that failed in the request the token was handed out for, and answering
+// with that request's results with the retried keys' merged in. If some
+// still fail, the response has a fresh token for them.
+func (s *keyServer) serveRetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "retry only supports POST", 405)
+		return
+	}
+	if s.retries == nil {
+		http.Error(w, "retries aren't enabled", 404)
+		return
+	}
+	held, ok := s.retries.take(r.URL.Query().Get("token"))
+	if !ok {
+		http.Error(w, "unknown or expired retry token", 404)
+		return
+	}
+	if err := s.admit(); err != nil {
+		s.reject(w, err)
+		return
+	}
+	defer s.release()
+	ctx, sp := spans.startRequest(r, "cache_retry")
+	defer sp.finish()
+	r = r.WithContext(ctx)
+	sp.set("aws.s3.bucket", held.cr.BucketName)
+	failed := make([]string, 0)
+	for _, result := range held.results {
+		if retryable(result) {
+			failed = append(failed, result.keyName)
+		}
+	}
+	retried := make(map[string]getResult, len(failed))
+	fetched := held.cr.fetch(r.Context(), held.getter, failed)
+	s.accessLog.record(r, held.cr.Credentials, fetched)
+	s.history.record(held.cr.Credentials, fetched)
+	for _, result := range fetched {
+		retried[result.keyName] = result
+	}
+	results := make([]getResult, len(held.results))
+	for i, result := range held.results {
+		if again, ok := retried[result.keyName]; ok && retryable(result) {
+			result = again
+		}
+		result.omitNullPath = s.omitNullPaths
+		results[i] = result
+	}
+	if token := s.retries.hold(held.cr, held.getter, results); token != "" {
+		w.Header().Set(retryTokenHeader, token)
+	}
+	out, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Write(out)
+}
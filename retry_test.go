@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"launchpad.net/goamz/s3"
+)
+
+// A flakyKeyReaderGetter fails the first GET of each key in flaky with a
+// 503, counting every GET of every key.
+type flakyKeyReaderGetter struct {
+	flaky    map[string]bool
+	attempts map[string]int
+	sync.Mutex
+}
+
+func (f *flakyKeyReaderGetter) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.attempts[keyName]++
+	if f.flaky[keyName] && f.attempts[keyName] == 1 {
+		return nil, &s3.Error{StatusCode: 503, Code: "SlowDown", Message: "Please reduce your request rate."}
+	}
+	return ioutil.NopCloser(bytes.NewReader([]byte("sample content"))), nil
+}
+
+func TestKeyServerRetriesOnlyFailedKeys(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	store := &flakyKeyReaderGetter{flaky: map[string]bool{"key2": true}, attempts: map[string]int{}}
+	dkg := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: store}, cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: dkg},
+		retries: &retryStore{ttl: time.Minute}}
+	decode := func(rec *httptest.ResponseRecorder) []map[string]interface{} {
+		var results []map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("Expected results, but got %v: %v", rec.Body.String(), err)
+		}
+		return results
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader([]byte(`{"bucket_name": "bucket", "keynames": ["key1", "key2", "key3"]}`))))
+	token := rec.Header().Get(retryTokenHeader)
+	if token == "" {
+		t.Fatalf("Expected a retry token for a request with a failed key, but got %v", decode(rec))
+	}
+
+	rec = httptest.NewRecorder()
+	server.serveRetry(rec, httptest.NewRequest("POST", "/retry?token="+token, nil))
+	results := decode(rec)
+	if len(results) != 3 {
+		t.Fatalf("Expected the retry to answer for all 3 keys, but got %v", results)
+	}
+	for i, keyName := range []string{"key1", "key2", "key3"} {
+		if results[i]["key_name"] != keyName || results[i]["local_path"] == nil {
+			t.Logf("Expected %v cached in position %v, but got %v", keyName, i, results[i])
+			t.Fail()
+		}
+	}
+	if store.attempts["key1"] != 1 || store.attempts["key2"] != 2 || store.attempts["key3"] != 1 {
+		t.Logf("Expected only key2 to be fetched again, but the attempts were %v", store.attempts)
+		t.Fail()
+	}
+	if rec.Header().Get(retryTokenHeader) != "" {
+		t.Logf("Expected no further token once every key succeeded")
+		t.Fail()
+	}
+
+	rec = httptest.NewRecorder()
+	server.serveRetry(rec, httptest.NewRequest("POST", "/retry?token="+token, nil))
+	if rec.Code != 404 {
+		t.Logf("Expected a used token to be refused, but got %v", rec.Code)
+		t.Fail()
+	}
+}
@@ -2,19 +2,32 @@ package main
 
 import (
 	"container/list"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"launchpad.net/goamz/aws"
 	"launchpad.net/goamz/s3"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 // A getResult represents an entry in the cache
@@ -25,17 +38,59 @@ type getResult struct {
 	bucketName       string
 	bytesTransferred int64
 	md5              string
+	sha256           string
+	etag             string
+	cachedAt         time.Time
+	fetchTime        time.Duration
+	throughput       float64
+	err              *resultError
+	omitNullPath     bool
+	provenance       provenance
+	pinnedUntil      time.Time
+	used             uint64
 }
 
+// MarshalJSON includes a nil localPath as a null local_path, or leaves it
+// out for strict clients if omitNullPath is set.
 func (r *getResult) MarshalJSON() ([]byte, error) {
 	out := map[string]interface{}{"key_name": r.keyName,
 		"status":     r.status,
 		"local_path": r.localPath}
+	if r.localPath == nil && r.omitNullPath {
+		delete(out, "local_path")
+	}
+	if r.err != nil {
+		out["error"] = r.err
+	}
+	if r.provenance.Source != "" {
+		out["provenance"] = r.provenance
+	}
+	if r.throughput > 0 {
+		out["throughput_bytes_per_sec"] = r.throughput
+	}
 	return json.Marshal(out)
 }
 
+// A resultError is the structured form of the error that failed a
+// getResult. Only errors from S3 itself have a code and status code.
+type resultError struct {
+	Code       string `json:"code,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Message    string `json:"message"`
+	RequestId  string `json:"request_id,omitempty"`
+}
+
+func newResultError(err error) *resultError {
+	var s3Err *s3.Error
+	if errors.As(err, &s3Err) {
+		return &resultError{Code: s3Err.Code, StatusCode: s3Err.StatusCode, Message: s3Err.Message,
+			RequestId: s3Err.RequestId}
+	}
+	return &resultError{Message: err.Error()}
+}
+
 type KeyGetter interface {
-	get(bucketName string, keyNames []string) []getResult
+	get(ctx context.Context, bucketName string, keyNames []string) []getResult
 }
 
 type CachedKeyGetter interface {
@@ -44,109 +99,483 @@ type CachedKeyGetter interface {
 	remove(bucketName string, keyName string) bool
 }
 
+// An s3Conn is a connection to S3. skew, if set, is kept measured from
+// its downloads. With regions set, a bucket S3 says is in another region
+// is looked up and requested from there instead.
 type s3Conn struct {
-	*s3.S3
+	*swappableS3
+	skew    *clockSkew
+	regions *bucketRegions
 }
 
 type keyReaderGetter interface {
 	getKeyReader(bucketName, keyName string) (io.ReadCloser, error)
 }
 
+// An etaggedReadCloser carries the ETag S3 sent along with an object's body.
+type etaggedReadCloser struct {
+	io.ReadCloser
+	etag string
+}
+
 func (s *s3Conn) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
-	bucket := s.Bucket(bucketName)
-	return bucket.GetReader(keyName)
+	resp, err := s.Bucket(bucketName).GetResponse(keyName)
+	if err != nil && s.relocate(bucketName, err) {
+		resp, err = s.Bucket(bucketName).GetResponse(keyName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.skew.observe(resp.Header)
+	return &etaggedReadCloser{resp.Body, normalizeETag(resp.Header.Get("ETag"))}, nil
 }
 
+// A tempKeyGetter downloads keys to fresh temp files. If stallTimeout is
+// set, a download that goes that long without receiving any bytes is
+// aborted with a stalled status. If downloadSlots is set, its limit
+// bounds the number of downloads in flight at once. If copyBufferSize is
+// set, downloads are copied through pooled buffers of that size rather
+// than io.Copy's default. fds, if set, bounds the files held open. Keys
+// of at least rangeMinBytes are fetched as rangeParts concurrent ranged
+// GETs, if rangeParts is more than one and the keyReaderGetter can.
+// Downloads whose md5 doesn't match one keyMD5 finds in their key name
+// are discarded. A key with a tee in its context is copied there too as
+// it downloads, and never fetched with ranged GETs. A key its bucket
+// doesn't have is fetched from the bucket's secondaryOrigins, if any, but
+// is still cached as the requested bucket's; mutable_bucket checks only
+// ever look at the requested bucket, though. integrityMode (one of
+// integrityModes, off if empty) decides how downloads are verified.
 type tempKeyGetter struct {
 	keyReaderGetter
+	stallTimeout     time.Duration
+	downloadSlots    *slots
+	copyBufferSize   int
+	copyBuffers      sync.Pool
+	fds              *fdGuard
+	rangeParts       int
+	rangeMinBytes    int64
+	keyMD5           *keyMD5Pattern
+	secondaryOrigins map[string][]string
+	integrityMode    string
+	clock            func() time.Time
+}
+
+func (t *tempKeyGetter) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if t.copyBufferSize <= 0 {
+		return io.Copy(dst, src)
+	}
+	buf, _ := t.copyBuffers.Get().(*[]byte)
+	if buf == nil || len(*buf) != t.copyBufferSize {
+		fresh := make([]byte, t.copyBufferSize)
+		buf = &fresh
+	}
+	defer t.copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
 }
 
-func (t *tempKeyGetter) getKey(bucketName, keyName string) getResult {
+const cancelled = "cancelled"
+
+func (t *tempKeyGetter) getKey(ctx context.Context, bucketName, keyName string) getResult {
 	result := getResult{keyName: keyName}
-	rc, err := t.getKeyReader(bucketName, keyName)
-	defer rc.Close()
+	if !t.fds.acquire(ctx, fdsPerDownload) {
+		result.status = tooManyOpenFiles
+		return result
+	}
+	defer t.fds.release(fdsPerDownload)
+	if trace.enabled() {
+		trace.event("download_start", "bucket", bucketName, "key", keyName)
+	}
+	client := teeFor(ctx, keyName)
+	if ifMatchFor(ctx, keyName) == "" && client == nil && len(forwardedHeadersFor(ctx)) == 0 {
+		if ranged, ok := t.getKeyRanged(ctx, bucketName, keyName); ok {
+			return ranged
+		}
+	}
+	rc, err := t.openFromOrigins(ctx, bucketName, keyName)
 	if err != nil {
+		if trace.enabled() {
+			trace.event("download_error", "bucket", bucketName, "key", keyName, "error", err.Error())
+		}
 		result.status = err.Error()
+		result.err = newResultError(err)
+		if isPreconditionFailed(err) {
+			result.status = preconditionFailed
+		}
 		return result
 	}
-	f, err := ioutil.TempFile(os.TempDir(), "s3cache_")
-	defer f.Close()
+	if etagged, ok := rc.(*etaggedReadCloser); ok {
+		result.etag = etagged.etag
+	}
+	if t.stallTimeout > 0 {
+		rc = newWatchdogReader(rc, t.stallTimeout)
+	}
+	defer rc.Close()
+	stopCancelling := context.AfterFunc(ctx, func() { rc.Close() })
+	defer stopCancelling()
+	f, err := ioutil.TempFile(os.TempDir(), tempFilePattern())
 	if err != nil {
 		result.status = err.Error()
+		result.err = newResultError(err)
 		return result
 	}
-	h := md5.New()
-	written, err := io.Copy(io.MultiWriter(f, h), rc)
+	defer f.Close()
+	h, sha256Hash := md5.New(), sha256.New()
+	dst := io.MultiWriter(f, h, sha256Hash)
+	if client != nil {
+		dst = io.MultiWriter(dst, client)
+	}
+	written, err := t.copy(dst, rc)
 	if err != nil {
+		os.Remove(f.Name())
+		if trace.enabled() {
+			trace.event("download_error", "bucket", bucketName, "key", keyName, "error", err.Error())
+		}
 		result.status = err.Error()
+		result.err = newResultError(err)
+		if ctx.Err() != nil {
+			result.status = cancelled
+		}
 		return result
 	}
+	if trace.enabled() {
+		trace.event("download_end", "bucket", bucketName, "key", keyName, "bytes", written)
+	}
+	return t.completed(result, f.Name(), written, h, sha256Hash)
+}
 
-	localPath := f.Name()
+// completed fills in result for a download of written bytes to localPath,
+// or discards it if it fails verification, unless integrityMode is lenient.
+func (t *tempKeyGetter) completed(result getResult, localPath string, written int64, md5Hash, sha256Hash hash.Hash) getResult {
+	err := t.verify(result, hex.EncodeToString(md5Hash.Sum(nil)))
+	if err != nil && t.integrityMode != integrityLenient {
+		os.Remove(localPath)
+		result.status = err.Error()
+		result.err = newResultError(err)
+		return result
+	}
 	result.status = fmt.Sprintf("cache miss, transferred %v bytes", written)
+	if err != nil {
+		log.Printf("Serving %v anyway: %v", result.keyName, err)
+		result.status = fmt.Sprintf("cache miss, transferred %v bytes (integrity warning: %v)", written, err)
+	}
 	result.localPath = &localPath
 	result.bytesTransferred = written
-	result.md5 = hex.Dump(h.Sum(nil))
+	result.md5 = hex.EncodeToString(md5Hash.Sum(nil))
+	result.sha256 = hex.EncodeToString(sha256Hash.Sum(nil))
 	return result
 }
 
-func (t *tempKeyGetter) get(bucketName string, keyNames []string) []getResult {
-	out := make([]getResult, 0, len(keyNames))
-	inbox := make(chan getResult)
+// acquireSlot waits for room to start another download, returning false
+// without taking a slot if ctx is cancelled first.
+func (t *tempKeyGetter) acquireSlot(ctx context.Context) bool {
+	return t.downloadSlots.acquire(ctx)
+}
 
-	for _, keyName := range keyNames {
-		go func(keyName string) {
-			inbox <- t.getKey(bucketName, keyName)
-		}(keyName)
-	}
+func (t *tempKeyGetter) releaseSlot() {
+	t.downloadSlots.release()
+}
 
-	for _ = range keyNames {
-		result := <-inbox
-		result.bucketName = bucketName
-		out = append(out, result)
+// get downloads keyNames concurrently. Once ctx is cancelled no further
+// downloads are started, and those in flight are aborted.
+func (t *tempKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	keyNames = t.inFetchOrder(ctx, bucketName, keyNames)
+	out := make([]getResult, len(keyNames))
+	var wg sync.WaitGroup
+	for i, keyName := range keyNames {
+		if !t.acquireSlot(ctx) {
+			out[i] = getResult{keyName: keyName, bucketName: bucketName, status: cancelled}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, keyName string) {
+			defer wg.Done()
+			defer t.releaseSlot()
+			ctx, sp := spans.start(ctx, "get_key")
+			defer sp.finish()
+			sp.set("aws.s3.bucket", bucketName)
+			sp.set("aws.s3.key", keyName)
+			sp.set("cache.hit", false)
+			start := t.now()
+			result := t.getKey(ctx, bucketName, keyName)
+			result.bucketName = bucketName
+			result.fetchTime = t.now().Sub(start)
+			result.throughput = throughput(result.bytesTransferred, result.fetchTime)
+			sp.set("download.bytes", result.bytesTransferred)
+			if result.localPath == nil {
+				sp.set("error", result.status)
+			}
+			if result.localPath != nil {
+				result.provenance = t.fetchedProvenance(ctx)
+			}
+			out[i] = result
+		}(i, keyName)
 	}
-
+	wg.Wait()
 	return out
 }
 
+// An lruCachedKeyGetter remembers the results of its base getter in
+// order of use. Each entry it returns is pinned for pinFor, so eviction
+// can't delete a file out from under a client that hasn't opened it yet;
+// once opened, deleting the file no longer affects the reader. With
+// shared set, the order keys were used in is kept there too, and it's
+// that order entries are evicted in. With shards set, keys are kept in
+// those instead, each locked on its own; see newShardedLRU.
 type lruCachedKeyGetter struct {
-	base  KeyGetter
-	cache map[string]map[string]*list.Element
+	base   KeyGetter
+	cache  lruIndex
+	pinFor time.Duration
+	shared sharedIndex
+	shards []*lruCachedKeyGetter
+	tally  lruTally
 	list.List
 	sync.RWMutex
 }
 
+// pinned reports whether r was returned to a client too recently to evict.
+func (r getResult) pinned() bool {
+	return time.Now().Before(r.pinnedUntil)
+}
+
+// An lruIndex finds the list element caching a bucket's key.
+type lruIndex interface {
+	lookup(bucketName, keyName string) (*list.Element, bool)
+	store(bucketName, keyName string, elem *list.Element)
+	drop(bucketName, keyName string)
+}
+
+// A nestedLRUIndex keeps a map of keys for each bucket.
+type nestedLRUIndex map[string]map[string]*list.Element
+
+func (n nestedLRUIndex) lookup(bucketName, keyName string) (*list.Element, bool) {
+	elem, had := n[bucketName][keyName]
+	return elem, had
+}
+
+func (n nestedLRUIndex) store(bucketName, keyName string, elem *list.Element) {
+	bucket, had := n[bucketName]
+	if !had {
+		bucket = make(map[string]*list.Element)
+		n[bucketName] = bucket
+	}
+	bucket[keyName] = elem
+}
+
+func (n nestedLRUIndex) drop(bucketName, keyName string) {
+	delete(n[bucketName], keyName)
+}
+
+// A flatLRUIndex keeps every bucket's keys in one map, which saves the
+// inner maps when many buckets are cached, though composing the index key
+// costs an allocation on every lookup that a nestedLRUIndex doesn't. Bucket
+// names can't contain a NUL, so the first one in an index key always ends
+// the bucket name and no two bucket/key pairs share an index key.
+type flatLRUIndex map[string]*list.Element
+
+func flatLRUKey(bucketName, keyName string) string {
+	return bucketName + "\x00" + keyName
+}
+
+func (f flatLRUIndex) lookup(bucketName, keyName string) (*list.Element, bool) {
+	elem, had := f[flatLRUKey(bucketName, keyName)]
+	return elem, had
+}
+
+func (f flatLRUIndex) store(bucketName, keyName string, elem *list.Element) {
+	f[flatLRUKey(bucketName, keyName)] = elem
+}
+
+func (f flatLRUIndex) drop(bucketName, keyName string) {
+	delete(f, flatLRUKey(bucketName, keyName))
+}
+
+// A boundedDiskCachedKeyGetter keeps the disk cache under a byte budget by
+// evicting the least recently used entries, though never one cached less
+// than gracePeriod ago. Past softLimit, keepClean evicts in the background
+// without holding up requests; past hardLimit, the request that crossed it
+// evicts synchronously before returning. Background eviction waits
+// evictionPace between deletes so it doesn't starve downloads of disk I/O.
+// With the random2 policy, each eviction takes the less recently used of
+// two entries sampled at random rather than the least recently used one.
+// If keepClean panics, it logs why, waits restartDelay and starts over,
+// counting the restart in stats. With behindAfter set, a cache that stays
+// past softLimit that long is taken to be downloading faster than it can
+// evict, and downloads are held back by behindAction (one of
+// behindActions) until it catches up.
 type boundedDiskCachedKeyGetter struct {
-	lru        *lruCachedKeyGetter
-	disk       CachedKeyGetter
-	downloaded chan int64
-}
-
-func (b *boundedDiskCachedKeyGetter) keepClean(maxBytes int64) {
-	var totalDownloaded int64 = 0
-	for {
-		totalDownloaded += <-b.downloaded
-		if totalDownloaded > maxBytes {
-			b.lru.Lock()
-			for maxBytes-totalDownloaded > 0 {
-				oldestResult := b.lru.oldest()
-				if oldestResult == nil {
-					log.Printf("Above maxBytes %v with size of %v, but no entries left in lru!", maxBytes, totalDownloaded)
-					break
-				}
-				b.lru.remove(oldestResult.bucketName, oldestResult.keyName)
-				b.disk.remove(oldestResult.bucketName, oldestResult.keyName)
-				totalDownloaded -= oldestResult.bytesTransferred
+	lru            *lruCachedKeyGetter
+	disk           CachedKeyGetter
+	gracePeriod    time.Duration
+	softLimit      int64
+	hardLimit      int64
+	evictionPace   time.Duration
+	evictionPolicy string
+	rng            *rand.Rand
+	wake           chan struct{}
+	restartDelay   time.Duration
+	reconcileSizes bool
+	behindAfter    time.Duration
+	behindAction   string
+	behindBackoff  time.Duration
+	stats          *cacheStats
+	total          int64
+	overSince      time.Time
+	isBehind       bool
+	sync.Mutex
+}
+
+var evictionPolicies = []string{"lru", "random2"}
+
+// nextVictim picks the next entry to evict under the eviction policy.
+func (b *boundedDiskCachedKeyGetter) nextVictim() *getResult {
+	if b.evictionPolicy == "random2" {
+		// a rand.Rand isn't safe for concurrent use
+		b.Lock()
+		defer b.Unlock()
+		if b.rng == nil {
+			b.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		return b.lru.sampleOldest(b.gracePeriod, 2, b.rng)
+	}
+	return b.lru.oldest(b.gracePeriod)
+}
+
+func (b *boundedDiskCachedKeyGetter) keepClean() {
+	for !b.cleanUntilClosed() {
+		b.stats.evictionRestarted()
+		time.Sleep(b.restartDelay)
+	}
+}
+
+// cleanUntilClosed evicts down to softLimit each time it's woken, returning
+// true once wake is closed or false if eviction panicked. Left to die, the
+// eviction goroutine would let the cache grow without bound. With
+// reconcileSizes set, the total is corrected for files that have changed
+// size on disk before anything is evicted.
+func (b *boundedDiskCachedKeyGetter) cleanUntilClosed() (closed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Background eviction panicked, restarting it: %v\n%s", r, debug.Stack())
+		}
+	}()
+	for range b.wake {
+		if b.reconcileSizes {
+			b.reconcileAll()
+		}
+		soft, _, pace := b.limits()
+		b.shrinkTo(soft, pace)
+	}
+	return true
+}
+
+// limits returns the soft and hard limits and the eviction pace, which
+// setLimits may change while keys are being cached.
+func (b *boundedDiskCachedKeyGetter) limits() (soft, hard int64, pace time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	return b.softLimit, b.hardLimit, b.evictionPace
+}
+
+// setLimits changes the limits in place, waking keepClean to evict down to
+// the new soft limit if the cache is already past it.
+func (b *boundedDiskCachedKeyGetter) setLimits(soft, hard int64, pace time.Duration) {
+	b.Lock()
+	b.softLimit, b.hardLimit, b.evictionPace = soft, hard, pace
+	over := b.total > soft
+	b.Unlock()
+	if over {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *boundedDiskCachedKeyGetter) size() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.total
+}
+
+func (b *boundedDiskCachedKeyGetter) adjust(bytes int64) int64 {
+	b.Lock()
+	defer b.Unlock()
+	b.total += bytes
+	return b.total
+}
+
+// account adds newly cached bytes to the total, waking keepClean past the
+// soft limit and evicting right away past the hard one.
+func (b *boundedDiskCachedKeyGetter) account(bytes int64) {
+	total := b.adjust(bytes)
+	soft, hard, _ := b.limits()
+	if hard > 0 && total > hard {
+		b.shrinkTo(hard, 0)
+	}
+	if total > soft {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+	b.behind()
+}
+
+// shrinkTo evicts entries one at a time, pace apart, until the total is
+// within limit. The total is rechecked before each delete, so bytes cached
+// or evicted elsewhere while it waits are counted.
+func (b *boundedDiskCachedKeyGetter) shrinkTo(limit int64, pace time.Duration) {
+	for evicted := 0; b.size() > limit; evicted++ {
+		if evicted > 0 && pace > 0 {
+			time.Sleep(pace)
+			if b.size() <= limit {
+				return
 			}
-			b.lru.Unlock()
+		}
+		oldestResult := b.nextVictim()
+		if oldestResult == nil {
+			log.Printf("Above %v bytes with size of %v, but no evictable entries left in lru!", limit, b.size())
+			return
+		}
+		if trace.enabled() {
+			trace.event("evict", "bucket", oldestResult.bucketName, "key", oldestResult.keyName)
+		}
+		if b.lru.remove(oldestResult.bucketName, oldestResult.keyName) {
+			b.disk.remove(oldestResult.bucketName, oldestResult.keyName)
+			b.adjust(-oldestResult.bytesTransferred)
 		}
 	}
 }
 
-func (b *boundedDiskCachedKeyGetter) get(bucketName string, keyNames []string) []getResult {
-	out := make([]getResult, len(keyNames))
-	known := make([]string, len(keyNames)/2)
-	missing := make([]string, len(keyNames)/2)
+func (b *boundedDiskCachedKeyGetter) has(bucketName, keyName string) bool {
+	return b.disk.has(bucketName, keyName)
+}
+
+// admitImported counts a key put on disk some other way than through b,
+// as if b had just fetched it, in place of whatever it had for it before.
+func (b *boundedDiskCachedKeyGetter) admitImported(result getResult) {
+	if previous := b.lru.peek(result.bucketName, result.keyName); previous != nil {
+		b.adjust(-previous.bytesTransferred)
+	}
+	b.lru.admit(result)
+	b.account(result.bytesTransferred)
+}
+
+func (b *boundedDiskCachedKeyGetter) remove(bucketName, keyName string) bool {
+	result := b.lru.peek(bucketName, keyName)
+	if b.lru.remove(bucketName, keyName) && result != nil {
+		b.adjust(-result.bytesTransferred)
+	}
+	return b.disk.remove(bucketName, keyName)
+}
+
+func (b *boundedDiskCachedKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	out := make([]getResult, 0, len(keyNames))
+	known := make([]string, 0, len(keyNames))
+	missing := make([]string, 0, len(keyNames))
+	for _, dropped := range b.lru.dropForgotten(bucketName, keyNames) {
+		b.adjust(-dropped.bytesTransferred)
+	}
 	for _, keyName := range keyNames {
 		if b.lru.has(bucketName, keyName) {
 			known = append(known, keyName)
@@ -154,125 +583,403 @@ func (b *boundedDiskCachedKeyGetter) get(bucketName string, keyNames []string) [
 			missing = append(missing, keyName)
 		}
 	}
-	out = append(out, b.lru.get(bucketName, known)...)
+	out = append(out, b.lru.get(ctx, bucketName, known)...)
+	missing, refused := b.holdBack(ctx, bucketName, missing)
+	out = append(out, refused...)
 	var newdled int64
-	for _, result := range b.lru.get(bucketName, missing) {
-		newdled += result.bytesTransferred
+	for _, result := range b.lru.get(ctx, bucketName, missing) {
+		if !passedThroughFile(result) {
+			newdled += result.bytesTransferred
+		}
 		out = append(out, result)
 	}
-	b.downloaded <- newdled
+	b.account(newdled)
 	return out
 }
 
+// A diskCachedKeyGetter keeps the results of its base getter under
+// cacheDir. With dedupByETag set, keys whose content has the same ETag
+// share a single hard-linked file. With contentAddressed set, each newly
+// cached file is also hard-linked under its md5 for serveCAS. Files live
+// on fs, or the real filesystem if it's nil; base's downloads must be on
+// the same one. Keys are laid out by layout, or under
+// cacheDir/bucket/key if it's nil. Newly cached files are flushed to disk
+// according to fsyncPolicy (one of fsyncPolicies), or not at all if it's
+// empty. onDuplicate (one of duplicatePolicies, replace if empty) decides
+// whether a download of a key already cached replaces it. With foldCase
+// set, key names are encoded on disk so that ones differing only in case
+// don't collide on a case-insensitive filesystem. moveSlots, if set, caps
+// how many downloads are moved into the cache at once, since many
+// concurrent mkdirs and renames contend on some filesystems' metadata locks.
+// With dirs set, removing a key also removes the directories it leaves
+// empty. A move that fails with ENOSPC or EBUSY is retried up to
+// moveRetries times, calling makeRoom, if set, to evict before each retry
+// for space. onRemove, if set, is called with each key removed. Its
+// /digest, /manifest and /cas/ handlers only serve buckets allowed
+// allows, as keyServer only fetches them.
 type diskCachedKeyGetter struct {
-	base     KeyGetter
-	cacheDir string
+	base             KeyGetter
+	cacheDir         string
+	layout           *pathTemplate
+	fsyncPolicy      string
+	onDuplicate      string
+	foldCase         bool
+	moveSlots        *slots
+	moveRetries      int
+	makeRoom         func(bytes int64)
+	onRemove         func(bucketName, keyName string)
+	allowed          bucketAllowlist
+	dirs             *dirGuard
+	fs               cacheFS
+	stats            *cacheStats
+	dedupByETag      bool
+	contentAddressed bool
+	etagTwins        map[string]etagTwin
+	etagsLock        sync.Mutex
+}
+
+func (d *diskCachedKeyGetter) files() cacheFS {
+	if d.fs == nil {
+		return osFS{}
+	}
+	return d.fs
 }
 
 func (d *diskCachedKeyGetter) remove(bucketName string, keyName string) bool {
-	err := os.Remove(d.pathFor(bucketName, keyName))
+	if d.contentAddressed {
+		d.unlinkCAS(bucketName, keyName)
+	}
+	keyPath, err := d.pathFor(bucketName, keyName)
+	if err != nil {
+		return false
+	}
+	metadataPath, _ := d.metadataPathFor(bucketName, keyName)
+	if d.dedupByETag {
+		d.forgetETagTwin(bucketName, keyName, keyPath)
+	}
+	err = d.files().Remove(keyPath)
+	if err == nil {
+		d.stats.removed(bucketName)
+		d.removeMetadata(bucketName, keyName)
+		if d.onRemove != nil {
+			d.onRemove(bucketName, keyName)
+		}
+		d.dirs.pruneParents(d.files(), keyPath, d.cacheDir)
+		d.dirs.pruneParents(d.files(), metadataPath, path.Join(d.cacheDir, ".meta"))
+	}
 	return !os.IsNotExist(err)
 }
 
-func (m *lruCachedKeyGetter) oldest() *getResult {
-	if m.List.Len() == 0 {
+// oldest returns the least recently used unpinned entry that was cached
+// at least minAge ago, or nil if there is none.
+func (m *lruCachedKeyGetter) oldest(minAge time.Duration) *getResult {
+	if m.shared != nil {
+		if result, ok := m.sharedOldest(minAge); ok {
+			return result
+		}
+	}
+	if m.shards != nil {
+		return m.shardedOldest(minAge)
+	}
+	m.RLock()
+	defer m.RUnlock()
+	for elem := m.List.Back(); elem != nil; elem = elem.Prev() {
+		result, ok := elem.Value.(getResult)
+		if !ok {
+			log.Printf("Skipping an lru entry holding a %T rather than a getResult", elem.Value)
+			continue
+		}
+		if time.Since(result.cachedAt) >= minAge && !result.pinned() {
+			return &result
+		}
+	}
+	return nil
+}
+
+// sampleOldest picks samples unpinned entries cached at least minAge ago
+// at random and returns the least recently used of them, or nil if there
+// are none. Unlike oldest, a scan that touches many keys once doesn't
+// decide which entries go next.
+func (m *lruCachedKeyGetter) sampleOldest(minAge time.Duration, samples int, rng *rand.Rand) *getResult {
+	if m.shards != nil {
+		return m.shardedSampleOldest(minAge, samples, rng)
+	}
+	m.RLock()
+	defer m.RUnlock()
+	// reservoir sampling, walking from the least recently used end so the
+	// first of the sample seen is the one to evict
+	positions := make([]int, 0, samples)
+	chosen := make([]*list.Element, 0, samples)
+	seen := 0
+	for elem := m.List.Back(); elem != nil; elem = elem.Prev() {
+		if result, ok := elem.Value.(getResult); !ok || time.Since(result.cachedAt) < minAge || result.pinned() {
+			continue
+		}
+		if len(chosen) < samples {
+			positions = append(positions, seen)
+			chosen = append(chosen, elem)
+		} else if i := rng.Intn(seen + 1); i < samples {
+			positions[i], chosen[i] = seen, elem
+		}
+		seen++
+	}
+	if len(chosen) == 0 {
+		return nil
+	}
+	victim := 0
+	for i := range chosen {
+		if positions[i] < positions[victim] {
+			victim = i
+		}
+	}
+	result := chosen[victim].Value.(getResult)
+	return &result
+}
+
+func (m *lruCachedKeyGetter) peek(bucketName, keyName string) *getResult {
+	if m.shards != nil {
+		return m.shardFor(bucketName, keyName).peek(bucketName, keyName)
+	}
+	m.RLock()
+	defer m.RUnlock()
+	if m.cache == nil {
+		return nil
+	}
+	elem, had := m.cache.lookup(bucketName, keyName)
+	if !had {
 		return nil
 	}
-	result := m.List.Back().Value.(getResult)
+	result := elem.Value.(getResult)
 	return &result
 }
 
+// remove drops keyName, from the shared index too even if this node never
+// had it, since whoever's removing it is deleting it from disk.
 func (m *lruCachedKeyGetter) remove(bucketName string, keyName string) bool {
-	if !m.has(bucketName, keyName) {
+	if m.shared != nil {
+		if err := m.shared.forget(bucketName, keyName); err != nil {
+			log.Printf("Couldn't drop %v/%v from the shared index: %v", bucketName, keyName, err)
+		}
+	}
+	if m.shards != nil {
+		return m.shardFor(bucketName, keyName).remove(bucketName, keyName)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.cache == nil {
+		return false
+	}
+	elem, had := m.cache.lookup(bucketName, keyName)
+	if !had {
 		return false
+	}
+	m.untallyLocked(elem)
+	m.Remove(elem)
+	m.cache.drop(bucketName, keyName)
+	return true
+}
+
+func (m *lruCachedKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	var out []getResult
+	var missing []string
+	if m.shards != nil {
+		out, missing = m.shardedHits(bucketName, keyNames)
 	} else {
-		m.Lock()
-		m.Remove(m.cache[bucketName][keyName])
-		delete(m.cache[bucketName], keyName)
-		m.Unlock()
-		return true
+		out, missing = m.hits(bucketName, keyNames)
 	}
+	touched := append([]getResult(nil), out...)
+	if len(missing) > 0 {
+		for _, result := range m.base.get(ctx, bucketName, missing) {
+			out = append(out, result)
+			if result.localPath != nil && !passedThroughFile(result) {
+				segment := m.shardFor(bucketName, result.keyName)
+				segment.Lock()
+				result.pinnedUntil = time.Now().Add(m.pinFor)
+				segment.admitLocked(bucketName, result)
+				segment.Unlock()
+				result.cachedAt = time.Now()
+				touched = append(touched, result)
+			}
+		}
+	}
+	m.touchShared(bucketName, touched)
+	return out
 }
 
-func (m *lruCachedKeyGetter) get(bucketName string, keyNames []string) []getResult {
-	bucket, had := m.cache[bucketName]
-	if !had {
-		m.Lock()
-		bucket = make(map[string]*list.Element, 2*len(keyNames))
-		m.cache[bucketName] = bucket
-		m.Unlock()
+// hits returns the entries for those of keyNames that are in the lru,
+// marking them just used, and the rest as missing.
+func (m *lruCachedKeyGetter) hits(bucketName string, keyNames []string) ([]getResult, []string) {
+	out := make([]getResult, 0, len(keyNames))
+	missing := make([]string, 0, len(keyNames))
+	m.Lock()
+	defer m.Unlock()
+	if m.cache == nil {
+		m.cache = nestedLRUIndex{}
 	}
-	out := make([]getResult, len(keyNames))
-	missing := make([]string, len(keyNames)/2)
 	for _, keyName := range keyNames {
-		m.RLock()
-		cachedResultElement, had := bucket[keyName]
-		if had {
+		if cachedResultElement, had := m.cache.lookup(bucketName, keyName); had {
 			m.MoveToFront(cachedResultElement)
 			cachedResult := cachedResultElement.Value.(getResult)
+			cachedResult.pinnedUntil = time.Now().Add(m.pinFor)
+			cachedResult.used = lruUses.Add(1)
+			cachedResultElement.Value = cachedResult
 			cachedResult.status = "cache_hit"
+			cachedResult.provenance.Source = fromMemory
 			out = append(out, cachedResult)
-			m.RUnlock()
-			continue
 		} else {
-			m.RUnlock()
 			missing = append(missing, keyName)
 		}
 	}
-	if len(missing) > 0 {
-		results := m.base.get(bucketName, missing)
-		m.Lock()
-		for _, result := range results {
-			resultElem := m.PushFront(result)
-			bucket[result.keyName] = resultElem
-			out = append(out, result)
-		}
-		m.Unlock()
+	m.tally.hits.Add(int64(len(out)))
+	m.tally.misses.Add(int64(len(missing)))
+	return out, missing
+}
+
+// admit records a result fetched some other way as the most recently used.
+func (m *lruCachedKeyGetter) admit(result getResult) {
+	if m.shards != nil {
+		m.shardFor(result.bucketName, result.keyName).admit(result)
+		result.cachedAt = time.Now()
+		m.touchShared(result.bucketName, []getResult{result})
+		return
+	}
+	m.Lock()
+	if m.cache == nil {
+		m.cache = nestedLRUIndex{}
+	}
+	m.admitLocked(result.bucketName, result)
+	m.Unlock()
+	result.cachedAt = time.Now()
+	m.touchShared(result.bucketName, []getResult{result})
+}
+
+func (m *lruCachedKeyGetter) admitLocked(bucketName string, result getResult) {
+	result.cachedAt = time.Now()
+	m.pushLocked(bucketName, result)
+}
+
+func (m *lruCachedKeyGetter) pushLocked(bucketName string, result getResult) {
+	if m.cache == nil {
+		m.cache = nestedLRUIndex{}
+	}
+	result.used = lruUses.Add(1)
+	if previous, had := m.cache.lookup(bucketName, result.keyName); had {
+		m.untallyLocked(previous)
+		m.Remove(previous)
+	}
+	m.cache.store(bucketName, result.keyName, m.PushFront(result))
+	m.tally.entries.Add(1)
+	m.tally.bytes.Add(result.bytesTransferred)
+}
+
+// untallyLocked takes elem, about to be removed, out of m's tallies.
+func (m *lruCachedKeyGetter) untallyLocked(elem *list.Element) {
+	if result, ok := elem.Value.(getResult); ok {
+		m.tally.entries.Add(-1)
+		m.tally.bytes.Add(-result.bytesTransferred)
 	}
-	return out
 }
 
 func (m *lruCachedKeyGetter) has(bucketName, keyName string) bool {
-	bucket, had := m.cache[bucketName]
-	if !had {
-		return false
+	if m.shards != nil {
+		return m.shardFor(bucketName, keyName).has(bucketName, keyName)
 	}
-	_, had = bucket[keyName]
-	if !had {
+	m.RLock()
+	defer m.RUnlock()
+	if m.cache == nil {
 		return false
 	}
-	return true
+	_, had := m.cache.lookup(bucketName, keyName)
+	return had
 }
 
+// has only counts regular files, since the path for a key like a/b is a
+// directory when a/b/c is cached.
 func (d *diskCachedKeyGetter) has(bucketName, keyName string) bool {
-	if _, err := os.Stat(d.pathFor(bucketName, keyName)); os.IsNotExist(err) {
+	keyPath, err := d.pathFor(bucketName, keyName)
+	if err != nil {
+		return false
+	}
+	if info, err := d.files().Stat(keyPath); err != nil {
 		return false
 	} else {
-		return true
+		return info.Mode().IsRegular()
 	}
 }
 
-func (d *diskCachedKeyGetter) get(bucketName string, keyNames []string) []getResult {
+const folderMarker = "folder marker, not cached"
+
+func (d *diskCachedKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
 	out := make([]getResult, 0, len(keyNames))
 	missing := make([]string, 0, len(keyNames)/2)
 	for _, keyName := range keyNames {
 		var result getResult
-		if d.has(bucketName, keyName) {
-			localPath := d.pathFor(bucketName, keyName)
+		if strings.HasSuffix(keyName, "/") {
+			// its path would be the directory holding the keys under it
+			out = append(out, getResult{keyName: keyName, bucketName: bucketName, status: folderMarker})
+		} else if _, err := d.pathFor(bucketName, keyName); err != nil {
+			// it has nowhere under the cache to go, so it isn't fetched
+			out = append(out, getResult{keyName: keyName, bucketName: bucketName, status: err.Error()})
+		} else if d.has(bucketName, keyName) {
+			localPath, _ := d.pathFor(bucketName, keyName)
 			result = getResult{status: "disk cache hit", localPath: &localPath, keyName: keyName,
 				bucketName: bucketName}
+			d.loadMetadata(&result)
+			if info, err := d.files().Stat(localPath); err == nil {
+				// nothing was transferred, but the entry still takes up its size
+				result.bytesTransferred = info.Size()
+			}
+			result.provenance.Source = fromDisk
+			d.stats.hit(bucketName)
+			if trace.enabled() {
+				trace.event("hit", "bucket", bucketName, "key", keyName)
+			}
+			_, sp := spans.start(ctx, "get_key")
+			sp.set("aws.s3.bucket", bucketName)
+			sp.set("aws.s3.key", keyName)
+			sp.set("cache.hit", true)
+			sp.finish()
 			out = append(out, result)
 		} else {
+			d.stats.miss(bucketName)
+			if trace.enabled() {
+				trace.event("miss", "bucket", bucketName, "key", keyName)
+			}
 			missing = append(missing, keyName)
 		}
 	}
 	if len(missing) > 0 {
-		results := d.base.get(bucketName, missing)
+		timed := d.stats.sampled()
+		results := d.base.get(ctx, bucketName, missing)
 		for _, result := range results {
-			cachedResult, err := d.moveToCache(bucketName, result)
+			if result.localPath == nil || passedThroughFile(result) {
+				// the base getter failed or passed the key through; pass
+				// its result along untouched
+				out = append(out, result)
+				continue
+			}
+			cachedResult, err := d.moveWithRetries(ctx, bucketName, result)
 			if err != nil {
+				d.files().Remove(*result.localPath)
 				cachedResult.status = err.Error()
+				if ctx.Err() != nil {
+					cachedResult.status = cancelled
+				}
 				cachedResult.localPath = nil
+			} else {
+				d.stats.stored(bucketName, cachedResult.bytesTransferred)
+				d.stats.downloaded(bucketName, cachedResult)
+				if timed {
+					d.stats.fetched(cachedResult.fetchTime)
+				}
+				if err := d.writeMetadata(bucketName, cachedResult); err != nil {
+					log.Printf("Couldn't record metadata for %v/%v: %v", bucketName, cachedResult.keyName, err)
+				}
+				if d.contentAddressed {
+					if err := d.linkCAS(cachedResult); err != nil {
+						log.Printf("Couldn't link %v/%v by content: %v", bucketName, cachedResult.keyName, err)
+					}
+				}
 			}
 			out = append(out, cachedResult)
 		}
@@ -280,54 +987,386 @@ func (d *diskCachedKeyGetter) get(bucketName string, keyNames []string) []getRes
 	return out
 }
 
-func (d *diskCachedKeyGetter) pathFor(bucketName, keyName string) string {
-	return path.Join(d.cacheDir, bucketName, keyName)
+// checkBucketName refuses a bucket name that isn't a single path segment,
+// or starts with . or _ like the cache's own directories under cacheDir.
+// S3 allows neither, so no real bucket is refused.
+func checkBucketName(bucketName string) error {
+	if bucketName == "" || strings.ContainsAny(bucketName, "/\\") || strings.HasPrefix(bucketName, ".") ||
+		strings.HasPrefix(bucketName, "_") {
+		return fmt.Errorf("invalid bucket name %q", bucketName)
+	}
+	return nil
+}
+
+// checkNames refuses names whose files would land anywhere but under their
+// bucket's own directory: a bad bucket name, or a key with a . or ..
+// segment, which a path would resolve rather than keep.
+func checkNames(bucketName, keyName string) error {
+	if err := checkBucketName(bucketName); err != nil {
+		return err
+	}
+	for _, segment := range strings.Split(keyName, "/") {
+		if segment == "." || segment == ".." {
+			return fmt.Errorf("invalid key name %q: it has a %v segment", keyName, segment)
+		}
+	}
+	return nil
+}
+
+// pathFor is where keyName's file is cached, or an error if the names
+// would put it anywhere but under its bucket's directory.
+func (d *diskCachedKeyGetter) pathFor(bucketName, keyName string) (string, error) {
+	if err := checkNames(bucketName, keyName); err != nil {
+		return "", err
+	}
+	if d.foldCase {
+		keyName = foldSafeKeyName(keyName)
+	}
+	var keyPath string
+	if d.layout == nil {
+		keyPath = path.Join(d.cacheDir, bucketName, keyName)
+	} else {
+		keyPath = d.layout.expand(d.cacheDir, bucketName, keyName)
+	}
+	return keyPath, inside(path.Join(d.cacheDir, bucketName), keyPath)
+}
+
+// inside refuses p unless it's somewhere under dir.
+func inside(dir, p string) error {
+	if !strings.HasPrefix(p, dir+"/") {
+		return fmt.Errorf("%v is outside %v", p, dir)
+	}
+	return nil
 }
 
-func (d *diskCachedKeyGetter) moveToCache(bucketName string, g getResult) (getResult, error) {
-	newPath := d.pathFor(bucketName, g.keyName)
+// moveToCache puts g's file in place under cacheDir all at once, by a
+// rename or a hard link, so a cancelled request never leaves a partial
+// entry behind. Once ctx is cancelled, nothing more is moved.
+func (d *diskCachedKeyGetter) moveToCache(ctx context.Context, bucketName string, g getResult) (getResult, error) {
+	newPath, err := d.pathFor(bucketName, g.keyName)
+	if err != nil {
+		return g, err
+	}
 	if g.localPath == nil {
 		return g, fmt.Errorf("no localPath for given getResult")
 	}
-	if err := os.MkdirAll(path.Dir(newPath), 0777); err != nil {
-		return g, fmt.Errorf("couldn't create directory to move getResult to")
+	if !d.moveSlots.acquire(ctx) {
+		return g, ctx.Err()
 	}
-	err := os.Rename(*g.localPath, newPath)
-	if err != nil {
+	defer d.moveSlots.release()
+	d.dirs.filling()
+	defer d.dirs.filled()
+	if err := d.files().MkdirAll(path.Dir(newPath), 0777); errors.Is(err, syscall.ENOTDIR) {
+		return g, fmt.Errorf("can't cache %v under another cached key that is a prefix of it", g.keyName)
+	} else if err != nil {
+		return g, fmt.Errorf("couldn't create directory to move getResult to: %v", err)
+	}
+	if info, err := d.files().Stat(newPath); err == nil && info.IsDir() {
+		return g, fmt.Errorf("can't cache %v over the other cached keys under it", g.keyName)
+	}
+	if err := ctx.Err(); err != nil {
+		return g, err
+	}
+	if d.dedupByETag && d.linkETagTwin(bucketName, g, newPath) {
+		d.files().Remove(*g.localPath)
+	} else if kept, err := d.place(ctx, *g.localPath, newPath); err != nil {
 		return g, err
+	} else if kept {
+		if trace.enabled() {
+			trace.event("duplicate_kept", "bucket", bucketName, "key", g.keyName)
+		}
 	}
+	d.syncEntry(newPath)
 	g.localPath = &newPath
 	return g, nil
 }
 
-// An EvictingMutableKeyGetter checks with a ShouldEvicter to determine
-// if a key should be deleted from the cache for mutable requests.
-// As this exposes the underlying CachedKeyGetter, eviction can be ignored
-// by using the .get(bucketName, keyNames) interface
-type EvictingMutableKeyGetter struct {
-	CachedKeyGetter
-	ShouldEvicter
-}
-
-type ShouldEvicter interface {
-	ShouldEvict(getResult) (bool, error)
-}
+// What moveToCache does with a download of a key that's already cached,
+// which two downloads of the same key racing each other can leave it with.
+const (
+	replaceDuplicate = "replace"
+	keepDuplicate    = "keep"
+)
 
-type md5ShouldEvicter struct {
-	*s3.S3
-}
+var duplicatePolicies = []string{replaceDuplicate, keepDuplicate}
 
-func md5For(conn *s3.S3, bucketName, keyName string) (string, error) {
-	listResp, err := conn.Bucket(bucketName).List("", "", keyName, 1)
-	if err != nil {
-		return "", err
+// place moves from to to, reporting false. If to already exists, it's
+// replaced all at once, or with onDuplicate set to keep, left as it is
+// and from discarded instead, in which case place reports true.
+func (d *diskCachedKeyGetter) place(ctx context.Context, from, to string) (bool, error) {
+	if d.onDuplicate != keepDuplicate {
+		err := d.files().Rename(from, to)
+		if errors.Is(err, syscall.EXDEV) {
+			if err = d.copyIntoPlace(ctx, from, to); err == nil {
+				d.files().Remove(from)
+			}
+		}
+		return false, err
 	}
-	etag := listResp.Contents[0].ETag
-	return etag[1 : len(etag)-1], nil
+	// unlike a rename, a link never replaces what's already there
+	err := d.files().Link(from, to)
+	if errors.Is(err, syscall.EXDEV) {
+		// which can't be done across filesystems, so there's a window
+		// between checking for to and copying over it
+		if _, statErr := d.files().Stat(to); statErr == nil {
+			err = os.ErrExist
+		} else {
+			err = d.copyIntoPlace(ctx, from, to)
+		}
+	}
+	if err != nil && !os.IsExist(err) {
+		return false, err
+	}
+	d.files().Remove(from)
+	return err != nil, nil
+}
+
+const (
+	fsyncNone    = "none"
+	fsyncFile    = "file"
+	fsyncFileDir = "file+dir"
+)
+
+// fsyncPolicies trade throughput for how much of a newly cached entry is
+// sure to survive a power loss: nothing, its contents, or its contents and
+// its name. Without the directory synced, a crash can lose the rename and
+// with it the entry, which is a miss; without the file synced, the entry
+// can survive empty or partial, which would be a corrupt hit.
+var fsyncPolicies = []string{fsyncNone, fsyncFile, fsyncFileDir}
+
+func (d *diskCachedKeyGetter) syncEntry(localPath string) {
+	if d.fsyncPolicy != fsyncFile && d.fsyncPolicy != fsyncFileDir {
+		return
+	}
+	if err := d.files().Sync(localPath); err != nil {
+		log.Printf("Couldn't sync %v to disk: %v", localPath, err)
+	}
+	if d.fsyncPolicy == fsyncFileDir {
+		if err := d.files().Sync(path.Dir(localPath)); err != nil {
+			log.Printf("Couldn't sync %v to disk: %v", path.Dir(localPath), err)
+		}
+	}
+}
+
+// copyIntoPlace copies from to to when they're on different filesystems
+// and can't be renamed, which only happens on the real filesystem. The
+// copy is made under cacheDir/_partial (no S3 bucket name can start with
+// an underscore) and only renamed into place once complete; if ctx is
+// cancelled partway, the partial copy is removed.
+func (d *diskCachedKeyGetter) copyIntoPlace(ctx context.Context, from, to string) error {
+	partialDir := path.Join(d.cacheDir, "_partial")
+	if err := os.MkdirAll(partialDir, 0777); err != nil {
+		return err
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	partial, err := ioutil.TempFile(partialDir, "move_")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(partial, ctxReader{ctx, src})
+	if closeErr := partial.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = os.Rename(partial.Name(), to)
+	}
+	if err != nil {
+		os.Remove(partial.Name())
+	}
+	return err
+}
+
+// A ctxReader stops reading once its context is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.Reader.Read(p)
+}
+
+// An etagTwin is the cached file new downloads with its ETag are linked to.
+type etagTwin struct {
+	bucketName, keyName, path string
+}
+
+// linkETagTwin hard-links newPath to an already cached file with the same
+// ETag as g, returning false (and remembering newPath for next time) when
+// there is no such file to link to. The twin's sidecar must still record
+// that ETag, in case it's been replaced since it was remembered.
+func (d *diskCachedKeyGetter) linkETagTwin(bucketName string, g getResult, newPath string) bool {
+	// whatever newPath held is about to be replaced
+	d.forgetETagTwin(bucketName, g.keyName, newPath)
+	// Multipart ETags aren't content hashes, so equal ones prove nothing.
+	if g.etag == "" || strings.Contains(g.etag, "-") {
+		return false
+	}
+	d.etagsLock.Lock()
+	defer d.etagsLock.Unlock()
+	twin, had := d.etagTwins[g.etag]
+	if had && twin.path != newPath {
+		recorded := getResult{bucketName: twin.bucketName, keyName: twin.keyName}
+		d.loadMetadata(&recorded)
+		if recorded.etag == g.etag && d.files().Link(twin.path, newPath) == nil {
+			return true
+		}
+	}
+	if d.etagTwins == nil {
+		d.etagTwins = make(map[string]etagTwin)
+	}
+	d.etagTwins[g.etag] = etagTwin{bucketName, g.keyName, newPath}
+	return false
+}
+
+// forgetETagTwin stops linking new downloads to keyPath, which is about to
+// be removed or replaced, going by the ETag its sidecar records.
+func (d *diskCachedKeyGetter) forgetETagTwin(bucketName, keyName, keyPath string) {
+	cached := getResult{bucketName: bucketName, keyName: keyName}
+	d.loadMetadata(&cached)
+	d.etagsLock.Lock()
+	defer d.etagsLock.Unlock()
+	if twin, had := d.etagTwins[cached.etag]; had && twin.path == keyPath {
+		delete(d.etagTwins, cached.etag)
+	}
+}
+
+// An EvictingMutableKeyGetter checks with a ShouldEvicter to determine
+// if a key should be deleted from the cache for mutable requests.
+// As this exposes the underlying CachedKeyGetter, eviction can be ignored
+// by using the .get(ctx, bucketName, keyNames) interface.
+// Requests may pick one of the named strategies instead of the default
+// ShouldEvicter, or "none" to skip the check. What happens to a key found
+// to have changed is up to onChange (one of changeActions), which requests
+// may also override. Keys cached longer than maxAge ago, if it's set, or
+// than a request's own max age are re-fetched; keys with no recorded cache
+// time never expire. See needsCheck for freshFor and maxMetadataAge.
+// Keys found changed are replaced by refresh. With staleIfError set, a key
+// that can't be checked is served as it is while it's retried with
+// backoff, starting at staleRetryBackoff, but evicted once its checks have
+// been failing for longer than staleIfError. Keys found unchanged are
+// recorded in validations, if it's set, for freshFor.
+type EvictingMutableKeyGetter struct {
+	CachedKeyGetter
+	ShouldEvicter
+	strategies        map[string]ShouldEvicter
+	onChange          string
+	maxAge            time.Duration
+	freshFor          time.Duration
+	maxMetadataAge    time.Duration
+	staleIfError      time.Duration
+	staleRetryBackoff time.Duration
+	checkFailures     checkFailures
+	validations       *validationTimes
+	refreshes         refreshes
+}
+
+// evictionStrategies are the names a request may give as its strategy.
+var evictionStrategies = []string{"md5", "etag", "last_modified", "none"}
+
+const (
+	evictOnChange    = "evict"
+	warnServeStale   = "warn_serve_stale"
+	serveStaleSilent = "serve_stale_silent"
+)
+
+// changeActions are what can be done with a cached key that changed upstream.
+var changeActions = []string{evictOnChange, warnServeStale, serveStaleSilent}
+
+const staleServed = "changed upstream, serving stale copy"
+
+type ShouldEvicter interface {
+	ShouldEvict(getResult) (bool, error)
+}
+
+// getOptions are the per-request settings for MutableKeyGetter.Get. A nil
+// maxAge leaves the getter's own in effect. Keys in ifMatch must have the
+// ETags given there. With mutableKeys set, only the keys in it are checked
+// for changes, whatever mutableBucket says. Missing keys are downloaded in
+// fetchOrder, one of fetchOrders, or as listed if it's empty. With noCache
+// set, they're fetched without being cached.
+type getOptions struct {
+	mutableBucket bool
+	mutableKeys   map[string]bool
+	strategy      string
+	onChange      string
+	maxAge        *time.Duration
+	ifMatch       map[string]string
+	headers       map[string]string
+	fetchOrder    string
+	noCache       bool
+}
+
+// A md5ShouldEvicter evicts keys whose current digest, as its digester
+// finds it, differs from the md5 they were cached with.
+type md5ShouldEvicter struct {
+	digester
+}
+
+// notFound is the status of a cached key found deleted upstream.
+const notFound = "not_found"
+
+var errNotFoundUpstream = errors.New("not found")
+
+// isNotFound reports whether err means a key doesn't exist in S3.
+func isNotFound(err error) bool {
+	var s3Err *s3.Error
+	if errors.As(err, &s3Err) {
+		return s3Err.StatusCode == 404
+	}
+	return errors.Is(err, errNotFoundUpstream)
+}
+
+// keyFor looks up the listing entry for a single key.
+func keyFor(conn *s3.S3, bucketName, keyName string) (*s3.Key, error) {
+	listResp, err := conn.Bucket(bucketName).List(keyName, "", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(listResp.Contents) == 0 || listResp.Contents[0].Key != keyName {
+		return nil, fmt.Errorf("%v/%v %w", bucketName, keyName, errNotFoundUpstream)
+	}
+	return &listResp.Contents[0], nil
+}
+
+func etagFor(conn *s3.S3, bucketName, keyName string) (string, error) {
+	key, err := keyFor(conn, bucketName, keyName)
+	if err != nil {
+		return "", err
+	}
+	return normalizeETag(key.ETag), nil
+}
+
+// md5For relies on S3 using the content's md5 as the ETag of any object
+// that wasn't uploaded in parts.
+func md5For(conn *s3.S3, bucketName, keyName string) (string, error) {
+	return etagFor(conn, bucketName, keyName)
+}
+
+// normalizeETag reduces the different ways S3-compatible stores format an
+// ETag (quoted or not, weak "W/" prefix, upper or lower case) to the bare
+// lowercase hex form we store on a getResult.
+func normalizeETag(etag string) string {
+	etag = strings.TrimSpace(etag)
+	etag = strings.TrimPrefix(etag, "W/")
+	if len(etag) >= 2 && etag[0] == '"' && etag[len(etag)-1] == '"' {
+		etag = etag[1 : len(etag)-1]
+	}
+	return strings.ToLower(etag)
 }
 
 func (m *md5ShouldEvicter) ShouldEvict(r getResult) (bool, error) {
-	currentMD5, err := md5For(m.S3, r.bucketName, r.keyName)
+	currentMD5, err := m.currentDigest(r.bucketName, r.keyName)
 	if err != nil {
 		return false, err
 	}
@@ -338,7 +1377,64 @@ func (m *md5ShouldEvicter) ShouldEvict(r getResult) (bool, error) {
 	}
 }
 
-func (e *EvictingMutableKeyGetter) Get(bucketName string, keyNames []string, mutableBucket bool) []getResult {
+// An etagShouldEvicter evicts keys whose ETag has changed since they were
+// cached, which unlike md5 also works for multipart uploads.
+type etagShouldEvicter struct {
+	*swappableS3
+}
+
+func (e *etagShouldEvicter) ShouldEvict(r getResult) (bool, error) {
+	currentETag, err := etagFor(e.current(), r.bucketName, r.keyName)
+	if err != nil {
+		return false, err
+	}
+	return r.etag != currentETag, nil
+}
+
+// A lastModifiedShouldEvicter evicts keys modified since they were cached.
+// Keys' modification times are by S3's clock and cache times by the local
+// one, so with skew set, cache times are adjusted by it to compare them.
+type lastModifiedShouldEvicter struct {
+	*swappableS3
+	skew *clockSkew
+}
+
+func (l *lastModifiedShouldEvicter) ShouldEvict(r getResult) (bool, error) {
+	key, err := keyFor(l.current(), r.bucketName, r.keyName)
+	if err != nil {
+		return false, err
+	}
+	lastModified, err := time.Parse(time.RFC3339Nano, key.LastModified)
+	if err != nil {
+		return false, err
+	}
+	return l.modifiedSince(lastModified, r.cachedAt), nil
+}
+
+// modifiedSince reports whether lastModified, by S3's clock, is after
+// cachedAt, by the local one.
+func (l *lastModifiedShouldEvicter) modifiedSince(lastModified, cachedAt time.Time) bool {
+	return lastModified.After(l.skew.toUpstream(cachedAt))
+}
+
+func (e *EvictingMutableKeyGetter) evicterFor(strategy string) (ShouldEvicter, error) {
+	if strategy == "" {
+		return e.ShouldEvicter, nil
+	}
+	evicter, ok := e.strategies[strategy]
+	if !ok {
+		return nil, fmt.Errorf("eviction strategy %q isn't available", strategy)
+	}
+	return evicter, nil
+}
+
+func (e *EvictingMutableKeyGetter) Get(ctx context.Context, bucketName string, keyNames []string, opts getOptions) []getResult {
+	ctx = withIfMatch(ctx, opts.ifMatch)
+	ctx = withFetchOrder(ctx, opts.fetchOrder)
+	ctx = withForwardedHeaders(ctx, opts.headers)
+	if opts.noCache {
+		ctx = withNoCache(ctx)
+	}
 	presents := make([]string, 0)
 	absents := make([]string, 0, len(keyNames))
 	for _, keyName := range keyNames {
@@ -348,53 +1444,476 @@ func (e *EvictingMutableKeyGetter) Get(bucketName string, keyNames []string, mut
 			absents = append(absents, keyName)
 		}
 	}
-	cached := e.get(bucketName, presents)
-	out := make([]getResult, len(keyNames))
+	cached := e.get(ctx, bucketName, presents)
+	out := make([]getResult, 0, len(keyNames))
+	changed := make([]getResult, 0)
+	mutable := func(keyName string) bool {
+		if opts.strategy == "none" {
+			return false
+		}
+		if opts.mutableKeys != nil {
+			return opts.mutableKeys[keyName]
+		}
+		return opts.mutableBucket
+	}
+	evicter, evicterErr := e.evicterFor(opts.strategy)
+	onChange := opts.onChange
+	if onChange == "" {
+		onChange = e.onChange
+	}
+	maxAge := e.maxAge
+	if opts.maxAge != nil {
+		maxAge = *opts.maxAge
+	}
 	for _, getResult := range cached {
-		if !mutableBucket {
+		if mismatched(ctx, getResult) {
+			// not the version asked for; fetch it, if it's still current
+			if trace.enabled() {
+				trace.event("evict", "bucket", bucketName, "key", getResult.keyName)
+			}
+			e.remove(bucketName, getResult.keyName)
+			absents = append(absents, getResult.keyName)
+			continue
+		}
+		if (maxAge > 0 || opts.maxAge != nil) && !getResult.cachedAt.IsZero() && time.Since(getResult.cachedAt) > maxAge {
+			if trace.enabled() {
+				trace.event("expire", "bucket", bucketName, "key", getResult.keyName)
+			}
+			e.remove(bucketName, getResult.keyName)
+			absents = append(absents, getResult.keyName)
+			continue
+		}
+		if !e.needsCheck(getResult, mutable(getResult.keyName), opts.strategy == "none") {
 			out = append(out, getResult)
 			continue
 		}
-		evict, err := e.ShouldEvict(getResult)
-		if err != nil && !evict {
+		if evicterErr != nil {
+			getResult.status = evicterErr.Error()
+			getResult.localPath = nil
 			out = append(out, getResult)
-		} else {
+			continue
+		}
+		if e.staleIfError > 0 {
+			if wait, expired := e.backingOff(bucketName, getResult.keyName); expired {
+				out = append(out, e.evictStale(bucketName, getResult))
+				continue
+			} else if wait {
+				getResult.status = staleOnError
+				out = append(out, getResult)
+				continue
+			}
+		}
+		evict, err := evicter.ShouldEvict(getResult)
+		if isNotFound(err) {
+			// deleted upstream, so there's nothing to fetch in its place
+			if trace.enabled() {
+				trace.event("evict", "bucket", bucketName, "key", getResult.keyName)
+			}
 			e.remove(bucketName, getResult.keyName)
-			absents = append(absents, getResult.keyName)
+			getResult.status = notFound
+			getResult.localPath = nil
+			out = append(out, getResult)
+			continue
+		}
+		if err != nil {
+			log.Printf("Couldn't check %v/%v for changes: %v", bucketName, getResult.keyName, err)
+			if e.staleIfError > 0 {
+				if e.checkFailed(bucketName, getResult.keyName) {
+					out = append(out, e.evictStale(bucketName, getResult))
+					continue
+				}
+				getResult.status = staleOnError
+			}
+		} else {
+			if e.staleIfError > 0 {
+				e.checkSucceeded(bucketName, getResult.keyName)
+			}
+			if !evict {
+				e.validated(bucketName, getResult.keyName)
+			}
+		}
+		if evict && onChange == warnServeStale {
+			log.Printf("%v/%v changed upstream, but serving the stale cached copy", bucketName, getResult.keyName)
+			getResult.status = staleServed
+		}
+		if !evict || onChange == warnServeStale || onChange == serveStaleSilent {
+			out = append(out, getResult)
+		} else {
+			changed = append(changed, getResult)
 		}
 	}
 
+	// keys found changed are refreshed alongside the fetch of the absent ones
+	var fetcht []getResult
+	var wg sync.WaitGroup
+	refreshed := make([]getResult, len(changed))
+	for i, stale := range changed {
+		wg.Add(1)
+		go func(i int, stale getResult) {
+			defer wg.Done()
+			refreshed[i] = e.refresh(ctx, bucketName, stale)
+		}(i, stale)
+	}
 	if len(absents) > 0 {
-		fetcht := e.get(bucketName, absents)
-		for _, getResult := range fetcht {
-			out = append(out, getResult)
+		fetcht = e.get(ctx, bucketName, absents)
+	}
+	wg.Wait()
+	for _, getResult := range append(fetcht, refreshed...) {
+		if getResult.localPath != nil && mismatched(ctx, getResult) {
+			// fetched by a store that couldn't check, or by another request
+			getResult.status = preconditionFailed
+			getResult.localPath = nil
+		}
+		out = append(out, getResult)
+	}
+
+	return inRequestOrder(keyNames, out)
+}
+
+const missNotFetched = "miss_not_fetched"
+
+// A readOnlyKeyGetter stands in for the S3 getter when the cache is only
+// ever filled out-of-band: every key it's asked for is a missNotFetched.
+type readOnlyKeyGetter struct{}
+
+func (readOnlyKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	out := make([]getResult, 0, len(keyNames))
+	for _, keyName := range keyNames {
+		out = append(out, getResult{keyName: keyName, bucketName: bucketName, status: missNotFetched})
+	}
+	return out
+}
+
+// A neverEvicter keeps every cached key without checking S3 for changes.
+type neverEvicter struct{}
+
+func (neverEvicter) ShouldEvict(getResult) (bool, error) {
+	return false, nil
+}
+
+// GetCached returns results only for the keys already in the cache; absent
+// keys are reported as missNotFetched without any call to the base getter.
+func (e *EvictingMutableKeyGetter) GetCached(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	presents := make([]string, 0, len(keyNames))
+	out := make([]getResult, 0, len(keyNames))
+	for _, keyName := range keyNames {
+		if e.has(bucketName, keyName) {
+			presents = append(presents, keyName)
+		} else {
+			out = append(out, getResult{keyName: keyName, bucketName: bucketName, status: missNotFetched})
 		}
 	}
+	if len(presents) > 0 {
+		out = append(out, e.get(ctx, bucketName, presents)...)
+	}
+	return inRequestOrder(keyNames, out)
+}
 
+// inRequestOrder puts results back in the order of the keyNames they were
+// requested as, since the layers of the cache each handle hits and misses
+// separately and return them grouped that way.
+func inRequestOrder(keyNames []string, results []getResult) []getResult {
+	positions := make(map[string][]int, len(results))
+	for i, result := range results {
+		positions[result.keyName] = append(positions[result.keyName], i)
+	}
+	used := make([]bool, len(results))
+	out := make([]getResult, 0, len(results))
+	for _, keyName := range keyNames {
+		if left := positions[keyName]; len(left) > 0 {
+			out = append(out, results[left[0]])
+			used[left[0]] = true
+			positions[keyName] = left[1:]
+		}
+	}
+	for i, result := range results {
+		if !used[i] {
+			out = append(out, result)
+		}
+	}
 	return out
 }
 
 type MutableKeyGetter interface {
-	Get(bucketName string, keyNames []string, mutableBucket bool) []getResult
+	Get(ctx context.Context, bucketName string, keyNames []string, opts getOptions) []getResult
+	GetCached(ctx context.Context, bucketName string, keyNames []string) []getResult
 }
 
+// A keyServer serves CacheRequests over HTTP. Requests with no keys are
+// rejected unless allowEmptyKeys is set. With omitNullPaths set, failed
+// results have no local_path rather than a null one. If requestSlots is
+// set, its limit bounds the requests served at once, and any past it
+// are turned away with a 503 rather than queued; stats, if set, counts
+// those in flight. Every key served is recorded in accessLog, if set.
+// onDisconnect is what /object does when a client leaves mid-download.
+// With normalizeKeys set, key names are normalized before anything else
+// sees them, so clients' stray slashes don't split a key's cache entry.
+// With maxGoroutines set, requests are also turned away while the process
+// runs more goroutines than that, as counted by goroutines. With
+// maxDownloadQueue set, requests are turned away with a 429 while every
+// one of downloadSlots is taken and that many downloads wait for one.
+// Only the headers a request asks for that are named in forwardHeaders are
+// sent to S3 with its downloads; the rest are dropped. Requests for
+// buckets allowedBuckets doesn't allow are refused with a 403 before
+// anything touches S3. With retries set, responses with keys that failed
+// carry a token for retrying just those. Keys served are also counted in
+// history, if set, for the next run to warm the hottest of.
 type keyServer struct {
 	MutableKeyGetter
+	credentials      *credentialRouter
+	allowEmptyKeys   bool
+	omitNullPaths    bool
+	requestSlots     *slots
+	onDisconnect     string
+	normalizeKeys    bool
+	forwardHeaders   []string
+	allowedBuckets   bucketAllowlist
+	retries          *retryStore
+	maxGoroutines    int
+	goroutines       func() int
+	downloadSlots    *slots
+	maxDownloadQueue int
+	stats            *cacheStats
+	accessLog        *accessLog
+	history          *accessHistory
+}
+
+var errDownloadsQueued = errors.New("too many downloads waiting to start")
+
+// admit takes a slot for a request, returning why not if it can't.
+func (s *keyServer) admit() error {
+	if s.maxDownloadQueue > 0 && s.downloadSlots.queued(s.maxDownloadQueue) {
+		return errDownloadsQueued
+	}
+	if s.maxGoroutines > 0 {
+		count := runtime.NumGoroutine
+		if s.goroutines != nil {
+			count = s.goroutines
+		}
+		if running := count(); running > s.maxGoroutines {
+			return fmt.Errorf("too many goroutines running (%v)", running)
+		}
+	}
+	if !s.requestSlots.tryAcquire() {
+		return errors.New("too many requests in flight")
+	}
+	s.stats.entered()
+	return nil
+}
+
+// reject turns a request admit refused away, telling the client to back
+// off: with a 429 if it's downloads backing up, or a 503 otherwise.
+func (s *keyServer) reject(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", "1")
+	code := 503
+	if errors.Is(err, errDownloadsQueued) {
+		code = 429
+	}
+	http.Error(w, err.Error(), code)
+}
+
+func (s *keyServer) release() {
+	s.stats.left()
+	s.requestSlots.release()
 }
 
 type CacheRequest struct {
-	BucketName    string   `json:"bucket_name"`
-	KeyNames      []string `json:"keynames"`
-	MutableBucket bool     `json:"mutable_bucket"`
+	BucketName    string            `json:"bucket_name"`
+	KeyNames      []string          `json:"keynames"`
+	MutableBucket bool              `json:"mutable_bucket"`
+	MutableKeys   []string          `json:"mutable_keys"`
+	OnlyCached    bool              `json:"only_cached"`
+	Credentials   string            `json:"credentials"`
+	Strategy      string            `json:"strategy"`
+	OnChange      string            `json:"on_change"`
+	FallbackKey   string            `json:"fallback_key"`
+	MaxAgeSeconds *float64          `json:"max_age_seconds"`
+	MinReady      int               `json:"min_ready"`
+	IfMatch       map[string]string `json:"if_match"`
+	Headers       map[string]string `json:"headers"`
+	FetchOrder    string            `json:"fetch_order"`
+	NoCache       bool              `json:"no_cache"`
 }
 
-func (s *keyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var cr CacheRequest
-	err := json.NewDecoder(r.Body).Decode(&cr)
+func oneOf(value string, allowed []string) bool {
+	for _, candidate := range allowed {
+		if value == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+func (cr *CacheRequest) validate(allowEmptyKeys bool) error {
+	if cr.BucketName == "" {
+		return fmt.Errorf("no bucket_name given")
+	}
+	if len(cr.KeyNames) == 0 && !allowEmptyKeys {
+		return fmt.Errorf("no keys requested")
+	}
+	if cr.Strategy != "" && !oneOf(cr.Strategy, evictionStrategies) {
+		return fmt.Errorf("unknown strategy %q, expected one of %v", cr.Strategy, evictionStrategies)
+	}
+	if cr.OnChange != "" && !oneOf(cr.OnChange, changeActions) {
+		return fmt.Errorf("unknown on_change %q, expected one of %v", cr.OnChange, changeActions)
+	}
+	if cr.FetchOrder != "" && !oneOf(cr.FetchOrder, fetchOrders) {
+		return fmt.Errorf("unknown fetch_order %q, expected one of %v", cr.FetchOrder, fetchOrders)
+	}
+	if cr.MaxAgeSeconds != nil && *cr.MaxAgeSeconds < 0 {
+		return fmt.Errorf("max_age_seconds can't be negative")
+	}
+	if cr.MinReady < 0 {
+		return fmt.Errorf("min_ready can't be negative")
+	}
+	if err := checkNames(cr.BucketName, cr.FallbackKey); err != nil {
+		return err
+	}
+	for _, keyName := range cr.KeyNames {
+		if err := checkNames(cr.BucketName, keyName); err != nil {
+			return err
+		}
+	}
+	for _, keyName := range cr.MutableKeys {
+		if !oneOf(keyName, cr.KeyNames) {
+			return fmt.Errorf("mutable key %q isn't one of the keys requested", keyName)
+		}
+	}
+	return nil
+}
+
+// decode reads and validates a CacheRequest, posted as JSON or as a form,
+// and picks the getter for its credentials, writing the error response
+// itself if it can't.
+func (s *keyServer) decode(w http.ResponseWriter, r *http.Request) (*CacheRequest, MutableKeyGetter, bool) {
+	cr, code, err := readCacheRequest(r)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		http.Error(w, err.Error(), code)
+		return nil, nil, false
+	}
+	if err := cr.validate(s.allowEmptyKeys); err != nil {
+		http.Error(w, err.Error(), 400)
+		return nil, nil, false
+	}
+	if !s.allowedBuckets.allows(cr.BucketName) {
+		http.Error(w, fmt.Sprintf("bucket %v isn't allowed", cr.BucketName), 403)
+		return nil, nil, false
+	}
+	if s.normalizeKeys {
+		if err := cr.normalizeKeys(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return nil, nil, false
+		}
+	}
+	cr.Headers = forwardable(cr.Headers, s.forwardHeaders)
+	if trace.enabled() {
+		trace.event("request", "bucket", cr.BucketName, "keys", len(cr.KeyNames), "mutable", cr.MutableBucket)
+	}
+	var getter MutableKeyGetter = s.MutableKeyGetter
+	if cr.Credentials != "" {
+		if s.credentials == nil {
+			http.Error(w, "no alternate credentials are configured", 403)
+			return nil, nil, false
+		}
+		getter, err = s.credentials.getterFor(cr.Credentials, cr.BucketName)
+		if err != nil {
+			http.Error(w, err.Error(), 403)
+			return nil, nil, false
+		}
+	}
+	return &cr, getter, true
+}
+
+// fetch gets keyNames from getter the way cr asks, standing cr's fallback
+// key in for any that don't exist.
+func (cr *CacheRequest) fetch(ctx context.Context, getter MutableKeyGetter, keyNames []string) []getResult {
+	results := cr.fetchExactly(ctx, getter, keyNames)
+	if cr.FallbackKey == "" {
+		return results
+	}
+	var fallback *getResult
+	for i, result := range results {
+		if !isMissing(result) || result.keyName == cr.FallbackKey {
+			continue
+		}
+		if fallback == nil {
+			fallbacks := cr.fetchExactly(ctx, getter, []string{cr.FallbackKey})
+			if len(fallbacks) != 1 || fallbacks[0].localPath == nil {
+				log.Printf("Couldn't get fallback %v/%v: %v", cr.BucketName, cr.FallbackKey, fallbacks)
+				return results
+			}
+			fallback = &fallbacks[0]
+		}
+		results[i].localPath = fallback.localPath
+		results[i].status = servedFallback
+		results[i].provenance = fallback.provenance
+		results[i].provenance.Source = fromFallback
+		results[i].err = nil
 	}
-	out, err := json.Marshal(s.Get(cr.BucketName, cr.KeyNames, cr.MutableBucket))
+	return results
+}
+
+func (cr *CacheRequest) fetchExactly(ctx context.Context, getter MutableKeyGetter, keyNames []string) []getResult {
+	if cr.OnlyCached {
+		return getter.GetCached(ctx, cr.BucketName, keyNames)
+	}
+	opts := getOptions{mutableBucket: cr.MutableBucket, strategy: cr.Strategy, onChange: cr.OnChange,
+		ifMatch: cr.IfMatch, headers: cr.Headers, fetchOrder: cr.FetchOrder, noCache: cr.NoCache}
+	if cr.MutableKeys != nil {
+		opts.mutableKeys = make(map[string]bool, len(cr.MutableKeys))
+		for _, keyName := range cr.MutableKeys {
+			opts.mutableKeys[keyName] = true
+		}
+	}
+	if cr.MaxAgeSeconds != nil {
+		maxAge := time.Duration(*cr.MaxAgeSeconds * float64(time.Second))
+		opts.maxAge = &maxAge
+	}
+	return getter.Get(ctx, cr.BucketName, keyNames, opts)
+}
+
+// servedFallback is the status of a missing key whose local_path is the
+// request's fallback key instead.
+const servedFallback = "fallback"
+
+// isMissing reports whether a result failed because its key doesn't
+// exist, upstream or (for only_cached requests) in the cache.
+func isMissing(r getResult) bool {
+	if r.localPath != nil {
+		return false
+	}
+	return r.status == notFound || r.status == missNotFetched || (r.err != nil && r.err.StatusCode == 404)
+}
+
+func (s *keyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, sp := spans.startRequest(r, "cache_request")
+	defer sp.finish()
+	r = r.WithContext(ctx)
+	if err := s.admit(); err != nil {
+		s.reject(w, err)
+		return
+	}
+	defer s.release()
+	cr, getter, ok := s.decode(w, r)
+	if !ok {
+		return
+	}
+	if cr.MinReady > 0 {
+		s.serveStream(w, r, cr, getter)
+		return
+	}
+	sp.set("aws.s3.bucket", cr.BucketName)
+	sp.set("cache.keys", len(cr.KeyNames))
+	results := cr.fetch(r.Context(), getter, cr.KeyNames)
+	s.accessLog.record(r, cr.Credentials, results)
+	s.history.record(cr.Credentials, results)
+	for i := range results {
+		results[i].omitNullPath = s.omitNullPaths
+	}
+	if token := s.retries.hold(cr, getter, results); token != "" {
+		w.Header().Set(retryTokenHeader, token)
+	}
+	out, err := json.Marshal(results)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 	}
@@ -402,17 +1921,463 @@ func (s *keyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	auth, err := aws.EnvAuth()
+	cacheDir := flag.String("cache-dir", "", "directory to cache keys under (defaults to the working directory)")
+	prefetchSiblings := flag.Int("prefetch-siblings", 0, "on a miss, warm up to this many sibling keys under the same prefix")
+	regionName := flag.String("region", aws.USEast.Name, "AWS region of the default credentials' buckets, unless -auth-file names another")
+	authFilePath := flag.String("auth-file", "", "JSON file of the default access_key, secret_key and region, reloaded when it changes, instead of the environment's credentials")
+	authFilePoll := flag.Duration("auth-file-poll", 10*time.Second, "how often to check -auth-file for changes")
+	credentialsFile := flag.String("credentials", "", "JSON file of named alternate credentials that requests may reference")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "export OpenTelemetry spans of requests and key downloads to the OTLP/HTTP collector at this URL, like http://localhost:4318 (none if unset)")
+	traceEvents := flag.Bool("trace", false, "write a structured line to stdout for every cache event")
+	stallTimeout := flag.Duration("stall-timeout", 0, "abort a download that receives no bytes for this long (0 to disable)")
+	dedupETag := flag.Bool("dedup-etag", false, "hard-link cached keys that share a (non-multipart) ETag")
+	maxBytes := flag.Int64("max-bytes", 0, "evict least recently used keys before a request finishes once a cache passes this many bytes (0 for no limit)")
+	softMaxBytes := flag.Int64("soft-max-bytes", 0, "start evicting in the background once a cache passes this many bytes (defaults to -max-bytes)")
+	evictionGrace := flag.Duration("eviction-grace", 0, "never evict a key cached less than this long ago")
+	evictionPolicy := flag.String("eviction-policy", "lru", fmt.Sprintf("how to pick entries to evict, one of %v", evictionPolicies))
+	evictionPace := flag.Duration("eviction-pace", 0, "how long background eviction waits between deletes")
+	allowEmptyKeys := flag.Bool("allow-empty-keys", false, "answer requests with no keynames with an empty list instead of a 400")
+	listTTL := flag.Duration("list-ttl", 30*time.Second, "how long /list remembers a bucket and prefix's listing")
+	copyBuffer := flag.Int("copy-buffer", 0, "size in bytes of the buffer used to copy downloads (0 for io.Copy's default)")
+	maxOpenFiles := flag.Int("max-open-files", 0, "maximum number of files downloads may hold open at once (0 for no limit)")
+	openFilesWait := flag.Duration("open-files-wait", 10*time.Second, "how long a download waits for -max-open-files to allow it before giving up")
+	onChange := flag.String("on-change", evictOnChange, fmt.Sprintf("what to do with a mutable key that changed upstream, one of %v", changeActions))
+	maxInventoryKeys := flag.Int("max-inventory-keys", 10000, "most objects /warm-inventory will fetch from one manifest")
+	maxBuckets := flag.Int("max-buckets", 0, "maximum number of buckets to cache keys from, dropping the least recently used (0 for no limit)")
+	contentAddressed := flag.Bool("content-addressed", false, "also link each cached key under -cache-dir/_cas/<md5>, served at /cas/<md5> unless -allowed-buckets is set")
+	gzipMinBytes := flag.Int("gzip-min-bytes", 1024, "gzip JSON responses at least this big for clients that accept it (0 to never compress)")
+	sweepTempAfter := flag.Duration("sweep-temp-after", 0, "remove downloads crashed instances left in the temp directory once they're this old (0 to never)")
+	followRegionRedirects := flag.Bool("follow-region-redirects", false, "when S3 says a bucket is in another region, find out which and send the bucket's requests there")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3 endpoint to use instead of AWS's, for S3-compatible stores")
+	httpsOnly := flag.Bool("https-only", false, "refuse to start unless S3 is reached over https")
+	rangeParts := flag.Int("range-parts", 0, "download large keys as this many concurrent ranged GETs (0 or 1 for a single GET)")
+	rangeMinBytes := flag.Int64("range-min-bytes", 64<<20, "smallest key -range-parts applies to")
+	omitNullPaths := flag.Bool("omit-null-paths", false, "leave local_path out of failed results instead of sending it as null")
+	verifyInterval := flag.Duration("verify-interval", 100*time.Millisecond, "minimum time between the S3 checks /verify makes")
+	digestHeader := flag.String("digest-header", "", "response header an S3-compatible store puts each key's md5 in, if not its ETag")
+	sizePartitions := flag.String("size-partitions", "", "split the cache into size classes with their own budgets, as largest-object:budget,...,:budget")
+	pathTemplate := flag.String("path-template", defaultPathTemplate, "layout of cached keys on disk; between {bucket} and {key} may go literal names, {keyHash} or {keyHashPrefix}")
+	keyMD5Regexp := flag.String("key-md5-pattern", "", "regexp whose first group (or match) is an md5 in key names to verify downloads against")
+	maxAge := flag.Duration("max-age", 0, "re-fetch keys cached longer ago than this, unless a request gives its own max_age_seconds (0 for never)")
+	historyPath := flag.String("access-history", "", "file to save how often each key was served to on shutdown, and warm the hottest keys from at startup before serving")
+	warmTopKeys := flag.Int("warm-top-keys", 1000, "most keys to warm from -access-history at startup (0 for no limit)")
+	warmTopBytes := flag.Int64("warm-top-bytes", 0, "most bytes of keys to warm from -access-history at startup (0 for no limit)")
+	accessLogPath := flag.String("access-log", "", "append a JSON line for every key served to this file, or - for stdout; reopened on SIGHUP")
+	objectTags := flag.Bool("object-tags", false, "skip caching objects tagged cache=no, and re-fetch those tagged ttl=<seconds> once older")
+	tagTTL := flag.Duration("tag-ttl", 5*time.Minute, "how long -object-tags remembers an object's tags")
+	freshFor := flag.Duration("fresh-for", 0, "skip mutable_bucket checks of keys checked or cached less than this long ago")
+	maxMetadataAge := flag.Duration("max-metadata-age", 0, "check keys checked or cached longer ago than this for changes, even outside mutable_bucket requests and within -fresh-for (0 for never)")
+	evictionRestartDelay := flag.Duration("eviction-restart-delay", time.Second, "how long to wait before restarting background eviction after it panics")
+	fsyncPolicy := flag.String("fsync", fsyncNone, fmt.Sprintf("what to flush to disk for each newly cached key, one of %v", fsyncPolicies))
+	lruShards := flag.Int("lru-shards", 1, "split each cache's lru into this many independently locked shards, so requests for different keys contend less")
+	pinFor := flag.Duration("pin-for", 0, "never evict a key for this long after returning it, so clients have time to open it (0 to not pin keys)")
+	lruSnapshot := flag.String("lru-snapshot", "", "file to save the -max-bytes LRU to on shutdown and restore it from at startup")
+	sharedIndexURL := flag.String("shared-index", "", "redis://[:password@]host:port[/db] of a Redis that nodes sharing -cache-dir keep their -max-bytes LRU in, so they agree on what's cached and evict alike (empty for each node's own)")
+	readOnly := flag.Bool("read-only", false, "never fetch from S3, only serve what's already in -cache-dir")
+	slowKeysWindow := flag.Duration("slow-keys-window", 10*time.Minute, "list the keys downloaded slowest within this long in /stats?by=slowest (0 to keep none)")
+	timingSampleEvery := flag.Int("timing-sample-every", 1, "time the downloads of 1 in this many requests for the fetch duration histogram (0 for none)")
+	maxRequests := flag.Int("max-requests", 0, "turn away cache requests with a 503 past this many in flight (0 for no limit)")
+	maxDownloads := flag.Int("max-downloads", 0, "maximum number of concurrent downloads from S3 (0 for no limit)")
+	onDisconnect := flag.String("on-disconnect", finishOnDisconnect, fmt.Sprintf("what /object does with a download whose client goes away, one of %v", disconnectPolicies))
+	secondaryOrigins := flag.String("secondary-origins", "", "buckets to fetch keys from that a bucket doesn't have, as bucket:secondary[:...],...")
+	caseFold := flag.String("case-insensitive-fs", caseFoldAuto, fmt.Sprintf("whether -cache-dir ignores case, so keys differing only in case need encoding on disk; one of %v", caseFoldSettings))
+	onDuplicate := flag.String("on-duplicate", replaceDuplicate, fmt.Sprintf("what to do with a download of a key that's already cached, one of %v", duplicatePolicies))
+	reconcileSizes := flag.Bool("reconcile-sizes", false, "before each background eviction, check every cached key's file size, correcting the cache's total for any changed behind its back")
+	behindAfter := flag.Duration("eviction-behind-after", 0, "hold back downloads, and log and count it loudly, once the cache has stayed past its soft limit this long (0 to never)")
+	behindAction := flag.String("eviction-behind-action", slowWhenBehind, fmt.Sprintf("how downloads are held back while eviction is behind, one of %v", behindActions))
+	behindBackoff := flag.Duration("eviction-behind-backoff", time.Second, "how long each request waits before downloading while eviction is behind, with -eviction-behind-action slow")
+	staleIfError := flag.Duration("stale-if-error", 0, "serve a mutable key that can't be checked for changes as it is, retrying with backoff, for up to this long before evicting it (0 to always serve it)")
+	integrityMode := flag.String("integrity-mode", integrityOff, fmt.Sprintf("how downloads are checked against their ETags and what's done with mismatches, one of %v", integrityModes))
+	retryTTL := flag.Duration("retry-ttl", 0, "hand out a token with responses where keys failed, good for this long, to retry just those keys at /retry (0 to not)")
+	detectClockSkew := flag.Bool("detect-clock-skew", false, "measure how far S3's clock is off from the local one and allow for it in last_modified checks")
+	clockSkewWarn := flag.Duration("clock-skew-warn", 30*time.Second, "log when -detect-clock-skew finds S3's clock off by more than this")
+	allowedBuckets := flag.String("allowed-buckets", "", "comma-separated buckets, or globs such as logs-*, the only ones requests may fetch from (empty for any)")
+	forwardHeaders := flag.String("forward-headers", "", "comma-separated headers, such as x-amz-request-payer, that requests may have sent with their downloads from S3")
+	pruneEmptyDirs := flag.Bool("prune-empty-dirs", false, "remove the directories evicting a key leaves empty")
+	compactEvery := flag.Duration("compact-dirs-every", 0, "also sweep the whole cache for empty directories this often, with -prune-empty-dirs (0 for never)")
+	maxMoves := flag.Int("max-moves", 0, "maximum number of downloads being moved into -cache-dir at once, capping concurrent mkdirs and renames (0 for no limit)")
+	recountLRUEvery := flag.Duration("recount-lru-every", 0, "recount the entries and bytes in each lru this often, correcting the running totals /stats reports if they've drifted (0 for never)")
+	moveRetries := flag.Int("move-retries", 0, "retry moving a download into -cache-dir this many times when it fails with ENOSPC, evicting first, or EBUSY (0 to not retry)")
+	maxDownloadQueue := flag.Int("max-download-queue", 0, "turn away cache requests with a 429 while -max-downloads is reached and this many more wait to start (0 to always queue)")
+	maxGoroutines := flag.Int("max-goroutines", 0, "turn away cache requests with a 503 while the process runs more goroutines than this (0 for no limit)")
+	normalizeKeys := flag.Bool("normalize-keys", false, "strip leading slashes from requested keys and collapse doubled ones, so /path//key and path/key are one key")
+	adminTokenFile := flag.String("admin-token-file", "", "file holding the bearer token that lets /config change limits at runtime and /export and /import copy the cache (all three are off without one)")
+	eventTokenFile := flag.String("s3-event-token-file", "", "file holding the token S3 event notifications must carry to /s3-event, as a bearer token or basic auth password (/s3-event is off without one)")
+	flag.Parse()
+	layout, err := parsePathTemplate(*pathTemplate)
 	if err != nil {
-		log.Panicln(err)
-	}
-	conn := s3.New(auth, aws.USEast)
-	s3Conn := s3Conn{conn}
-	tempDirGetter := &tempKeyGetter{&s3Conn}
-	diskCachedGetter := &diskCachedKeyGetter{base: tempDirGetter}
-	evicter := md5ShouldEvicter{conn}
-	mutableGetter := EvictingMutableKeyGetter{diskCachedGetter, &evicter}
-	server := keyServer{&mutableGetter}
-	http.Handle("/", &server)
-	http.ListenAndServe(":8780", nil)
+		log.Fatalln(err)
+	}
+	var keyMD5 *keyMD5Pattern
+	if *keyMD5Regexp != "" {
+		if keyMD5, err = parseKeyMD5Pattern(*keyMD5Regexp); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	allowed, err := parseBucketAllowlist(*allowedBuckets)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var shared sharedIndex
+	if *sharedIndexURL != "" {
+		if shared, err = parseRedisIndex(*sharedIndexURL); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	var origins map[string][]string
+	if *secondaryOrigins != "" {
+		if origins, err = parseSecondaryOrigins(*secondaryOrigins); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *sizePartitions != "" {
+		if *maxBytes > 0 {
+			log.Fatalln("-size-partitions and -max-bytes can't be used together")
+		}
+		if _, err := parseSizePartitions(*sizePartitions); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if !oneOf(*evictionPolicy, evictionPolicies) {
+		log.Fatalf("-eviction-policy must be one of %v", evictionPolicies)
+	}
+	if !oneOf(*caseFold, caseFoldSettings) {
+		log.Fatalf("-case-insensitive-fs must be one of %v", caseFoldSettings)
+	}
+	foldCase := *caseFold == caseFoldOn
+	if *caseFold == caseFoldAuto {
+		if foldCase, err = caseInsensitive(*cacheDir); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if !oneOf(*onDuplicate, duplicatePolicies) {
+		log.Fatalf("-on-duplicate must be one of %v", duplicatePolicies)
+	}
+	if !oneOf(*behindAction, behindActions) {
+		log.Fatalf("-eviction-behind-action must be one of %v", behindActions)
+	}
+	if !oneOf(*integrityMode, integrityModes) {
+		log.Fatalf("-integrity-mode must be one of %v", integrityModes)
+	}
+	if !oneOf(*fsyncPolicy, fsyncPolicies) {
+		log.Fatalf("-fsync must be one of %v", fsyncPolicies)
+	}
+	if !oneOf(*onDisconnect, disconnectPolicies) {
+		log.Fatalf("-on-disconnect must be one of %v", disconnectPolicies)
+	}
+	if !oneOf(*onChange, changeActions) {
+		log.Fatalf("-on-change must be one of %v", changeActions)
+	}
+	if *traceEvents {
+		trace.enable(os.Stdout)
+	}
+	if *otlpEndpoint != "" {
+		exporter := &otlpExporter{endpoint: *otlpEndpoint, client: &http.Client{Timeout: 10 * time.Second}}
+		spans.enable(exporter)
+		go exporter.run(5 * time.Second)
+	}
+
+	var auth aws.Auth
+	region, ok := aws.Regions[*regionName]
+	if !ok {
+		names := make([]string, 0, len(aws.Regions))
+		for name := range aws.Regions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Fatalf("Unknown -region %q, expected one of %v", *regionName, names)
+	}
+	if *authFilePath == "" {
+		if auth, err = aws.EnvAuth(); err != nil {
+			log.Panicln(err)
+		}
+	}
+	if *sweepTempAfter > 0 {
+		sweeper := &tempSweeper{dir: os.TempDir(), maxAge: *sweepTempAfter, alive: processAlive}
+		go sweeper.run(*sweepTempAfter / 2)
+	}
+	stats := &cacheStats{sampleEvery: *timingSampleEvery, slowWindow: *slowKeysWindow}
+	var fds *fdGuard
+	if *maxOpenFiles > 0 {
+		if *maxOpenFiles < fdsPerDownload {
+			log.Fatalf("-max-open-files must be at least %v to allow any downloads", fdsPerDownload)
+		}
+		fds = newFDGuard(*maxOpenFiles, *openFilesWait)
+	}
+	if *softMaxBytes <= 0 || *softMaxBytes > *maxBytes {
+		*softMaxBytes = *maxBytes
+	}
+	config := &runtimeConfig{maxBytes: *maxBytes, softMaxBytes: *softMaxBytes, evictionPace: *evictionPace,
+		downloadSlots: newSlots(*maxDownloads), requestSlots: newSlots(*maxRequests)}
+	if *adminTokenFile != "" {
+		if config.token, err = readTokenFile(*adminTokenFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	var eventToken string
+	if *eventTokenFile != "" {
+		if eventToken, err = readTokenFile(*eventTokenFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if _, err := s3Region(region, *s3Endpoint, *httpsOnly); err != nil {
+		log.Fatalln(err)
+	}
+	endpointFor := func(region aws.Region) aws.Region {
+		// every built-in region's endpoint is https, so only -s3-endpoint
+		// can fail this, and it's been checked already
+		region, _ = s3Region(region, *s3Endpoint, *httpsOnly)
+		return region
+	}
+	var skew *clockSkew
+	if *detectClockSkew {
+		skew = &clockSkew{warnAbove: *clockSkewWarn}
+	}
+	// shared by every credentials' getter, since they share -cache-dir
+	moveSlots := newSlots(*maxMoves)
+	var dirs *dirGuard
+	if *pruneEmptyDirs {
+		dirs = &dirGuard{}
+	}
+	// shared like moveSlots, since a key any getter removes is gone for all
+	validations := &validationTimes{}
+	// every credentials' getter caches into the same -cache-dir, so the LRU
+	// (or partitions) bounding it is built once, with the first, and shared
+	// by the rest; the one LRU is also what -lru-snapshot saves
+	var bounded *boundedDiskCachedKeyGetter
+	var boundedLayer CachedKeyGetter
+	newBoundedLayer := func(diskCachedGetter *diskCachedKeyGetter) {
+		// misses are cached through whichever credentials' disk getter
+		// the request came through
+		router := &credentialDiskRouter{CachedKeyGetter: diskCachedGetter}
+		if *maxBytes > 0 {
+			bounded = &boundedDiskCachedKeyGetter{
+				lru:            newShardedLRU(router, *pinFor, *lruShards),
+				disk:           diskCachedGetter,
+				gracePeriod:    *evictionGrace,
+				evictionPolicy: *evictionPolicy,
+				wake:           make(chan struct{}, 1),
+				restartDelay:   *evictionRestartDelay,
+				reconcileSizes: *reconcileSizes,
+				behindAfter:    *behindAfter,
+				behindAction:   *behindAction,
+				behindBackoff:  *behindBackoff,
+				stats:          stats,
+			}
+			bounded.lru.shared = shared
+			config.track(bounded)
+			stats.watch(bounded.lru)
+			go bounded.lru.recountEvery(*recountLRUEvery)
+			if *lruSnapshot != "" {
+				bounded.loadSnapshot(*lruSnapshot, diskCachedGetter)
+			}
+			go bounded.keepClean()
+			boundedLayer = bounded
+		}
+		if *sizePartitions != "" {
+			// already checked at startup
+			partitions, _ := parseSizePartitions(*sizePartitions)
+			for _, partition := range partitions {
+				partition.lru = newShardedLRU(router, *pinFor, *lruShards)
+				partition.disk = diskCachedGetter
+				partition.gracePeriod = *evictionGrace
+				partition.evictionPace = *evictionPace
+				partition.evictionPolicy = *evictionPolicy
+				partition.wake = make(chan struct{}, 1)
+				partition.restartDelay = *evictionRestartDelay
+				partition.reconcileSizes = *reconcileSizes
+				partition.behindAfter = *behindAfter
+				partition.behindAction = *behindAction
+				partition.behindBackoff = *behindBackoff
+				partition.stats = stats
+				stats.watch(partition.lru)
+				go partition.lru.recountEvery(*recountLRUEvery)
+				go partition.keepClean()
+			}
+			boundedLayer = &partitionedKeyGetter{disk: router, partitions: partitions}
+		}
+	}
+	newGetterFor := func(conn *swappableS3) MutableKeyGetter {
+		s3Conn := s3Conn{swappableS3: conn, skew: skew}
+		if *followRegionRedirects {
+			s3Conn.regions = &bucketRegions{endpointFor: endpointFor}
+		}
+		var baseGetter KeyGetter = &tempKeyGetter{keyReaderGetter: &s3Conn, stallTimeout: *stallTimeout,
+			downloadSlots: config.downloadSlots, copyBufferSize: *copyBuffer, fds: fds,
+			rangeParts: *rangeParts, rangeMinBytes: *rangeMinBytes, keyMD5: keyMD5,
+			secondaryOrigins: origins, integrityMode: *integrityMode}
+		if *readOnly {
+			baseGetter = readOnlyKeyGetter{}
+		}
+		diskCachedGetter := &diskCachedKeyGetter{base: baseGetter, cacheDir: *cacheDir, layout: layout, stats: stats,
+			dedupByETag: *dedupETag, contentAddressed: *contentAddressed, fsyncPolicy: *fsyncPolicy,
+			onDuplicate: *onDuplicate, foldCase: foldCase, moveSlots: moveSlots, moveRetries: *moveRetries, dirs: dirs,
+			onRemove: validations.forget}
+		if boundedLayer == nil && (*maxBytes > 0 || *sizePartitions != "") {
+			newBoundedLayer(diskCachedGetter)
+		}
+		var cachedGetter CachedKeyGetter = diskCachedGetter
+		if bounded != nil {
+			diskCachedGetter.makeRoom = bounded.makeRoom
+			diskCachedGetter.base = &passthroughKeyGetter{KeyGetter: baseGetter, bounded: bounded}
+		}
+		if boundedLayer != nil {
+			cachedGetter = &credentialKeyGetter{CachedKeyGetter: boundedLayer, disk: diskCachedGetter}
+		}
+		if *maxBuckets > 0 {
+			cachedGetter = &bucketCappedKeyGetter{CachedKeyGetter: cachedGetter, disk: diskCachedGetter, maxBuckets: *maxBuckets}
+		}
+		if *objectTags && !*readOnly {
+			cachedGetter = &taggedKeyGetter{CachedKeyGetter: cachedGetter, disk: diskCachedGetter, direct: baseGetter,
+				tags: &tagCache{tagger: &s3Conn, ttl: *tagTTL}}
+		}
+		cachedGetter = &coalescingKeyGetter{CachedKeyGetter: cachedGetter, stats: stats}
+		if *prefetchSiblings > 0 && !*readOnly {
+			cachedGetter = &prefetchingKeyGetter{CachedKeyGetter: cachedGetter, lister: &s3Conn, maxKeys: *prefetchSiblings}
+		}
+		cachedGetter = &noCacheKeyGetter{CachedKeyGetter: cachedGetter, direct: baseGetter}
+		if *readOnly {
+			never := neverEvicter{}
+			return &EvictingMutableKeyGetter{
+				CachedKeyGetter: cachedGetter,
+				ShouldEvicter:   never,
+				strategies:      map[string]ShouldEvicter{"md5": never, "etag": never, "last_modified": never},
+				onChange:        *onChange,
+				validations:     validations,
+			}
+		}
+		var digests digester = &s3Conn
+		if *digestHeader != "" {
+			digests = &headerDigester{header: *digestHeader, urlFor: func(bucketName, keyName string) string {
+				return conn.Bucket(bucketName).SignedURL(keyName, time.Now().Add(time.Hour))
+			}}
+		}
+		evicter := &md5ShouldEvicter{digests}
+		return &EvictingMutableKeyGetter{
+			CachedKeyGetter: cachedGetter,
+			ShouldEvicter:   evicter,
+			strategies: map[string]ShouldEvicter{
+				"md5":           evicter,
+				"etag":          &etagShouldEvicter{conn},
+				"last_modified": &lastModifiedShouldEvicter{swappableS3: conn, skew: skew},
+			},
+			onChange:       *onChange,
+			maxAge:         *maxAge,
+			freshFor:       *freshFor,
+			maxMetadataAge: *maxMetadataAge,
+			staleIfError:   *staleIfError,
+			validations:    validations,
+		}
+	}
+	newGetter := func(auth aws.Auth, region aws.Region) MutableKeyGetter {
+		return newGetterFor(newSwappableS3(s3.New(auth, endpointFor(region))))
+	}
+	defaultConn := newSwappableS3(s3.New(auth, endpointFor(region)))
+	if *authFilePath != "" {
+		watcher := &authWatcher{path: *authFilePath, conn: defaultConn, endpointFor: endpointFor, defaultRegion: region}
+		if !watcher.check() {
+			log.Fatalf("Couldn't load credentials from %v", *authFilePath)
+		}
+		go watcher.run(*authFilePoll)
+	}
+	server := keyServer{MutableKeyGetter: newGetterFor(defaultConn), allowEmptyKeys: *allowEmptyKeys,
+		omitNullPaths: *omitNullPaths, requestSlots: config.requestSlots, onDisconnect: *onDisconnect, normalizeKeys: *normalizeKeys,
+		maxGoroutines: *maxGoroutines, downloadSlots: config.downloadSlots, maxDownloadQueue: *maxDownloadQueue,
+		allowedBuckets: allowed, stats: stats}
+	if *retryTTL > 0 {
+		server.retries = &retryStore{ttl: *retryTTL}
+	}
+	if *forwardHeaders != "" {
+		server.forwardHeaders = strings.Split(*forwardHeaders, ",")
+	}
+	if *accessLogPath != "" {
+		if server.accessLog, err = newAccessLog(*accessLogPath, 4096); err != nil {
+			log.Fatalln(err)
+		}
+		go func() {
+			hangups := make(chan os.Signal, 1)
+			signal.Notify(hangups, syscall.SIGHUP)
+			for range hangups {
+				server.accessLog.reopen()
+			}
+		}()
+	}
+	if *credentialsFile != "" {
+		sets, err := loadCredentialSets(*credentialsFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		server.credentials = &credentialRouter{sets: sets, newGetter: newGetter}
+	}
+	http.Handle("/", gzipResponses(&server, *gzipMinBytes))
+	http.HandleFunc("/zip", server.serveZip)
+	http.HandleFunc("/object", server.serveObject)
+	http.HandleFunc("/object/", server.serveObject)
+	http.HandleFunc("/retry", server.serveRetry)
+	var listings *listingCache
+	if !*readOnly {
+		listings = &listingCache{lister: &s3Conn{swappableS3: defaultConn}, ttl: *listTTL, allowed: allowed}
+		http.Handle("/list", gzipResponses(listings, *gzipMinBytes))
+		http.Handle("/warm-inventory", &inventoryWarmer{manifests: &s3Conn{swappableS3: defaultConn},
+			getter: server.MutableKeyGetter, maxKeys: *maxInventoryKeys, allowed: allowed})
+	}
+	if cache, ok := server.MutableKeyGetter.(keyRemover); ok && eventToken != "" {
+		http.Handle("/s3-event", &eventInvalidator{cache: cache, listings: listings, token: eventToken})
+	}
+	cacheFiles := &diskCachedKeyGetter{cacheDir: *cacheDir, layout: layout, stats: stats, foldCase: foldCase, dirs: dirs,
+		allowed: allowed}
+	if *compactEvery > 0 && dirs != nil {
+		go cacheFiles.compactEvery(*compactEvery)
+	}
+	if getter, ok := server.MutableKeyGetter.(*EvictingMutableKeyGetter); ok && !*readOnly {
+		http.Handle("/verify", &cacheVerifier{disk: cacheFiles, getter: getter, interval: *verifyInterval})
+	}
+	http.Handle("/digest", gzipResponses(http.HandlerFunc(cacheFiles.serveDigest), *gzipMinBytes))
+	http.Handle("/manifest", gzipResponses(http.HandlerFunc(cacheFiles.serveManifest), *gzipMinBytes))
+	http.HandleFunc("/cas/", cacheFiles.serveCAS)
+	http.Handle("/stats", gzipResponses(stats, *gzipMinBytes))
+	http.HandleFunc("/metrics", stats.servePrometheus)
+	if config.token != "" {
+		http.Handle("/config", config)
+		archive := &cacheArchive{disk: cacheFiles, bounded: bounded, admin: config}
+		http.HandleFunc("/export", archive.serveExport)
+		http.HandleFunc("/import", archive.serveImport)
+	}
+	if *historyPath != "" {
+		server.history = &accessHistory{}
+		if err := server.history.load(*historyPath); err != nil {
+			log.Printf("Couldn't load the access history, starting a new one: %v", err)
+		}
+		if !*readOnly {
+			warmed, failed := server.history.warm(context.Background(), server.MutableKeyGetter, allowed, *warmTopKeys,
+				*warmTopBytes)
+			log.Printf("Warmed %v of the hottest keys from the access history, %v failed", warmed, failed)
+		}
+	}
+	httpServer := &http.Server{Addr: ":8780"}
+	shutDown := make(chan struct{})
+	go func() {
+		defer close(shutDown)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		httpServer.Shutdown(context.Background())
+	}()
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// ListenAndServe returns as soon as shutdown starts; wait for the
+	// requests still in flight before saving anything
+	<-shutDown
+	server.accessLog.close()
+	if server.history != nil {
+		if err := server.history.save(*historyPath); err != nil {
+			log.Printf("Couldn't save the access history: %v", err)
+		}
+	}
+	if bounded != nil && *lruSnapshot != "" {
+		if err := bounded.saveSnapshot(*lruSnapshot); err != nil {
+			log.Printf("Couldn't save the LRU snapshot: %v", err)
+		}
+	}
 }
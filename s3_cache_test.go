@@ -2,14 +2,25 @@ package main
 
 import (
 	"bytes"
+	"container/list"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"launchpad.net/goamz/s3"
 )
 
 type mockKeyReaderGetter []byte
@@ -42,8 +53,8 @@ func compareContents(expected, path string, t *testing.T) {
 func TestTempKeyGetter(t *testing.T) {
 	contents := []byte("fancy s3 key contents")
 	var kg KeyGetter
-	kg = &tempKeyGetter{mockKeyReaderGetter(contents)}
-	results := kg.get("bucket", []string{"key1"})
+	kg = &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter(contents)}
+	results := kg.get(context.Background(), "bucket", []string{"key1"})
 	t.Log(results)
 	result := results[0]
 	if result.localPath == nil {
@@ -63,10 +74,27 @@ func TestTempKeyGetter(t *testing.T) {
 	}
 }
 
+func TestTempKeyGetterRecordsHexMD5(t *testing.T) {
+	contents := []byte("fancy s3 key contents")
+	kg := &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter(contents)}
+	result := kg.get(context.Background(), "bucket", []string{"key1"})[0]
+	if result.localPath == nil {
+		t.Fatalf("Expected a local file, but got %v", result.status)
+	}
+	defer os.Remove(*result.localPath)
+	sum := md5.Sum(contents)
+	if expected := hex.EncodeToString(sum[:]); result.md5 != expected {
+		t.Logf("Expected the md5 %q, as S3 gives it in ETags, but got %q", expected, result.md5)
+		t.Fail()
+	}
+}
+
 type mockKeyGetter struct {
 	content string
 	called  int
 	dir     string
+	etag    string
+	sync.Mutex
 }
 
 func (m *mockKeyGetter) getNewLocalName() string {
@@ -78,14 +106,16 @@ func (m *mockKeyGetter) getNewLocalName() string {
 
 const mockFetched = "mock fetched"
 
-func (m *mockKeyGetter) get(bucketName string, keyNames []string) []getResult {
+func (m *mockKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
 	out := make([]getResult, 0, len(keyNames))
 
 	for _, keyName := range keyNames {
 		localPath := m.getNewLocalName()
 		result := getResult{localPath: &localPath, keyName: keyName,
-			bucketName: bucketName, status: mockFetched}
+			bucketName: bucketName, status: mockFetched, bytesTransferred: int64(len(m.content)), etag: m.etag}
+		m.Lock()
 		m.called += 1
+		m.Unlock()
 		out = append(out, result)
 	}
 	return out
@@ -93,7 +123,83 @@ func (m *mockKeyGetter) get(bucketName string, keyNames []string) []getResult {
 
 func newMockKeyGetter(content string) *mockKeyGetter {
 	tempDir, _ := ioutil.TempDir("", "test_mock_key_getter")
-	return &mockKeyGetter{content, 0, tempDir}
+	return &mockKeyGetter{content: content, dir: tempDir}
+}
+
+// mustPathFor is pathFor for names a test knows are fine.
+func (d *diskCachedKeyGetter) mustPathFor(bucketName, keyName string) string {
+	keyPath, err := d.pathFor(bucketName, keyName)
+	if err != nil {
+		panic(err)
+	}
+	return keyPath
+}
+
+func (d *diskCachedKeyGetter) mustMetadataPathFor(bucketName, keyName string) string {
+	metadataPath, err := d.metadataPathFor(bucketName, keyName)
+	if err != nil {
+		panic(err)
+	}
+	return metadataPath
+}
+
+func TestNamesCantEscapeTheirBucket(t *testing.T) {
+	root, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cacheDir := path.Join(root, "cache")
+	secret := path.Join(root, "secret")
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	disk := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: disk}}
+
+	for _, target := range []string{"/object?bucket=bucket&key=../../secret", "/object?bucket=..&key=secret",
+		"/object/bucket/%2e%2e%2f%2e%2e%2fsecret", "/object/_cas/key", "/object/bucket/a%2f.%2fb"} {
+		rec := httptest.NewRecorder()
+		server.serveObject(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code != 400 {
+			t.Logf("Expected a 400 for %v, but got %v: %v", target, rec.Code, rec.Body)
+			t.Fail()
+		}
+	}
+	rec := httptest.NewRecorder()
+	disk.serveDigest(rec, httptest.NewRequest("GET", "/digest?bucket=bucket&key=../../secret", nil))
+	if rec.Code != 400 {
+		t.Logf("Expected a 400 from /digest, but got %v: %v", rec.Code, rec.Body)
+		t.Fail()
+	}
+	for _, body := range []string{`{"bucket_name": "bucket", "keynames": ["ok", "../../secret"]}`,
+		`{"bucket_name": "..", "keynames": ["secret"]}`, `{"bucket_name": ".meta", "keynames": ["key"]}`} {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		if rec.Code != 400 {
+			t.Logf("Expected a 400 for %v, but got %v: %v", body, rec.Code, rec.Body)
+			t.Fail()
+		}
+	}
+	results := disk.get(context.Background(), "bucket", []string{"../../secret", "key"})
+	if results[0].localPath != nil || results[1].localPath == nil {
+		t.Logf("Expected only the key that stays in its bucket to be cached, but got %+v", results)
+		t.Fail()
+	}
+	if base.called != 1 {
+		t.Logf("Expected the escaping key never to be fetched, but the base was called %v times", base.called)
+		t.Fail()
+	}
+	if disk.remove("bucket", "../../secret") {
+		t.Logf("Expected nothing to be removed outside the cache")
+		t.Fail()
+	}
+	if raw, err := ioutil.ReadFile(secret); err != nil || string(raw) != "secret" {
+		t.Logf("Expected the file outside the cache to be untouched, but got %q, %v", raw, err)
+		t.Fail()
+	}
 }
 
 func TestDiskCachedKeyGetter(t *testing.T) {
@@ -112,7 +218,7 @@ func TestDiskCachedKeyGetter(t *testing.T) {
 		t.Fail()
 	}
 
-	firstResults := ckg.get("bucket", keyNames)
+	firstResults := ckg.get(context.Background(), "bucket", keyNames)
 	if len(firstResults) != len(keyNames) {
 		t.Fatalf("Expected %v results, but found %v", len(keyNames), len(firstResults))
 	}
@@ -153,7 +259,7 @@ func TestDiskCachedKeyGetter(t *testing.T) {
 			t.Fail()
 		}
 	}
-	secondResults := ckg.get("bucket", keyNames)
+	secondResults := ckg.get(context.Background(), "bucket", keyNames)
 
 	if base.called != len(keyNames) {
 		t.Logf("Expected the number of calls to stay at %v, but had %v", len(keyNames), base.called)
@@ -220,33 +326,130 @@ func TestEvictingMutableKeyGetter(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(tempDir)
-	dbkg := diskCachedKeyGetter{base, tempDir}
+	dbkg := diskCachedKeyGetter{base: base, cacheDir: tempDir}
 	var evicter ShouldEvicter = ShouldEvictFunc(func(r getResult) (bool, error) {
 		return true, nil
 	})
-	emkg := EvictingMutableKeyGetter{&dbkg, evicter}
-	results := emkg.Get("bucket", []string{"key1"}, false)
+	emkg := EvictingMutableKeyGetter{CachedKeyGetter: &dbkg, ShouldEvicter: evicter}
+	results := emkg.Get(context.Background(), "bucket", []string{"key1"}, getOptions{})
 	if base.called != 1 {
 		t.Logf("results log %v", results)
 		t.Fatalf("Expected only one call to the base getter after the first call, but had %v", base.called)
 	}
-	_ = emkg.Get("bucket", []string{"key1"}, false)
+	_ = emkg.Get(context.Background(), "bucket", []string{"key1"}, getOptions{})
 	if base.called != 1 {
 		t.Fatalf("Expected only one call to the base getter after the second call, but had %v", base.called)
 	}
-	_ = emkg.Get("bucket", []string{"key1"}, true)
+	_ = emkg.Get(context.Background(), "bucket", []string{"key1"}, getOptions{mutableBucket: true})
 	if base.called != 2 {
 		t.Fatalf("Expected a second call to the base getter after a mutable call, but had %v", base.called)
 	}
 
 }
 
+func TestEvictingMutableKeyGetterMutableKeys(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	dbkg := diskCachedKeyGetter{base: base, cacheDir: tempDir}
+	checked := make(map[string]int)
+	var evicter ShouldEvicter = ShouldEvictFunc(func(r getResult) (bool, error) {
+		checked[r.keyName] += 1
+		return false, nil
+	})
+	emkg := EvictingMutableKeyGetter{CachedKeyGetter: &dbkg, ShouldEvicter: evicter}
+	keyNames := []string{"mutable", "immutable"}
+	emkg.Get(context.Background(), "bucket", keyNames, getOptions{})
+
+	// mutable_bucket is false, but mutable_keys decides
+	cr := CacheRequest{BucketName: "bucket", KeyNames: keyNames, MutableKeys: []string{"mutable"}}
+	if err := cr.validate(false); err != nil {
+		t.Fatal(err)
+	}
+	cr.fetchExactly(context.Background(), &emkg, keyNames)
+	if checked["mutable"] != 1 || checked["immutable"] != 0 {
+		t.Logf("Expected only the mutable key to be checked, but the checks were %v", checked)
+		t.Fail()
+	}
+
+	// without mutable_keys, mutable_bucket applies to every key
+	cr = CacheRequest{BucketName: "bucket", KeyNames: keyNames, MutableBucket: true}
+	cr.fetchExactly(context.Background(), &emkg, keyNames)
+	if checked["mutable"] != 2 || checked["immutable"] != 1 {
+		t.Logf("Expected every key to be checked for a mutable bucket, but the checks were %v", checked)
+		t.Fail()
+	}
+
+	cr = CacheRequest{BucketName: "bucket", KeyNames: keyNames, MutableKeys: []string{"other"}}
+	if err := cr.validate(false); err == nil {
+		t.Logf("Expected a mutable key that wasn't requested to be refused")
+		t.Fail()
+	}
+}
+
+func TestEvictingMutableKeyGetterCoalescesRefreshes(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	base.etag = "old"
+	dkg.get(context.Background(), "bucket", []string{"key"})
+	base.etag = "new"
+
+	const requests = 8
+	var checks sync.WaitGroup
+	checks.Add(requests)
+	evicter := ShouldEvictFunc(func(r getResult) (bool, error) {
+		if r.etag != "old" {
+			return false, nil
+		}
+		// hold every check until all the requests have found the key changed
+		checks.Done()
+		checks.Wait()
+		return true, nil
+	})
+	e := &EvictingMutableKeyGetter{CachedKeyGetter: dkg, ShouldEvicter: evicter}
+	var wg sync.WaitGroup
+	results := make([][]getResult, requests)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = e.Get(context.Background(), "bucket", []string{"key"}, getOptions{mutableBucket: true})
+		}(i)
+	}
+	wg.Wait()
+
+	if base.called != 2 {
+		t.Logf("Expected the changed key to be re-fetched once, but it was fetched %v times", base.called)
+		t.Fail()
+	}
+	for i, result := range results {
+		if len(result) != 1 || result[0].localPath == nil || result[0].etag != "new" {
+			t.Logf("Expected request %v to get the refreshed key, but got %v", i, result)
+			t.Fail()
+		}
+	}
+}
+
 type ignoringMutableKeyGetter struct {
 	KeyGetter
 }
 
-func (i ignoringMutableKeyGetter) Get(bucketName string, keyNames []string, mutable bool) []getResult {
-	return i.get(bucketName, keyNames)
+func (i ignoringMutableKeyGetter) Get(ctx context.Context, bucketName string, keyNames []string, opts getOptions) []getResult {
+	return i.get(ctx, bucketName, keyNames)
+}
+
+func (i ignoringMutableKeyGetter) GetCached(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	return i.get(ctx, bucketName, keyNames)
 }
 
 func TestKeyServer(t *testing.T) {
@@ -254,9 +457,1185 @@ func TestKeyServer(t *testing.T) {
 	base := newMockKeyGetter("sample content")
 	defer os.RemoveAll(base.dir)
 
-	ks := keyServer{ignoringMutableKeyGetter{base}}
+	ks := keyServer{MutableKeyGetter: ignoringMutableKeyGetter{base}}
 	ts := httptest.NewServer(&ks)
 	defer ts.Close()
 
 	http.Post(ts.URL, "application/json", bytes.NewReader(rawRequest))
 }
+
+func TestNormalizeETag(t *testing.T) {
+	expected := "d41d8cd98f00b204e9800998ecf8427e"
+	for _, etag := range []string{
+		`"d41d8cd98f00b204e9800998ecf8427e"`,
+		`d41d8cd98f00b204e9800998ecf8427e`,
+		`"D41D8CD98F00B204E9800998ECF8427E"`,
+		`W/"d41d8cd98f00b204e9800998ecf8427e"`,
+	} {
+		if actual := normalizeETag(etag); actual != expected {
+			t.Logf("Expected %v to normalize to %v, but got %v", etag, expected, actual)
+			t.Fail()
+		}
+	}
+}
+
+func TestKeyServerOnlyCached(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	dkg.get(context.Background(), "bucket", []string{"key1"})
+	ks := keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: &dkg}}
+
+	body := []byte(`{"bucket_name":"bucket","keynames":["key1","key2"],"only_cached":true}`)
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	ks.ServeHTTP(rec, req)
+
+	if base.called != 1 {
+		t.Fatalf("Expected no further calls to the base getter, but had %v", base.called)
+	}
+	var results []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]string)
+	for _, result := range results {
+		statuses[result["key_name"].(string)] = result["status"].(string)
+	}
+	if statuses["key1"] != "disk cache hit" {
+		t.Logf("Expected a disk cache hit for key1, but got %v", statuses["key1"])
+		t.Fail()
+	}
+	if statuses["key2"] != missNotFetched {
+		t.Logf("Expected %v for key2, but got %v", missNotFetched, statuses["key2"])
+		t.Fail()
+	}
+}
+
+func TestDiskCachedKeyGetterDedupByETag(t *testing.T) {
+	base := newMockKeyGetter("shared content")
+	base.etag = "9e107d9d372bb6826bd81d3542a419d6"
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir, dedupByETag: true}
+	dkg.get(context.Background(), "bucket", []string{"key1"})
+	dkg.get(context.Background(), "bucket", []string{"key2"})
+
+	first, err := os.Stat(dkg.mustPathFor("bucket", "key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.Stat(dkg.mustPathFor("bucket", "key2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(first, second) {
+		t.Logf("Expected keys sharing an ETag to share an inode")
+		t.Fail()
+	}
+
+	base.etag = "9e107d9d372bb6826bd81d3542a419d6-2"
+	dkg.get(context.Background(), "bucket", []string{"key3", "key4"})
+	third, _ := os.Stat(dkg.mustPathFor("bucket", "key3"))
+	fourth, _ := os.Stat(dkg.mustPathFor("bucket", "key4"))
+	if os.SameFile(third, fourth) {
+		t.Logf("Expected keys with a multipart ETag not to be deduplicated")
+		t.Fail()
+	}
+
+	// key1 is re-cached with new content, so key5 mustn't be linked to it
+	base.content, base.etag = "changed content", "e4d909c290d0fb1ca068ffaddf22cbd0"
+	changed := base.get(context.Background(), "bucket", []string{"key1"})[0]
+	if changed, err = dkg.moveToCache(context.Background(), "bucket", changed); err != nil {
+		t.Fatal(err)
+	}
+	dkg.writeMetadata("bucket", changed)
+	base.content, base.etag = "shared content", "9e107d9d372bb6826bd81d3542a419d6"
+	dkg.get(context.Background(), "bucket", []string{"key5"})
+	if raw, _ := ioutil.ReadFile(dkg.mustPathFor("bucket", "key5")); string(raw) != "shared content" {
+		t.Logf("Expected key5 not to be linked to key1's new content, but got %q", raw)
+		t.Fail()
+	}
+	for _, keyName := range []string{"key1", "key2", "key5"} {
+		dkg.remove("bucket", keyName)
+	}
+	if len(dkg.etagTwins) != 0 {
+		t.Logf("Expected removed keys' ETags to be forgotten, but had %v", dkg.etagTwins)
+		t.Fail()
+	}
+}
+
+func TestBoundedDiskCachedKeyGetterGracePeriod(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	lru := &lruCachedKeyGetter{base: dkg}
+	b := &boundedDiskCachedKeyGetter{lru: lru, disk: dkg, gracePeriod: time.Hour, wake: make(chan struct{}, 1)}
+
+	b.get(context.Background(), "bucket", []string{"fresh"})
+	b.get(context.Background(), "bucket", []string{"old"})
+	oldElem, _ := lru.cache.lookup("bucket", "old")
+	old := oldElem.Value.(getResult)
+	old.cachedAt = time.Now().Add(-2 * time.Hour)
+	oldElem.Value = old
+
+	size := int64(len("sample content"))
+	b.shrinkTo(size, 0)
+	if b.size() != size {
+		t.Logf("Expected %v bytes left after eviction, but had %v", size, b.size())
+		t.Fail()
+	}
+	if !b.has("bucket", "fresh") || !lru.has("bucket", "fresh") {
+		t.Logf("Expected the entry within its grace period to survive eviction")
+		t.Fail()
+	}
+	if b.has("bucket", "old") || lru.has("bucket", "old") {
+		t.Logf("Expected the entry past its grace period to be evicted")
+		t.Fail()
+	}
+}
+
+func TestBoundedDiskCachedKeyGetterCountsDiskHits(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	// cached by an earlier run, which left no snapshot
+	dkg.get(context.Background(), "bucket", []string{"key1"})
+	lru := &lruCachedKeyGetter{base: dkg}
+	b := &boundedDiskCachedKeyGetter{lru: lru, disk: dkg}
+
+	results := b.get(context.Background(), "bucket", []string{"key1"})
+	size := int64(len("sample content"))
+	if results[0].status != "disk cache hit" || results[0].bytesTransferred != size {
+		t.Logf("Expected a disk hit of %v bytes, but got %+v", size, results[0])
+		t.Fail()
+	}
+	if b.size() != size || lru.aggregates().Bytes != size {
+		t.Logf("Expected the disk hit's %v bytes to be counted, but the total was %v and the lru had %v",
+			size, b.size(), lru.aggregates().Bytes)
+		t.Fail()
+	}
+}
+
+func TestKeyServerEmptyKeys(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	getter := &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{base: base, cacheDir: cacheDir}}
+	body := []byte(`{"bucket_name":"bucket","keynames":[]}`)
+
+	rec := httptest.NewRecorder()
+	ks := keyServer{MutableKeyGetter: getter}
+	ks.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+	if rec.Code != 400 {
+		t.Logf("Expected a 400 for no keys by default, but got %v", rec.Code)
+		t.Fail()
+	}
+
+	rec = httptest.NewRecorder()
+	ks = keyServer{MutableKeyGetter: getter, allowEmptyKeys: true}
+	ks.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+	if rec.Code != 200 || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Logf("Expected an empty success when allowed, but got %v %v", rec.Code, rec.Body.String())
+		t.Fail()
+	}
+}
+
+func TestTempKeyGetterCopyBufferSize(t *testing.T) {
+	contents := bytes.Repeat([]byte("fancy s3 key contents "), 100)
+	kg := &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter(contents), copyBufferSize: 7}
+	for i := 0; i < 2; i++ {
+		result := kg.getKey(context.Background(), "bucket", "key1")
+		if result.localPath == nil {
+			t.Fatalf("Didn't return any path for local file: %v", result.status)
+		}
+		defer os.Remove(*result.localPath)
+		compareContents(string(contents), *result.localPath, t)
+		if result.bytesTransferred != int64(len(contents)) {
+			t.Logf("Transferred %v bytes, but expected %v", result.bytesTransferred, len(contents))
+			t.Fail()
+		}
+	}
+}
+
+func BenchmarkTempKeyGetterCopyBuffer(b *testing.B) {
+	contents := bytes.Repeat([]byte{'x'}, 16<<20)
+	for _, size := range []int{0, 4 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("buffer=%v", size), func(b *testing.B) {
+			kg := &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter(contents), copyBufferSize: size}
+			b.SetBytes(int64(len(contents)))
+			for i := 0; i < b.N; i++ {
+				result := kg.getKey(context.Background(), "bucket", "key1")
+				if result.localPath == nil {
+					b.Fatal(result.status)
+				}
+				os.Remove(*result.localPath)
+			}
+		})
+	}
+}
+
+func TestKeyServerStrategyOverride(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	dkg.get(context.Background(), "bucket", []string{"key1"})
+	checked := 0
+	var evicter ShouldEvicter = ShouldEvictFunc(func(r getResult) (bool, error) {
+		checked += 1
+		return true, nil
+	})
+	ks := keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: dkg, ShouldEvicter: evicter}}
+
+	rec := httptest.NewRecorder()
+	body := []byte(`{"bucket_name":"bucket","keynames":["key1"],"mutable_bucket":true,"strategy":"none"}`)
+	ks.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+	if checked != 0 || base.called != 1 {
+		t.Logf("Expected strategy none to skip the evicter, but it was called %v times and base %v times", checked, base.called)
+		t.Fail()
+	}
+
+	rec = httptest.NewRecorder()
+	body = []byte(`{"bucket_name":"bucket","keynames":["key1"],"mutable_bucket":true,"strategy":"bogus"}`)
+	ks.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+	if rec.Code != 400 {
+		t.Logf("Expected a 400 for an unknown strategy, but got %v", rec.Code)
+		t.Fail()
+	}
+
+	rec = httptest.NewRecorder()
+	body = []byte(`{"bucket_name":"bucket","keynames":["key1"],"mutable_bucket":true}`)
+	ks.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+	if checked != 1 || base.called != 2 {
+		t.Logf("Expected the default evicter to evict, but it was called %v times and base %v times", checked, base.called)
+		t.Fail()
+	}
+}
+
+func TestBoundedDiskCachedKeyGetterSoftAndHardLimits(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	size := int64(len("sample content"))
+	b := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg}, disk: dkg,
+		softLimit: 2 * size, hardLimit: 4 * size, wake: make(chan struct{}, 1)}
+
+	b.get(context.Background(), "bucket", []string{"key1", "key2", "key3"})
+	if b.size() != 3*size {
+		t.Logf("Expected nothing to be evicted synchronously below the hard limit, but size is %v", b.size())
+		t.Fail()
+	}
+	if len(b.wake) != 1 {
+		t.Logf("Expected background eviction to be woken past the soft limit")
+		t.Fail()
+	}
+
+	b.get(context.Background(), "bucket", []string{"key4", "key5"})
+	if b.size() > b.hardLimit {
+		t.Logf("Expected the request crossing the hard limit to evict before returning, but size is %v", b.size())
+		t.Fail()
+	}
+
+	go b.keepClean()
+	defer close(b.wake)
+	deadline := time.Now().Add(5 * time.Second)
+	for b.size() > b.softLimit && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if b.size() != b.softLimit {
+		t.Logf("Expected background eviction to bring the size to %v, but it's %v", b.softLimit, b.size())
+		t.Fail()
+	}
+	if b.has("bucket", "key1") || !b.has("bucket", "key5") {
+		t.Logf("Expected the oldest keys to be the ones evicted")
+		t.Fail()
+	}
+}
+
+func TestDiskCachedKeyGetterPrefixCollisions(t *testing.T) {
+	for _, order := range [][]string{{"a/b", "a/b/c"}, {"a/b/c", "a/b"}} {
+		base := newMockKeyGetter("sample content")
+		defer os.RemoveAll(base.dir)
+		cacheDir, err := ioutil.TempDir("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(cacheDir)
+		dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+
+		first := dkg.get(context.Background(), "bucket", order[:1])[0]
+		second := dkg.get(context.Background(), "bucket", order[1:])[0]
+		if first.localPath == nil {
+			t.Fatalf("Expected %v to be cached, but got %v", order[0], first.status)
+		}
+		compareContents("sample content", *first.localPath, t)
+		if second.localPath != nil || !strings.Contains(second.status, "can't cache") {
+			t.Logf("Expected %v to be refused after %v, but got %v", order[1], order[0], second.status)
+			t.Fail()
+		}
+		if dkg.has("bucket", order[1]) {
+			t.Logf("Expected %v not to look cached after %v", order[1], order[0])
+			t.Fail()
+		}
+		again := dkg.get(context.Background(), "bucket", order[:1])[0]
+		if again.status != "disk cache hit" {
+			t.Logf("Expected %v to still be a hit, but got %v", order[0], again.status)
+			t.Fail()
+		}
+	}
+
+	dkg := &diskCachedKeyGetter{base: newMockKeyGetter("unused")}
+	defer os.RemoveAll(dkg.base.(*mockKeyGetter).dir)
+	if result := dkg.get(context.Background(), "bucket", []string{"a/"})[0]; result.status != folderMarker {
+		t.Logf("Expected a folder marker status for a/, but got %v", result.status)
+		t.Fail()
+	}
+}
+
+func TestEvictingMutableKeyGetterOnChange(t *testing.T) {
+	alwaysChanged := ShouldEvictFunc(func(r getResult) (bool, error) {
+		return true, nil
+	})
+	for _, tc := range []struct {
+		onChange        string
+		expectedFetches int
+		expectedStatus  string
+	}{
+		{evictOnChange, 2, mockFetched},
+		{warnServeStale, 1, staleServed},
+		{serveStaleSilent, 1, "disk cache hit"},
+	} {
+		base := newMockKeyGetter("sample content")
+		defer os.RemoveAll(base.dir)
+		cacheDir, err := ioutil.TempDir("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(cacheDir)
+		emkg := &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{base: base, cacheDir: cacheDir},
+			ShouldEvicter: alwaysChanged, onChange: evictOnChange}
+		emkg.Get(context.Background(), "bucket", []string{"key1"}, getOptions{})
+
+		results := emkg.Get(context.Background(), "bucket", []string{"key1"}, getOptions{mutableBucket: true, onChange: tc.onChange})
+		if base.called != tc.expectedFetches {
+			t.Logf("Expected %v fetches with %v, but had %v", tc.expectedFetches, tc.onChange, base.called)
+			t.Fail()
+		}
+		if len(results) != 1 || results[0].status != tc.expectedStatus || results[0].localPath == nil {
+			t.Logf("Expected a %v result with %v, but got %v", tc.expectedStatus, tc.onChange, results)
+			t.Fail()
+		}
+	}
+}
+
+func TestReadOnlyKeyGetterNeverFetches(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	importer := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	importer.get(context.Background(), "bucket", []string{"imported"})
+
+	readOnly := &diskCachedKeyGetter{base: readOnlyKeyGetter{}, cacheDir: cacheDir}
+	emkg := &EvictingMutableKeyGetter{CachedKeyGetter: readOnly, ShouldEvicter: neverEvicter{}}
+	results := emkg.Get(context.Background(), "bucket", []string{"imported", "absent"}, getOptions{mutableBucket: true})
+	if base.called != 1 {
+		t.Logf("Expected only the import to fetch, but had %v fetches", base.called)
+		t.Fail()
+	}
+	statuses := make(map[string]string)
+	for _, result := range results {
+		statuses[result.keyName] = result.status
+		if result.keyName == "absent" && result.localPath != nil {
+			t.Logf("Expected no path for a key that was never imported, but got %v", *result.localPath)
+			t.Fail()
+		}
+	}
+	if statuses["imported"] != "disk cache hit" || statuses["absent"] != missNotFetched {
+		t.Logf("Expected a hit and a %v, but got %v", missNotFetched, statuses)
+		t.Fail()
+	}
+	if readOnly.has("bucket", "absent") {
+		t.Logf("Expected the absent key to stay uncached")
+		t.Fail()
+	}
+}
+
+func TestLRUIndexesKeepBucketsApart(t *testing.T) {
+	pairs := [][2]string{
+		{"a", "b/c"},
+		{"a.b", "c"},
+		{"a", ".b/c"},
+		{"ab", "c"},
+		{"a", "bc"},
+		{"a", "b\x00c"},
+		{"a", ""},
+		{"", "a"},
+	}
+	for name, index := range map[string]lruIndex{"nested": nestedLRUIndex{}, "flat": flatLRUIndex{}} {
+		var l list.List
+		for _, pair := range pairs {
+			index.store(pair[0], pair[1], l.PushBack(pair))
+		}
+		for _, pair := range pairs {
+			elem, had := index.lookup(pair[0], pair[1])
+			if !had || elem.Value.([2]string) != pair {
+				t.Logf("Expected the %v index to find %q, but it found %v", name, pair, elem)
+				t.Fail()
+			}
+		}
+		index.drop("a", "bc")
+		if _, had := index.lookup("ab", "c"); !had {
+			t.Logf("Expected dropping a/bc from the %v index to leave ab/c", name)
+			t.Fail()
+		}
+	}
+}
+
+func benchmarkLRUIndex(b *testing.B, index lruIndex) {
+	var l list.List
+	elem := l.PushBack(nil)
+	buckets := []string{"logs", "assets", "backups", "models"}
+	keyNames := make([]string, 256)
+	for i := range keyNames {
+		keyNames[i] = fmt.Sprintf("prefix/%v/object", i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bucketName, keyName := buckets[i%len(buckets)], keyNames[i%len(keyNames)]
+		if _, had := index.lookup(bucketName, keyName); !had {
+			index.store(bucketName, keyName, elem)
+		}
+	}
+}
+
+func BenchmarkNestedLRUIndex(b *testing.B) {
+	benchmarkLRUIndex(b, nestedLRUIndex{})
+}
+
+func BenchmarkFlatLRUIndex(b *testing.B) {
+	benchmarkLRUIndex(b, flatLRUIndex{})
+}
+
+// removalTimingKeyGetter records when each key is removed.
+type removalTimingKeyGetter struct {
+	CachedKeyGetter
+	removals []time.Time
+	sync.Mutex
+}
+
+func (r *removalTimingKeyGetter) remove(bucketName, keyName string) bool {
+	r.Lock()
+	r.removals = append(r.removals, time.Now())
+	r.Unlock()
+	return r.CachedKeyGetter.remove(bucketName, keyName)
+}
+
+func TestBoundedDiskCachedKeyGetterPacesEviction(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	disk := &removalTimingKeyGetter{CachedKeyGetter: dkg}
+	size := int64(len("sample content"))
+	pace := 20 * time.Millisecond
+	b := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg}, disk: disk,
+		softLimit: size, hardLimit: 10 * size, evictionPace: pace, wake: make(chan struct{}, 1)}
+
+	b.get(context.Background(), "bucket", []string{"key1", "key2", "key3", "key4"})
+	go b.keepClean()
+	defer close(b.wake)
+	deadline := time.Now().Add(5 * time.Second)
+	for b.size() > b.softLimit && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if b.size() != size {
+		t.Logf("Expected paced eviction to bring the size to %v, but it's %v", size, b.size())
+		t.Fail()
+	}
+	disk.Lock()
+	defer disk.Unlock()
+	if len(disk.removals) != 3 {
+		t.Fatalf("Expected 3 deletes, but had %v", len(disk.removals))
+	}
+	for i := 1; i < len(disk.removals); i++ {
+		if gap := disk.removals[i].Sub(disk.removals[i-1]); gap < pace {
+			t.Logf("Expected deletes at least %v apart, but deletes %v and %v were %v apart", pace, i-1, i, gap)
+			t.Fail()
+		}
+	}
+}
+
+type failingKeyReaderGetter struct {
+	err error
+}
+
+func (f failingKeyReaderGetter) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
+	return nil, f.err
+}
+
+func TestTempKeyGetterPropagatesS3Errors(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected string
+	}{
+		{&s3.Error{StatusCode: 403, Code: "AccessDenied", Message: "Access Denied", RequestId: "REQ123"},
+			`{"code":"AccessDenied","status_code":403,"message":"Access Denied","request_id":"REQ123"}`},
+		{fmt.Errorf("connection reset"), `{"message":"connection reset"}`},
+	} {
+		tkg := &tempKeyGetter{keyReaderGetter: failingKeyReaderGetter{tc.err}}
+		results := tkg.get(context.Background(), "bucket", []string{"key1"})
+		if len(results) != 1 || results[0].localPath != nil {
+			t.Fatalf("Expected one failed result, but got %v", results)
+		}
+		out, err := json.Marshal(&results[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var marshalled map[string]json.RawMessage
+		if err := json.Unmarshal(out, &marshalled); err != nil {
+			t.Fatal(err)
+		}
+		if string(marshalled["error"]) != tc.expected {
+			t.Logf("Expected the error %v, but got %s", tc.expected, marshalled["error"])
+			t.Fail()
+		}
+	}
+}
+
+func TestDiskCachedKeyGetterCancelledMoveLeavesAMiss(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results := dkg.get(ctx, "bucket", []string{"key1"})
+	if len(results) != 1 || results[0].status != cancelled || results[0].localPath != nil {
+		t.Logf("Expected a cancelled result with no path, but got %v", results)
+		t.Fail()
+	}
+	if dkg.has("bucket", "key1") {
+		t.Logf("Expected a cancelled move to leave key1 uncached")
+		t.Fail()
+	}
+	if leftovers, _ := ioutil.ReadDir(base.dir); len(leftovers) != 0 {
+		t.Logf("Expected the downloaded file to be cleaned up, but found %v", leftovers)
+		t.Fail()
+	}
+
+	from := path.Join(base.dir, "download")
+	if err := ioutil.WriteFile(from, bytes.Repeat([]byte("x"), 1<<20), 0666); err != nil {
+		t.Fatal(err)
+	}
+	to := dkg.mustPathFor("bucket", "key2")
+	if err := dkg.copyIntoPlace(ctx, from, to); err == nil {
+		t.Logf("Expected a cancelled copy to fail")
+		t.Fail()
+	}
+	if _, err := os.Stat(to); !os.IsNotExist(err) {
+		t.Logf("Expected nothing at %v after a cancelled copy, but got %v", to, err)
+		t.Fail()
+	}
+	if partials, _ := ioutil.ReadDir(path.Join(cacheDir, "_partial")); len(partials) != 0 {
+		t.Logf("Expected the partial copy to be removed, but found %v", partials)
+		t.Fail()
+	}
+}
+
+func TestDiskCachedKeyGetterDuplicateMoves(t *testing.T) {
+	for _, policy := range duplicatePolicies {
+		tempDir, err := ioutil.TempDir("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tempDir)
+		cacheDir, err := ioutil.TempDir("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(cacheDir)
+		dkg := &diskCachedKeyGetter{cacheDir: cacheDir, onDuplicate: policy}
+		download := func(content string) getResult {
+			f, err := ioutil.TempFile(tempDir, "download")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			f.WriteString(content)
+			localPath := f.Name()
+			return getResult{keyName: "key", localPath: &localPath}
+		}
+		if _, err := dkg.moveToCache(context.Background(), "bucket", download("first")); err != nil {
+			t.Fatal(err)
+		}
+
+		dest := dkg.mustPathFor("bucket", "key")
+		stop := make(chan struct{})
+		missing := make(chan error, 1)
+		var readers sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if f, err := os.Open(dest); err != nil {
+						select {
+						case missing <- err:
+						default:
+						}
+					} else {
+						f.Close()
+					}
+				}
+			}()
+		}
+		var movers sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			movers.Add(1)
+			go func(i int) {
+				defer movers.Done()
+				for j := 0; j < 20; j++ {
+					if _, err := dkg.moveToCache(context.Background(), "bucket", download(fmt.Sprintf("second %v", i))); err != nil {
+						t.Logf("Expected %v duplicate moves to succeed, but got %v", policy, err)
+						t.Fail()
+					}
+				}
+			}(i)
+		}
+		movers.Wait()
+		close(stop)
+		readers.Wait()
+
+		select {
+		case err := <-missing:
+			t.Logf("Expected readers never to miss %v under %v, but got %v", dest, policy, err)
+			t.Fail()
+		default:
+		}
+		content, err := ioutil.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept := string(content) == "first"; kept != (policy == keepDuplicate) {
+			t.Logf("Expected %v to leave the right file in place, but it holds %q", policy, content)
+			t.Fail()
+		}
+		if leftovers, _ := ioutil.ReadDir(tempDir); len(leftovers) != 0 {
+			t.Logf("Expected every download to be moved or removed under %v, but found %v", policy, len(leftovers))
+			t.Fail()
+		}
+	}
+}
+
+func TestLRUSampleOldestPicksTheOlderOfItsSample(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	lru := &lruCachedKeyGetter{base: base}
+	const entries = 10
+	for i := 0; i < entries; i++ {
+		lru.get(context.Background(), "bucket", []string{fmt.Sprint(i)})
+	}
+	rng := rand.New(rand.NewSource(1))
+	ageSum := 0
+	for trial := 0; trial < 200; trial++ {
+		victim := lru.sampleOldest(0, 2, rng)
+		if victim == nil {
+			t.Fatal("Expected a victim from a full lru")
+		}
+		if victim.keyName == fmt.Sprint(entries-1) {
+			t.Fatalf("Expected the most recently used entry never to be the less recent of two")
+		}
+		var age int
+		fmt.Sscan(victim.keyName, &age)
+		ageSum += entries - 1 - age
+	}
+	// the older of two of 10 averages around 6 positions from the front
+	if mean := float64(ageSum) / 200; mean < 5 {
+		t.Logf("Expected victims to skew old, but their mean age was %v", mean)
+		t.Fail()
+	}
+	if lru.sampleOldest(time.Hour, 2, rng) != nil {
+		t.Logf("Expected no victim when every entry is within the grace period")
+		t.Fail()
+	}
+}
+
+// slowFirstKeyReaderGetter takes longer to start downloading the keys
+// that come earlier in the alphabet.
+type slowFirstKeyReaderGetter struct{}
+
+func (slowFirstKeyReaderGetter) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
+	time.Sleep(time.Duration('z'-keyName[0]) * time.Millisecond)
+	return ioutil.NopCloser(strings.NewReader(keyName)), nil
+}
+
+func TestResultsKeepRequestOrder(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	emkg := &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{
+		base: &tempKeyGetter{keyReaderGetter: slowFirstKeyReaderGetter{}}, cacheDir: cacheDir}}
+	emkg.Get(context.Background(), "bucket", []string{"c", "x"}, getOptions{})
+
+	keyNames := []string{"a", "x", "m", "c", "z", "b"}
+	results := emkg.Get(context.Background(), "bucket", keyNames, getOptions{})
+	if len(results) != len(keyNames) {
+		t.Fatalf("Expected %v results, but got %v", len(keyNames), len(results))
+	}
+	for i, result := range results {
+		if result.keyName != keyNames[i] {
+			t.Logf("Expected %v at position %v, but found %v", keyNames[i], i, result.keyName)
+			t.Fail()
+		}
+	}
+}
+
+func TestEvictingMutableKeyGetterDeletedUpstream(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	for _, lookupErr := range []error{
+		&s3.Error{StatusCode: 404, Code: "NoSuchKey", Message: "The specified key does not exist."},
+		fmt.Errorf("bucket/key1 %w", errNotFoundUpstream),
+	} {
+		deleted := ShouldEvictFunc(func(r getResult) (bool, error) {
+			return false, lookupErr
+		})
+		emkg := &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{base: base, cacheDir: cacheDir},
+			ShouldEvicter: deleted}
+		emkg.Get(context.Background(), "bucket", []string{"key1"}, getOptions{})
+		called := base.called
+
+		results := emkg.Get(context.Background(), "bucket", []string{"key1"}, getOptions{mutableBucket: true})
+		if len(results) != 1 || results[0].status != notFound || results[0].localPath != nil {
+			t.Logf("Expected a %v result for %v, but got %v", notFound, lookupErr, results)
+			t.Fail()
+		}
+		if emkg.has("bucket", "key1") {
+			t.Logf("Expected the deleted key to be evicted for %v", lookupErr)
+			t.Fail()
+		}
+		if base.called != called {
+			t.Logf("Expected no refetch of a deleted key for %v", lookupErr)
+			t.Fail()
+		}
+	}
+}
+
+func TestKeyServerNullPaths(t *testing.T) {
+	failing := &tempKeyGetter{keyReaderGetter: failingKeyReaderGetter{fmt.Errorf("connection reset")}}
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	getter := &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{base: failing, cacheDir: cacheDir}}
+	for _, omit := range []bool{false, true} {
+		server := &keyServer{MutableKeyGetter: getter, omitNullPaths: omit}
+		rec := httptest.NewRecorder()
+		body := bytes.NewReader([]byte(`{"bucket_name": "bucket", "keynames": ["key1"]}`))
+		server.ServeHTTP(rec, httptest.NewRequest("POST", "/", body))
+		var results []map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("Expected one result, but got %v", results)
+		}
+		localPath, present := results[0]["local_path"]
+		if present == omit || localPath != nil {
+			t.Logf("Expected local_path to be present: %v and null with omitNullPaths %v, but got %v", !omit, omit, results[0])
+			t.Fail()
+		}
+	}
+}
+
+func TestKeyServerFallbackKey(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	objects := mapKeyReaderGetter{"config/default.json": `{"default": true}`, "config/team.json": `{"team": true}`}
+	getter := &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{
+		base: &tempKeyGetter{keyReaderGetter: objects}, cacheDir: cacheDir}}
+	server := &keyServer{MutableKeyGetter: getter}
+
+	rec := httptest.NewRecorder()
+	body := bytes.NewReader([]byte(`{"bucket_name": "config", "keynames": ["team.json", "other.json"], "fallback_key": "default.json"}`))
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/", body))
+	var results []struct {
+		KeyName   string  `json:"key_name"`
+		Status    string  `json:"status"`
+		LocalPath *string `json:"local_path"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[1].KeyName != "other.json" || results[1].Status != servedFallback || results[1].LocalPath == nil {
+		t.Fatalf("Expected other.json to be served the fallback, but got %v", rec.Body.String())
+	}
+	for i, expected := range []string{`{"team": true}`, `{"default": true}`} {
+		content, err := ioutil.ReadFile(*results[i].LocalPath)
+		if err != nil || string(content) != expected {
+			t.Logf("Expected %v for %v, but got %q, %v", expected, results[i].KeyName, content, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestKeyServerAdmissionControl(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	gated := &gatedKeyGetter{KeyGetter: base, gate: make(chan struct{})}
+	getter := &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{base: gated, cacheDir: cacheDir}}
+	stats := &cacheStats{}
+	server := &keyServer{MutableKeyGetter: getter, requestSlots: newSlots(2), stats: stats}
+	request := func(keyName string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := bytes.NewReader([]byte(`{"bucket_name": "bucket", "keynames": ["` + keyName + `"]}`))
+		server.ServeHTTP(rec, httptest.NewRequest("POST", "/", body))
+		return rec
+	}
+
+	var wg sync.WaitGroup
+	admitted := make([]*httptest.ResponseRecorder, 2)
+	for i := range admitted {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			admitted[i] = request(fmt.Sprintf("key%v", i))
+		}(i)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if total, _ := stats.snapshot(); total.InFlight == 2 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 requests in flight, but had %v", total.InFlight)
+		}
+	}
+
+	rec := request("key2")
+	if rec.Code != 503 || rec.Header().Get("Retry-After") == "" {
+		t.Logf("Expected a 503 with a Retry-After past the limit, but got %v %v", rec.Code, rec.Header())
+		t.Fail()
+	}
+	close(gated.gate)
+	wg.Wait()
+	for i, rec := range admitted {
+		if rec.Code != 200 {
+			t.Logf("Expected admitted request %v to succeed, but got %v", i, rec.Code)
+			t.Fail()
+		}
+	}
+	if total, _ := stats.snapshot(); total.InFlight != 0 {
+		t.Logf("Expected nothing in flight once the requests finished, but had %v", total.InFlight)
+		t.Fail()
+	}
+	if rec := request("key2"); rec.Code != 200 {
+		t.Logf("Expected a request to be admitted once slots freed up, but got %v", rec.Code)
+		t.Fail()
+	}
+}
+
+func TestKeyServerRejectsPastDownloadQueue(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	downloads := newSlots(1)
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{base: base, cacheDir: cacheDir}},
+		downloadSlots: downloads, maxDownloadQueue: 1}
+	request := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := bytes.NewReader([]byte(`{"bucket_name": "bucket", "keynames": ["key"]}`))
+		server.ServeHTTP(rec, httptest.NewRequest("POST", "/", body))
+		return rec
+	}
+
+	downloads.tryAcquire()
+	if rec := request(); rec.Code != 200 {
+		t.Logf("Expected a request to be admitted with nothing queued, but got %v", rec.Code)
+		t.Fail()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan bool)
+	go func() {
+		queued <- downloads.acquire(ctx)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); !downloads.queued(1); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a download to be queued")
+		}
+	}
+	if rec := request(); rec.Code != 429 || rec.Header().Get("Retry-After") == "" {
+		t.Logf("Expected a 429 with a Retry-After past the download queue depth, but got %v %v", rec.Code, rec.Header())
+		t.Fail()
+	}
+	cancel()
+	<-queued
+	downloads.release()
+	if rec := request(); rec.Code != 200 {
+		t.Logf("Expected a request to be admitted once the queue drained, but got %v", rec.Code)
+		t.Fail()
+	}
+}
+
+func TestKeyServerGoroutineCap(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	running := 10000
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{base: base, cacheDir: cacheDir}},
+		maxGoroutines: 5000, goroutines: func() int { return running }}
+	request := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := bytes.NewReader([]byte(`{"bucket_name": "bucket", "keynames": ["key"]}`))
+		server.ServeHTTP(rec, httptest.NewRequest("POST", "/", body))
+		return rec
+	}
+
+	if rec := request(); rec.Code != 503 || rec.Header().Get("Retry-After") == "" {
+		t.Logf("Expected a 503 with a Retry-After past the goroutine cap, but got %v %v", rec.Code, rec.Header())
+		t.Fail()
+	}
+	if base.called != 0 {
+		t.Logf("Expected a rejected request to fetch nothing, but it fetched %v keys", base.called)
+		t.Fail()
+	}
+	running = 100
+	if rec := request(); rec.Code != 200 {
+		t.Logf("Expected a request to be admitted under the goroutine cap, but got %v", rec.Code)
+		t.Fail()
+	}
+}
+
+func TestKeyServerMaxAge(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	server := &keyServer{MutableKeyGetter: &EvictingMutableKeyGetter{CachedKeyGetter: dkg, maxAge: time.Hour}}
+	request := func(body string) []map[string]interface{} {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		var results []map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+
+	request(`{"bucket_name": "bucket", "keynames": ["key1"]}`)
+	// pretend it was cached ten minutes ago, well within the server's hour
+	raw, _ := json.Marshal(entryMetadata{Size: int64(len("sample content")), CachedAt: time.Now().Add(-10 * time.Minute)})
+	if err := ioutil.WriteFile(dkg.mustMetadataPathFor("bucket", "key1"), raw, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if results := request(`{"bucket_name": "bucket", "keynames": ["key1"]}`); results[0]["status"] == mockFetched || base.called != 1 {
+		t.Logf("Expected an entry within the server's max age to be served from the cache, but got %v", results)
+		t.Fail()
+	}
+	if results := request(`{"bucket_name": "bucket", "keynames": ["key1"], "max_age_seconds": 60}`); results[0]["status"] != mockFetched || base.called != 2 {
+		t.Logf("Expected a shorter max_age_seconds to re-fetch the entry, but got %v", results)
+		t.Fail()
+	}
+}
+
+// A panickingCachedKeyGetter panics on its first remove.
+type panickingCachedKeyGetter struct {
+	CachedKeyGetter
+	panicked bool
+	sync.Mutex
+}
+
+func (p *panickingCachedKeyGetter) remove(bucketName, keyName string) bool {
+	p.Lock()
+	panicked := p.panicked
+	p.panicked = true
+	p.Unlock()
+	if !panicked {
+		panic("disk went away")
+	}
+	return p.CachedKeyGetter.remove(bucketName, keyName)
+}
+
+func TestBoundedDiskCachedKeyGetterRecoversFromPanics(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	lru := &lruCachedKeyGetter{base: dkg}
+	stats := &cacheStats{}
+	size := int64(len("sample content"))
+	b := &boundedDiskCachedKeyGetter{lru: lru, disk: &panickingCachedKeyGetter{CachedKeyGetter: dkg},
+		softLimit: size, wake: make(chan struct{}, 1), stats: stats}
+	b.get(context.Background(), "bucket", []string{"key1"})
+	// something that isn't a getResult, least recently used of all
+	lru.Lock()
+	lru.PushBack("not a getResult")
+	lru.Unlock()
+	done := make(chan struct{})
+	go func() {
+		b.keepClean()
+		close(done)
+	}()
+
+	b.get(context.Background(), "bucket", []string{"key2"})
+	for deadline := time.Now().Add(5 * time.Second); b.size() > size; time.Sleep(time.Millisecond) {
+		if total, _ := stats.snapshot(); total.EvictionRestarts == 1 {
+			// woken again, as the next request past the limit would
+			select {
+			case b.wake <- struct{}{}:
+			default:
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected eviction to recover and get back to %v bytes, but had %v", size, b.size())
+		}
+	}
+	close(b.wake)
+	<-done
+	if total, _ := stats.snapshot(); total.EvictionRestarts != 1 {
+		t.Logf("Expected one restart, but had %v", total.EvictionRestarts)
+		t.Fail()
+	}
+}
+
+func TestLRUOldestSkipsBadEntries(t *testing.T) {
+	lru := &lruCachedKeyGetter{cache: nestedLRUIndex{}}
+	lru.admit(getResult{keyName: "key1", bucketName: "bucket"})
+	lru.PushBack("not a getResult")
+	if oldest := lru.oldest(0); oldest == nil || oldest.keyName != "key1" {
+		t.Logf("Expected oldest to skip past the bad entry to key1, but got %v", oldest)
+		t.Fail()
+	}
+	if oldest := lru.sampleOldest(0, 2, rand.New(rand.NewSource(1))); oldest == nil || oldest.keyName != "key1" {
+		t.Logf("Expected sampleOldest to skip past the bad entry to key1, but got %v", oldest)
+		t.Fail()
+	}
+}
+
+func TestBoundedDiskCachedKeyGetterPinsReturnedKeys(t *testing.T) {
+	for _, pinFor := range []time.Duration{time.Hour, 0} {
+		base := newMockKeyGetter("sample content")
+		defer os.RemoveAll(base.dir)
+		cacheDir, err := ioutil.TempDir("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(cacheDir)
+		dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+		size := int64(len("sample content"))
+		b := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg, pinFor: pinFor}, disk: dkg,
+			softLimit: size, hardLimit: 2 * size, wake: make(chan struct{}, 1)}
+		done := make(chan struct{})
+		go func() {
+			b.keepClean()
+			close(done)
+		}()
+
+		hot := b.get(context.Background(), "bucket", []string{"hot"})[0]
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					b.get(context.Background(), "bucket", []string{fmt.Sprintf("cold%v-%v", i, j)})
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(b.wake)
+		<-done
+
+		_, err = os.Stat(*hot.localPath)
+		if pinFor > 0 && err != nil {
+			t.Logf("Expected the returned path to survive eviction while pinned, but got %v", err)
+			t.Fail()
+		}
+		if pinFor == 0 && err == nil {
+			t.Logf("Expected the least recently used key to be evicted without a pin")
+			t.Fail()
+		}
+	}
+}
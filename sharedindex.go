@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// A sharedIndex keeps which keys are cached, and in what order they were
+// last used, outside the process, so nodes caching onto one shared
+// filesystem agree on both instead of each going by its own requests.
+// Entries are lruSnapshotEntries, as saved LRUs are. -shared-index picks
+// a redisIndex.
+type sharedIndex interface {
+	// touch records entries as cached and just used, perhaps in the
+	// background.
+	touch(entries []lruSnapshotEntry) error
+	forget(bucketName, keyName string) error
+	// contains reports which of keyNames are in the index.
+	contains(bucketName string, keyNames []string) ([]bool, error)
+	// leastRecent lists up to n entries, least recently used first. Only
+	// their bucket and key names need be filled in.
+	leastRecent(n int) ([]lruSnapshotEntry, error)
+}
+
+func snapshotEntryFor(result getResult) lruSnapshotEntry {
+	entry := lruSnapshotEntry{BucketName: result.bucketName, KeyName: result.keyName,
+		Bytes: result.bytesTransferred, MD5: result.md5, ETag: result.etag, SHA256: result.sha256,
+		CachedAt: result.cachedAt}
+	if result.localPath != nil {
+		entry.LocalPath = *result.localPath
+	}
+	return entry
+}
+
+// touchShared records results as just used in the shared index, if any.
+func (m *lruCachedKeyGetter) touchShared(bucketName string, results []getResult) {
+	if m.shared == nil || len(results) == 0 {
+		return
+	}
+	entries := make([]lruSnapshotEntry, len(results))
+	for i, result := range results {
+		result.bucketName = bucketName
+		entries[i] = snapshotEntryFor(result)
+	}
+	if err := m.shared.touch(entries); err != nil {
+		log.Printf("Couldn't record %v keys from %v in the shared index: %v", len(entries), bucketName, err)
+	}
+}
+
+// dropForgotten removes those of keyNames from the LRU that another node
+// has evicted, going by the shared index, returning what it removed.
+func (m *lruCachedKeyGetter) dropForgotten(bucketName string, keyNames []string) []getResult {
+	if m.shared == nil {
+		return nil
+	}
+	held := make([]string, 0, len(keyNames))
+	for _, keyName := range keyNames {
+		if m.has(bucketName, keyName) {
+			held = append(held, keyName)
+		}
+	}
+	contained, err := m.shared.contains(bucketName, held)
+	if err != nil {
+		return nil
+	}
+	var dropped []getResult
+	for i, keyName := range held {
+		if contained[i] {
+			continue
+		}
+		if result := m.peek(bucketName, keyName); result != nil && m.remove(bucketName, keyName) {
+			dropped = append(dropped, *result)
+		}
+	}
+	return dropped
+}
+
+// sharedOldestWindow is how many of the shared index's least recently
+// used keys sharedOldest looks through for one of this node's own.
+const sharedOldestWindow = 64
+
+// sharedOldest is like oldest, but goes by the order the shared index
+// has keys in rather than this node's own, so a key another node has used
+// lately isn't evicted. It only looks at the least recently used few
+// keys, which may all be other nodes', and reports false if none of them
+// is this node's to evict or the index can't be read.
+func (m *lruCachedKeyGetter) sharedOldest(minAge time.Duration) (*getResult, bool) {
+	entries, err := m.shared.leastRecent(sharedOldestWindow)
+	if err != nil {
+		log.Printf("Couldn't read the shared index, evicting by local use: %v", err)
+		return nil, false
+	}
+	for _, entry := range entries {
+		result := m.peek(entry.BucketName, entry.KeyName)
+		if result != nil && time.Since(result.cachedAt) >= minAge && !result.pinned() {
+			return result, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// A memSharedIndex is a sharedIndex in memory that nodes in a test share,
+// as they would a Redis.
+type memSharedIndex struct {
+	entries map[string]lruSnapshotEntry
+	// flatLRUKeys, least recently used first
+	order []string
+	sync.Mutex
+}
+
+func (m *memSharedIndex) touch(entries []lruSnapshotEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, entry := range entries {
+		id := flatLRUKey(entry.BucketName, entry.KeyName)
+		m.dropLocked(id)
+		m.entries[id] = entry
+		m.order = append(m.order, id)
+	}
+	return nil
+}
+
+func (m *memSharedIndex) forget(bucketName, keyName string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.dropLocked(flatLRUKey(bucketName, keyName))
+	return nil
+}
+
+func (m *memSharedIndex) dropLocked(id string) {
+	delete(m.entries, id)
+	for i, ordered := range m.order {
+		if ordered == id {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *memSharedIndex) contains(bucketName string, keyNames []string) ([]bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	out := make([]bool, len(keyNames))
+	for i, keyName := range keyNames {
+		_, out[i] = m.entries[flatLRUKey(bucketName, keyName)]
+	}
+	return out, nil
+}
+
+func (m *memSharedIndex) leastRecent(n int) ([]lruSnapshotEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+	entries := make([]lruSnapshotEntry, 0, n)
+	for _, id := range m.order {
+		if len(entries) == n {
+			break
+		}
+		entries = append(entries, m.entries[id])
+	}
+	return entries, nil
+}
+
+func TestBoundedDiskCachedKeyGetterSharedIndex(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	shared := &memSharedIndex{entries: make(map[string]lruSnapshotEntry)}
+	newNode := func() (*boundedDiskCachedKeyGetter, *mockKeyGetter) {
+		base := newMockKeyGetter("sample content")
+		dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+		return &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg, shared: shared}, disk: dkg,
+			softLimit: 1 << 20, wake: make(chan struct{}, 1)}, base
+	}
+	a, aBase := newNode()
+	defer os.RemoveAll(aBase.dir)
+	b, bBase := newNode()
+	defer os.RemoveAll(bBase.dir)
+	size := int64(len("sample content"))
+
+	a.get(context.Background(), "bucket", []string{"key1"})
+	a.get(context.Background(), "bucket", []string{"key2"})
+	// b finds key1 where a cached it, and its use counts for a too
+	b.get(context.Background(), "bucket", []string{"key1"})
+	if bBase.called != 0 {
+		t.Logf("Expected b to find key1 already cached, but it downloaded %v keys", bBase.called)
+		t.Fail()
+	}
+	if victim := a.nextVictim(); victim == nil || victim.keyName != "key2" {
+		t.Logf("Expected a to evict key2, since b used key1 since, but got %v", victim)
+		t.Fail()
+	}
+
+	b.remove("bucket", "key2")
+	if contained, _ := shared.contains("bucket", []string{"key2"}); contained[0] {
+		t.Logf("Expected key2 gone from the shared index once b evicted it")
+		t.Fail()
+	}
+	a.get(context.Background(), "bucket", []string{"key2"})
+	if aBase.called != 3 {
+		t.Logf("Expected a to download key2 again after b evicted it, but it made %v downloads", aBase.called)
+		t.Fail()
+	}
+	if a.size() != 2*size {
+		t.Logf("Expected a to count key2 once, but its size is %v", a.size())
+		t.Fail()
+	}
+	if !a.has("bucket", "key2") || !b.has("bucket", "key2") {
+		t.Logf("Expected both nodes to see key2 cached again")
+		t.Fail()
+	}
+}
+
+func TestSharedOldestFallsBackToLocalOrder(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	shared := &memSharedIndex{entries: make(map[string]lruSnapshotEntry)}
+	// other nodes' keys fill the shared index's least recently used end
+	for i := 0; i < sharedOldestWindow; i++ {
+		shared.touch([]lruSnapshotEntry{{BucketName: "other", KeyName: fmt.Sprint(i)}})
+	}
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	b := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg, shared: shared}, disk: dkg,
+		softLimit: 1 << 20, wake: make(chan struct{}, 1)}
+	b.get(context.Background(), "bucket", []string{"key1", "key2"})
+
+	if victim := b.nextVictim(); victim == nil || victim.keyName != "key1" {
+		t.Logf("Expected key1 evicted by local order when the shared index's oldest keys are all other nodes', but got %v", victim)
+		t.Fail()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A clockSkew tracks how far S3's clock is ahead of the local one, going
+// by the Date header on S3's responses, so timestamps from one can be
+// compared with timestamps from the other. A skew of more than warnAbove
+// is logged whenever it's first seen. A nil *clockSkew measures nothing
+// and takes the clocks to agree.
+type clockSkew struct {
+	warnAbove time.Duration
+	offset    time.Duration
+	warned    bool
+	sync.Mutex
+}
+
+// observe measures the skew from a response's headers, if they have a
+// Date. It has only a second's resolution, so smaller skews are ignored.
+func (c *clockSkew) observe(header http.Header) {
+	if c == nil {
+		return
+	}
+	upstream, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return
+	}
+	offset := upstream.Sub(time.Now()).Round(time.Second)
+	c.Lock()
+	defer c.Unlock()
+	c.offset = offset
+	large := offset > c.warnAbove || -offset > c.warnAbove
+	if large && !c.warned {
+		log.Printf("S3's clock is %v off from the local one; adjusting last_modified checks for it", offset)
+	}
+	c.warned = large
+}
+
+// toUpstream is what S3's clock read when the local one read local.
+func (c *clockSkew) toUpstream(local time.Time) time.Time {
+	if c == nil {
+		return local
+	}
+	c.Lock()
+	defer c.Unlock()
+	return local.Add(c.offset)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClockSkewAdjustsLastModifiedChecks(t *testing.T) {
+	skew := &clockSkew{warnAbove: time.Minute}
+	// S3's clock runs an hour ahead of ours
+	skew.observe(http.Header{"Date": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}})
+	if offset := skew.toUpstream(time.Time{}).Sub(time.Time{}); offset < 59*time.Minute || offset > 61*time.Minute {
+		t.Fatalf("Expected a measured skew of an hour, but got %v", offset)
+	}
+
+	cachedAt := time.Now()
+	// modified before it was cached, but at a later time by S3's clock
+	lastModified := cachedAt.Add(30 * time.Minute)
+	if !(&lastModifiedShouldEvicter{}).modifiedSince(lastModified, cachedAt) {
+		t.Fatalf("Expected the unadjusted check to see a modification")
+	}
+	evicter := &lastModifiedShouldEvicter{skew: skew}
+	if evicter.modifiedSince(lastModified, cachedAt) {
+		t.Logf("Expected a key modified before it was cached not to be evicted once adjusted for skew")
+		t.Fail()
+	}
+	if !evicter.modifiedSince(cachedAt.Add(90*time.Minute), cachedAt) {
+		t.Logf("Expected a key modified after it was cached to still be evicted")
+		t.Fail()
+	}
+
+	skew.observe(http.Header{})
+	if offset := skew.toUpstream(time.Time{}).Sub(time.Time{}); offset < 59*time.Minute {
+		t.Logf("Expected a response without a Date to leave the skew alone, but it's %v", offset)
+		t.Fail()
+	}
+}
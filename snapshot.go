@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// An lruSnapshotEntry is one entry of an LRU saved across restarts.
+type lruSnapshotEntry struct {
+	BucketName string    `json:"bucket"`
+	KeyName    string    `json:"key"`
+	LocalPath  string    `json:"local_path"`
+	Bytes      int64     `json:"bytes"`
+	MD5        string    `json:"md5,omitempty"`
+	ETag       string    `json:"etag,omitempty"`
+	SHA256     string    `json:"sha256,omitempty"`
+	CachedAt   time.Time `json:"cached_at"`
+}
+
+// writeSnapshot writes the LRU's entries, least recently used first.
+func (m *lruCachedKeyGetter) writeSnapshot(w io.Writer) error {
+	results := m.entries()
+	if m.shards != nil {
+		// each shard's entries are in order, but not across shards
+		sort.Slice(results, func(i, j int) bool { return results[i].used > results[j].used })
+	}
+	entries := make([]lruSnapshotEntry, 0, len(results))
+	for i := len(results) - 1; i >= 0; i-- {
+		result := results[i]
+		entries = append(entries, lruSnapshotEntry{BucketName: result.bucketName, KeyName: result.keyName,
+			LocalPath: *result.localPath, Bytes: result.bytesTransferred, MD5: result.md5, ETag: result.etag,
+			SHA256: result.sha256, CachedAt: result.cachedAt})
+	}
+	return json.NewEncoder(w).Encode(entries)
+}
+
+// restore adds entries to the LRU in order, so the last is the most
+// recently used, skipping any no longer cached. It returns their bytes.
+func (m *lruCachedKeyGetter) restore(entries []lruSnapshotEntry, cached func(bucketName, keyName string) bool) int64 {
+	if m.shards != nil {
+		var total int64
+		for _, entry := range entries {
+			total += m.shardFor(entry.BucketName, entry.KeyName).restore([]lruSnapshotEntry{entry}, cached)
+		}
+		return total
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.cache == nil {
+		m.cache = nestedLRUIndex{}
+	}
+	var total int64
+	for _, entry := range entries {
+		if !cached(entry.BucketName, entry.KeyName) {
+			continue
+		}
+		localPath := entry.LocalPath
+		m.pushLocked(entry.BucketName, getResult{bucketName: entry.BucketName, keyName: entry.KeyName,
+			localPath: &localPath, bytesTransferred: entry.Bytes, md5: entry.MD5, etag: entry.ETag,
+			sha256: entry.SHA256, cachedAt: entry.CachedAt, status: "cache_hit"})
+		total += entry.Bytes
+	}
+	return total
+}
+
+// saveSnapshot writes the LRU to path, via a rename so a crash mid-write
+// can't leave a truncated snapshot.
+func (b *boundedDiskCachedKeyGetter) saveSnapshot(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	err = b.lru.writeSnapshot(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// loadSnapshot rebuilds the LRU and byte total from the snapshot at path
+// or, if it's missing or corrupt, from what's in the disk cache, taking
+// files' modification times as their recency.
+func (b *boundedDiskCachedKeyGetter) loadSnapshot(path string, disk *diskCachedKeyGetter) {
+	var entries []lruSnapshotEntry
+	raw, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(raw, &entries)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Couldn't load the LRU snapshot, rebuilding it from %v: %v", disk.cacheDir, err)
+		}
+		entries = scanForSnapshot(disk)
+	}
+	b.adjust(b.lru.restore(entries, disk.has))
+}
+
+func scanForSnapshot(disk *diskCachedKeyGetter) []lruSnapshotEntry {
+	var entries []lruSnapshotEntry
+	for _, bucketName := range disk.cachedBuckets() {
+		for _, keyName := range disk.keysIn(bucketName) {
+			localPath, err := disk.pathFor(bucketName, keyName)
+			if err != nil {
+				continue
+			}
+			info, err := os.Stat(localPath)
+			if err != nil {
+				continue
+			}
+			entry := lruSnapshotEntry{BucketName: bucketName, KeyName: keyName, LocalPath: localPath,
+				Bytes: info.Size(), CachedAt: info.ModTime()}
+			result := getResult{bucketName: bucketName, keyName: keyName}
+			disk.loadMetadata(&result)
+			entry.MD5, entry.ETag, entry.SHA256 = result.md5, result.etag, result.sha256
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].CachedAt.Before(entries[j].CachedAt) })
+	return entries
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func lruOrder(lru *lruCachedKeyGetter) []string {
+	lru.RLock()
+	defer lru.RUnlock()
+	var keyNames []string
+	for elem := lru.List.Back(); elem != nil; elem = elem.Prev() {
+		keyNames = append(keyNames, elem.Value.(getResult).keyName)
+	}
+	return keyNames
+}
+
+func TestLRUSnapshotRoundTrip(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	b := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg}, disk: dkg}
+	for _, keyName := range []string{"a", "b", "c"} {
+		b.get(context.Background(), "bucket", []string{keyName})
+	}
+	b.get(context.Background(), "bucket", []string{"a"})
+
+	snapshot := path.Join(cacheDir, "_lru-snapshot.json")
+	if err := b.saveSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	restored := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg}, disk: dkg}
+	restored.loadSnapshot(snapshot, dkg)
+	if order := lruOrder(restored.lru); !reflect.DeepEqual(order, []string{"b", "c", "a"}) {
+		t.Logf("Expected the snapshot to restore the LRU as [b c a], but got %v", order)
+		t.Fail()
+	}
+	if restored.size() != b.size() {
+		t.Logf("Expected the restored LRU to count %v bytes, but it counted %v", b.size(), restored.size())
+		t.Fail()
+	}
+}
+
+func TestLRUSnapshotCorruptFallsBackToScan(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	dkg.get(context.Background(), "bucket", []string{"newer", "older"})
+	now := time.Now()
+	os.Chtimes(dkg.mustPathFor("bucket", "older"), now, now.Add(-time.Hour))
+
+	snapshot := path.Join(cacheDir, "_lru-snapshot.json")
+	if err := ioutil.WriteFile(snapshot, []byte("[{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := &boundedDiskCachedKeyGetter{lru: &lruCachedKeyGetter{base: dkg}, disk: dkg}
+	b.loadSnapshot(snapshot, dkg)
+	if order := lruOrder(b.lru); !reflect.DeepEqual(order, []string{"older", "newer"}) {
+		t.Logf("Expected a corrupt snapshot to fall back to file times, [older newer], but got %v", order)
+		t.Fail()
+	}
+	if size := int64(2 * len("sample content")); b.size() != size {
+		t.Logf("Expected the rebuilt LRU to count %v bytes, but it counted %v", size, b.size())
+		t.Fail()
+	}
+}
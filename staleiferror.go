@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// staleOnError is the status of a cached key served as it is because it
+// couldn't be checked for changes, within the stale-if-error window.
+const staleOnError = "couldn't check for changes, serving stale copy"
+
+// A checkFailure is a run of failed checks of one cached key.
+type checkFailure struct {
+	since   time.Time
+	retryAt time.Time
+	backoff time.Duration
+}
+
+// checkFailures are the keys whose last check failed, by flatLRUKey.
+type checkFailures struct {
+	byKey map[string]*checkFailure
+	sync.Mutex
+}
+
+// defaultStaleRetryBackoff is how long to wait before checking a key
+// again after its first failed check, if staleRetryBackoff isn't set. The
+// wait doubles with each failure after.
+const defaultStaleRetryBackoff = time.Second
+
+// backingOff reports whether a key whose checks have been failing shouldn't
+// be checked again yet, and whether it's been failing for longer than the
+// stale-if-error window and should go.
+func (e *EvictingMutableKeyGetter) backingOff(bucketName, keyName string) (wait, expired bool) {
+	e.checkFailures.Lock()
+	defer e.checkFailures.Unlock()
+	failure, ok := e.checkFailures.byKey[flatLRUKey(bucketName, keyName)]
+	if !ok {
+		return false, false
+	}
+	now := time.Now()
+	return now.Before(failure.retryAt), now.Sub(failure.since) > e.staleIfError
+}
+
+// checkFailed records a failed check of a key, reporting whether it's been
+// failing for longer than the stale-if-error window.
+func (e *EvictingMutableKeyGetter) checkFailed(bucketName, keyName string) (expired bool) {
+	e.checkFailures.Lock()
+	defer e.checkFailures.Unlock()
+	if e.checkFailures.byKey == nil {
+		e.checkFailures.byKey = make(map[string]*checkFailure)
+	}
+	id := flatLRUKey(bucketName, keyName)
+	now := time.Now()
+	failure, ok := e.checkFailures.byKey[id]
+	if !ok {
+		backoff := e.staleRetryBackoff
+		if backoff <= 0 {
+			backoff = defaultStaleRetryBackoff
+		}
+		failure = &checkFailure{since: now, backoff: backoff}
+		e.checkFailures.byKey[id] = failure
+	} else {
+		failure.backoff *= 2
+	}
+	failure.retryAt = now.Add(failure.backoff)
+	return now.Sub(failure.since) > e.staleIfError
+}
+
+func (e *EvictingMutableKeyGetter) checkSucceeded(bucketName, keyName string) {
+	e.checkFailures.Lock()
+	defer e.checkFailures.Unlock()
+	delete(e.checkFailures.byKey, flatLRUKey(bucketName, keyName))
+}
+
+// evictStale evicts a key that's gone unchecked past the stale-if-error
+// window, returning its result.
+func (e *EvictingMutableKeyGetter) evictStale(bucketName string, r getResult) getResult {
+	if trace.enabled() {
+		trace.event("evict", "bucket", bucketName, "key", r.keyName)
+	}
+	e.remove(bucketName, r.keyName)
+	e.checkSucceeded(bucketName, r.keyName)
+	r.status = fmt.Sprintf("couldn't check for changes for longer than %v, evicted", e.staleIfError)
+	r.localPath = nil
+	return r
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEvictingMutableKeyGetterStaleIfError(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	checks := 0
+	// S3 is down
+	evicter := ShouldEvictFunc(func(r getResult) (bool, error) {
+		checks++
+		return false, errors.New("S3 unavailable")
+	})
+	emkg := &EvictingMutableKeyGetter{CachedKeyGetter: dkg, ShouldEvicter: evicter,
+		staleIfError: 100 * time.Millisecond, staleRetryBackoff: 20 * time.Millisecond}
+	get := func() getResult {
+		return emkg.Get(context.Background(), "bucket", []string{"key"}, getOptions{mutableBucket: true})[0]
+	}
+	get()
+
+	for i := 0; i < 2; i++ {
+		if result := get(); result.localPath == nil || result.status != staleOnError {
+			t.Logf("Expected the stale copy to be served within the window, but got %v", result.status)
+			t.Fail()
+		}
+	}
+	if checks != 1 {
+		t.Logf("Expected the check to back off after failing, but it was made %v times", checks)
+		t.Fail()
+	}
+	time.Sleep(30 * time.Millisecond)
+	if result := get(); result.localPath == nil || checks != 2 {
+		t.Logf("Expected the check to be retried once the backoff passed and the copy still served, but got %v after %v checks", result.status, checks)
+		t.Fail()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if result := get(); result.localPath != nil {
+		t.Logf("Expected the key to be evicted past the window, but got %v", result.status)
+		t.Fail()
+	}
+	if dkg.has("bucket", "key") {
+		t.Logf("Expected nothing left cached past the window")
+		t.Fail()
+	}
+	if base.called != 1 {
+		t.Logf("Expected the key to be downloaded only once, but it was %v times", base.called)
+		t.Fail()
+	}
+}
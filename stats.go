@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// bucketStats are the counters kept both overall and for each bucket.
+// Entries only counts what this process has cached and not since removed.
+// Coalesced counts requests that waited on another's download of the same
+// key rather than starting their own; Waiting is how many are waiting now,
+// and PeakWaiters the most that have waited on any one download. InFlight,
+// the cache requests being served now, EvictionRestarts, the times
+// background eviction has panicked and been restarted, EvictionBehind,
+// the bounded caches whose eviction is falling behind now, Backpressured,
+// the requests whose downloads were held back for it, ServedBytes, the
+// bytes of content /object has sent clients, Goroutines, the process's
+// count when the stats were taken, and the LRU fields, the running totals
+// of the watched lrus, are only kept overall.
+type bucketStats struct {
+	Hits             int64 `json:"hits"`
+	Misses           int64 `json:"misses"`
+	Bytes            int64 `json:"bytes"`
+	Entries          int64 `json:"entries"`
+	Coalesced        int64 `json:"coalesced"`
+	Waiting          int64 `json:"waiting"`
+	PeakWaiters      int64 `json:"peak_waiters"`
+	InFlight         int64 `json:"in_flight,omitempty"`
+	EvictionRestarts int64 `json:"eviction_restarts,omitempty"`
+	EvictionBehind   int64 `json:"eviction_behind,omitempty"`
+	Backpressured    int64 `json:"backpressured,omitempty"`
+	ServedBytes      int64 `json:"served_bytes,omitempty"`
+	Goroutines       int64 `json:"goroutines,omitempty"`
+	LRUEntries       int64 `json:"lru_entries,omitempty"`
+	LRUBytes         int64 `json:"lru_bytes,omitempty"`
+	LRUHits          int64 `json:"lru_hits,omitempty"`
+	LRUMisses        int64 `json:"lru_misses,omitempty"`
+}
+
+// fetchBuckets are the upper bounds, in seconds, of the fetch duration
+// histogram's buckets.
+var fetchBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// A fetchHistogram counts download durations into fetchBuckets, plus an
+// overflow bucket past the last.
+type fetchHistogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func (h *fetchHistogram) observe(took time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(fetchBuckets)+1)
+	}
+	seconds := took.Seconds()
+	h.counts[sort.SearchFloat64s(fetchBuckets, seconds)] += 1
+	h.count += 1
+	h.sum += seconds
+}
+
+// A cacheStats tracks hits, misses, downloaded bytes and entries, which
+// are cheap enough to count for every request, and times the downloads of
+// 1 in sampleEvery requests, or none if it's 0. It also keeps the
+// throughput of each key downloaded within slowWindow, to list the slowest.
+// The totals of the lrus it watches are read from their tallies, without
+// taking their locks. A nil *cacheStats is valid and records nothing.
+type cacheStats struct {
+	total       bucketStats
+	byBucket    map[string]*bucketStats
+	sampleEvery int
+	requests    int64
+	fetchTimes  fetchHistogram
+	slowWindow  time.Duration
+	throughputs map[string]keyThroughput
+	lrus        []*lruCachedKeyGetter
+	sync.Mutex
+}
+
+func (c *cacheStats) record(bucketName string, update func(*bucketStats)) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.byBucket == nil {
+		c.byBucket = make(map[string]*bucketStats)
+	}
+	bucket, had := c.byBucket[bucketName]
+	if !had {
+		bucket = &bucketStats{}
+		c.byBucket[bucketName] = bucket
+	}
+	update(&c.total)
+	update(bucket)
+}
+
+func (c *cacheStats) hit(bucketName string) {
+	c.record(bucketName, func(s *bucketStats) { s.Hits += 1 })
+}
+
+func (c *cacheStats) miss(bucketName string) {
+	c.record(bucketName, func(s *bucketStats) { s.Misses += 1 })
+}
+
+func (c *cacheStats) stored(bucketName string, bytes int64) {
+	c.record(bucketName, func(s *bucketStats) {
+		s.Bytes += bytes
+		s.Entries += 1
+	})
+}
+
+func (c *cacheStats) removed(bucketName string) {
+	c.record(bucketName, func(s *bucketStats) { s.Entries -= 1 })
+}
+
+// coalesced records one more request waiting on a download that now has
+// waiters waiting on it.
+func (c *cacheStats) coalesced(bucketName string, waiters int64) {
+	c.record(bucketName, func(s *bucketStats) {
+		s.Coalesced += 1
+		s.Waiting += 1
+		if waiters > s.PeakWaiters {
+			s.PeakWaiters = waiters
+		}
+	})
+}
+
+// landed records a download finishing and releasing its waiters.
+func (c *cacheStats) landed(bucketName string, waiters int64) {
+	if waiters == 0 {
+		return
+	}
+	c.record(bucketName, func(s *bucketStats) { s.Waiting -= waiters })
+}
+
+// sampled reports whether to time this request's downloads.
+func (c *cacheStats) sampled() bool {
+	if c == nil || c.sampleEvery <= 0 {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.requests += 1
+	return c.requests%int64(c.sampleEvery) == 0
+}
+
+// fetched records how long a sampled download took.
+func (c *cacheStats) fetched(took time.Duration) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.fetchTimes.observe(took)
+}
+
+func (c *cacheStats) fetchHistogram() fetchHistogram {
+	c.Lock()
+	defer c.Unlock()
+	h := c.fetchTimes
+	h.counts = append([]int64(nil), h.counts...)
+	return h
+}
+
+// entered records a cache request starting to be served.
+func (c *cacheStats) entered() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.total.InFlight += 1
+}
+
+// left records a cache request finishing.
+func (c *cacheStats) left() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.total.InFlight -= 1
+}
+
+// evictionBehind records a bounded cache starting (by 1) or ceasing (by
+// -1) to fall behind on eviction.
+func (c *cacheStats) evictionBehind(by int64) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.total.EvictionBehind += by
+}
+
+// backpressured records a request's downloads being held back or refused
+// while eviction is behind.
+func (c *cacheStats) backpressured() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.total.Backpressured += 1
+}
+
+// served records bytes of content reaching a client.
+func (c *cacheStats) served(bytes int64) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.total.ServedBytes += bytes
+}
+
+// watch adds m's totals to the overall stats.
+func (c *cacheStats) watch(m *lruCachedKeyGetter) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.lrus = append(c.lrus, m)
+}
+
+func (c *cacheStats) evictionRestarted() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.total.EvictionRestarts += 1
+}
+
+func (c *cacheStats) snapshot() (bucketStats, map[string]bucketStats) {
+	c.Lock()
+	defer c.Unlock()
+	byBucket := make(map[string]bucketStats, len(c.byBucket))
+	for bucketName, bucket := range c.byBucket {
+		byBucket[bucketName] = *bucket
+	}
+	total := c.total
+	total.Goroutines = int64(runtime.NumGoroutine())
+	var lrus lruAggregates
+	for _, m := range c.lrus {
+		lrus = lrus.plus(m.aggregates())
+	}
+	total.LRUEntries, total.LRUBytes, total.LRUHits, total.LRUMisses = lrus.Entries, lrus.Bytes, lrus.Hits, lrus.Misses
+	return total, byBucket
+}
+
+// ServeHTTP serves the overall stats as JSON, the per-bucket ones for
+// /stats?by=bucket, or the keys downloaded slowest lately for
+// /stats?by=slowest.
+func (c *cacheStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	total, byBucket := c.snapshot()
+	var out []byte
+	var err error
+	switch r.URL.Query().Get("by") {
+	case "":
+		out, err = json.Marshal(total)
+	case "bucket":
+		out, err = json.Marshal(byBucket)
+	case "slowest":
+		out, err = json.Marshal(c.slowest())
+	default:
+		http.Error(w, "stats can only be broken down by bucket or slowest", 400)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// servePrometheus serves the per-bucket stats in the Prometheus text format.
+func (c *cacheStats) servePrometheus(w http.ResponseWriter, r *http.Request) {
+	total, byBucket := c.snapshot()
+	bucketNames := make([]string, 0, len(byBucket))
+	for bucketName := range byBucket {
+		bucketNames = append(bucketNames, bucketName)
+	}
+	sort.Strings(bucketNames)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics := []struct {
+		name, kind string
+		value      func(bucketStats) int64
+	}{
+		{"s3cache_hits_total", "counter", func(s bucketStats) int64 { return s.Hits }},
+		{"s3cache_misses_total", "counter", func(s bucketStats) int64 { return s.Misses }},
+		{"s3cache_downloaded_bytes_total", "counter", func(s bucketStats) int64 { return s.Bytes }},
+		{"s3cache_entries", "gauge", func(s bucketStats) int64 { return s.Entries }},
+		{"s3cache_coalesced_requests_total", "counter", func(s bucketStats) int64 { return s.Coalesced }},
+		{"s3cache_download_waiters", "gauge", func(s bucketStats) int64 { return s.Waiting }},
+		{"s3cache_download_peak_waiters", "gauge", func(s bucketStats) int64 { return s.PeakWaiters }},
+	}
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# TYPE %v %v\n", metric.name, metric.kind)
+		for _, bucketName := range bucketNames {
+			fmt.Fprintf(w, "%v{bucket=%q} %v\n", metric.name, bucketName, metric.value(byBucket[bucketName]))
+		}
+	}
+	fmt.Fprintf(w, "# TYPE s3cache_eviction_restarts_total counter\n")
+	fmt.Fprintf(w, "s3cache_eviction_restarts_total %v\n", total.EvictionRestarts)
+	fmt.Fprintf(w, "# TYPE s3cache_eviction_behind gauge\n")
+	fmt.Fprintf(w, "s3cache_eviction_behind %v\n", total.EvictionBehind)
+	fmt.Fprintf(w, "# TYPE s3cache_backpressured_requests_total counter\n")
+	fmt.Fprintf(w, "s3cache_backpressured_requests_total %v\n", total.Backpressured)
+	fmt.Fprintf(w, "# TYPE s3cache_served_bytes_total counter\n")
+	fmt.Fprintf(w, "s3cache_served_bytes_total %v\n", total.ServedBytes)
+	fmt.Fprintf(w, "# TYPE s3cache_goroutines gauge\n")
+	fmt.Fprintf(w, "s3cache_goroutines %v\n", total.Goroutines)
+	fmt.Fprintf(w, "# TYPE s3cache_lru_entries gauge\n")
+	fmt.Fprintf(w, "s3cache_lru_entries %v\n", total.LRUEntries)
+	fmt.Fprintf(w, "# TYPE s3cache_lru_bytes gauge\n")
+	fmt.Fprintf(w, "s3cache_lru_bytes %v\n", total.LRUBytes)
+	fmt.Fprintf(w, "# TYPE s3cache_lru_hits_total counter\n")
+	fmt.Fprintf(w, "s3cache_lru_hits_total %v\n", total.LRUHits)
+	fmt.Fprintf(w, "# TYPE s3cache_lru_misses_total counter\n")
+	fmt.Fprintf(w, "s3cache_lru_misses_total %v\n", total.LRUMisses)
+	fetchTimes := c.fetchHistogram()
+	fmt.Fprintf(w, "# TYPE s3cache_fetch_duration_seconds histogram\n")
+	var cumulative int64
+	for i, le := range fetchBuckets {
+		if fetchTimes.counts != nil {
+			cumulative += fetchTimes.counts[i]
+		}
+		fmt.Fprintf(w, "s3cache_fetch_duration_seconds_bucket{le=\"%v\"} %v\n", le, cumulative)
+	}
+	fmt.Fprintf(w, "s3cache_fetch_duration_seconds_bucket{le=\"+Inf\"} %v\n", fetchTimes.count)
+	fmt.Fprintf(w, "s3cache_fetch_duration_seconds_sum %v\n", fetchTimes.sum)
+	fmt.Fprintf(w, "s3cache_fetch_duration_seconds_count %v\n", fetchTimes.count)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCacheStatsByBucket(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	stats := &cacheStats{}
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir, stats: stats}
+
+	dkg.get(context.Background(), "bucket-a", []string{"key1", "key2"})
+	dkg.get(context.Background(), "bucket-a", []string{"key1", "key2"})
+	dkg.get(context.Background(), "bucket-b", []string{"key1"})
+	dkg.remove("bucket-b", "key1")
+
+	rec := httptest.NewRecorder()
+	stats.ServeHTTP(rec, httptest.NewRequest("GET", "/stats?by=bucket", nil))
+	var byBucket map[string]bucketStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &byBucket); err != nil {
+		t.Fatal(err)
+	}
+	contentLen := int64(len("sample content"))
+	expected := map[string]bucketStats{
+		"bucket-a": {Hits: 2, Misses: 2, Bytes: 2 * contentLen, Entries: 2},
+		"bucket-b": {Hits: 0, Misses: 1, Bytes: contentLen, Entries: 0},
+	}
+	for bucketName, want := range expected {
+		if byBucket[bucketName] != want {
+			t.Logf("Expected %+v for %v, but got %+v", want, bucketName, byBucket[bucketName])
+			t.Fail()
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	stats.servePrometheus(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`s3cache_hits_total{bucket="bucket-a"} 2`,
+		`s3cache_misses_total{bucket="bucket-b"} 1`,
+		`s3cache_entries{bucket="bucket-a"} 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Logf("Expected %q in the prometheus output:\n%v", line, rec.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+func TestCacheStatsTimingSampleRate(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	for _, tc := range []struct {
+		sampleEvery int
+		timed       int64
+	}{{0, 0}, {1, 4}, {2, 2}} {
+		cacheDir, err := ioutil.TempDir("", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(cacheDir)
+		stats := &cacheStats{sampleEvery: tc.sampleEvery}
+		dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir, stats: stats}
+		for _, keyName := range []string{"key1", "key2", "key3", "key4"} {
+			dkg.get(context.Background(), "bucket", []string{keyName})
+		}
+
+		total, _ := stats.snapshot()
+		if total.Misses != 4 || total.Entries != 4 {
+			t.Logf("Expected every miss counted at a sample rate of %v, but got %+v", tc.sampleEvery, total)
+			t.Fail()
+		}
+		if timed := stats.fetchHistogram().count; timed != tc.timed {
+			t.Logf("Expected %v timed fetches at a sample rate of %v, but got %v", tc.timed, tc.sampleEvery, timed)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// serveStream answers a CacheRequest with min_ready set as newline
+// delimited JSON, one result per line, fetching its keys concurrently.
+// Nothing is sent until min_ready keys are ready; those are then flushed
+// together, and each remaining key follows on its own line as soon as it's
+// ready. Lines come in the order keys become ready rather than the order
+// they were asked for, so a client wanting the rest should match them up
+// by key_name. Every key gets exactly one line, failures included, and
+// the response ends once the last key is ready.
+func (s *keyServer) serveStream(w http.ResponseWriter, r *http.Request, cr *CacheRequest, getter MutableKeyGetter) {
+	ctx := r.Context()
+	landed := make(chan getResult, len(cr.KeyNames))
+	for _, keyName := range cr.KeyNames {
+		go func(keyName string) {
+			for _, result := range cr.fetch(ctx, getter, []string{keyName}) {
+				landed <- result
+			}
+		}(keyName)
+	}
+	minReady := cr.MinReady
+	if minReady > len(cr.KeyNames) {
+		minReady = len(cr.KeyNames)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	for sent := 0; sent < len(cr.KeyNames); sent++ {
+		result := <-landed
+		s.accessLog.record(r, cr.Credentials, []getResult{result})
+		s.history.record(cr.Credentials, []getResult{result})
+		result.omitNullPath = s.omitNullPaths
+		if err := encoder.Encode(&result); err != nil {
+			log.Printf("Stream of %v failed partway: %v", cr.BucketName, err)
+			return
+		}
+		if sent+1 >= minReady {
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A slowKeyGetter holds up fetches of its slow key until gate is closed.
+type slowKeyGetter struct {
+	KeyGetter
+	slow string
+	gate chan struct{}
+}
+
+func (g *slowKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	for _, keyName := range keyNames {
+		if keyName == g.slow {
+			<-g.gate
+		}
+	}
+	return g.KeyGetter.get(ctx, bucketName, keyNames)
+}
+
+func TestKeyServerMinReady(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	slow := &slowKeyGetter{KeyGetter: base, slow: "slow", gate: make(chan struct{})}
+	getter := &EvictingMutableKeyGetter{CachedKeyGetter: &diskCachedKeyGetter{base: slow, cacheDir: cacheDir}}
+	server := httptest.NewServer(&keyServer{MutableKeyGetter: getter})
+	defer server.Close()
+
+	body := `{"bucket_name": "bucket", "keynames": ["fast1", "slow", "fast2"], "min_ready": 2}`
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Logf("Expected an ndjson response, but got %v", resp.Header.Get("Content-Type"))
+		t.Fail()
+	}
+	lines := bufio.NewScanner(resp.Body)
+	next := func() map[string]interface{} {
+		if !lines.Scan() {
+			t.Fatalf("Expected another result line: %v", lines.Err())
+		}
+		var result map[string]interface{}
+		if err := json.Unmarshal(lines.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// the slow key is still held up, so these can only have been flushed early
+	ready := map[interface{}]bool{next()["key_name"]: true, next()["key_name"]: true}
+	if !ready["fast1"] || !ready["fast2"] {
+		t.Logf("Expected the two fast keys first, but got %v", ready)
+		t.Fail()
+	}
+	close(slow.gate)
+	if result := next(); result["key_name"] != "slow" || result["local_path"] == nil {
+		t.Logf("Expected the slow key to follow once ready, but got %v", result)
+		t.Fail()
+	}
+	if lines.Scan() {
+		t.Logf("Expected nothing after the last key, but got %v", lines.Text())
+		t.Fail()
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Downloads are written to temp files named s3cache_<pid>-*, so a sweeper
+// can tell which instance a leftover belongs to.
+const tempFilePrefix = "s3cache_"
+
+func tempFilePattern() string {
+	return tempFilePrefix + strconv.Itoa(os.Getpid()) + "-*"
+}
+
+// A tempSweeper removes download temp files left in dir by crashed
+// instances once they're older than maxAge. Files of this instance, or of
+// any other instance that's still running, are left alone.
+type tempSweeper struct {
+	dir    string
+	maxAge time.Duration
+	alive  func(pid int) bool
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// ownerOf returns the pid that named a temp file, or false for files from
+// before temp files were named by pid.
+func ownerOf(name string) (int, bool) {
+	dash := strings.Index(name, "-")
+	if dash < 0 {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(name[len(tempFilePrefix):dash])
+	return pid, err == nil
+}
+
+func (s *tempSweeper) sweep() int {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Couldn't sweep %v for stale downloads: %v", s.dir, err)
+		return 0
+	}
+	removed := 0
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, tempFilePrefix) || !info.Mode().IsRegular() || time.Since(info.ModTime()) < s.maxAge {
+			continue
+		}
+		if pid, owned := ownerOf(name); owned && (pid == os.Getpid() || s.alive(pid)) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, name)); err == nil {
+			if trace.enabled() {
+				trace.event("sweep", "file", name)
+			}
+			removed += 1
+		}
+	}
+	return removed
+}
+
+// run sweeps now and then every interval, forever.
+func (s *tempSweeper) run(interval time.Duration) {
+	for {
+		if removed := s.sweep(); removed > 0 {
+			log.Printf("Removed %v stale downloads from %v", removed, s.dir)
+		}
+		time.Sleep(interval)
+	}
+}
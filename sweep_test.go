@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTempSweeperRemovesOnlyStaleOrphans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := time.Now().Add(-2 * time.Hour)
+	files := map[string]bool{ // name: whether it should be swept
+		"s3cache_999999-1":                       true,  // old, from a dead instance
+		"s3cache_123456789":                      true,  // old, from before pid naming
+		"s3cache_4242-1":                         false, // old, but its instance is running
+		fmt.Sprintf("s3cache_%v-1", os.Getpid()): false, // old, but ours
+		"other_download":                         false, // old, but not ours to touch
+	}
+	for name := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("partial"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files["s3cache_999998-1"] = false // new, from a dead instance
+	if err := ioutil.WriteFile(filepath.Join(dir, "s3cache_999998-1"), []byte("partial"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	sweeper := &tempSweeper{dir: dir, maxAge: time.Hour, alive: func(pid int) bool { return pid == 4242 }}
+	if removed := sweeper.sweep(); removed != 2 {
+		t.Logf("Expected 2 files swept, but %v were", removed)
+		t.Fail()
+	}
+	for name, swept := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if swept != os.IsNotExist(err) {
+			t.Logf("Expected %v to be swept: %v, but stat gave %v", name, swept, err)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"launchpad.net/goamz/s3"
+)
+
+// notCached is the status of a key tagged cache=no. Like passedThrough,
+// its local_path is an uncached temporary file the client should remove.
+const notCached = "tagged not to cache, passed through"
+
+type tagGetter interface {
+	tagsFor(bucketName, keyName string) (map[string]string, error)
+}
+
+// tagsFor gets an object's tags. goamz has no tagging API, so this signs
+// the GET ?tagging request itself, the same (V2) way goamz signs the rest.
+func (s *s3Conn) tagsFor(bucketName, keyName string) (map[string]string, error) {
+	conn := s.current()
+	expires := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	resource := (&url.URL{Path: "/" + bucketName + "/" + keyName}).EscapedPath() + "?tagging"
+	mac := hmac.New(sha1.New, []byte(conn.SecretKey))
+	fmt.Fprintf(mac, "GET\n\n\n%v\n%v", expires, resource)
+	query := url.Values{"AWSAccessKeyId": {conn.AccessKey}, "Expires": {expires},
+		"Signature": {base64.StdEncoding.EncodeToString(mac.Sum(nil))}}
+	resp, err := http.Get(conn.Bucket(bucketName).URL(keyName) + "?tagging&" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &s3.Error{StatusCode: resp.StatusCode, Message: resp.Status}
+	}
+	var tagging struct {
+		Tags []struct {
+			Key   string
+			Value string
+		} `xml:"TagSet>Tag"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&tagging); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(tagging.Tags))
+	for _, tag := range tagging.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	return tags, nil
+}
+
+type cachedTags struct {
+	tags     map[string]string
+	lookedAt time.Time
+}
+
+// A tagCache remembers objects' tags for ttl, so checking them doesn't
+// cost an S3 call for every key of every request.
+type tagCache struct {
+	tagger tagGetter
+	ttl    time.Duration
+	tags   map[string]map[string]cachedTags
+	sync.Mutex
+}
+
+func (c *tagCache) tagsFor(bucketName, keyName string) (map[string]string, error) {
+	c.Lock()
+	cached, had := c.tags[bucketName][keyName]
+	c.Unlock()
+	if had && time.Since(cached.lookedAt) < c.ttl {
+		return cached.tags, nil
+	}
+	tags, err := c.tagger.tagsFor(bucketName, keyName)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.tags == nil {
+		c.tags = make(map[string]map[string]cachedTags)
+	}
+	if c.tags[bucketName] == nil {
+		c.tags[bucketName] = make(map[string]cachedTags)
+	}
+	c.tags[bucketName][keyName] = cachedTags{tags, time.Now()}
+	return tags, nil
+}
+
+// A taggedKeyGetter lets objects' tags decide how they're cached: keys
+// tagged cache=no are fetched straight from direct and never cached, and
+// keys tagged ttl=<seconds> are re-fetched once cached longer ago than
+// that. Keys whose tags can't be read are cached as usual.
+type taggedKeyGetter struct {
+	CachedKeyGetter
+	disk   *diskCachedKeyGetter
+	direct KeyGetter
+	tags   tagGetter
+}
+
+func (t *taggedKeyGetter) get(ctx context.Context, bucketName string, keyNames []string) []getResult {
+	cacheable := make([]string, 0, len(keyNames))
+	uncacheable := make([]string, 0)
+	for _, keyName := range keyNames {
+		tags, err := t.tags.tagsFor(bucketName, keyName)
+		if err != nil {
+			log.Printf("Couldn't read the tags of %v/%v, so caching it as usual: %v", bucketName, keyName, err)
+		}
+		if tags["cache"] == "no" {
+			if t.has(bucketName, keyName) {
+				// cached before it was tagged
+				t.remove(bucketName, keyName)
+			}
+			if trace.enabled() {
+				trace.event("not_cached", "bucket", bucketName, "key", keyName)
+			}
+			uncacheable = append(uncacheable, keyName)
+			continue
+		}
+		if ttl, err := strconv.Atoi(tags["ttl"]); err == nil && t.has(bucketName, keyName) {
+			metadata, err := t.disk.readMetadata(bucketName, keyName)
+			if err == nil && time.Since(metadata.CachedAt) > time.Duration(ttl)*time.Second {
+				if trace.enabled() {
+					trace.event("expire", "bucket", bucketName, "key", keyName)
+				}
+				t.remove(bucketName, keyName)
+			}
+		}
+		cacheable = append(cacheable, keyName)
+	}
+	out := make([]getResult, 0, len(keyNames))
+	if len(cacheable) > 0 {
+		out = append(out, t.CachedKeyGetter.get(ctx, bucketName, cacheable)...)
+	}
+	if len(uncacheable) > 0 {
+		for _, result := range t.direct.get(ctx, bucketName, uncacheable) {
+			if result.localPath != nil {
+				result.status = notCached
+			}
+			out = append(out, result)
+		}
+	}
+	return out
+}
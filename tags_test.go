@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mapTagGetter struct {
+	tags   map[string]map[string]string
+	called int
+	sync.Mutex
+}
+
+func (m *mapTagGetter) tagsFor(bucketName, keyName string) (map[string]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.called += 1
+	return m.tags[keyName], nil
+}
+
+func TestTaggedKeyGetterSkipsTheCacheForNoCacheTags(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	direct := newMockKeyGetter("sample content")
+	defer os.RemoveAll(direct.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	tagger := &mapTagGetter{tags: map[string]map[string]string{"volatile": {"cache": "no"}}}
+	tagged := &taggedKeyGetter{CachedKeyGetter: dkg, disk: dkg, direct: direct,
+		tags: &tagCache{tagger: tagger, ttl: time.Hour}}
+
+	for i := 0; i < 2; i++ {
+		results := tagged.get(context.Background(), "bucket", []string{"volatile", "plain"})
+		if len(results) != 2 || results[1].status != notCached || results[1].localPath == nil {
+			t.Fatalf("Expected the key tagged cache=no to be served uncached, but got %v", results)
+		}
+		os.Remove(*results[1].localPath)
+	}
+	if dkg.has("bucket", "volatile") || !dkg.has("bucket", "plain") {
+		t.Logf("Expected only the untagged key to be cached")
+		t.Fail()
+	}
+	if base.called != 1 || direct.called != 2 {
+		t.Logf("Expected one cached and two direct fetches, but had %v and %v", base.called, direct.called)
+		t.Fail()
+	}
+	if tagger.called != 2 {
+		t.Logf("Expected each key's tags to be looked up once, but had %v lookups", tagger.called)
+		t.Fail()
+	}
+}
+
+func TestTaggedKeyGetterTTL(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	tagged := &taggedKeyGetter{CachedKeyGetter: dkg, disk: dkg,
+		tags: &mapTagGetter{tags: map[string]map[string]string{"short": {"ttl": "60"}, "long": {"ttl": "3600"}}}}
+
+	tagged.get(context.Background(), "bucket", []string{"short", "long"})
+	for _, keyName := range []string{"short", "long"} {
+		raw, _ := json.Marshal(entryMetadata{CachedAt: time.Now().Add(-10 * time.Minute)})
+		if err := ioutil.WriteFile(dkg.mustMetadataPathFor("bucket", keyName), raw, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results := inRequestOrder([]string{"short", "long"}, tagged.get(context.Background(), "bucket", []string{"short", "long"}))
+	if results[0].status != mockFetched || results[1].status == mockFetched || base.called != 3 {
+		t.Logf("Expected only the key past its ttl tag to be re-fetched, but got %v", results)
+		t.Fail()
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// slowestKeysShown is how many keys /stats?by=slowest lists.
+const slowestKeysShown = 20
+
+// throughput is the rate, in bytes per second, of a download of
+// bytesTransferred that took took, or 0 if it took no measurable time.
+func throughput(bytesTransferred int64, took time.Duration) float64 {
+	if took <= 0 {
+		return 0
+	}
+	return float64(bytesTransferred) / took.Seconds()
+}
+
+// A keyThroughput is the rate a key was last downloaded at.
+type keyThroughput struct {
+	Bucket       string    `json:"bucket"`
+	Key          string    `json:"key"`
+	BytesPerSec  float64   `json:"throughput_bytes_per_sec"`
+	Bytes        int64     `json:"bytes"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+}
+
+// now is the time by t's clock, which is only set by tests.
+func (t *tempKeyGetter) now() time.Time {
+	if t.clock == nil {
+		return time.Now()
+	}
+	return t.clock()
+}
+
+// downloaded records the throughput of a key's download, for
+// /stats?by=slowest. Keys downloaded longer than slowWindow ago are
+// dropped; with no slowWindow, nothing is kept.
+func (c *cacheStats) downloaded(bucketName string, result getResult) {
+	if c == nil || c.slowWindow <= 0 || result.throughput <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.throughputs == nil {
+		c.throughputs = make(map[string]keyThroughput)
+	}
+	now := time.Now()
+	c.expireThroughputsLocked(now)
+	c.throughputs[flatLRUKey(bucketName, result.keyName)] = keyThroughput{
+		Bucket:       bucketName,
+		Key:          result.keyName,
+		BytesPerSec:  result.throughput,
+		Bytes:        result.bytesTransferred,
+		DownloadedAt: now,
+	}
+}
+
+func (c *cacheStats) expireThroughputsLocked(now time.Time) {
+	for id, kt := range c.throughputs {
+		if now.Sub(kt.DownloadedAt) > c.slowWindow {
+			delete(c.throughputs, id)
+		}
+	}
+}
+
+// slowest returns the keys downloaded slowest within slowWindow, slowest
+// first, at most slowestKeysShown of them.
+func (c *cacheStats) slowest() []keyThroughput {
+	c.Lock()
+	defer c.Unlock()
+	c.expireThroughputsLocked(time.Now())
+	out := make([]keyThroughput, 0, len(c.throughputs))
+	for _, kt := range c.throughputs {
+		out = append(out, kt)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].BytesPerSec < out[j].BytesPerSec })
+	if len(out) > slowestKeysShown {
+		out = out[:slowestKeysShown]
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTempKeyGetterThroughput(t *testing.T) {
+	content := make([]byte, 4096)
+	// each reading of the clock is two seconds after the last
+	clock := time.Unix(0, 0)
+	tkg := &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter(content), clock: func() time.Time {
+		clock = clock.Add(2 * time.Second)
+		return clock
+	}}
+	results := tkg.get(context.Background(), "bucket", []string{"key"})
+	if results[0].localPath == nil {
+		t.Fatalf("Expected the key to be downloaded, but got %v", results[0].status)
+	}
+	defer os.Remove(*results[0].localPath)
+	if results[0].throughput != 2048 {
+		t.Logf("Expected 4096 bytes over 2s to be 2048 bytes/sec, but got %v", results[0].throughput)
+		t.Fail()
+	}
+	out, err := json.Marshal(&results[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	json.Unmarshal(out, &decoded)
+	if decoded["throughput_bytes_per_sec"] != 2048.0 {
+		t.Logf("Expected throughput_bytes_per_sec in the result, but got %s", out)
+		t.Fail()
+	}
+}
+
+func TestCacheStatsSlowest(t *testing.T) {
+	stats := &cacheStats{slowWindow: time.Minute}
+	stats.downloaded("bucket", getResult{keyName: "fast", throughput: 1000})
+	stats.downloaded("bucket", getResult{keyName: "slow", throughput: 10})
+	stats.downloaded("bucket", getResult{keyName: "middling", throughput: 100})
+	// downloaded before the window
+	stats.throughputs[flatLRUKey("bucket", "stale")] = keyThroughput{Bucket: "bucket", Key: "stale",
+		BytesPerSec: 1, DownloadedAt: time.Now().Add(-time.Hour)}
+
+	rec := httptest.NewRecorder()
+	stats.ServeHTTP(rec, httptest.NewRequest("GET", "/stats?by=slowest", nil))
+	var slowest []keyThroughput
+	if err := json.Unmarshal(rec.Body.Bytes(), &slowest); err != nil {
+		t.Fatalf("Couldn't decode %q: %v", rec.Body.String(), err)
+	}
+	var keyNames []string
+	for _, kt := range slowest {
+		keyNames = append(keyNames, kt.Key)
+	}
+	if len(keyNames) != 3 || keyNames[0] != "slow" || keyNames[1] != "middling" || keyNames[2] != "fast" {
+		t.Logf("Expected the keys downloaded within the window, slowest first, but got %v", keyNames)
+		t.Fail()
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+)
+
+// A tracer writes one structured line per cache event (requests, hits,
+// misses, downloads and evictions). Until enabled, event returns before
+// doing any formatting, but its fields are still boxed into interfaces for
+// the call, so calls on hot paths check enabled first.
+type tracer struct {
+	logger *log.Logger
+}
+
+var trace tracer
+
+func (t *tracer) enable(w io.Writer) {
+	t.logger = log.New(w, "", log.LstdFlags|log.Lmicroseconds)
+}
+
+func (t *tracer) enabled() bool {
+	return t.logger != nil
+}
+
+// event logs name followed by fields, which alternate between key and value.
+func (t *tracer) event(name string, fields ...interface{}) {
+	if !t.enabled() {
+		return
+	}
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "event=%v", name)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if s, ok := fields[i+1].(string); ok {
+			fmt.Fprintf(&line, " %v=%q", fields[i], s)
+		} else {
+			fmt.Fprintf(&line, " %v=%v", fields[i], fields[i+1])
+		}
+	}
+	t.logger.Println(line.String())
+}
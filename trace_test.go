@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTraceMissThenHit(t *testing.T) {
+	var out bytes.Buffer
+	trace.enable(&out)
+	defer func() { trace = tracer{} }()
+
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	contents := "fancy s3 key contents"
+	dkg := &diskCachedKeyGetter{base: &tempKeyGetter{keyReaderGetter: mockKeyReaderGetter(contents)}, cacheDir: cacheDir}
+	dkg.get(context.Background(), "bucket", []string{"key1"})
+	dkg.get(context.Background(), "bucket", []string{"key1"})
+
+	expected := []string{
+		`event=miss bucket="bucket" key="key1"`,
+		`event=download_start bucket="bucket" key="key1"`,
+		`event=download_end bucket="bucket" key="key1" bytes=21`,
+		`event=hit bucket="bucket" key="key1"`,
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %v trace lines, but got %v:\n%v", len(expected), len(lines), out.String())
+	}
+	for i, want := range expected {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Logf("Expected trace line %v to end with %v, but was %v", i, want, lines[i])
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A cacheVerifier checks every cached key against S3 with the getter's
+// eviction strategies, making at most one check per interval.
+type cacheVerifier struct {
+	disk     *diskCachedKeyGetter
+	getter   *EvictingMutableKeyGetter
+	interval time.Duration
+}
+
+type verifySummary struct {
+	Checked int      `json:"checked"`
+	Fresh   int      `json:"fresh"`
+	Stale   []string `json:"stale"`
+	Failed  []string `json:"failed"`
+	Evicted int      `json:"evicted"`
+}
+
+// cachedBuckets lists the buckets with keys cached, skipping the
+// directories for metadata and other bookkeeping, whose names can't be
+// bucket names.
+func (d *diskCachedKeyGetter) cachedBuckets() []string {
+	infos, err := ioutil.ReadDir(d.cacheDir)
+	if err != nil {
+		return nil
+	}
+	var bucketNames []string
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") && !strings.HasPrefix(info.Name(), "_") {
+			bucketNames = append(bucketNames, info.Name())
+		}
+	}
+	return bucketNames
+}
+
+// ServeHTTP serves POST /verify[?strategy=...][&evict=true], reporting
+// which cached keys are stale and, if asked, evicting them.
+func (v *cacheVerifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "verify only supports POST", 405)
+		return
+	}
+	evicter, err := v.getter.evicterFor(r.URL.Query().Get("strategy"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	evict := r.URL.Query().Get("evict") == "true"
+	var pace <-chan time.Time
+	if v.interval > 0 {
+		ticker := time.NewTicker(v.interval)
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+	summary := verifySummary{Stale: []string{}, Failed: []string{}}
+	for _, bucketName := range v.disk.cachedBuckets() {
+		for _, keyName := range v.disk.keysIn(bucketName) {
+			if pace != nil {
+				select {
+				case <-pace:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			localPath, err := v.disk.pathFor(bucketName, keyName)
+			if err != nil {
+				continue
+			}
+			result := getResult{bucketName: bucketName, keyName: keyName, localPath: &localPath}
+			v.disk.loadMetadata(&result)
+			summary.Checked += 1
+			stale, err := evicter.ShouldEvict(result)
+			if err != nil {
+				log.Printf("Couldn't verify %v/%v: %v", bucketName, keyName, err)
+				summary.Failed = append(summary.Failed, bucketName+"/"+keyName)
+				continue
+			}
+			if !stale {
+				summary.Fresh += 1
+				continue
+			}
+			summary.Stale = append(summary.Stale, bucketName+"/"+keyName)
+			if evict && v.getter.remove(bucketName, keyName) {
+				if trace.enabled() {
+					trace.event("evict", "bucket", bucketName, "key", keyName)
+				}
+				summary.Evicted += 1
+			}
+		}
+	}
+	out, err := json.Marshal(summary)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
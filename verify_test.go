@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCacheVerifierClassifiesEntries(t *testing.T) {
+	base := newMockKeyGetter("sample content")
+	defer os.RemoveAll(base.dir)
+	cacheDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	dkg := &diskCachedKeyGetter{base: base, cacheDir: cacheDir}
+	dkg.get(context.Background(), "bucket-a", []string{"same", "dir/changed"})
+	dkg.get(context.Background(), "bucket-b", []string{"same", "gone"})
+	changedUpstream := ShouldEvictFunc(func(r getResult) (bool, error) {
+		if r.keyName == "gone" {
+			return false, fmt.Errorf("S3 unavailable")
+		}
+		return strings.Contains(r.keyName, "changed"), nil
+	})
+	emkg := &EvictingMutableKeyGetter{CachedKeyGetter: dkg, ShouldEvicter: changedUpstream}
+	verifier := &cacheVerifier{disk: dkg, getter: emkg}
+
+	rec := httptest.NewRecorder()
+	verifier.ServeHTTP(rec, httptest.NewRequest("POST", "/verify?evict=true", nil))
+	var summary verifySummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("Expected a summary, but got %v: %v", rec.Body.String(), err)
+	}
+	sort.Strings(summary.Stale)
+	if summary.Checked != 4 || summary.Fresh != 2 || summary.Evicted != 1 ||
+		fmt.Sprint(summary.Stale) != "[bucket-a/dir/changed]" || fmt.Sprint(summary.Failed) != "[bucket-b/gone]" {
+		t.Logf("Expected 2 fresh, 1 stale and evicted and 1 failed of 4, but got %+v", summary)
+		t.Fail()
+	}
+	if dkg.has("bucket-a", "dir/changed") || !dkg.has("bucket-a", "same") || !dkg.has("bucket-b", "gone") {
+		t.Logf("Expected only the stale entry to be evicted")
+		t.Fail()
+	}
+}
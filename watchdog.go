@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const stalled = "stalled"
+
+var errStalled = errors.New(stalled)
+
+// A watchdogReader closes the underlying reader if no bytes have come
+// through it for timeout, which unblocks a Read stuck on a connection that
+// is still open but no longer sending anything.
+type watchdogReader struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	fired   int32
+}
+
+func newWatchdogReader(rc io.ReadCloser, timeout time.Duration) *watchdogReader {
+	w := &watchdogReader{ReadCloser: rc, timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&w.fired, 1)
+		rc.Close()
+	})
+	return w
+}
+
+func (w *watchdogReader) Read(p []byte) (int, error) {
+	n, err := w.ReadCloser.Read(p)
+	if atomic.LoadInt32(&w.fired) == 1 {
+		return n, errStalled
+	}
+	if n > 0 {
+		w.timer.Reset(w.timeout)
+	}
+	return n, err
+}
+
+func (w *watchdogReader) Close() error {
+	w.timer.Stop()
+	return w.ReadCloser.Close()
+}
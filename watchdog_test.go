@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// A stallingReadCloser hands out its contents and then blocks, like a
+// connection that stays open after the sender goes quiet, until closed.
+type stallingReadCloser struct {
+	contents []byte
+	closed   chan struct{}
+}
+
+func (s *stallingReadCloser) Read(p []byte) (int, error) {
+	if len(s.contents) > 0 {
+		n := copy(p, s.contents)
+		s.contents = s.contents[n:]
+		return n, nil
+	}
+	<-s.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (s *stallingReadCloser) Close() error {
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	return nil
+}
+
+type stallingKeyReaderGetter []byte
+
+func (s stallingKeyReaderGetter) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
+	return &stallingReadCloser{[]byte(s), make(chan struct{})}, nil
+}
+
+func TestTempKeyGetterStallWatchdog(t *testing.T) {
+	kg := &tempKeyGetter{keyReaderGetter: stallingKeyReaderGetter("some bytes"), stallTimeout: 50 * time.Millisecond}
+	done := make(chan getResult)
+	go func() {
+		done <- kg.getKey(context.Background(), "bucket", "key1")
+	}()
+	select {
+	case result := <-done:
+		if result.status != stalled {
+			t.Logf("Expected a %v status, but got %v", stalled, result.status)
+			t.Fail()
+		}
+		if result.localPath != nil {
+			t.Logf("Expected no local path for a stalled download, but got %v", *result.localPath)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watchdog never aborted the stalled download")
+	}
+}
+
+// A signallingKeyReaderGetter hands out readers that stall forever,
+// announcing each key as its download starts.
+type signallingKeyReaderGetter chan string
+
+func (s signallingKeyReaderGetter) getKeyReader(bucketName, keyName string) (io.ReadCloser, error) {
+	s <- keyName
+	return &stallingReadCloser{[]byte("some bytes"), make(chan struct{})}, nil
+}
+
+func TestTempKeyGetterCancelledBatch(t *testing.T) {
+	started := make(signallingKeyReaderGetter, 3)
+	kg := &tempKeyGetter{keyReaderGetter: started, downloadSlots: newSlots(1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan []getResult)
+	go func() {
+		done <- kg.get(ctx, "bucket", []string{"key1", "key2", "key3"})
+	}()
+	<-started
+	cancel()
+
+	select {
+	case results := <-done:
+		if len(results) != 3 {
+			t.Fatalf("Expected 3 results, but got %v", len(results))
+		}
+		for _, result := range results {
+			if result.status != cancelled {
+				t.Logf("Expected %v to be %v, but got %v", result.keyName, cancelled, result.status)
+				t.Fail()
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cancelling the context never aborted the batch")
+	}
+	if len(started) != 0 {
+		t.Logf("Expected no downloads to start after cancelling, but %v did", len(started))
+		t.Fail()
+	}
+}